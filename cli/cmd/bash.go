@@ -69,27 +69,39 @@ func bashCommandFunc(command *cobra.Command, args []string) {
 	gConf, e := getGlobalConf(command)
 	if e != nil {
 		logger.Fatal(e)
-		os.Exit(1)
 	}
 	bc.Pid = gConf.Pid
 	bc.Uid = gConf.Uid
 	bc.Debug = gConf.Debug
 	bc.IsHex = gConf.IsHex
+	bc.Format = gConf.Format
+	bc.Processor = gConf.Processor
+
+	sink, e := newEventSink(gConf)
+	if e != nil {
+		logger.Fatal(e)
+	}
+	mod.SetSink(sink)
+
+	metrics, e := newMetricsServer(gConf)
+	if e != nil {
+		logger.Fatal(e)
+	}
 
 	logger.Printf("ECAPTURE :: pid info :%d", os.Getpid())
 	//bc.Pid = globalFlags.Pid
 	if e := bc.Check(); e != nil {
 		logger.Fatal(e)
-		os.Exit(1)
 	}
 
 	//初始化
 	err := mod.Init(ctx, logger, bc)
 	if err != nil {
 		logger.Fatal(err)
-		os.Exit(1)
 	}
 
+	metrics.Add(mod)
+
 	// 加载ebpf，挂载到hook点上，开始监听
 	go func(module module.IModule) {
 		err := module.Run()
@@ -99,5 +111,16 @@ func bashCommandFunc(command *cobra.Command, args []string) {
 	}(mod)
 	<-stopper
 	cancelFun()
-	os.Exit(0)
+
+	// clean up
+	var exitCode int
+	if err = mod.Close(); err != nil {
+		logger.Printf("%s\tmodule close failed. error:%+v", mod.Name(), err)
+		exitCode = 1
+	}
+	_ = metrics.Close()
+	if sink != nil {
+		_ = sink.Close()
+	}
+	os.Exit(exitCode)
 }
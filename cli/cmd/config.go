@@ -0,0 +1,146 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"ecapture/user/config"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var (
+	configFile  string // --config
+	printConfig bool   // --print-config
+)
+
+// configSections 配置文件中各节对应的配置，即各命令参数绑定的变量
+var configSections = []config.FileSection{
+	{Name: "global", Value: &globalFlags},
+	{Name: "openssl", Value: oc},
+	{Name: "gnutls", Value: gc},
+	{Name: "nspr", Value: nc},
+	{Name: "gotls", Value: goc},
+	{Name: "bash", Value: bc},
+}
+
+// loadConfigFile 读取 --config 文件，命令行中指定的参数优先
+func loadConfigFile(command *cobra.Command, args []string) error {
+	if configFile != "" {
+		if err := mergeConfigFile(command.Flags(), configFile); err != nil {
+			return err
+		}
+	}
+	if printConfig {
+		if err := checkConfigs(command, args); err != nil {
+			return err
+		}
+		b, err := config.DumpFile(configSections)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(b))
+		os.Exit(0)
+	}
+	return nil
+}
+
+// checkConfigs 与运行时一样，将全局参数写入当前命令的配置并检查，输出的是检查后实际生效的配置。
+// tls 命令中检查失败的 module 运行时会被跳过，只提示；全部失败时返回错误
+func checkConfigs(command *cobra.Command, args []string) error {
+	gConf, err := getGlobalConf(command)
+	if err != nil {
+		return err
+	}
+
+	var confs []config.IConfig
+	var names []string
+	switch command.Name() {
+	case "tls":
+		setPcapFilter(command, args, &oc.PcapFilter, &oc.Port)
+		confs, names = []config.IConfig{oc}, []string{"openssl"}
+		if !config.ElfArchIsandroid {
+			confs, names = append(confs, gc, nc), append(names, "gnutls", "nspr")
+		}
+	case "gotls":
+		setPcapFilter(command, args, &goc.PcapFilter, &goc.Port)
+		confs, names = []config.IConfig{goc}, []string{"gotls"}
+	case "bash":
+		confs, names = []config.IConfig{bc}, []string{"bash"}
+	case "mysqld", "postgres":
+		// mysqldConfig、postgresConfig 不在 androidgki 中编译，由 mysqld.go、postgres.go 注册到 moduleConfigs
+		if mc, found := moduleConfigs[command.Name()]; found {
+			confs, names = []config.IConfig{mc.conf}, []string{command.Name()}
+		}
+	}
+
+	var errs []string
+	for i, conf := range confs {
+		conf.SetPid(gConf.Pid)
+		conf.SetUid(gConf.Uid)
+		conf.SetDebug(gConf.Debug)
+		conf.SetHex(gConf.IsHex)
+		conf.SetNoSearch(gConf.NoSearch)
+		conf.SetFormat(gConf.Format)
+		conf.SetProcessor(gConf.Processor)
+		if err = conf.Check(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s config check failed: %v", names[i], err))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	if len(errs) == len(confs) {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	for _, e := range errs {
+		fmt.Fprintf(os.Stderr, "%s, module will be skipped\n", e)
+	}
+	return nil
+}
+
+// mergeConfigFile 参数与配置文件绑定的是同一个变量，先保存命令行中指定的参数值，读取配置文件后重新设置
+func mergeConfigFile(flags *pflag.FlagSet, filename string) error {
+	changed := make(map[string]interface{})
+	flags.Visit(func(f *pflag.Flag) {
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			changed[f.Name] = append([]string(nil), sv.GetSlice()...)
+		} else {
+			changed[f.Name] = f.Value.String()
+		}
+	})
+
+	if err := config.LoadFile(filename, configSections); err != nil {
+		return err
+	}
+
+	var err error
+	flags.Visit(func(f *pflag.Flag) {
+		if err != nil {
+			return
+		}
+		switch v := changed[f.Name].(type) {
+		case []string:
+			err = f.Value.(pflag.SliceValue).Replace(v)
+		case string:
+			err = f.Value.Set(v)
+		}
+	})
+	return err
+}
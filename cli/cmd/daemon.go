@@ -0,0 +1,139 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"ecapture/pkg/util/kernel"
+	"ecapture/user/config"
+	"ecapture/user/module"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+const defaultDaemonSocket = "/var/run/ecapture.sock"
+
+var daemonSocket string
+
+// daemonCmd represents the daemon command
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "serve a HTTP API on a unix socket, start and stop modules on demand.",
+	Long: `list, start and stop module instances, and stream their events through a HTTP API on a unix socket.
+settings given by flags and the --config file are the defaults of the instances started by the API.
+a module can be started several times with different settings, each start returns a new instance id.
+  GET  /modules                       registered modules and their running instances
+  GET  /modules/{name}                running instances of a module
+  POST /modules/{name}/start          start a new instance, body: {"pid": 1234, "format": "json", "config": {"openssl": "/lib/libssl.so.3"}}
+  GET  /instances/{id}                status and counters of an instance
+  POST /instances/{id}/stop           stop an instance
+  GET  /events?module={name}&instance={id}  stream events, one record per line
+ecapture daemon --socket=/var/run/ecapture.sock
+curl --unix-socket /var/run/ecapture.sock -X POST -d '{"pid":1234}' http://localhost/modules/EBPFProbeBash/start
+curl --unix-socket /var/run/ecapture.sock -X POST http://localhost/instances/EBPFProbeBash-1/stop
+curl --unix-socket /var/run/ecapture.sock http://localhost/events
+`,
+	Run: daemonCommandFunc,
+}
+
+func init() {
+	daemonCmd.PersistentFlags().StringVar(&daemonSocket, "socket", defaultDaemonSocket, "unix socket path of the HTTP API")
+	rootCmd.AddCommand(daemonCmd)
+}
+
+// newDaemonConfig 复制命令行参数、配置文件中 module 的配置，作为 daemon 每次启动实例的初始配置
+func newDaemonConfig(modName string) config.IConfig {
+	for _, mc := range moduleConfigs {
+		if mc.modName != modName {
+			continue
+		}
+		v := reflect.New(reflect.TypeOf(mc.conf).Elem())
+		v.Elem().Set(reflect.ValueOf(mc.conf).Elem())
+		return v.Interface().(config.IConfig)
+	}
+	return nil
+}
+
+// daemonCommandFunc executes the "daemon" command.
+func daemonCommandFunc(command *cobra.Command, args []string) {
+	stopper := make(chan os.Signal, 1)
+	signal.Notify(stopper, os.Interrupt, syscall.SIGTERM)
+
+	logger := log.New(os.Stdout, "daemon_", log.LstdFlags)
+
+	// save global config
+	gConf, err := getGlobalConf(command)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	if gConf.LoggerFile != "" {
+		f, e := os.Create(gConf.LoggerFile)
+		if e != nil {
+			logger.Fatal(e)
+		}
+		logger.SetOutput(f)
+	}
+	logger.Printf("ECAPTURE :: %s Version : %s", cliName, GitVersion)
+	logger.Printf("ECAPTURE :: Pid Info : %d", os.Getpid())
+	version, _ := kernel.HostVersion()
+	logger.Printf("ECAPTURE :: Kernel Info : %s", version.String())
+
+	sink, err := newEventSink(gConf)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	metrics, err := newMetricsServer(gConf)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	daemon, err := module.NewDaemon(daemonSocket, logger, newDaemonConfig)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	daemon.SetDefaults(module.StartRequest{
+		Pid:       gConf.Pid,
+		Uid:       gConf.Uid,
+		Hex:       gConf.IsHex,
+		Debug:     gConf.Debug,
+		NoSearch:  gConf.NoSearch,
+		Format:    gConf.Format,
+		Processor: gConf.Processor,
+	})
+	daemon.SetSink(sink)
+	daemon.SetMetrics(metrics)
+	daemon.Start()
+	logger.Printf("ECAPTURE :: \tdaemon listening on %s", daemon.Addr())
+
+	<-stopper
+
+	// clean up，停止所有实例后再关闭 sink
+	var exitCode int
+	if err = daemon.Close(); err != nil {
+		logger.Printf("ECAPTURE :: \tdaemon close failed. error:%+v", err)
+		exitCode = 1
+	}
+	_ = metrics.Close()
+	if sink != nil {
+		_ = sink.Close()
+	}
+	os.Exit(exitCode)
+}
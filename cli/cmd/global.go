@@ -15,18 +15,43 @@
 package cmd
 
 import (
+	"ecapture/pkg/event_processor"
+	"ecapture/user/config"
+	"ecapture/user/module"
+	"fmt"
+	"strings"
+
 	"github.com/spf13/cobra"
 )
 
 // GlobalFlags are flags that defined globally
 // and are inherited to all sub-commands.
+// json tag 为配置文件 global 节的字段名
 type GlobalFlags struct {
-	IsHex      bool
-	Debug      bool
-	Pid        uint64 // PID
-	Uid        uint64 // UID
-	NoSearch   bool   // No lib search
-	loggerFile string // save file
+	IsHex       bool                   `json:"hex"`
+	Debug       bool                   `json:"debug"`
+	Pid         uint64                 `json:"pid"`       // PID
+	Uid         uint64                 `json:"uid"`       // UID
+	NoSearch    bool                   `json:"noSearch"`  // No lib search
+	LoggerFile  string                 `json:"logFile"`   // save file
+	Format      string                 `json:"format"`    // output format, text or json
+	Sinks       []string               `json:"sinks"`     // event sinks, output to logger if empty
+	GrpcProto   string                 `json:"grpcProto"` // directory of protobuf descriptor sets, decode gRPC messages as JSON
+	Har         string                 `json:"har"`       // HAR file of paired HTTP transactions
+	Processor   config.ProcessorConfig `json:"processor"`
+	MetricsAddr string                 `json:"metricsAddr"` // listen address of Prometheus metrics, disabled if empty
+}
+
+// setPcapFilter tcpdump 风格的过滤表达式(TC 模式)，未指定 --port 时不再限制为默认的 443 端口。
+// 没有参数时使用配置文件中的 pcapFilter
+func setPcapFilter(command *cobra.Command, args []string, filter *string, port *uint16) {
+	if len(args) == 0 {
+		return
+	}
+	*filter = strings.Join(args, " ")
+	if !command.Flags().Changed("port") {
+		*port = 0
+	}
 }
 
 func getGlobalConf(command *cobra.Command) (conf GlobalFlags, err error) {
@@ -55,9 +80,108 @@ func getGlobalConf(command *cobra.Command) (conf GlobalFlags, err error) {
 		return
 	}
 
-	conf.loggerFile, err = command.Flags().GetString("log-file")
+	conf.LoggerFile, err = command.Flags().GetString("log-file")
+	if err != nil {
+		return
+	}
+
+	conf.Format, err = command.Flags().GetString("format")
+	if err != nil {
+		return
+	}
+	switch conf.Format {
+	case config.OutputFormatText, config.OutputFormatJson:
+	default:
+		err = fmt.Errorf("unsupported output format:%s, must be one of %s and %s", conf.Format, config.OutputFormatText, config.OutputFormatJson)
+		return
+	}
+
+	conf.Sinks, err = command.Flags().GetStringArray("sink")
+	if err != nil {
+		return
+	}
+
+	conf.GrpcProto, err = command.Flags().GetString("grpc-proto")
+	if err != nil {
+		return
+	}
+
+	conf.Har, err = command.Flags().GetString("har")
+	if err != nil {
+		return
+	}
+
+	conf.Processor, err = getProcessorConf(command)
+	if err != nil {
+		return
+	}
+
+	conf.MetricsAddr, err = command.Flags().GetString("metrics-addr")
+	return
+}
+
+// getProcessorConf 事件处理器的队列长度和连接超时
+func getProcessorConf(command *cobra.Command) (pc config.ProcessorConfig, err error) {
+	pc.WorkerTimeout, err = command.Flags().GetDuration("worker-timeout")
+	if err != nil {
+		return
+	}
+	pc.WorkerTick, err = command.Flags().GetDuration("worker-tick")
+	if err != nil {
+		return
+	}
+	pc.WorkerQueueLen, err = command.Flags().GetInt("worker-queue")
+	if err != nil {
+		return
+	}
+	pc.IncomingQueueLen, err = command.Flags().GetInt("event-queue")
+	if err != nil {
+		return
+	}
+	pc.MaxWorkers, err = command.Flags().GetInt("max-workers")
 	if err != nil {
 		return
 	}
+	pc.ShutdownTimeout, err = command.Flags().GetDuration("shutdown-timeout")
+	if err != nil {
+		return
+	}
+
+	switch {
+	case pc.WorkerTick <= 0:
+		err = fmt.Errorf("invalid worker-tick:%s, must be greater than 0", pc.WorkerTick)
+	case pc.WorkerTimeout < pc.WorkerTick:
+		err = fmt.Errorf("invalid worker-timeout:%s, must not be less than worker-tick:%s", pc.WorkerTimeout, pc.WorkerTick)
+	case pc.WorkerQueueLen <= 0 || pc.IncomingQueueLen <= 0 || pc.MaxWorkers <= 0:
+		err = fmt.Errorf("worker-queue, event-queue and max-workers must be greater than 0")
+	case pc.ShutdownTimeout <= 0:
+		err = fmt.Errorf("invalid shutdown-timeout:%s, must be greater than 0", pc.ShutdownTimeout)
+	}
 	return
 }
+
+// newEventSink 根据 --sink 参数创建输出目标，未指定时返回 nil，由 module 输出到 logger
+func newEventSink(conf GlobalFlags) (module.EventSink, error) {
+	return module.NewEventSinks(conf.Sinks)
+}
+
+// newHarWriter 根据 --har 参数创建 HAR 文件，未指定时返回 nil
+func newHarWriter(conf GlobalFlags) (*event_processor.HarWriter, error) {
+	if conf.Har == "" {
+		return nil, nil
+	}
+	return event_processor.NewHarWriter(conf.Har, GitVersion)
+}
+
+// newMetricsServer 根据 --metrics-addr 参数启动 Prometheus 指标服务，未指定时返回 nil
+func newMetricsServer(conf GlobalFlags) (*module.MetricsServer, error) {
+	if conf.MetricsAddr == "" {
+		return nil, nil
+	}
+	ms, err := module.NewMetricsServer(conf.MetricsAddr)
+	if err != nil {
+		return nil, err
+	}
+	ms.Start()
+	return ms, nil
+}
@@ -32,7 +32,7 @@ var goc = config.NewGoTLSConfig()
 
 // gotlsCmd represents the openssl command
 var gotlsCmd = &cobra.Command{
-	Use:     "gotls",
+	Use:     "gotls [flags] [expression]",
 	Aliases: []string{"tlsgo"},
 	Short:   "capturing plaintext communication of TLS/HTTPS encrypted programs written in Golang.",
 	Long: `use eBPF uprobe/TC to capture process event data and network data. also support pcap-NG format.
@@ -40,6 +40,7 @@ ecapture gotls
 ecapture gotls --elfpath=/home/cfc4n/go_https_client --hex --pid=3423
 ecapture gotls --elfpath=/home/cfc4n/go_https_client -l save.log --pid=3423
 ecapture gotls -w save_android.pcapng -i wlan0 --port 443 --gobin=/home/cfc4n/go_https_client
+ecapture gotls -w save.pcapng -i all --elfpath=/home/cfc4n/go_https_client ip6 and dst port 8443
 `,
 	Run: goTLSCommandFunc,
 }
@@ -47,8 +48,12 @@ ecapture gotls -w save_android.pcapng -i wlan0 --port 443 --gobin=/home/cfc4n/go
 func init() {
 	gotlsCmd.PersistentFlags().StringVarP(&goc.Path, "elfpath", "e", "", "ELF path to binary built with Go toolchain.")
 	gotlsCmd.PersistentFlags().StringVarP(&goc.Write, "write", "w", "", "write the  raw packets to file as pcapng format.")
-	gotlsCmd.PersistentFlags().StringVarP(&goc.Ifname, "ifname", "i", "", "(TC Classifier) Interface name on which the probe will be attached.")
+	gotlsCmd.PersistentFlags().StringVarP(&goc.Ifname, "ifname", "i", "", "(TC Classifier) Interface names on which the probe will be attached, separated by commas, or \"all\" for every ethernet interface that is up, loopback included.")
 	gotlsCmd.PersistentFlags().Uint16Var(&goc.Port, "port", 443, "port number to capture, default:443.")
+	gotlsCmd.PersistentFlags().Uint64Var(&goc.RotateSize, "rotate-size", 0, "(with -w) rotate the pcapng file when it is larger than N MB, like tcpdump -C.")
+	gotlsCmd.PersistentFlags().Uint64Var(&goc.RotateTime, "rotate-time", 0, "(with -w) rotate the pcapng file every N seconds, like tcpdump -G.")
+	gotlsCmd.PersistentFlags().Uint64Var(&goc.RotatePackets, "rotate-packets", 0, "(with -w) rotate the pcapng file every N packets.")
+	gotlsCmd.PersistentFlags().Uint64Var(&goc.RotateFiles, "rotate-files", 0, "(with -w) keep at most N pcapng files as a ring buffer, like tcpdump -W.")
 	rootCmd.AddCommand(gotlsCmd)
 }
 
@@ -64,11 +69,12 @@ func goTLSCommandFunc(command *cobra.Command, args []string) {
 	if err != nil {
 		logger.Fatal(err)
 	}
-	if gConf.loggerFile != "" {
-		f, e := os.Create(gConf.loggerFile)
+
+	setPcapFilter(command, args, &goc.PcapFilter, &goc.Port)
+	if gConf.LoggerFile != "" {
+		f, e := os.Create(gConf.LoggerFile)
 		if e != nil {
 			logger.Fatal(e)
-			return
 		}
 		logger.SetOutput(f)
 	}
@@ -96,6 +102,25 @@ func goTLSCommandFunc(command *cobra.Command, args []string) {
 	conf.SetDebug(gConf.Debug)
 	conf.SetHex(gConf.IsHex)
 	conf.SetNoSearch(gConf.NoSearch)
+	conf.SetFormat(gConf.Format)
+	conf.SetProcessor(gConf.Processor)
+
+	sink, err := newEventSink(gConf)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	mod.SetSink(sink)
+
+	har, err := newHarWriter(gConf)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	mod.SetHar(har)
+
+	metrics, err := newMetricsServer(gConf)
+	if err != nil {
+		logger.Fatal(err)
+	}
 
 	err = conf.Check()
 
@@ -126,13 +151,19 @@ func goTLSCommandFunc(command *cobra.Command, args []string) {
 	}
 
 	logger.Printf("%s\tmodule started successfully.", mod.Name())
+	metrics.Add(mod)
 
 	<-stopper
 
 	// clean up
-	err = mod.Close()
-	if err != nil {
-		logger.Fatalf("%s\tmodule close failed. error:%+v", mod.Name(), err)
+	var exitCode int
+	if err = mod.Close(); err != nil {
+		logger.Printf("%s\tmodule close failed. error:%+v", mod.Name(), err)
+		exitCode = 1
+	}
+	_ = metrics.Close()
+	if sink != nil {
+		_ = sink.Close()
 	}
-	os.Exit(0)
+	os.Exit(exitCode)
 }
@@ -46,6 +46,8 @@ func init() {
 	mysqldCmd.PersistentFlags().Uint64VarP(&mysqldConfig.Offset, "offset", "", 0, "0x710410")
 	mysqldCmd.PersistentFlags().StringVarP(&mysqldConfig.FuncName, "funcname", "f", "", "function name to hook")
 	rootCmd.AddCommand(mysqldCmd)
+	configSections = append(configSections, config.FileSection{Name: "mysqld", Value: mysqldConfig})
+	moduleConfigs["mysqld"] = moduleConfig{module.ModuleNameMysqld, mysqldConfig}
 }
 
 // mysqldCommandFunc executes the "mysqld" command.
@@ -64,26 +66,38 @@ func mysqldCommandFunc(command *cobra.Command, args []string) {
 	gConf, e := getGlobalConf(command)
 	if e != nil {
 		logger.Fatal(e)
-		os.Exit(1)
 	}
 	mysqldConfig.Pid = gConf.Pid
 	mysqldConfig.Debug = gConf.Debug
 	mysqldConfig.IsHex = gConf.IsHex
+	mysqldConfig.Format = gConf.Format
+	mysqldConfig.Processor = gConf.Processor
+
+	sink, e := newEventSink(gConf)
+	if e != nil {
+		logger.Fatal(e)
+	}
+	mod.SetSink(sink)
+
+	metrics, e := newMetricsServer(gConf)
+	if e != nil {
+		logger.Fatal(e)
+	}
 
 	log.Printf("ECAPTURE :: pid info :%d", os.Getpid())
 	//bc.Pid = globalFlags.Pid
 	if e := mysqldConfig.Check(); e != nil {
 		logger.Fatal(e)
-		os.Exit(1)
 	}
 
 	//初始化
 	err := mod.Init(ctx, logger, mysqldConfig)
 	if err != nil {
 		logger.Fatal(err)
-		os.Exit(1)
 	}
 
+	metrics.Add(mod)
+
 	// 加载ebpf，挂载到hook点上，开始监听
 	go func(module module.IModule) {
 		err := module.Run()
@@ -93,5 +107,16 @@ func mysqldCommandFunc(command *cobra.Command, args []string) {
 	}(mod)
 	<-stopper
 	cancelFun()
-	os.Exit(0)
+
+	// clean up
+	var exitCode int
+	if err = mod.Close(); err != nil {
+		logger.Printf("%s\tmodule close failed. error:%+v", mod.Name(), err)
+		exitCode = 1
+	}
+	_ = metrics.Close()
+	if sink != nil {
+		_ = sink.Close()
+	}
+	os.Exit(exitCode)
 }
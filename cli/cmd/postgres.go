@@ -42,6 +42,8 @@ func init() {
 	postgresCmd.PersistentFlags().StringVarP(&postgresConfig.PostgresPath, "postgres", "m", "/usr/bin/postgres", "postgres binary file path, use to hook")
 	postgresCmd.PersistentFlags().StringVarP(&postgresConfig.FuncName, "funcname", "f", "", "function name to hook")
 	rootCmd.AddCommand(postgresCmd)
+	configSections = append(configSections, config.FileSection{Name: "postgres", Value: postgresConfig})
+	moduleConfigs["postgres"] = moduleConfig{module.ModuleNamePostgres, postgresConfig}
 }
 
 // postgres CommandFunc executes the "psql" command.
@@ -60,25 +62,37 @@ func postgresCommandFunc(command *cobra.Command, args []string) {
 	gConf, e := getGlobalConf(command)
 	if e != nil {
 		logger.Fatal(e)
-		os.Exit(1)
 	}
 	postgresConfig.Pid = gConf.Pid
 	postgresConfig.Debug = gConf.Debug
 	postgresConfig.IsHex = gConf.IsHex
+	postgresConfig.Format = gConf.Format
+	postgresConfig.Processor = gConf.Processor
+
+	sink, e := newEventSink(gConf)
+	if e != nil {
+		logger.Fatal(e)
+	}
+	mod.SetSink(sink)
+
+	metrics, e := newMetricsServer(gConf)
+	if e != nil {
+		logger.Fatal(e)
+	}
 
 	log.Printf("ECAPTURE :: pid info: %d", os.Getpid())
 	//bc.Pid = globalFlags.Pid
 	if e := postgresConfig.Check(); e != nil {
 		logger.Fatal(e)
-		os.Exit(1)
 	}
 	// init
 	err := mod.Init(ctx, logger, postgresConfig)
 	if err != nil {
 		logger.Fatal(err)
-		os.Exit(1)
 	}
 
+	metrics.Add(mod)
+
 	// 加载ebpf，挂载到hook点上，开始监听
 	go func(module module.IModule) {
 		err := module.Run()
@@ -88,5 +102,16 @@ func postgresCommandFunc(command *cobra.Command, args []string) {
 	}(mod)
 	<-stopper
 	cancelFun()
-	os.Exit(0)
+
+	// clean up
+	var exitCode int
+	if err = mod.Close(); err != nil {
+		logger.Printf("%s\tmodule close failed. error:%+v", mod.Name(), err)
+		exitCode = 1
+	}
+	_ = metrics.Close()
+	if sink != nil {
+		_ = sink.Close()
+	}
+	os.Exit(exitCode)
 }
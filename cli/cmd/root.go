@@ -16,6 +16,8 @@ package cmd
 
 import (
 	"ecapture/cli/cobrautl"
+	"ecapture/pkg/event_processor"
+	"ecapture/user/config"
 	"os"
 
 	"github.com/spf13/cobra"
@@ -36,6 +38,8 @@ const (
 	defaultUid uint64 = 0
 )
 
+var globalFlags = GlobalFlags{}
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:        cliName,
@@ -57,6 +61,18 @@ Usage:
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	// Run: func(cmd *cobra.Command, args []string) { },
+	PersistentPreRunE: setupCommand,
+}
+
+// setupCommand 合并配置文件后，加载各命令共用的资源，只在启动时执行一次
+func setupCommand(command *cobra.Command, args []string) error {
+	if err := loadConfigFile(command, args); err != nil {
+		return err
+	}
+	if globalFlags.GrpcProto != "" {
+		return event_processor.LoadGrpcDescriptorSets(globalFlags.GrpcProto)
+	}
+	return nil
 }
 
 func usageFunc(c *cobra.Command) error {
@@ -80,12 +96,12 @@ func Execute() {
 
 func init() {
 	cobra.EnablePrefixMatching = true
-	var globalFlags = GlobalFlags{}
 	// Here you will define your flags and configuration settings.
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 
-	// rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.cli.yaml)")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "YAML or JSON config file of global flags and all modules, flags given on the command line override it. e.g: --config=/etc/ecapture.yaml")
+	rootCmd.PersistentFlags().BoolVar(&printConfig, "print-config", false, "print the effective config merged from --config file and flags as YAML, then exit")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -95,5 +111,16 @@ func init() {
 	rootCmd.PersistentFlags().BoolVar(&globalFlags.NoSearch, "nosearch", false, "no lib search")
 	rootCmd.PersistentFlags().Uint64VarP(&globalFlags.Pid, "pid", "p", defaultPid, "if pid is 0 then we target all pids")
 	rootCmd.PersistentFlags().Uint64VarP(&globalFlags.Uid, "uid", "u", defaultUid, "if uid is 0 then we target all users")
-	rootCmd.PersistentFlags().StringVarP(&globalFlags.loggerFile, "log-file", "l", "", "-l save the packets to file")
+	rootCmd.PersistentFlags().StringVarP(&globalFlags.LoggerFile, "log-file", "l", "", "-l save the packets to file")
+	rootCmd.PersistentFlags().StringVar(&globalFlags.Format, "format", config.OutputFormatText, "output format of events, text or json (newline-delimited JSON records)")
+	rootCmd.PersistentFlags().StringArrayVar(&globalFlags.Sinks, "sink", nil, "event sinks, can be repeated. e.g: --sink=stdout --sink=file:///var/log/ecapture.log?max_size=100&max_backups=5 --sink=unix:///run/collector.sock --sink=tcp://127.0.0.1:9000")
+	rootCmd.PersistentFlags().StringVar(&globalFlags.GrpcProto, "grpc-proto", "", "directory of protobuf descriptor sets (*.pb, *.protoset, *.desc, generated by protoc --include_imports --descriptor_set_out), decode gRPC messages as JSON. raw protobuf decoding if not set")
+	rootCmd.PersistentFlags().StringVar(&globalFlags.Har, "har", "", "(tls, gotls) write paired HTTP requests and responses to file as HAR 1.2 format, flushed on exit. e.g: --har=ecapture.har")
+	rootCmd.PersistentFlags().DurationVar(&globalFlags.Processor.WorkerTimeout, "worker-timeout", event_processor.DefaultWorkerTick*event_processor.MaxTickerCount, "output the buffered data of a connection when no new data arrives within the timeout, increase it for slow long-polling connections")
+	rootCmd.PersistentFlags().DurationVar(&globalFlags.Processor.WorkerTick, "worker-tick", event_processor.DefaultWorkerTick, "interval of checking worker-timeout")
+	rootCmd.PersistentFlags().IntVar(&globalFlags.Processor.WorkerQueueLen, "worker-queue", event_processor.MaxChanLen, "event queue length of each connection, events are dropped and counted when it is full")
+	rootCmd.PersistentFlags().IntVar(&globalFlags.Processor.IncomingQueueLen, "event-queue", event_processor.MaxIncomingChanLen, "event queue length of the event processor, events are dropped and counted when it is full")
+	rootCmd.PersistentFlags().IntVar(&globalFlags.Processor.MaxWorkers, "max-workers", event_processor.MaxParserQueueLen, "max number of connections processed at the same time, events of new connections are dropped and counted when it is reached")
+	rootCmd.PersistentFlags().DurationVar(&globalFlags.Processor.ShutdownTimeout, "shutdown-timeout", event_processor.DefaultShutdownTimeout, "max time to wait for the buffered data of all connections to be output on exit")
+	rootCmd.PersistentFlags().StringVar(&globalFlags.MetricsAddr, "metrics-addr", "", "serve Prometheus metrics of modules on http://<addr>/metrics, e.g: --metrics-addr=127.0.0.1:9090. disabled if empty")
 }
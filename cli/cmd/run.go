@@ -0,0 +1,227 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"ecapture/pkg/util/kernel"
+	"ecapture/user/config"
+	"ecapture/user/module"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// runConfig 配置文件的 run 节
+type runConfig struct {
+	Modules []string `json:"modules"` // 同时启动的 module，名称同配置文件的节名
+}
+
+// moduleConfig run 命令可以启动的 module 及其配置
+type moduleConfig struct {
+	modName string
+	conf    config.IConfig
+}
+
+var rc = &runConfig{}
+
+// moduleConfigs key 为配置文件的节名
+var moduleConfigs = map[string]moduleConfig{
+	"openssl": {module.ModuleNameOpenssl, oc},
+	"gnutls":  {module.ModuleNameGnutls, gc},
+	"nspr":    {module.ModuleNameNspr, nc},
+	"gotls":   {module.ModuleNameGotls, goc},
+	"bash":    {module.ModuleNameBash, bc},
+}
+
+// runCmd represents the run command
+var runCmd = &cobra.Command{
+	Use:   "run [flags] [module...]",
+	Short: "run several modules together in one process, e.g. openssl, gotls, bash and mysqld.",
+	Long: `start a mix of modules under one context, with the same sinks, metrics and shutdown.
+settings of each module are read from the --config file, sections are named after the modules.
+modules to run are given as arguments, or the modules list of the run section in the --config file.
+ecapture run --config=/etc/ecapture.yaml
+ecapture run --config=/etc/ecapture.yaml openssl gotls bash
+`,
+	Run: runCommandFunc,
+}
+
+func init() {
+	configSections = append(configSections, config.FileSection{Name: "run", Value: rc})
+	rootCmd.AddCommand(runCmd)
+}
+
+// moduleConfigNames run 命令支持的 module 名称
+func moduleConfigNames() []string {
+	names := make([]string, 0, len(moduleConfigs))
+	for name := range moduleConfigs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runModuleNames 要启动的 module，参数优先于配置文件，去除重复
+func runModuleNames(args []string) ([]string, error) {
+	names := rc.Modules
+	if len(args) > 0 {
+		names = args
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no module to run, one or more of %s are required", strings.Join(moduleConfigNames(), ", "))
+	}
+	seen := make(map[string]bool, len(names))
+	result := make([]string, 0, len(names))
+	for _, name := range names {
+		if _, found := moduleConfigs[name]; !found {
+			return nil, fmt.Errorf("unknown module:%s, must be one of %s", name, strings.Join(moduleConfigNames(), ", "))
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		result = append(result, name)
+	}
+	return result, nil
+}
+
+// runCommandFunc executes the "run" command.
+func runCommandFunc(command *cobra.Command, args []string) {
+	stopper := make(chan os.Signal, 1)
+	signal.Notify(stopper, os.Interrupt, syscall.SIGTERM)
+	ctx, cancelFun := context.WithCancel(context.TODO())
+
+	logger := log.New(os.Stdout, "run_", log.LstdFlags)
+
+	// save global config
+	gConf, err := getGlobalConf(command)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	names, err := runModuleNames(args)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	if gConf.LoggerFile != "" {
+		f, e := os.Create(gConf.LoggerFile)
+		if e != nil {
+			logger.Fatal(e)
+		}
+		logger.SetOutput(f)
+	}
+	logger.Printf("ECAPTURE :: %s Version : %s", cliName, GitVersion)
+	logger.Printf("ECAPTURE :: Pid Info : %d", os.Getpid())
+	version, _ := kernel.HostVersion()
+	logger.Printf("ECAPTURE :: Kernel Info : %s", version.String())
+
+	sink, err := newEventSink(gConf)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	har, err := newHarWriter(gConf)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	metrics, err := newMetricsServer(gConf)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	var runModules []module.IModule
+	for _, name := range names {
+		mc := moduleConfigs[name]
+		mod := module.GetModuleByName(mc.modName)
+		if mod == nil {
+			logger.Printf("ECAPTURE :: \tcant found module: %s", mc.modName)
+			continue
+		}
+
+		conf := mc.conf
+		conf.SetPid(gConf.Pid)
+		conf.SetUid(gConf.Uid)
+		conf.SetDebug(gConf.Debug)
+		conf.SetHex(gConf.IsHex)
+		conf.SetNoSearch(gConf.NoSearch)
+		conf.SetFormat(gConf.Format)
+		conf.SetProcessor(gConf.Processor)
+		mod.SetSink(sink)
+		mod.SetHar(har)
+
+		err = conf.Check()
+		if err != nil {
+			// ErrorGoBINNotSET is a special error, we should not print it.
+			if errors.Is(err, config.ErrorGoBINNotSET) {
+				logger.Printf("%s\tmodule [disabled].", mod.Name())
+				continue
+			}
+
+			logger.Printf("%s\tmodule initialization failed. [skip it]. error:%+v", mod.Name(), err)
+			continue
+		}
+
+		logger.Printf("%s\tmodule initialization", mod.Name())
+
+		//初始化
+		err = mod.Init(ctx, logger, conf)
+		if err != nil {
+			logger.Printf("%s\tmodule initialization failed, [skip it]. error:%+v", mod.Name(), err)
+			continue
+		}
+
+		// 加载ebpf，挂载到hook点上，开始监听
+		err = mod.Run()
+		if err != nil {
+			logger.Printf("%s\tmodule run failed, [skip it]. error:%+v", mod.Name(), err)
+			continue
+		}
+		runModules = append(runModules, mod)
+		metrics.Add(mod)
+		logger.Printf("%s\tmodule started successfully.", mod.Name())
+	}
+
+	if len(runModules) == 0 {
+		logger.Println("ECAPTURE :: \tNo runnable modules, Exit(1)")
+		os.Exit(1)
+	}
+	logger.Printf("ECAPTURE :: \tstart %d modules", len(runModules))
+	<-stopper
+	cancelFun()
+
+	// clean up，各 module 共用 sink，全部关闭后再关闭 sink
+	var exitCode int
+	for _, mod := range runModules {
+		if err = mod.Close(); err != nil {
+			logger.Printf("%s\tmodule close failed. error:%+v", mod.Name(), err)
+			exitCode = 1
+		}
+	}
+	_ = metrics.Close()
+	if sink != nil {
+		_ = sink.Close()
+	}
+	os.Exit(exitCode)
+}
@@ -35,7 +35,7 @@ var nc = config.NewNsprConfig()
 
 // opensslCmd represents the openssl command
 var opensslCmd = &cobra.Command{
-	Use:     "tls",
+	Use:     "tls [flags] [expression]",
 	Aliases: []string{"openssl", "gnutls", "nss"},
 	Short:   "use to capture tls/ssl text content without CA cert. (Support Linux(Android)  X86_64 4.18/aarch64 5.5 or newer).",
 	Long: `use eBPF uprobe/TC to capture process event data and network data.also support pcap-NG format.
@@ -45,6 +45,7 @@ ecapture tls -l save.log --pid=3423
 ecapture tls --libssl=/lib/x86_64-linux-gnu/libssl.so.1.1
 ecapture tls -w save_3_0_5.pcapng --ssl_version="openssl 3.0.5" --libssl=/lib/x86_64-linux-gnu/libssl.so.3 
 ecapture tls -w save_android.pcapng -i wlan0 --libssl=/apex/com.android.conscrypt/lib64/libssl.so --ssl_version="boringssl 1.1.1" --port 443
+ecapture tls -w save.pcapng -i eth0,lo host 10.0.0.1 and port 443 or portrange 8000-9000
 `,
 	Run: openSSLCommandFunc,
 }
@@ -57,8 +58,12 @@ func init() {
 	opensslCmd.PersistentFlags().StringVar(&nc.Firefoxpath, "firefox", "", "firefox file path, default: /usr/lib/firefox/firefox. (Deprecated)")
 	opensslCmd.PersistentFlags().StringVar(&nc.Nsprpath, "nspr", "", "libnspr44.so file path, will automatically find it from curl default.")
 	opensslCmd.PersistentFlags().StringVarP(&oc.Write, "write", "w", "", "write the  raw packets to file as pcapng format.")
-	opensslCmd.PersistentFlags().StringVarP(&oc.Ifname, "ifname", "i", "", "(TC Classifier) Interface name on which the probe will be attached.")
+	opensslCmd.PersistentFlags().StringVarP(&oc.Ifname, "ifname", "i", "", "(TC Classifier) Interface names on which the probe will be attached, separated by commas, or \"all\" for every ethernet interface that is up, loopback included.")
 	opensslCmd.PersistentFlags().Uint16Var(&oc.Port, "port", 443, "port number to capture, default:443.")
+	opensslCmd.PersistentFlags().Uint64Var(&oc.RotateSize, "rotate-size", 0, "(with -w) rotate the pcapng file when it is larger than N MB, like tcpdump -C.")
+	opensslCmd.PersistentFlags().Uint64Var(&oc.RotateTime, "rotate-time", 0, "(with -w) rotate the pcapng file every N seconds, like tcpdump -G.")
+	opensslCmd.PersistentFlags().Uint64Var(&oc.RotatePackets, "rotate-packets", 0, "(with -w) rotate the pcapng file every N packets.")
+	opensslCmd.PersistentFlags().Uint64Var(&oc.RotateFiles, "rotate-files", 0, "(with -w) keep at most N pcapng files as a ring buffer, like tcpdump -W.")
 	opensslCmd.PersistentFlags().StringVar(&oc.SslVersion, "ssl_version", "", "openssl/boringssl version， e.g: --ssl_version=\"openssl 1.1.1g\" or  --ssl_version=\"boringssl 1.1.1\"")
 
 	rootCmd.AddCommand(opensslCmd)
@@ -77,11 +82,12 @@ func openSSLCommandFunc(command *cobra.Command, args []string) {
 	if err != nil {
 		logger.Fatal(err)
 	}
-	if gConf.loggerFile != "" {
-		f, e := os.Create(gConf.loggerFile)
+
+	setPcapFilter(command, args, &oc.PcapFilter, &oc.Port)
+	if gConf.LoggerFile != "" {
+		f, e := os.Create(gConf.LoggerFile)
 		if e != nil {
 			logger.Fatal(e)
-			return
 		}
 		logger.SetOutput(f)
 	}
@@ -98,6 +104,21 @@ func openSSLCommandFunc(command *cobra.Command, args []string) {
 		modNames = []string{module.ModuleNameOpenssl, module.ModuleNameGnutls, module.ModuleNameNspr}
 	}
 
+	sink, err := newEventSink(gConf)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	har, err := newHarWriter(gConf)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	metrics, err := newMetricsServer(gConf)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
 	var runMods uint8
 	var runModules = make(map[string]module.IModule)
 	var wg sync.WaitGroup
@@ -132,6 +153,10 @@ func openSSLCommandFunc(command *cobra.Command, args []string) {
 		conf.SetDebug(gConf.Debug)
 		conf.SetHex(gConf.IsHex)
 		conf.SetNoSearch(gConf.NoSearch)
+		conf.SetFormat(gConf.Format)
+		conf.SetProcessor(gConf.Processor)
+		mod.SetSink(sink)
+		mod.SetHar(har)
 
 		err = conf.Check()
 
@@ -165,6 +190,7 @@ func openSSLCommandFunc(command *cobra.Command, args []string) {
 			continue
 		}
 		runModules[mod.Name()] = mod
+		metrics.Add(mod)
 		logger.Printf("%s\tmodule started successfully.", mod.Name())
 		wg.Add(1)
 		runMods++
@@ -180,15 +206,21 @@ func openSSLCommandFunc(command *cobra.Command, args []string) {
 	}
 	cancelFun()
 
-	// clean up
+	// clean up，关闭失败时继续关闭其他 module，最后以非0退出
+	var exitCode int
 	for _, mod := range runModules {
 		err = mod.Close()
 		wg.Done()
 		if err != nil {
-			logger.Fatalf("%s\tmodule close failed. error:%+v", mod.Name(), err)
+			logger.Printf("%s\tmodule close failed. error:%+v", mod.Name(), err)
+			exitCode = 1
 		}
 	}
 
 	wg.Wait()
-	os.Exit(0)
+	_ = metrics.Close()
+	if sink != nil {
+		_ = sink.Close()
+	}
+	os.Exit(exitCode)
 }
@@ -3,14 +3,19 @@ module ecapture
 go 1.18
 
 require (
+	github.com/andybalholm/brotli v1.0.4
 	github.com/cilium/ebpf v0.10.0
 	github.com/gojue/ebpfmanager v0.4.1
 	github.com/google/gopacket v1.1.19
+	github.com/klauspost/compress v1.15.15
 	github.com/shuLhan/go-bindata v4.0.0+incompatible
 	github.com/spf13/cobra v1.4.0
 	github.com/spf13/pflag v1.0.5
 	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa
+	golang.org/x/net v0.7.0
 	golang.org/x/sys v0.5.0
+	google.golang.org/protobuf v1.28.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -26,8 +31,8 @@ require (
 	github.com/stretchr/testify v1.7.0 // indirect
 	github.com/vishvananda/netlink v1.1.0 // indirect
 	github.com/vishvananda/netns v0.0.0-20210104183010-2eb08e3e575f // indirect
-	golang.org/x/net v0.7.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
+	golang.org/x/text v0.7.0 // indirect
 )
 
 replace github.com/google/gopacket v1.1.19 => github.com/cfc4n/gopacket v1.1.20
@@ -37,12 +37,15 @@
 
 #define AF_INET 2
 #define AF_INET6 10
-#define SA_DATA_LEN 14
+// sizeof(struct sockaddr_in6) - sizeof(sa_family_t)
+#define SA_DATA_LEN 26
+#define SA_DATA_LEN_IPV4 14
 #define BASH_ERRNO_DEFAULT 128
 
 ///////// for TC & XDP ebpf programs in tc.h
 #define TC_ACT_OK 0
 #define ETH_P_IP 0x0800 /* Internet Protocol packet        */
+#define ETH_P_IPV6 0x86DD /* IPv6 over bluebook             */
 #define SKB_MAX_DATA_SIZE 2048
 
 // .rodata section bug via : https://github.com/gojue/ecapture/issues/39
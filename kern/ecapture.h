@@ -54,6 +54,7 @@
 #include <uapi/linux/pkt_cls.h>
 #include <linux/if_ether.h>
 #include <linux/ip.h>
+#include <linux/ipv6.h>
 #include <linux/in.h>
 
 struct tcphdr {
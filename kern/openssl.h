@@ -39,6 +39,7 @@ struct connect_event_t {
     u32 pid;
     u32 tid;
     u32 fd;
+    u16 sa_family;
     char sa_data[SA_DATA_LEN];
     char comm[TASK_COMM_LEN];
 };
@@ -47,6 +48,14 @@ struct {
     __uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
 } connect_events SEC(".maps");
 
+// sockaddr pointer of accept/accept4, key: pid_tgid
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, u64);
+    __type(value, u64);
+    __uint(max_entries, 1024);
+} active_accept_args_map SEC(".maps");
+
 struct active_ssl_buf {
     /*
      * protocol version (one of SSL2_VERSION, SSL3_VERSION, TLS1_VERSION,
@@ -317,6 +326,42 @@ int probe_ret_SSL_read(struct pt_regs* ctx) {
     return 0;
 }
 
+static __inline int output_connect_event(struct pt_regs* ctx,
+                                         u64 current_pid_tgid, u32 fd,
+                                         struct sockaddr* saddr) {
+    if (!saddr) {
+        return 0;
+    }
+    sa_family_t address_family = 0;
+    bpf_probe_read_user(&address_family, sizeof(address_family),
+                        &saddr->sa_family);
+
+    if (address_family != AF_INET && address_family != AF_INET6) {
+        return 0;
+    }
+
+    debug_bpf_printk("@ sockaddr FM :%d\n", address_family);
+
+    struct connect_event_t conn;
+    __builtin_memset(&conn, 0, sizeof(conn));
+    conn.timestamp_ns = bpf_ktime_get_ns();
+    conn.pid = current_pid_tgid >> 32;
+    conn.tid = current_pid_tgid;
+    conn.fd = fd;
+    conn.sa_family = address_family;
+    // sockaddr_in is shorter than sockaddr_in6, do not read past its end
+    if (address_family == AF_INET) {
+        bpf_probe_read_user(&conn.sa_data, SA_DATA_LEN_IPV4, &saddr->sa_data);
+    } else {
+        bpf_probe_read_user(&conn.sa_data, SA_DATA_LEN, &saddr->sa_data);
+    }
+    bpf_get_current_comm(&conn.comm, sizeof(conn.comm));
+
+    bpf_perf_event_output(ctx, &connect_events, BPF_F_CURRENT_CPU, &conn,
+                          sizeof(struct connect_event_t));
+    return 0;
+}
+
 // https://github.com/lattera/glibc/blob/895ef79e04a953cac1493863bcae29ad85657ee1/socket/connect.c
 // int __connect (int fd, __CONST_SOCKADDR_ARG addr, socklen_t len)
 SEC("uprobe/connect")
@@ -338,29 +383,51 @@ int probe_connect(struct pt_regs* ctx) {
 
     u32 fd = (u32)PT_REGS_PARM1(ctx);
     struct sockaddr* saddr = (struct sockaddr*)PT_REGS_PARM2(ctx);
-    if (!saddr) {
+    return output_connect_event(ctx, current_pid_tgid, fd, saddr);
+}
+
+// int accept (int fd, __SOCKADDR_ARG addr, socklen_t *addr_len)
+// int accept4 (int fd, __SOCKADDR_ARG addr, socklen_t *addr_len, int flags)
+// the peer address is filled in when accept returns the new fd.
+SEC("uprobe/accept")
+int probe_entry_accept(struct pt_regs* ctx) {
+    u64 current_pid_tgid = bpf_get_current_pid_tgid();
+    u32 pid = current_pid_tgid >> 32;
+    u64 current_uid_gid = bpf_get_current_uid_gid();
+    u32 uid = current_uid_gid;
+
+#ifndef KERNEL_LESS_5_2
+    // if target_ppid is 0 then we target all pids
+    if (target_pid != 0 && target_pid != pid) {
         return 0;
     }
-    sa_family_t address_family = 0;
-    bpf_probe_read_user(&address_family, sizeof(address_family),
-                        &saddr->sa_family);
-
-    if (address_family != AF_INET) {
+    if (target_uid != 0 && target_uid != uid) {
         return 0;
     }
+#endif
 
-    debug_bpf_printk("@ sockaddr FM :%d\n", address_family);
+    u64 saddr = (u64)PT_REGS_PARM2(ctx);
+    if (!saddr) {
+        return 0;
+    }
+    bpf_map_update_elem(&active_accept_args_map, &current_pid_tgid, &saddr,
+                        BPF_ANY);
+    return 0;
+}
 
-    struct connect_event_t conn;
-    __builtin_memset(&conn, 0, sizeof(conn));
-    conn.timestamp_ns = bpf_ktime_get_ns();
-    conn.pid = pid;
-    conn.tid = current_pid_tgid;
-    conn.fd = fd;
-    bpf_probe_read_user(&conn.sa_data, SA_DATA_LEN, &saddr->sa_data);
-    bpf_get_current_comm(&conn.comm, sizeof(conn.comm));
+SEC("uretprobe/accept")
+int probe_ret_accept(struct pt_regs* ctx) {
+    u64 current_pid_tgid = bpf_get_current_pid_tgid();
+    u64* saddr = bpf_map_lookup_elem(&active_accept_args_map, &current_pid_tgid);
+    if (saddr == NULL) {
+        return 0;
+    }
+    struct sockaddr* addr = (struct sockaddr*)*saddr;
+    bpf_map_delete_elem(&active_accept_args_map, &current_pid_tgid);
 
-    bpf_perf_event_output(ctx, &connect_events, BPF_F_CURRENT_CPU, &conn,
-                          sizeof(struct connect_event_t));
-    return 0;
+    int fd = (int)PT_REGS_RC(ctx);
+    if (fd < 0) {
+        return 0;
+    }
+    return output_connect_event(ctx, current_pid_tgid, fd, addr);
 }
@@ -92,30 +92,42 @@ int capture_packets(struct __sk_buff *skb, bool is_ingress) {
     unsigned char *data_end = (void *)(long)skb->data_end;
     u32 data_len = (u32)skb->len;
     uint32_t l4_hdr_off;
+    u8 l4_proto;
 
     // Ethernet headers
     struct ethhdr *eth = (struct ethhdr *)data_start;
-    // IP headers
-    struct iphdr *iph = (struct iphdr *)(data_start + sizeof(struct ethhdr));
 
     // Simple length check
-    if ((data_start + sizeof(struct ethhdr) + sizeof(struct iphdr)) >
-        data_end) {
+    if ((data_start + sizeof(struct ethhdr)) > data_end) {
         return TC_ACT_OK;
     }
 
     // filter out non-IP packets
-    // TODO support IPv6
-    if (eth->h_proto != bpf_htons(ETH_P_IP)) {
-        return TC_ACT_OK;
-    }
-    l4_hdr_off = sizeof(struct ethhdr) + sizeof(struct iphdr);
-    if (!skb_revalidate_data(skb, &data_start, &data_end, l4_hdr_off)) {
+    if (eth->h_proto == bpf_htons(ETH_P_IP)) {
+        l4_hdr_off = sizeof(struct ethhdr) + sizeof(struct iphdr);
+        if (!skb_revalidate_data(skb, &data_start, &data_end, l4_hdr_off)) {
+            return TC_ACT_OK;
+        }
+        // IP headers
+        struct iphdr *iph =
+            (struct iphdr *)(data_start + sizeof(struct ethhdr));
+        l4_proto = iph->protocol;
+    } else if (eth->h_proto == bpf_htons(ETH_P_IPV6)) {
+        l4_hdr_off = sizeof(struct ethhdr) + sizeof(struct ipv6hdr);
+        if (!skb_revalidate_data(skb, &data_start, &data_end, l4_hdr_off)) {
+            return TC_ACT_OK;
+        }
+        // IPv6 headers, extension headers are not supported, TCP must be the
+        // next header.
+        struct ipv6hdr *ip6h =
+            (struct ipv6hdr *)(data_start + sizeof(struct ethhdr));
+        l4_proto = ip6h->nexthdr;
+    } else {
         return TC_ACT_OK;
     }
 
     // filter out non-TCP packets
-    if (iph->protocol != IPPROTO_TCP) {
+    if (l4_proto != IPPROTO_TCP) {
         return TC_ACT_OK;
     }
     if (!skb_revalidate_data(skb, &data_start, &data_end,
@@ -125,7 +137,9 @@ int capture_packets(struct __sk_buff *skb, bool is_ingress) {
     struct tcphdr *tcp = (struct tcphdr *)(data_start + l4_hdr_off);
 
 #ifndef KERNEL_LESS_5_2
-    if (tcp->source != bpf_htons(target_port) &&
+    // target_port is 0 when a pcap filter expression is used, the filter is
+    // applied in user space.
+    if (target_port != 0 && tcp->source != bpf_htons(target_port) &&
         tcp->dest != bpf_htons(target_port)) {
         return TC_ACT_OK;
     }
@@ -0,0 +1,192 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package capture 在其他程序中运行 eCapture 的 module，以 event.IEventStruct 的形式返回事件：
+//
+//	conf := config.NewBashConfig()
+//	conf.SetPid(1234)
+//	c, err := capture.Start(ctx, module.ModuleNameBash, conf, capture.Options{})
+//	if err != nil {
+//		return err
+//	}
+//	for e := range c.Events() {
+//		if be, ok := e.(*event.BashEvent); ok {
+//			...
+//		}
+//	}
+//	return c.Wait()
+//
+// ctx 结束时停止 module，关闭 Events。每次 Start 创建独立的 module 实例。
+package capture
+
+import (
+	"context"
+	"ecapture/user/config"
+	"ecapture/user/event"
+	"ecapture/user/module"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+)
+
+const DefaultQueueLen = 1024 // Events 的默认队列长度
+
+// Options Start 的可选参数
+type Options struct {
+	// Logger module 的日志，为 nil 时丢弃
+	Logger *log.Logger
+
+	// Handler 事件回调，在 module 读取事件的协程中调用，应尽快返回，阻塞时内核会丢弃事件。
+	// 为 nil 时通过 Capture.Events 读取事件
+	Handler func(event.IEventStruct)
+
+	// QueueLen Handler 为 nil 时 Events 的队列长度，为 0 时使用 DefaultQueueLen
+	QueueLen int
+}
+
+// Capture 运行中的 module
+type Capture struct {
+	mod    module.IModule
+	ctx    context.Context
+	cancel context.CancelFunc
+	events chan event.IEventStruct
+
+	// 保护 events 的关闭，发送时持有读锁
+	lock   sync.RWMutex
+	closed bool
+
+	done chan struct{}
+	err  error
+}
+
+// Modules 可以通过 Start 运行的 module 名称
+func Modules() []string {
+	names := make([]string, 0, len(module.GetAllModules()))
+	for name := range module.GetAllModules() {
+		if module.NewModule(name) != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Start 以 conf 检查、初始化并启动 module，conf 需与 module 对应，如 module.ModuleNameBash 对应 config.BashConfig。
+// ctx 结束时停止 module
+func Start(ctx context.Context, modName string, conf config.IConfig, opts Options) (*Capture, error) {
+	mod := module.NewModule(modName)
+	if mod == nil {
+		return nil, fmt.Errorf("capture: module %s not found", modName)
+	}
+	if err := conf.Check(); err != nil {
+		return nil, fmt.Errorf("capture: invalid config of module %s:%v", modName, err)
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	this := &Capture{
+		mod:    mod,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	handler := opts.Handler
+	if handler == nil {
+		queueLen := opts.QueueLen
+		if queueLen <= 0 {
+			queueLen = DefaultQueueLen
+		}
+		this.events = make(chan event.IEventStruct, queueLen)
+		handler = this.send
+	}
+	mod.SetEventHandler(handler)
+
+	if err := mod.Init(ctx, logger, conf); err != nil {
+		cancel()
+		return nil, fmt.Errorf("capture: init module %s error:%v", modName, err)
+	}
+	if err := mod.Run(); err != nil {
+		cancel()
+		// Init 已加载 eBPF 程序，Run 失败时关闭 module 释放
+		if e := mod.Close(); e != nil {
+			return nil, fmt.Errorf("capture: run module %s error:%v, close error:%v", modName, err, e)
+		}
+		return nil, fmt.Errorf("capture: run module %s error:%v", modName, err)
+	}
+
+	go this.wait()
+	return this, nil
+}
+
+// Name module 名称
+func (this *Capture) Name() string {
+	return this.mod.Name()
+}
+
+// Events 解码后的事件，module 停止后关闭。Options.Handler 不为 nil 时返回 nil
+func (this *Capture) Events() <-chan event.IEventStruct {
+	return this.events
+}
+
+// Stats module 的运行计数
+func (this *Capture) Stats() module.ModuleStats {
+	return this.mod.Stats()
+}
+
+// Done module 停止后关闭
+func (this *Capture) Done() <-chan struct{} {
+	return this.done
+}
+
+// Wait 等待 ctx 结束、module 停止，返回关闭 module 的错误
+func (this *Capture) Wait() error {
+	<-this.done
+	return this.err
+}
+
+// Stop 停止 module，与 ctx 结束相同，返回关闭 module 的错误
+func (this *Capture) Stop() error {
+	this.cancel()
+	return this.Wait()
+}
+
+// send 事件写入 Events，队列已满时阻塞，直到读取或 ctx 结束
+func (this *Capture) send(e event.IEventStruct) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	if this.closed {
+		return
+	}
+	select {
+	case this.events <- e:
+	case <-this.ctx.Done():
+	}
+}
+
+func (this *Capture) wait() {
+	<-this.ctx.Done()
+	this.err = this.mod.Close()
+	if this.events != nil {
+		this.lock.Lock()
+		this.closed = true
+		close(this.events)
+		this.lock.Unlock()
+	}
+	close(this.done)
+}
@@ -0,0 +1,176 @@
+package capture
+
+import (
+	"context"
+	"ecapture/user/config"
+	"ecapture/user/event"
+	"ecapture/user/module"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testModuleName = "EBPFProbeTestCapture"
+
+// fakeModule Run 时输出 3 个 BashEvent
+type fakeModule struct {
+	module.Module
+	runErr error
+	closed bool
+}
+
+// fakeModules 已创建的实例，fakeRunErr 新建实例 Run 返回的错误
+var (
+	fakeModules []*fakeModule
+	fakeRunErr  error
+)
+
+func (this *fakeModule) Name() string {
+	return testModuleName
+}
+
+func (this *fakeModule) Init(context.Context, *log.Logger, config.IConfig) error {
+	return nil
+}
+
+func (this *fakeModule) Run() error {
+	if this.runErr != nil {
+		return this.runErr
+	}
+	go func() {
+		for i := 1; i <= 3; i++ {
+			this.Module.Dispatcher(&event.BashEvent{Pid: uint32(i)})
+		}
+	}()
+	return nil
+}
+
+func (this *fakeModule) Close() error {
+	this.closed = true
+	return nil
+}
+
+func init() {
+	module.RegisterFunc(func() module.IModule {
+		mod := &fakeModule{runErr: fakeRunErr}
+		fakeModules = append(fakeModules, mod)
+		return mod
+	})
+}
+
+func testConfig() config.IConfig {
+	conf := config.NewGoTLSConfig()
+	conf.Path = os.Args[0]
+	return conf
+}
+
+func TestStart_Events(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c, err := Start(ctx, testModuleName, testConfig(), Options{QueueLen: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		e := <-c.Events()
+		if be, ok := e.(*event.BashEvent); !ok || be.Pid != uint32(i) {
+			t.Fatalf("event %d: %#v", i, e)
+		}
+	}
+
+	cancel()
+	if err = c.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-c.Events(); ok {
+		t.Fatal("Events not closed")
+	}
+	if !c.mod.(*fakeModule).closed {
+		t.Fatal("module not closed")
+	}
+}
+
+func TestStart_Handler(t *testing.T) {
+	var lock sync.Mutex
+	var pids []uint32
+	received := make(chan struct{})
+	handler := func(e event.IEventStruct) {
+		lock.Lock()
+		defer lock.Unlock()
+		pids = append(pids, e.(*event.BashEvent).Pid)
+		if len(pids) == 3 {
+			close(received)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c1, err := Start(ctx, testModuleName, testConfig(), Options{Handler: handler})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c1.Events() != nil {
+		t.Fatal("Events should be nil with Handler")
+	}
+	select {
+	case <-received:
+	case <-time.After(time.Second * 3):
+		t.Fatalf("received %v", pids)
+	}
+
+	// 每次 Start 使用独立的 module 实例
+	c2, err := Start(ctx, testModuleName, testConfig(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c1.mod == c2.mod || c1.mod == module.GetModuleByName(testModuleName) {
+		t.Fatal("module instance shared")
+	}
+
+	cancel()
+	for _, c := range []*Capture{c1, c2} {
+		select {
+		case <-c.Done():
+		case <-time.After(time.Second * 3):
+			t.Fatalf("%s not stopped", c.Name())
+		}
+	}
+}
+
+func TestStart_Invalid(t *testing.T) {
+	if _, err := Start(context.Background(), "EBPFProbeUnknown", testConfig(), Options{}); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := Start(context.Background(), testModuleName, config.NewGoTLSConfig(), Options{}); err == nil || !strings.Contains(err.Error(), config.ErrorGoBINNotSET.Error()) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestStart_RunFailed(t *testing.T) {
+	fakeRunErr = errors.New("attach failed")
+	defer func() { fakeRunErr = nil }()
+
+	created := len(fakeModules)
+	if _, err := Start(context.Background(), testModuleName, testConfig(), Options{}); err == nil || !strings.Contains(err.Error(), "attach failed") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(fakeModules) != created+1 || !fakeModules[created].closed {
+		t.Fatal("module not closed after Run failed")
+	}
+}
+
+func TestModules(t *testing.T) {
+	names := Modules()
+	for _, want := range []string{testModuleName, module.ModuleNameBash, module.ModuleNameOpenssl} {
+		found := false
+		for _, name := range names {
+			found = found || name == want
+		}
+		if !found {
+			t.Errorf("module %s not in %v", want, names)
+		}
+	}
+}
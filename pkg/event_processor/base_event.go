@@ -34,7 +34,7 @@ const ChunkSize = 16
 const ChunkSizeHalf = ChunkSize / 2
 
 const MaxDataSize = 1024 * 4
-const SaDataLen = 14
+const SaDataLen = 26
 
 const (
 	Ssl2Version   = 0x0002
@@ -131,6 +131,23 @@ func (this *BaseEvent) PayloadLen() int {
 	return int(this.Data_len)
 }
 
+func (this *BaseEvent) Base() event.Base {
+	b := event.Base{
+		Pid:       uint64(this.Pid),
+		Tid:       uint64(this.Tid),
+		Comm:      CToGoString(this.Comm[:]),
+		Timestamp: this.Timestamp,
+		Payload:   this.Payload(),
+	}
+	switch AttachType(this.DataType) {
+	case ProbeEntry:
+		b.Direction = event.DirectionIngress
+	case ProbeRet:
+		b.Direction = event.DirectionEgress
+	}
+	return b
+}
+
 func (this *BaseEvent) StringHex() string {
 
 	var perfix, connInfo string
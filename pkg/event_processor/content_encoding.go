@@ -0,0 +1,134 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package event_processor
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// MaxDecodedBodyLen 解压后消息体的最大长度，防止压缩炸弹
+const MaxDecodedBodyLen = 64 * 1024 * 1024
+
+// httpContentEncodings Content-Encoding 的编码列表，按编码的先后顺序
+func httpContentEncodings(header http.Header) []string {
+	var encodings []string
+	for _, v := range header.Values("Content-Encoding") {
+		for _, e := range strings.Split(v, ",") {
+			e = strings.ToLower(strings.TrimSpace(e))
+			if e != "" && e != "identity" {
+				encodings = append(encodings, e)
+			}
+		}
+	}
+	return encodings
+}
+
+// httpDecodeBody 按 Content-Encoding 逆序逐层解码，返回解码后的数据、最外层编码的包类型，
+// 以及是否在 MaxDecodedBodyLen 处截断
+func httpDecodeBody(body []byte, encodings []string) ([]byte, PacketType, bool, error) {
+	packetType := PacketTypeNull
+	truncated := false
+	for i := len(encodings) - 1; i >= 0; i-- {
+		r, pt, err := httpDecoder(encodings[i], body)
+		if err != nil {
+			return nil, PacketTypeNull, false, err
+		}
+		body, err = io.ReadAll(io.LimitReader(r, MaxDecodedBodyLen+1))
+		_ = r.Close()
+		// 内层数据已截断时，外层解码到截断处为止
+		if err != nil && !truncated {
+			return nil, PacketTypeNull, false, fmt.Errorf("%s decode error:%v", encodings[i], err)
+		}
+		if len(body) > MaxDecodedBodyLen {
+			body = body[:MaxDecodedBodyLen]
+			truncated = true
+		}
+		if packetType == PacketTypeNull {
+			packetType = pt
+		}
+	}
+	return body, packetType, truncated, nil
+}
+
+func httpDecoder(encoding string, body []byte) (io.ReadCloser, PacketType, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		return r, PacketTypeGzip, err
+	case "deflate":
+		// RFC 7230 规定为 zlib 格式，部分服务端发送不带 zlib 头的原始 deflate
+		r, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return flate.NewReader(bytes.NewReader(body)), PacketTypeDeflate, nil
+		}
+		return r, PacketTypeDeflate, nil
+	case "br":
+		return io.NopCloser(brotli.NewReader(bytes.NewReader(body))), PacketTypeBrotli, nil
+	case "zstd":
+		d, err := zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderMaxMemory(MaxDecodedBodyLen))
+		if err != nil {
+			return nil, PacketTypeNull, err
+		}
+		return d.IOReadCloser(), PacketTypeZstd, nil
+	}
+	return nil, PacketTypeNull, fmt.Errorf("unsupported Content-Encoding:%s", encoding)
+}
+
+// httpDecodedBody 读取并解码消息体，解码失败时返回原始数据，packetType 为 PacketTypeNull
+func httpDecodedBody(body io.Reader, header http.Header) ([]byte, PacketType, bool, error) {
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return raw, PacketTypeNull, false, err
+	}
+	encodings := httpContentEncodings(header)
+	if len(encodings) == 0 || len(raw) == 0 {
+		return raw, PacketTypeNull, false, nil
+	}
+	decoded, packetType, truncated, err := httpDecodeBody(raw, encodings)
+	if err != nil {
+		return raw, PacketTypeNull, false, err
+	}
+	return decoded, packetType, truncated, nil
+}
+
+// httpDecodedHeader 解码成功后输出用的头部，去掉已不再适用的 Content-Encoding，
+// Content-Length 由 Dump 按解码后的长度输出；原始头部保留给 HAR、访问日志
+func httpDecodedHeader(header http.Header, packetType PacketType) http.Header {
+	if packetType == PacketTypeNull {
+		return header
+	}
+	h := header.Clone()
+	h.Del("Content-Encoding")
+	h.Del("Content-Length")
+	return h
+}
+
+// httpTruncatedNote 解码后的消息体被截断时，附加在输出末尾的说明
+func httpTruncatedNote(b []byte, truncated bool) []byte {
+	if !truncated {
+		return b
+	}
+	return append(b, fmt.Sprintf("\n[decoded body truncated at %d bytes]", MaxDecodedBodyLen)...)
+}
@@ -0,0 +1,131 @@
+package event_processor
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func encodeBody(t *testing.T, body []byte, encodings ...string) []byte {
+	for _, encoding := range encodings {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		switch encoding {
+		case "gzip":
+			w = gzip.NewWriter(&buf)
+		case "deflate":
+			w = zlib.NewWriter(&buf)
+		case "raw-deflate":
+			w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+		case "br":
+			w = brotli.NewWriter(&buf)
+		case "zstd":
+			w, _ = zstd.NewWriter(&buf)
+		default:
+			t.Fatalf("unknown encoding %s", encoding)
+		}
+		_, _ = w.Write(body)
+		_ = w.Close()
+		body = buf.Bytes()
+	}
+	return body
+}
+
+func TestHTTPResponse_ContentEncoding(t *testing.T) {
+	plain := []byte(strings.Repeat("ecapture content encoding ", 10))
+	tests := []struct {
+		header    string
+		encodings []string
+		packet    PacketType
+	}{
+		{"gzip", []string{"gzip"}, PacketTypeGzip},
+		{"deflate", []string{"deflate"}, PacketTypeDeflate},
+		{"deflate", []string{"raw-deflate"}, PacketTypeDeflate},
+		{"br", []string{"br"}, PacketTypeBrotli},
+		{"zstd", []string{"zstd"}, PacketTypeZstd},
+		{"gzip, br", []string{"gzip", "br"}, PacketTypeBrotli},
+		{"deflate, identity, zstd", []string{"deflate", "zstd"}, PacketTypeZstd},
+	}
+	for _, tt := range tests {
+		body := encodeBody(t, plain, tt.encodings...)
+		msg := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Encoding: %s\r\nContent-Length: %d\r\n\r\n%s", tt.header, len(body), body)
+		p := &HTTPResponse{}
+		p.Init()
+		_, _ = p.Write([]byte(msg))
+		if !p.IsDone() {
+			t.Fatalf("%s: response should be done", tt.header)
+		}
+		got := p.Display()
+		if !bytes.HasSuffix(got, plain) || p.PacketType() != tt.packet {
+			t.Fatalf("%s: packet type %d, display:\n%q", tt.header, p.PacketType(), got)
+		}
+		// 输出的是解码后的消息体，头部需一致
+		if bytes.Contains(got, []byte("Content-Encoding")) || !bytes.Contains(got, []byte(fmt.Sprintf("Content-Length: %d\r\n", len(plain)))) {
+			t.Fatalf("%s: stale headers in display:\n%q", tt.header, got)
+		}
+		if p.messages()[0].header.Get("Content-Encoding") != tt.header {
+			t.Fatalf("%s: original header not kept for transaction", tt.header)
+		}
+	}
+}
+
+func TestHTTPRequest_ContentEncoding(t *testing.T) {
+	plain := []byte(`{"name":"ecapture"}`)
+	body := encodeBody(t, plain, "gzip")
+
+	// chunked request body
+	msg := fmt.Sprintf("POST /api HTTP/1.1\r\nHost: example.com\r\nContent-Encoding: gzip\r\nTransfer-Encoding: chunked\r\n\r\n%x\r\n%s\r\n0\r\n\r\n", len(body), body)
+	p := &HTTPRequest{}
+	p.Init()
+	_, _ = p.Write([]byte(msg))
+	if !p.IsDone() {
+		t.Fatal("request should be done")
+	}
+	got := p.Display()
+	if !bytes.HasSuffix(got, plain) || p.PacketType() != PacketTypeGzip {
+		t.Fatalf("display:\n%q", got)
+	}
+	if bytes.Contains(got, []byte("Content-Encoding")) {
+		t.Fatalf("stale Content-Encoding in display:\n%q", got)
+	}
+}
+
+func TestHTTPResponse_ContentEncodingError(t *testing.T) {
+	msg := "HTTP/1.1 200 OK\r\nContent-Encoding: br2\r\nContent-Length: 4\r\n\r\nabcd"
+	p := &HTTPResponse{}
+	p.Init()
+	_, _ = p.Write([]byte(msg))
+	if got := p.Display(); !bytes.HasSuffix(got, []byte("abcd")) {
+		t.Fatalf("unsupported encoding should display the raw body:\n%q", got)
+	}
+}
+
+func TestHTTPDecodeBody_Truncated(t *testing.T) {
+	plain := make([]byte, MaxDecodedBodyLen+10)
+	body := encodeBody(t, plain, "gzip")
+	decoded, packetType, truncated, err := httpDecodeBody(body, []string{"gzip"})
+	if err != nil || packetType != PacketTypeGzip || !truncated || len(decoded) != MaxDecodedBodyLen {
+		t.Fatalf("len:%d, packet type:%d, truncated:%v, err:%v", len(decoded), packetType, truncated, err)
+	}
+
+	msg := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	p := &HTTPResponse{}
+	p.Init()
+	_, _ = p.Write([]byte(msg))
+	if got := p.Display(); !bytes.HasSuffix(got, []byte(fmt.Sprintf("[decoded body truncated at %d bytes]", MaxDecodedBodyLen))) {
+		t.Fatalf("truncation not marked: %q", got[len(got)-64:])
+	}
+
+	_, _, truncated, err = httpDecodeBody(encodeBody(t, plain[:10], "gzip"), []string{"gzip"})
+	if err != nil || truncated {
+		t.Fatalf("truncated:%v, err:%v", truncated, err)
+	}
+}
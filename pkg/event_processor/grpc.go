@@ -0,0 +1,422 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package event_processor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/http2/hpack"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	// 消息前缀：Compressed-Flag(1) + Message-Length(4)
+	grpcMessageHeaderLen = 5
+
+	// 原始 protobuf 解码的最大嵌套层数
+	grpcRawMaxDepth = 16
+
+	// MaxGrpcStreamMethods 单个连接上等待响应的 gRPC 方法数，超过后淘汰流ID最小的
+	MaxGrpcStreamMethods = 1024
+
+	// MaxGrpcConns 记录 gRPC 方法的连接数，超过后淘汰最久未使用的连接
+	MaxGrpcConns = 1024
+)
+
+// GrpcDescriptorExts 描述符集文件的扩展名，protoc --include_imports --descriptor_set_out 生成
+var GrpcDescriptorExts = []string{".pb", ".protoset", ".desc"}
+
+// grpcStatusCodes grpc-status 的名称
+var grpcStatusCodes = []string{
+	"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED", "NOT_FOUND",
+	"ALREADY_EXISTS", "PERMISSION_DENIED", "RESOURCE_EXHAUSTED", "FAILED_PRECONDITION",
+	"ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED", "INTERNAL", "UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED",
+}
+
+// grpcDescriptors 方法路径到方法描述符，由 LoadGrpcDescriptorSets 加载
+type grpcDescriptors struct {
+	sync.RWMutex
+	methods map[string]protoreflect.MethodDescriptor // /package.Service/Method
+}
+
+var grpcRegistry = &grpcDescriptors{methods: make(map[string]protoreflect.MethodDescriptor)}
+
+// LoadGrpcDescriptorSets 加载目录中的 FileDescriptorSet 文件，用于将 gRPC 消息解码为 JSON
+func LoadGrpcDescriptorSets(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.IsDir() || !grpcIsDescriptorFile(entry.Name()) {
+			continue
+		}
+		filename := filepath.Join(dir, entry.Name())
+		b, e := os.ReadFile(filename)
+		if e != nil {
+			return e
+		}
+		fds := &descriptorpb.FileDescriptorSet{}
+		if e = proto.Unmarshal(b, fds); e != nil {
+			return fmt.Errorf("parse descriptor set %s error:%v", filename, e)
+		}
+		for _, fd := range fds.GetFile() {
+			if seen[fd.GetName()] {
+				continue
+			}
+			seen[fd.GetName()] = true
+			set.File = append(set.File, fd)
+		}
+	}
+	if len(set.File) == 0 {
+		return fmt.Errorf("no descriptor set (%s) found in %s", strings.Join(GrpcDescriptorExts, ","), dir)
+	}
+
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return fmt.Errorf("load descriptor sets in %s error:%v", dir, err)
+	}
+	methods := make(map[string]protoreflect.MethodDescriptor)
+	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		services := fd.Services()
+		for i := 0; i < services.Len(); i++ {
+			sd := services.Get(i)
+			for j := 0; j < sd.Methods().Len(); j++ {
+				md := sd.Methods().Get(j)
+				methods[fmt.Sprintf("/%s/%s", sd.FullName(), md.Name())] = md
+			}
+		}
+		return true
+	})
+
+	grpcRegistry.Lock()
+	defer grpcRegistry.Unlock()
+	grpcRegistry.methods = methods
+	return nil
+}
+
+func grpcIsDescriptorFile(name string) bool {
+	ext := filepath.Ext(name)
+	for _, e := range GrpcDescriptorExts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *grpcDescriptors) method(path string) protoreflect.MethodDescriptor {
+	this.RLock()
+	defer this.RUnlock()
+	return this.methods[path]
+}
+
+// grpcStreamMethods 连接+流ID 到请求的方法路径，请求、响应由不同的解析器处理，响应据此选择消息类型
+type grpcStreamMethods struct {
+	sync.Mutex
+	conns map[string]*grpcConnMethods
+}
+
+// grpcConnMethods 单个连接上各个流的方法路径
+type grpcConnMethods struct {
+	methods  map[uint32]string
+	lastSeen time.Time
+}
+
+var grpcMethods = &grpcStreamMethods{conns: make(map[string]*grpcConnMethods)}
+
+func (this *grpcStreamMethods) add(conn string, streamID uint32, path string) {
+	this.Lock()
+	defer this.Unlock()
+	cm, found := this.conns[conn]
+	if !found {
+		if len(this.conns) >= MaxGrpcConns {
+			this.evictConn()
+		}
+		cm = &grpcConnMethods{methods: make(map[uint32]string)}
+		this.conns[conn] = cm
+	}
+	if len(cm.methods) >= MaxGrpcStreamMethods {
+		// 流ID递增，最小的是最早发起、最可能已丢失响应的流
+		var oldest uint32
+		first := true
+		for id := range cm.methods {
+			if first || id < oldest {
+				oldest, first = id, false
+			}
+		}
+		delete(cm.methods, oldest)
+	}
+	cm.methods[streamID] = path
+	cm.lastSeen = time.Now()
+}
+
+// take 获取并删除方法路径
+func (this *grpcStreamMethods) take(conn string, streamID uint32) string {
+	this.Lock()
+	defer this.Unlock()
+	cm, found := this.conns[conn]
+	if !found {
+		return ""
+	}
+	path := cm.methods[streamID]
+	delete(cm.methods, streamID)
+	if len(cm.methods) == 0 {
+		delete(this.conns, conn)
+	}
+	return path
+}
+
+// delConn 删除连接上所有流的方法路径，连接被新连接替换时调用
+func (this *grpcStreamMethods) delConn(conn string) {
+	this.Lock()
+	defer this.Unlock()
+	delete(this.conns, conn)
+}
+
+// evictConn 淘汰最久未使用的连接，调用方持有锁
+func (this *grpcStreamMethods) evictConn() {
+	var oldest string
+	var oldestSeen time.Time
+	for conn, cm := range this.conns {
+		if oldest == "" || cm.lastSeen.Before(oldestSeen) {
+			oldest, oldestSeen = conn, cm.lastSeen
+		}
+	}
+	delete(this.conns, oldest)
+}
+
+// grpcIsProto 是否为 protobuf 编码的 gRPC，application/grpc+json 等按原文输出
+func grpcIsProto(contentType string) bool {
+	contentType = strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	return contentType == "application/grpc" || contentType == "application/grpc+proto"
+}
+
+// grpcDisplay 输出长度前缀的 gRPC 消息，method 为空或未加载描述符时按原始 protobuf 解码
+func grpcDisplay(b *bytes.Buffer, body []byte, path, encoding string, isRequest bool) {
+	var msgType protoreflect.MessageDescriptor
+	if md := grpcRegistry.method(path); md != nil {
+		if isRequest {
+			msgType = md.Input()
+		} else {
+			msgType = md.Output()
+		}
+	}
+
+	for i := 0; len(body) > 0; i++ {
+		if len(body) < grpcMessageHeaderLen {
+			fmt.Fprintf(b, "[gRPC message truncated, %d bytes]\n", len(body))
+			return
+		}
+		compressed := body[0] == 1
+		length := binary.BigEndian.Uint32(body[1:grpcMessageHeaderLen])
+		body = body[grpcMessageHeaderLen:]
+		if uint64(len(body)) < uint64(length) {
+			fmt.Fprintf(b, "[gRPC message #%d truncated, %d of %d bytes]\n", i, len(body), length)
+			return
+		}
+		msg := body[:length]
+		body = body[length:]
+
+		fmt.Fprintf(b, "gRPC Message #%d, Length:%d", i, length)
+		if compressed {
+			fmt.Fprintf(b, ", Compressed:%s", encoding)
+			if encoding != "gzip" {
+				fmt.Fprintf(b, "\n[unsupported grpc-encoding]\n")
+				continue
+			}
+			var err error
+			var truncated bool
+			if msg, truncated, err = grpcGunzip(msg); err != nil {
+				fmt.Fprintf(b, "\n[gunzip error:%v]\n", err)
+				continue
+			}
+			if truncated {
+				fmt.Fprintf(b, ", Decompressed:truncated at %d bytes", MaxDecodedBodyLen)
+			}
+		}
+		if msgType != nil {
+			fmt.Fprintf(b, ", Type:%s\n", msgType.FullName())
+			if s, err := grpcMessageJson(msgType, msg); err == nil {
+				b.WriteString(s)
+				b.WriteString("\n")
+				continue
+			}
+			// 描述符与数据不匹配时按原始 protobuf 输出
+		} else {
+			b.WriteString("\n")
+		}
+		grpcRawDisplay(b, msg, 0)
+	}
+}
+
+// grpcGunzip 解压消息，与 HTTP 消息体相同，最多解压 MaxDecodedBodyLen，超过的部分截断
+func grpcGunzip(msg []byte) ([]byte, bool, error) {
+	r, err := gzip.NewReader(bytes.NewReader(msg))
+	if err != nil {
+		return nil, false, err
+	}
+	defer r.Close()
+	msg, err = io.ReadAll(io.LimitReader(r, MaxDecodedBodyLen+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(msg) > MaxDecodedBodyLen {
+		return msg[:MaxDecodedBodyLen], true, nil
+	}
+	return msg, false, nil
+}
+
+func grpcMessageJson(msgType protoreflect.MessageDescriptor, msg []byte) (string, error) {
+	m := dynamicpb.NewMessage(msgType)
+	if err := proto.Unmarshal(msg, m); err != nil {
+		return "", err
+	}
+	j, err := protojson.MarshalOptions{Multiline: true, Indent: "  "}.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string(j), nil
+}
+
+// grpcRawDisplay 按 protoc --decode_raw 的格式输出 protobuf 数据
+func grpcRawDisplay(b *bytes.Buffer, msg []byte, depth int) {
+	if !grpcRawValid(msg, depth) {
+		fmt.Fprintf(b, "%s%q\n", strings.Repeat("  ", depth), msg)
+		return
+	}
+	indent := strings.Repeat("  ", depth)
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		msg = msg[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(msg)
+			msg = msg[n:]
+			fmt.Fprintf(b, "%s%d: %d\n", indent, num, v)
+		case protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(msg)
+			msg = msg[n:]
+			fmt.Fprintf(b, "%s%d: 0x%08x\n", indent, num, v)
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(msg)
+			msg = msg[n:]
+			fmt.Fprintf(b, "%s%d: 0x%016x\n", indent, num, v)
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(msg)
+			msg = msg[n:]
+			if len(v) > 0 && !grpcIsText(v) && depth+1 < grpcRawMaxDepth && grpcRawValid(v, depth+1) {
+				fmt.Fprintf(b, "%s%d {\n", indent, num)
+				grpcRawDisplay(b, v, depth+1)
+				fmt.Fprintf(b, "%s}\n", indent)
+			} else {
+				fmt.Fprintf(b, "%s%d: %q\n", indent, num, v)
+			}
+		case protowire.StartGroupType:
+			// 已废弃的 group，n 包含 EndGroup 标签
+			n := protowire.ConsumeFieldValue(num, typ, msg)
+			fmt.Fprintf(b, "%s%d {\n", indent, num)
+			grpcRawDisplay(b, msg[:n-protowire.SizeTag(num)], depth+1)
+			fmt.Fprintf(b, "%s}\n", indent)
+			msg = msg[n:]
+		}
+	}
+}
+
+// grpcRawValid 数据能否完整地解析为 protobuf 字段
+func grpcRawValid(msg []byte, depth int) bool {
+	if depth >= grpcRawMaxDepth {
+		return false
+	}
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 || num <= 0 {
+			return false
+		}
+		msg = msg[n:]
+		n = protowire.ConsumeFieldValue(num, typ, msg)
+		if n < 0 {
+			return false
+		}
+		msg = msg[n:]
+	}
+	return true
+}
+
+// grpcIsText 可打印的 UTF-8 文本
+func grpcIsText(v []byte) bool {
+	if !utf8.Valid(v) {
+		return false
+	}
+	for _, r := range string(v) {
+		if r < 0x20 && r != '\t' && r != '\r' && r != '\n' {
+			return false
+		}
+	}
+	return true
+}
+
+// grpcStatus 从 trailers(或 Trailers-Only 响应的头部)中获取 grpc-status、grpc-message
+func grpcStatus(fields ...[]hpack.HeaderField) (string, bool) {
+	var status, message string
+	var found bool
+	for _, fs := range fields {
+		for _, f := range fs {
+			switch f.Name {
+			case "grpc-status":
+				status, found = f.Value, true
+			case "grpc-message":
+				// grpc-message 为百分号编码
+				if m, err := url.PathUnescape(f.Value); err == nil {
+					message = m
+				} else {
+					message = f.Value
+				}
+			}
+		}
+	}
+	if !found {
+		return "", false
+	}
+	s := fmt.Sprintf("gRPC Status:%s", status)
+	var code int
+	if _, err := fmt.Sscanf(status, "%d", &code); err == nil && code >= 0 && code < len(grpcStatusCodes) {
+		s += fmt.Sprintf(" (%s)", grpcStatusCodes[code])
+	}
+	if message != "" {
+		s += fmt.Sprintf(", Message:%s", message)
+	}
+	return s, true
+}
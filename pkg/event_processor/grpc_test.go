@@ -0,0 +1,193 @@
+package event_processor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func grpcFrame(msg []byte) []byte {
+	b := make([]byte, grpcMessageHeaderLen, grpcMessageHeaderLen+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// writeTestDescriptorSet test.Greeter/Hello(HelloRequest{name}) returns (HelloReply{code})
+func writeTestDescriptorSet(t *testing.T) string {
+	field := func(name string, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(1),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+		}
+	}
+	fd := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("test.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("HelloRequest"), Field: []*descriptorpb.FieldDescriptorProto{field("name", descriptorpb.FieldDescriptorProto_TYPE_STRING)}},
+			{Name: proto.String("HelloReply"), Field: []*descriptorpb.FieldDescriptorProto{field("code", descriptorpb.FieldDescriptorProto_TYPE_INT32)}},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Greeter"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("Hello"),
+				InputType:  proto.String(".test.HelloRequest"),
+				OutputType: proto.String(".test.HelloReply"),
+			}},
+		}},
+	}
+	b, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{fd}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err = os.WriteFile(filepath.Join(dir, "test.pb"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestGrpcDisplay_Raw(t *testing.T) {
+	var msg []byte
+	msg = protowire.AppendTag(msg, 1, protowire.VarintType)
+	msg = protowire.AppendVarint(msg, 150)
+	msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+	msg = protowire.AppendString(msg, "hello")
+	var nested []byte
+	nested = protowire.AppendTag(nested, 1, protowire.VarintType)
+	nested = protowire.AppendVarint(nested, 1)
+	msg = protowire.AppendTag(msg, 3, protowire.BytesType)
+	msg = protowire.AppendBytes(msg, nested)
+
+	var b bytes.Buffer
+	body := append(grpcFrame(msg), 0, 0)
+	grpcDisplay(&b, body, "/unknown.Service/Method", "", true)
+	want := "gRPC Message #0, Length:14\n1: 150\n2: \"hello\"\n3 {\n  1: 1\n}\n[gRPC message truncated, 2 bytes]\n"
+	if b.String() != want {
+		t.Fatalf("display:\n%q\nwant:\n%q", b.String(), want)
+	}
+}
+
+func TestGrpcGunzip_Truncated(t *testing.T) {
+	var z bytes.Buffer
+	w := gzip.NewWriter(&z)
+	if _, err := w.Write(make([]byte, MaxDecodedBodyLen+100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	msg, truncated, err := grpcGunzip(z.Bytes())
+	if err != nil || !truncated || len(msg) != MaxDecodedBodyLen {
+		t.Fatalf("gunzip: len:%d, truncated:%v, error:%v", len(msg), truncated, err)
+	}
+
+	body := grpcFrame(z.Bytes())
+	body[0] = 1
+	var b bytes.Buffer
+	grpcDisplay(&b, body, "", "gzip", true)
+	if want := fmt.Sprintf(", Decompressed:truncated at %d bytes", MaxDecodedBodyLen); !strings.Contains(b.String(), want) {
+		t.Fatalf("display without %q:\n%.200s", want, b.String())
+	}
+}
+
+func TestGrpc_Descriptors(t *testing.T) {
+	if err := LoadGrpcDescriptorSets(writeTestDescriptorSet(t)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		grpcRegistry.methods = make(map[string]protoreflect.MethodDescriptor)
+	}()
+
+	var req, resp []byte
+	req = protowire.AppendTag(req, 1, protowire.BytesType)
+	req = protowire.AppendString(req, "ecapture")
+	resp = protowire.AppendTag(resp, 1, protowire.VarintType)
+	resp = protowire.AppendVarint(resp, 7)
+
+	// request direction
+	f := newHttp2Frames()
+	f.buf.WriteString(Http2ClientPreface)
+	f.headers(1, false, ":method", "POST", ":path", "/test.Greeter/Hello", ":authority", "localhost", "content-type", "application/grpc")
+	_ = f.framer.WriteData(1, true, grpcFrame(req))
+	reqParser := &HTTP2Request{}
+	reqParser.Init()
+	reqParser.setConn("conn")
+	_, _ = reqParser.Write(f.bytes())
+	got := string(reqParser.Display())
+	if !strings.Contains(got, "Stream:1, gRPC Method:/test.Greeter/Hello\n") ||
+		!strings.Contains(got, "Type:test.HelloRequest\n{") || !strings.Contains(got, `"ecapture"`) {
+		t.Fatalf("request display:\n%s", got)
+	}
+
+	// response direction, message type from the request method of the same connection
+	f = newHttp2Frames()
+	_ = f.framer.WriteSettings()
+	f.headers(1, false, ":status", "200", "content-type", "application/grpc")
+	_ = f.framer.WriteData(1, false, grpcFrame(resp))
+	f.headers(1, true, "grpc-status", "5", "grpc-message", "not%20found")
+	respParser := &HTTP2Response{}
+	respParser.Init()
+	respParser.setConn("conn")
+	_, _ = respParser.Write(f.bytes())
+	got = string(respParser.Display())
+	// protojson output is unstable in whitespace
+	if !strings.Contains(got, "Type:test.HelloReply\n{") || !strings.Contains(strings.Join(strings.Fields(got), ""), `"code":7`) ||
+		!strings.Contains(got, "gRPC Status:5 (NOT_FOUND), Message:not found") {
+		t.Fatalf("response display:\n%s", got)
+	}
+}
+
+func TestLoadGrpcDescriptorSets_Error(t *testing.T) {
+	if err := LoadGrpcDescriptorSets(t.TempDir()); err == nil {
+		t.Fatal("empty directory should fail")
+	}
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "bad.pb"), []byte{0xff, 0xff}, 0644)
+	if err := LoadGrpcDescriptorSets(dir); err == nil {
+		t.Fatal("invalid descriptor set should fail")
+	}
+}
+
+func TestGrpcStreamMethods(t *testing.T) {
+	m := &grpcStreamMethods{conns: make(map[string]*grpcConnMethods)}
+	for i := uint32(0); i <= MaxGrpcStreamMethods; i++ {
+		m.add("conn1", i*2+1, "/svc/Method")
+	}
+	m.add("conn2", 1, "/svc/Other")
+	if len(m.conns["conn1"].methods) != MaxGrpcStreamMethods {
+		t.Fatalf("conn1 methods:%d", len(m.conns["conn1"].methods))
+	}
+	if path := m.take("conn1", 1); path != "" {
+		t.Fatalf("oldest stream not evicted: %s", path)
+	}
+	if path := m.take("conn2", 1); path != "/svc/Other" {
+		t.Fatalf("conn2 evicted by conn1: %q", path)
+	}
+
+	m.delConn("conn1")
+	if path := m.take("conn1", 3); path != "" || len(m.conns) != 0 {
+		t.Fatalf("delConn: %q, %d", path, len(m.conns))
+	}
+
+	for i := 0; i <= MaxGrpcConns; i++ {
+		m.add(fmt.Sprintf("conn%d", i), 1, "/svc/Method")
+	}
+	if len(m.conns) != MaxGrpcConns {
+		t.Fatalf("conns:%d", len(m.conns))
+	}
+}
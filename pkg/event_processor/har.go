@@ -0,0 +1,389 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package event_processor
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	HarVersion = "1.2"
+	// MaxHarEntries HAR 文件在内存中累积，超过后丢弃新的事务
+	MaxHarEntries = 100000
+	// MaxHarSize 内存中事务的总字节数(主要是消息体)，超过后丢弃新的事务
+	MaxHarSize = 256 * 1024 * 1024
+	// MaxHarBodyLen 单个消息体保存的最大长度，超过的部分截断，并在 _comment 中说明
+	MaxHarBodyLen = 1024 * 1024
+)
+
+// HAR 1.2 格式，见 http://www.softwareishard.com/blog/har-12-spec/
+// 以下划线开头的为自定义字段。
+
+type harArchive struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string      `json:"version"`
+	Creator harCreator  `json:"creator"`
+	Entries []*harEntry `json:"entries"`
+	Comment string      `json:"comment,omitempty"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Connection      string      `json:"connection,omitempty"`
+	Module          string      `json:"_module,omitempty"`
+	Pid             uint64      `json:"_pid"`
+	Comm            string      `json:"_comm"`
+	Comment         string      `json:"_comment,omitempty"`
+
+	started time.Time // 用于排序，RFC3339Nano 省略末尾的 0，不能按字符串比较
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+// harPostData HAR 1.2 的 postData 没有 encoding 字段，二进制的消息体同 content 以 base64 输出，
+// 由自定义字段 _encoding 标记
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// HarWriter 收集配对的 HTTP 事务，Flush 时整体写入 HAR 文件。多个 module 可共用一个 HarWriter。
+type HarWriter struct {
+	sync.Mutex
+	filename string
+	version  string // eCapture 的版本
+	bootTime int64  // BPF 时间戳(CLOCK_MONOTONIC)转换为墙上时间的偏移
+	entries  []*harEntry
+	size     int // entries 的估算字节数
+	dropped  uint64
+}
+
+// NewHarWriter 创建 HAR 文件，确保在开始捕获前文件可写
+func NewHarWriter(filename, version string) (*HarWriter, error) {
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("create HAR file %s error:%v", filename, err)
+	}
+	_ = f.Close()
+
+	var ts unix.Timespec
+	if err = unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return nil, err
+	}
+	return &HarWriter{
+		filename: filename,
+		version:  version,
+		bootTime: time.Now().UnixNano() - ts.Nano(),
+	}, nil
+}
+
+// Filename HAR 文件的绝对路径
+func (this *HarWriter) Filename() string {
+	return this.filename
+}
+
+// Add 记录一个事务
+func (this *HarWriter) Add(tx *HttpTransaction) {
+	entry := this.entry(tx)
+	size := entry.size()
+	this.Lock()
+	defer this.Unlock()
+	if len(this.entries) >= MaxHarEntries || this.size+size > MaxHarSize {
+		this.dropped++
+		return
+	}
+	this.entries = append(this.entries, entry)
+	this.size += size
+}
+
+// Flush 将已收集的全部事务写入 HAR 文件，可重复调用
+func (this *HarWriter) Flush() error {
+	this.Lock()
+	archive := harArchive{Log: harLog{
+		Version: HarVersion,
+		Creator: harCreator{Name: "eCapture", Version: this.version},
+		Entries: append([]*harEntry{}, this.entries...),
+	}}
+	if this.dropped > 0 {
+		archive.Log.Comment = fmt.Sprintf("%d entries dropped, more than %d entries or %d bytes", this.dropped, MaxHarEntries, MaxHarSize)
+	}
+	this.Unlock()
+
+	// 按开始时间排序，不同连接的事务完成顺序与开始顺序不一定相同
+	sort.SliceStable(archive.Log.Entries, func(i, j int) bool {
+		return archive.Log.Entries[i].started.Before(archive.Log.Entries[j].started)
+	})
+
+	b, err := json.MarshalIndent(archive, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := this.filename + ".tmp"
+	if err = os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, this.filename)
+}
+
+func (this *HarWriter) entry(tx *HttpTransaction) *harEntry {
+	req, resp := tx.request, tx.response
+	latency := float64(tx.Latency) / float64(time.Millisecond)
+	started := time.Unix(0, this.bootTime+int64(tx.Timestamp))
+	e := &harEntry{
+		StartedDateTime: started.Format(time.RFC3339Nano),
+		Time:            latency,
+		Request: harRequest{
+			Method:      tx.Method,
+			URL:         harURL(tx.Host, tx.URL),
+			HTTPVersion: tx.Proto,
+			Cookies:     harCookies((&http.Request{Header: req.header}).Cookies()),
+			Headers:     harHeaders(req.header, tx.Host, req.stream != 0),
+			QueryString: harQueryString(tx.URL),
+			HeadersSize: -1,
+			BodySize:    len(req.body),
+		},
+		Response: harResponse{
+			Status:      tx.Status,
+			StatusText:  http.StatusText(tx.Status),
+			HTTPVersion: resp.proto,
+			Cookies:     harCookies((&http.Response{Header: resp.header}).Cookies()),
+			Headers:     harHeaders(resp.header, "", false),
+			Content:     harBody(harTruncate(resp.body), resp.header.Get("Content-Type")),
+			RedirectURL: resp.header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    len(resp.body),
+		},
+		Timings:    harTimings{Wait: latency},
+		Connection: tx.LocalAddr,
+		Module:     tx.Module,
+		Pid:        tx.Pid,
+		Comm:       tx.Comm,
+		started:    started,
+	}
+	if host, _, err := net.SplitHostPort(tx.RemoteAddr); err == nil {
+		e.ServerIPAddress = host
+	}
+	e.Response.Content.Size = len(resp.body)
+	var truncated []string
+	if len(req.body) > MaxHarBodyLen {
+		truncated = append(truncated, fmt.Sprintf("request body truncated to %d of %d bytes", MaxHarBodyLen, len(req.body)))
+	}
+	if len(resp.body) > MaxHarBodyLen {
+		truncated = append(truncated, fmt.Sprintf("response body truncated to %d of %d bytes", MaxHarBodyLen, len(resp.body)))
+	}
+	e.Comment = strings.Join(truncated, ", ")
+	if len(req.body) > 0 {
+		content := harBody(harTruncate(req.body), req.header.Get("Content-Type"))
+		e.Request.PostData = &harPostData{MimeType: content.MimeType, Text: content.Text, Encoding: content.Encoding}
+	}
+	return e
+}
+
+// size 估算事务占用的内存，消息体之外的字段按头部、URL 的长度计算
+func (this *harEntry) size() int {
+	n := len(this.Request.URL) + len(this.Response.Content.Text)
+	if this.Request.PostData != nil {
+		n += len(this.Request.PostData.Text)
+	}
+	for _, h := range this.Request.Headers {
+		n += len(h.Name) + len(h.Value)
+	}
+	for _, h := range this.Response.Headers {
+		n += len(h.Name) + len(h.Value)
+	}
+	return n
+}
+
+// harTruncate 截断超过 MaxHarBodyLen 的消息体，在字符边界处截断，文本仍是合法的 UTF-8
+func harTruncate(body []byte) []byte {
+	if len(body) <= MaxHarBodyLen {
+		return body
+	}
+	n := MaxHarBodyLen
+	for i := n; i > n-utf8.UTFMax; i-- {
+		if utf8.RuneStart(body[i]) {
+			return body[:i]
+		}
+	}
+	return body[:n]
+}
+
+// harURL 捕获的均为 TLS 明文，以 https 还原请求的完整 URL
+func harURL(host, uri string) string {
+	if host == "" || !strings.HasPrefix(uri, "/") {
+		return uri
+	}
+	return "https://" + host + uri
+}
+
+// harHeaders HTTP/1 的 Host 头已被 net/http 移到 Request.Host，HTTP/2 的 :authority 不是普通头部，均补回 Host
+func harHeaders(header http.Header, host string, isHttp2 bool) []harNameValue {
+	headers := make([]harNameValue, 0, len(header)+1)
+	if host != "" {
+		name := "Host"
+		if isHttp2 {
+			name = ":authority"
+		}
+		headers = append(headers, harNameValue{name, host})
+	}
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range header[name] {
+			headers = append(headers, harNameValue{name, v})
+		}
+	}
+	return headers
+}
+
+func harQueryString(uri string) []harNameValue {
+	qs := make([]harNameValue, 0)
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return qs
+	}
+	values := u.Query()
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range values[name] {
+			qs = append(qs, harNameValue{name, v})
+		}
+	}
+	return qs
+}
+
+func harCookies(cookies []*http.Cookie) []harCookie {
+	hc := make([]harCookie, 0, len(cookies))
+	for _, c := range cookies {
+		cookie := harCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HTTPOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			cookie.Expires = c.Expires.Format(time.RFC3339)
+		}
+		hc = append(hc, cookie)
+	}
+	return hc
+}
+
+// harBody 已解码的消息体，二进制数据以 base64 编码
+func harBody(body []byte, mimeType string) harContent {
+	content := harContent{Size: len(body), MimeType: mimeType}
+	if len(body) == 0 {
+		return content
+	}
+	if utf8.Valid(body) {
+		content.Text = string(body)
+	} else {
+		content.Text = base64.StdEncoding.EncodeToString(body)
+		content.Encoding = "base64"
+	}
+	return content
+}
@@ -0,0 +1,196 @@
+package event_processor
+
+import (
+	"context"
+	"ecapture/user/event"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHarWriter(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "ecapture.har")
+	har, err := NewHarWriter(filename, "v0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := newTransactionTracker()
+	req := httpMessageInfo{
+		isRequest: true, method: "POST", host: "example.com", url: "/api?b=2&a=1", proto: "HTTP/1.1",
+		header: http.Header{"Content-Type": {"application/json"}, "Cookie": {"sid=1"}},
+		body:   []byte(`{"name":"ecapture"}`),
+	}
+	resp := httpMessageInfo{
+		status: 201, proto: "HTTP/1.1",
+		header: http.Header{"Content-Type": {"application/octet-stream"}, "Set-Cookie": {"sid=2; Path=/; HttpOnly"}},
+		body:   []byte{0xff, 0xfe},
+	}
+	_ = tr.add("c1", req, event.Base{Pid: 100, Comm: "curl", RemoteAddr: "10.0.0.1:443", Timestamp: 1000})
+	tx := tr.add("c1", resp, event.Base{Timestamp: 3001000})
+	har.Add(tx)
+	if err = har.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive harArchive
+	if err = json.Unmarshal(b, &archive); err != nil {
+		t.Fatalf("invalid HAR %v:\n%s", err, b)
+	}
+	if archive.Log.Version != HarVersion || len(archive.Log.Entries) != 1 {
+		t.Fatalf("unexpected HAR:\n%s", b)
+	}
+	e := archive.Log.Entries[0]
+	if e.Request.URL != "https://example.com/api?b=2&a=1" || e.Time != 3 || e.Timings.Wait != 3 {
+		t.Fatalf("unexpected entry:\n%s", b)
+	}
+	if _, err = time.Parse(time.RFC3339Nano, e.StartedDateTime); err != nil {
+		t.Fatalf("invalid startedDateTime %s", e.StartedDateTime)
+	}
+	if len(e.Request.QueryString) != 2 || e.Request.QueryString[0].Name != "a" {
+		t.Fatalf("unexpected queryString %+v", e.Request.QueryString)
+	}
+	if e.Request.PostData == nil || e.Request.PostData.Text != `{"name":"ecapture"}` {
+		t.Fatalf("unexpected postData %+v", e.Request.PostData)
+	}
+	if e.Request.PostData.Encoding != "" || e.Request.BodySize != len(req.body) {
+		t.Fatalf("unexpected postData %+v, bodySize %d", e.Request.PostData, e.Request.BodySize)
+	}
+	if len(e.Request.Cookies) != 1 || len(e.Response.Cookies) != 1 || !e.Response.Cookies[0].HTTPOnly {
+		t.Fatalf("unexpected cookies %+v %+v", e.Request.Cookies, e.Response.Cookies)
+	}
+	if e.Response.Status != 201 || e.Response.StatusText != "Created" || e.Response.Content.Encoding != "base64" || e.Response.Content.Text != "//4=" {
+		t.Fatalf("unexpected response %+v", e.Response)
+	}
+	if e.Pid != 100 || e.Comm != "curl" || e.ServerIPAddress != "10.0.0.1" {
+		t.Fatalf("unexpected custom fields:\n%s", b)
+	}
+}
+
+func TestHarWriter_BinaryPostData(t *testing.T) {
+	har := &HarWriter{}
+	body := []byte{0x00, 0xff, 0xfe, 0x01}
+	tx := newHttpTransaction(
+		&pendingMessage{info: httpMessageInfo{isRequest: true, method: "POST", host: "example.com", url: "/upload", proto: "HTTP/1.1",
+			header: http.Header{"Content-Type": {"application/octet-stream"}}, body: body}},
+		&pendingMessage{info: httpMessageInfo{status: 204, proto: "HTTP/1.1", header: http.Header{}}},
+	)
+	e := har.entry(tx)
+	pd := e.Request.PostData
+	if pd == nil || pd.Text != "AP/+AQ==" || pd.Encoding != "base64" || e.Request.BodySize != len(body) {
+		t.Fatalf("unexpected postData %+v, bodySize %d", pd, e.Request.BodySize)
+	}
+}
+
+func TestEventProcessor_Har(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "ecapture.har")
+	har, err := NewHarWriter(filename, "v0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf syncBuffer
+	ep := NewEventProcessor(log.New(&buf, "", 0), false)
+	ep.SetHar(har)
+	go func() {
+		_ = ep.Serve(context.Background())
+	}()
+
+	req := &BaseEvent{DataType: int64(ProbeRet), Pid: 100, Tid: 100, Fd: 3, Timestamp: 1000}
+	req.Data_len = int32(copy(req.Data[:], "GET /path HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	ep.Write(req)
+	resp := &BaseEvent{DataType: int64(ProbeEntry), Pid: 100, Tid: 100, Fd: 3, Timestamp: 5000}
+	resp.Data_len = int32(copy(resp.Data[:], "HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nContent-Length: 0\r\n\r\n"))
+	ep.Write(resp)
+	time.Sleep(time.Millisecond * 200)
+
+	// workers are still alive, HAR is flushed anyway
+	_ = ep.Close()
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive harArchive
+	if err = json.Unmarshal(b, &archive); err != nil || len(archive.Log.Entries) != 1 {
+		t.Fatalf("unexpected HAR %v:\n%s", err, b)
+	}
+	if e := archive.Log.Entries[0]; e.Request.URL != "https://example.com/path" || e.Response.Status != 200 {
+		t.Fatalf("unexpected entry:\n%s", b)
+	}
+}
+
+func TestHarWriter_Order(t *testing.T) {
+	// RFC3339Nano 省略末尾的 0，UTC 时 "01.1Z" 按字符串比较大于 "01.15Z"
+	local := time.Local
+	time.Local = time.UTC
+	defer func() { time.Local = local }()
+
+	filename := filepath.Join(t.TempDir(), "ecapture.har")
+	har, err := NewHarWriter(filename, "v0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	har.bootTime = 0
+	har.Add(&HttpTransaction{URL: "/first", Timestamp: 1100000000})
+	har.Add(&HttpTransaction{URL: "/second", Timestamp: 1150000000})
+	if err = har.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive harArchive
+	if err = json.Unmarshal(b, &archive); err != nil {
+		t.Fatal(err)
+	}
+	if len(archive.Log.Entries) != 2 || archive.Log.Entries[0].Request.URL != "/first" {
+		t.Fatalf("unexpected order:\n%s", b)
+	}
+}
+
+func TestHarWriter_Limit(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "ecapture.har")
+	har, err := NewHarWriter(filename, "v0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(strings.Repeat("中", MaxHarBodyLen))
+	tx := &HttpTransaction{URL: "/large"}
+	tx.response = httpMessageInfo{header: http.Header{"Content-Type": {"text/plain"}}, body: body}
+	har.Add(tx)
+	har.size = MaxHarSize
+	har.Add(&HttpTransaction{URL: "/dropped"})
+	if err = har.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive harArchive
+	if err = json.Unmarshal(b, &archive); err != nil {
+		t.Fatal(err)
+	}
+	if len(archive.Log.Entries) != 1 || archive.Log.Comment == "" {
+		t.Fatalf("size limit not applied: %d entries, comment:%q", len(archive.Log.Entries), archive.Log.Comment)
+	}
+	e := archive.Log.Entries[0]
+	content := e.Response.Content
+	if len(content.Text) > MaxHarBodyLen || content.Encoding != "" || content.Size != len(body) || e.Response.BodySize != len(body) {
+		t.Fatalf("text:%d, encoding:%s, size:%d", len(content.Text), content.Encoding, content.Size)
+	}
+	if !strings.Contains(e.Comment, "response body truncated") {
+		t.Fatalf("truncation not noted: %q", e.Comment)
+	}
+}
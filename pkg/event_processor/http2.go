@@ -0,0 +1,490 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package event_processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// Http2ClientPreface 客户端连接序言
+const Http2ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	http2FrameHeaderLen = 9
+
+	// HPACK 动态表初始大小，对端 SETTINGS_HEADER_TABLE_SIZE 在另一个方向上，
+	// 无法关联，故允许动态表大小更新到 Http2MaxHeaderTableSize
+	http2InitHeaderTableSize = 4096
+	Http2MaxHeaderTableSize  = 1 << 20
+)
+
+// 帧类型，RFC 7540 6.x
+const (
+	http2FrameData         = 0x0
+	http2FrameHeaders      = 0x1
+	http2FramePriority     = 0x2
+	http2FrameRSTStream    = 0x3
+	http2FrameSettings     = 0x4
+	http2FramePushPromise  = 0x5
+	http2FramePing         = 0x6
+	http2FrameGoAway       = 0x7
+	http2FrameWindowUpdate = 0x8
+	http2FrameContinuation = 0x9
+)
+
+// 帧标志
+const (
+	http2FlagEndStream  = 0x1
+	http2FlagEndHeaders = 0x4
+	http2FlagPadded     = 0x8
+	http2FlagPriority   = 0x20
+)
+
+var errHttp2Padding = errors.New("http2: invalid padding")
+
+// http2Stream 一个 HTTP/2 流的头部、数据
+type http2Stream struct {
+	id       uint32
+	headers  []hpack.HeaderField
+	trailers []hpack.HeaderField
+	body     bytes.Buffer
+	// RST_STREAM 的错误码
+	reset     bool
+	errorCode uint32
+}
+
+// http2Parser 单向的 HTTP/2 连接解析器，HPACK 动态表在连接的整个生命周期内有效，
+// 故 Reset 只清理已输出的流，不清理连接状态。
+type http2Parser struct {
+	conn           string // 连接标识，见 IConnParser
+	isRequest      bool
+	prefaceChecked bool
+	reader         *bytes.Buffer // 未解析的帧数据
+	decoder        *hpack.Decoder
+	streams        map[uint32]*http2Stream
+	// 已结束、待输出的流
+	done []*http2Stream
+
+	// HEADERS/PUSH_PROMISE + CONTINUATION 的头部块
+	headerBlock     bytes.Buffer
+	headerStream    uint32
+	headerEndStream bool
+	headerIsPush    bool
+	inHeaderBlock   bool
+
+	// 连接级错误，如 HPACK 解码失败，之后的头部无法解码
+	err error
+}
+
+func (this *http2Parser) init(isRequest bool) {
+	this.isRequest = isRequest
+	this.prefaceChecked = !isRequest
+	this.reader = bytes.NewBuffer(nil)
+	this.decoder = hpack.NewDecoder(http2InitHeaderTableSize, nil)
+	this.decoder.SetAllowedMaxDynamicTableSize(Http2MaxHeaderTableSize)
+	this.streams = make(map[uint32]*http2Stream)
+	this.done = nil
+	this.headerBlock.Reset()
+	this.inHeaderBlock = false
+	this.err = nil
+}
+
+func (this *http2Parser) setConn(conn string) {
+	this.conn = conn
+}
+
+func (this *http2Parser) PacketType() PacketType {
+	return PacketTypeNull
+}
+
+func (this *http2Parser) buffered() []byte {
+	return this.reader.Bytes()
+}
+
+func (this *http2Parser) Write(b []byte) (int, error) {
+	n, e := this.reader.Write(b)
+	if e != nil {
+		return n, e
+	}
+	this.parseFrames()
+	return n, nil
+}
+
+func (this *http2Parser) IsDone() bool {
+	return len(this.done) > 0
+}
+
+// Reset 清理已输出的流，保留 HPACK 动态表和未结束的流
+func (this *http2Parser) Reset() {
+	this.done = nil
+}
+
+func (this *http2Parser) messages() []httpMessageInfo {
+	infos := make([]httpMessageInfo, 0, len(this.done))
+	for _, s := range this.done {
+		info := httpMessageInfo{
+			isRequest: this.isRequest,
+			stream:    s.id,
+			method:    http2Field(s.headers, ":method"),
+			host:      http2Field(s.headers, ":authority"),
+			url:       http2Field(s.headers, ":path"),
+			proto:     "HTTP/2.0",
+			bytes:     s.body.Len(),
+		}
+		info.status, _ = strconv.Atoi(http2Field(s.headers, ":status"))
+		info.header = make(http.Header)
+		for _, f := range s.headers {
+			if !f.IsPseudo() {
+				info.header.Add(f.Name, f.Value)
+			}
+		}
+		info.body, _, _, _ = httpDecodedBody(bytes.NewReader(s.body.Bytes()), info.header)
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+func (this *http2Parser) Display() []byte {
+	var b bytes.Buffer
+	for i, s := range this.done {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		this.displayStream(&b, s)
+	}
+	return b.Bytes()
+}
+
+// parseFrames 解析缓冲区中完整的帧，不完整的帧留待后续数据
+func (this *http2Parser) parseFrames() {
+	if !this.prefaceChecked {
+		b := this.reader.Bytes()
+		if len(b) < len(Http2ClientPreface) {
+			if bytes.HasPrefix([]byte(Http2ClientPreface), b) {
+				return
+			}
+		} else if bytes.HasPrefix(b, []byte(Http2ClientPreface)) {
+			this.reader.Next(len(Http2ClientPreface))
+		}
+		this.prefaceChecked = true
+	}
+
+	for {
+		b := this.reader.Bytes()
+		if len(b) < http2FrameHeaderLen {
+			return
+		}
+		length := int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+		if len(b) < http2FrameHeaderLen+length {
+			return
+		}
+		typ, flags := b[3], b[4]
+		streamID := binary.BigEndian.Uint32(b[5:9]) & 0x7fffffff
+		payload := b[http2FrameHeaderLen : http2FrameHeaderLen+length]
+		this.handleFrame(typ, flags, streamID, payload)
+		this.reader.Next(http2FrameHeaderLen + length)
+	}
+}
+
+func (this *http2Parser) handleFrame(typ, flags uint8, streamID uint32, payload []byte) {
+	var err error
+	switch typ {
+	case http2FrameData:
+		if flags&http2FlagPadded != 0 {
+			if payload, err = http2StripPadding(payload); err != nil {
+				return
+			}
+		}
+		s := this.stream(streamID)
+		s.body.Write(payload)
+		if flags&http2FlagEndStream != 0 {
+			this.endStream(s)
+		}
+	case http2FrameHeaders:
+		if flags&http2FlagPadded != 0 {
+			if payload, err = http2StripPadding(payload); err != nil {
+				return
+			}
+		}
+		if flags&http2FlagPriority != 0 {
+			// Stream Dependency(4) + Weight(1)
+			if len(payload) < 5 {
+				return
+			}
+			payload = payload[5:]
+		}
+		this.beginHeaderBlock(streamID, flags&http2FlagEndStream != 0, false)
+		this.headerBlock.Write(payload)
+		if flags&http2FlagEndHeaders != 0 {
+			this.endHeaderBlock()
+		}
+	case http2FramePushPromise:
+		if flags&http2FlagPadded != 0 {
+			if payload, err = http2StripPadding(payload); err != nil {
+				return
+			}
+		}
+		if len(payload) < 4 {
+			return
+		}
+		promisedID := binary.BigEndian.Uint32(payload[0:4]) & 0x7fffffff
+		this.beginHeaderBlock(promisedID, false, true)
+		this.headerBlock.Write(payload[4:])
+		if flags&http2FlagEndHeaders != 0 {
+			this.endHeaderBlock()
+		}
+	case http2FrameContinuation:
+		if !this.inHeaderBlock {
+			return
+		}
+		this.headerBlock.Write(payload)
+		if flags&http2FlagEndHeaders != 0 {
+			this.endHeaderBlock()
+		}
+	case http2FrameRSTStream:
+		if len(payload) < 4 {
+			return
+		}
+		s := this.stream(streamID)
+		s.reset = true
+		s.errorCode = binary.BigEndian.Uint32(payload[0:4])
+		this.endStream(s)
+	default:
+		// PRIORITY、SETTINGS、PING、GOAWAY、WINDOW_UPDATE 等控制帧不影响输出
+	}
+}
+
+func (this *http2Parser) beginHeaderBlock(streamID uint32, endStream, isPush bool) {
+	this.headerBlock.Reset()
+	this.headerStream = streamID
+	this.headerEndStream = endStream
+	this.headerIsPush = isPush
+	this.inHeaderBlock = true
+}
+
+// endHeaderBlock 解码完整的头部块，每个头部块都必须按顺序解码，以保持动态表同步
+func (this *http2Parser) endHeaderBlock() {
+	this.inHeaderBlock = false
+	fields, err := this.decoder.DecodeFull(this.headerBlock.Bytes())
+	this.headerBlock.Reset()
+	if err != nil {
+		this.err = fmt.Errorf("hpack decode error:%v", err)
+	}
+
+	if this.headerIsPush {
+		// PUSH_PROMISE 携带的是服务端推送的请求头，仅需解码以同步动态表，推送的响应在被承诺的流上输出
+		return
+	}
+	s := this.stream(this.headerStream)
+	if s.headers == nil || http2IsInformational(s.headers) {
+		s.headers = fields
+		if this.isRequest && grpcIsProto(http2Field(fields, "content-type")) {
+			// 响应的消息类型由请求的方法决定
+			grpcMethods.add(this.conn, s.id, http2Field(fields, ":path"))
+		}
+	} else {
+		s.trailers = append(s.trailers, fields...)
+	}
+	if this.headerEndStream {
+		this.endStream(s)
+	}
+}
+
+func (this *http2Parser) stream(id uint32) *http2Stream {
+	s, found := this.streams[id]
+	if !found {
+		s = &http2Stream{id: id}
+		this.streams[id] = s
+	}
+	return s
+}
+
+func (this *http2Parser) endStream(s *http2Stream) {
+	delete(this.streams, s.id)
+	this.done = append(this.done, s)
+}
+
+// displayStream 按 HTTP/1 的格式输出流
+func (this *http2Parser) displayStream(b *bytes.Buffer, s *http2Stream) {
+	pseudo := make(map[string]string)
+	for _, f := range s.headers {
+		if f.IsPseudo() {
+			pseudo[f.Name] = f.Value
+		}
+	}
+
+	var grpcPath string
+	isGrpc := grpcIsProto(http2Field(s.headers, "content-type"))
+	if isGrpc {
+		if this.isRequest {
+			grpcPath = pseudo[":path"]
+		} else {
+			grpcPath = grpcMethods.take(this.conn, s.id)
+		}
+	}
+
+	fmt.Fprintf(b, "HTTP/2 Stream:%d", s.id)
+	if grpcPath != "" {
+		fmt.Fprintf(b, ", gRPC Method:%s", grpcPath)
+	}
+	b.WriteString("\n")
+	if this.isRequest {
+		fmt.Fprintf(b, "%s %s HTTP/2.0\r\n", pseudo[":method"], pseudo[":path"])
+		if authority, found := pseudo[":authority"]; found {
+			fmt.Fprintf(b, "Host: %s\r\n", authority)
+		}
+	} else {
+		fmt.Fprintf(b, "HTTP/2.0 %s\r\n", pseudo[":status"])
+	}
+	http2WriteFields(b, s.headers)
+	b.WriteString("\r\n")
+	if isGrpc {
+		grpcDisplay(b, s.body.Bytes(), grpcPath, http2Field(s.headers, "grpc-encoding"), this.isRequest)
+	} else {
+		b.Write(s.body.Bytes())
+	}
+	if len(s.trailers) > 0 {
+		if s.body.Len() > 0 && !isGrpc {
+			b.WriteString("\r\n")
+		}
+		http2WriteFields(b, s.trailers)
+	}
+	if isGrpc {
+		// Trailers-Only 响应的 grpc-status 在头部中
+		if status, found := grpcStatus(s.headers, s.trailers); found {
+			b.WriteString(status)
+		}
+	}
+	if s.reset {
+		fmt.Fprintf(b, "\n[RST_STREAM error code:%d]", s.errorCode)
+	}
+	if this.err != nil {
+		fmt.Fprintf(b, "\n[%v]", this.err)
+	}
+}
+
+func http2WriteFields(b *bytes.Buffer, fields []hpack.HeaderField) {
+	for _, f := range fields {
+		if f.IsPseudo() {
+			continue
+		}
+		fmt.Fprintf(b, "%s: %s\r\n", f.Name, f.Value)
+	}
+}
+
+// http2Field 头部的值，不存在时返回空
+func http2Field(fields []hpack.HeaderField, name string) string {
+	for _, f := range fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// http2IsInformational 1xx 响应头，之后还有最终的响应头
+func http2IsInformational(fields []hpack.HeaderField) bool {
+	for _, f := range fields {
+		if f.Name == ":status" {
+			return len(f.Value) == 3 && f.Value[0] == '1'
+		}
+	}
+	return false
+}
+
+func http2StripPadding(payload []byte) ([]byte, error) {
+	if len(payload) < 1 {
+		return nil, errHttp2Padding
+	}
+	padLen := int(payload[0])
+	if padLen > len(payload)-1 {
+		return nil, errHttp2Padding
+	}
+	return payload[1 : len(payload)-padLen], nil
+}
+
+////////////////////// HTTP2Request //////////////////////
+
+type HTTP2Request struct {
+	http2Parser
+}
+
+func (this *HTTP2Request) Init() {
+	this.init(true)
+}
+
+func (this *HTTP2Request) Name() string {
+	return "HTTP2Request"
+}
+
+func (this *HTTP2Request) ParserType() ParserType {
+	return ParserTypeHttp2Request
+}
+
+// detect 客户端以连接序言开始
+func (this *HTTP2Request) detect(payload []byte) error {
+	if !bytes.HasPrefix(payload, []byte(Http2ClientPreface)) {
+		return errors.New("not http2 client preface")
+	}
+	return nil
+}
+
+////////////////////// HTTP2Response //////////////////////
+
+type HTTP2Response struct {
+	http2Parser
+}
+
+func (this *HTTP2Response) Init() {
+	this.init(false)
+}
+
+func (this *HTTP2Response) Name() string {
+	return "HTTP2Response"
+}
+
+func (this *HTTP2Response) ParserType() ParserType {
+	return ParserTypeHttp2Response
+}
+
+// detect 服务端的第一个帧必须是 SETTINGS（非 ACK）
+func (this *HTTP2Response) detect(payload []byte) error {
+	if len(payload) < http2FrameHeaderLen {
+		return errors.New("http2 frame too short")
+	}
+	length := int(payload[0])<<16 | int(payload[1])<<8 | int(payload[2])
+	streamID := binary.BigEndian.Uint32(payload[5:9]) & 0x7fffffff
+	if payload[3] != http2FrameSettings || payload[4] != 0 || streamID != 0 || length%6 != 0 {
+		return errors.New("not http2 server settings frame")
+	}
+	return nil
+}
+
+func init() {
+	h2req := &HTTP2Request{}
+	h2req.Init()
+	Register(h2req)
+
+	h2resp := &HTTP2Response{}
+	h2resp.Init()
+	Register(h2resp)
+}
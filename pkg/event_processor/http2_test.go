@@ -0,0 +1,117 @@
+package event_processor
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// http2Frames encodes frames with http2.Framer, headers share one hpack encoder (dynamic table)
+type http2Frames struct {
+	buf    bytes.Buffer
+	framer *http2.Framer
+	hbuf   bytes.Buffer
+	enc    *hpack.Encoder
+}
+
+func newHttp2Frames() *http2Frames {
+	f := &http2Frames{}
+	f.framer = http2.NewFramer(&f.buf, nil)
+	f.enc = hpack.NewEncoder(&f.hbuf)
+	return f
+}
+
+func (this *http2Frames) headerBlock(fields ...string) []byte {
+	this.hbuf.Reset()
+	for i := 0; i+1 < len(fields); i += 2 {
+		_ = this.enc.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	return append([]byte(nil), this.hbuf.Bytes()...)
+}
+
+func (this *http2Frames) headers(streamID uint32, endStream bool, fields ...string) {
+	_ = this.framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      streamID,
+		BlockFragment: this.headerBlock(fields...),
+		EndStream:     endStream,
+		EndHeaders:    true,
+	})
+}
+
+func (this *http2Frames) bytes() []byte {
+	b := append([]byte(nil), this.buf.Bytes()...)
+	this.buf.Reset()
+	return b
+}
+
+func TestHTTP2Request(t *testing.T) {
+	f := newHttp2Frames()
+	f.buf.WriteString(Http2ClientPreface)
+	_ = f.framer.WriteSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: 65535})
+
+	// HEADERS + CONTINUATION, padded DATA
+	block := f.headerBlock(":method", "POST", ":scheme", "https", ":path", "/api", ":authority", "example.com", "user-agent", "ecapture")
+	_ = f.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block[:3]})
+	_ = f.framer.WriteContinuation(1, true, block[3:])
+	_ = f.framer.WriteDataPadded(1, true, []byte("hello"), []byte{0, 0, 0})
+	payload := f.bytes()
+
+	p := NewParser(payload)
+	if p.ParserType() != ParserTypeHttp2Request {
+		t.Fatalf("parser %s, want HTTP2Request", p.Name())
+	}
+	// frames split across events
+	for _, b := range [][]byte{payload[:10], payload[10:30], payload[30:]} {
+		_, _ = p.Write(b)
+	}
+	if !p.IsDone() {
+		t.Fatal("stream 1 should be done")
+	}
+	got := string(p.Display())
+	want := "HTTP/2 Stream:1\nPOST /api HTTP/2.0\r\nHost: example.com\r\nuser-agent: ecapture\r\n\r\nhello"
+	if got != want {
+		t.Fatalf("display:\n%q\nwant:\n%q", got, want)
+	}
+	p.Reset()
+
+	// same headers are encoded as dynamic table indexes
+	f.headers(3, true, ":method", "POST", ":scheme", "https", ":path", "/api", ":authority", "example.com", "user-agent", "ecapture")
+	_, _ = p.Write(f.bytes())
+	got = string(p.Display())
+	if !strings.Contains(got, "POST /api HTTP/2.0\r\nHost: example.com\r\nuser-agent: ecapture\r\n") {
+		t.Fatalf("dynamic table not kept:\n%q", got)
+	}
+}
+
+func TestHTTP2Response(t *testing.T) {
+	f := newHttp2Frames()
+	_ = f.framer.WriteSettings(http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: 100})
+	f.headers(1, false, ":status", "200", "content-type", "text/plain")
+	_ = f.framer.WriteData(1, false, []byte("data"))
+	f.headers(1, true, "x-trailer", "0")
+	f.headers(3, false, ":status", "500")
+	_ = f.framer.WriteRSTStream(3, http2.ErrCodeCancel)
+	payload := f.bytes()
+
+	p := NewParser(payload)
+	if p.ParserType() != ParserTypeHttp2Response {
+		t.Fatalf("parser %s, want HTTP2Response", p.Name())
+	}
+	_, _ = p.Write(payload)
+	got := string(p.Display())
+	want := "HTTP/2 Stream:1\nHTTP/2.0 200\r\ncontent-type: text/plain\r\n\r\ndata\r\nx-trailer: 0\r\n" +
+		"\nHTTP/2 Stream:3\nHTTP/2.0 500\r\n\r\n\n[RST_STREAM error code:8]"
+	if got != want {
+		t.Fatalf("display:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestHTTPRequest_NotHTTP2(t *testing.T) {
+	hr := &HTTPRequest{}
+	if err := hr.detect([]byte(Http2ClientPreface)); err == nil {
+		t.Fatal("HTTPRequest should not detect http2 client preface")
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package event_processor
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// HTTP 消息体的边界，RFC 7230 3.3.3
+type httpFraming uint8
+
+const (
+	httpFramingNone    httpFraming = iota // 无消息体
+	httpFramingLength                     // Content-Length
+	httpFramingChunked                    // Transfer-Encoding: chunked
+	httpFramingClose                      // 直到连接关闭
+)
+
+var httpCRLF = []byte("\r\n")
+
+// httpHeaderEnd 头部(含空行)的长度，头部不完整时返回 -1。与 net/http 一样兼容只有 \n 的换行
+func httpHeaderEnd(b []byte) int {
+	end := -1
+	if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+		end = i + HTTP_NEW_LINE_LENGTH
+	}
+	if i := bytes.Index(b, []byte("\n\n")); i >= 0 && (end < 0 || i+2 < end) {
+		end = i + 2
+	}
+	return end
+}
+
+// httpMessageEnd 完整消息的长度，消息不完整或直到连接关闭时返回 -1
+func httpMessageEnd(b []byte, headerLen int, framing httpFraming, contentLength int64) int {
+	switch framing {
+	case httpFramingNone:
+		return headerLen
+	case httpFramingLength:
+		if int64(len(b)-headerLen) < contentLength {
+			return -1
+		}
+		return headerLen + int(contentLength)
+	case httpFramingChunked:
+		n := httpChunkedLen(b[headerLen:])
+		if n < 0 {
+			return -1
+		}
+		return headerLen + n
+	}
+	return -1
+}
+
+// httpChunkedLen chunked 消息体(含 trailer)的长度，不完整或格式错误时返回 -1
+func httpChunkedLen(b []byte) int {
+	pos := 0
+	for {
+		i := bytes.Index(b[pos:], httpCRLF)
+		if i < 0 {
+			return -1
+		}
+		line := b[pos : pos+i]
+		// chunk-ext
+		if j := bytes.IndexByte(line, ';'); j >= 0 {
+			line = line[:j]
+		}
+		size, err := strconv.ParseUint(string(bytes.TrimSpace(line)), 16, 63)
+		if err != nil {
+			return -1
+		}
+		pos += i + len(httpCRLF)
+
+		if size == 0 {
+			// 0\r\n 之后为 trailer，以空行结束
+			if bytes.HasPrefix(b[pos:], httpCRLF) {
+				return pos + len(httpCRLF)
+			}
+			end := httpHeaderEnd(b[pos:])
+			if end < 0 {
+				return -1
+			}
+			return pos + end
+		}
+
+		if uint64(len(b)-pos) < size+uint64(len(httpCRLF)) {
+			return -1
+		}
+		pos += int(size) + len(httpCRLF)
+	}
+}
+
+func httpIsChunked(transferEncoding []string) bool {
+	for _, te := range transferEncoding {
+		if strings.EqualFold(te, "chunked") {
+			return true
+		}
+	}
+	return false
+}
+
+// httpBodyAllowed 1xx、204、304 响应没有消息体
+func httpBodyAllowed(status int) bool {
+	if status >= 100 && status <= 199 {
+		return false
+	}
+	return status != 204 && status != 304
+}
@@ -0,0 +1,136 @@
+package event_processor
+
+import (
+	"context"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPRequest_Pipelined(t *testing.T) {
+	p := &HTTPRequest{}
+	p.Init()
+	msgs := []string{
+		"GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"POST /b HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello",
+		"POST /c HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nX-Trailer: 1\r\n\r\n",
+	}
+	all := strings.Join(msgs, "")
+	// the last message is split across writes
+	_, _ = p.Write([]byte(all[:len(all)-10]))
+
+	var got []string
+	for p.IsDone() {
+		got = append(got, string(p.Display()))
+		p.Reset()
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d messages, want 2", len(got))
+	}
+	_, _ = p.Write([]byte(all[len(all)-10:]))
+	if !p.IsDone() {
+		t.Fatal("chunked request should be done")
+	}
+	got = append(got, string(p.Display()))
+	p.Reset()
+
+	for i, want := range []string{"GET /a HTTP/1.1", "POST /b HTTP/1.1", "POST /c HTTP/1.1"} {
+		if !strings.HasPrefix(got[i], want) {
+			t.Fatalf("message %d:\n%s\nwant prefix %s", i, got[i], want)
+		}
+	}
+	if !strings.HasSuffix(got[1], "\r\n\r\nhello") || !strings.Contains(got[2], "hello world") {
+		t.Fatalf("unexpected body:\n%s\n%s", got[1], got[2])
+	}
+}
+
+func TestHTTPResponse_Framing(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		done bool
+	}{
+		{"length", "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", true},
+		{"length incomplete", "HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\nok", false},
+		{"chunked", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n", true},
+		{"chunked incomplete", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n", false},
+		{"no content", "HTTP/1.1 204 No Content\r\nContent-Length: 10\r\n\r\n", true},
+		{"continue", "HTTP/1.1 100 Continue\r\n\r\n", true},
+		{"close", "HTTP/1.0 200 OK\r\n\r\nuntil close", false},
+	}
+	for _, tt := range tests {
+		p := &HTTPResponse{}
+		p.Init()
+		_, _ = p.Write([]byte(tt.msg))
+		if p.IsDone() != tt.done {
+			t.Fatalf("%s: done %v, want %v", tt.name, p.IsDone(), tt.done)
+		}
+	}
+
+	// response to HEAD has no body despite Content-Length
+	head := &HTTPResponse{}
+	head.Init()
+	head.setRequestMethod(func() string { return "HEAD" })
+	_, _ = head.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n"))
+	if !head.IsDone() {
+		t.Fatal("response to HEAD should be done")
+	}
+	if got := string(head.Display()); !strings.Contains(got, "Content-Length: 10\r\n") {
+		t.Fatalf("display:\n%s", got)
+	}
+
+	// close delimited response is displayed when the worker times out
+	p := &HTTPResponse{}
+	p.Init()
+	_, _ = p.Write([]byte("HTTP/1.0 200 OK\r\n\r\nuntil close"))
+	if got := string(p.Display()); !strings.HasSuffix(got, "until close") {
+		t.Fatalf("display:\n%s", got)
+	}
+}
+
+func TestEventProcessor_KeepAlive(t *testing.T) {
+	var buf syncBuffer
+	ep := NewEventProcessor(log.New(&buf, "", 0), false)
+	go func() {
+		_ = ep.Serve(context.Background())
+	}()
+
+	e := &BaseEvent{DataType: int64(ProbeEntry), Pid: 100, Tid: 100, Fd: 3}
+	e.Data_len = int32(copy(e.Data[:], "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\naHTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\nb"))
+	ep.Write(e)
+
+	// displayed before the worker times out
+	time.Sleep(time.Millisecond * 200)
+	if n := strings.Count(buf.String(), "Name:HTTPResponse"); n != 2 {
+		t.Fatalf("got %d responses, want 2:\n%s", n, buf.String())
+	}
+}
+
+func TestEventProcessor_KeepAliveHead(t *testing.T) {
+	var buf syncBuffer
+	ep := NewEventProcessor(log.New(&buf, "", 0), false)
+	go func() {
+		_ = ep.Serve(context.Background())
+	}()
+
+	req := &BaseEvent{DataType: int64(ProbeRet), Pid: 100, Tid: 100, Fd: 3}
+	req.Data_len = int32(copy(req.Data[:], "HEAD /a HTTP/1.1\r\nHost: example.com\r\n\r\nGET /b HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	ep.Write(req)
+	time.Sleep(time.Millisecond * 50)
+
+	resp := &BaseEvent{DataType: int64(ProbeEntry), Pid: 100, Tid: 100, Fd: 3}
+	resp.Data_len = int32(copy(resp.Data[:], "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nHTTP/1.1 404 Not Found\r\nContent-Length: 2\r\n\r\nno"))
+	ep.Write(resp)
+	time.Sleep(time.Millisecond * 200)
+
+	out := buf.String()
+	if n := strings.Count(out, "Name:HTTPResponse"); n != 2 {
+		t.Fatalf("got %d responses, want 2:\n%s", n, out)
+	}
+	for _, want := range []string{`"HEAD /a HTTP/1.1" 200`, `"GET /b HTTP/1.1" 404`} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing access log %q:\n%s", want, out)
+		}
+	}
+}
@@ -17,6 +17,8 @@ package event_processor
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"io"
 	"log"
 	"net/http"
 	"net/http/httputil"
@@ -26,14 +28,18 @@ type HTTPRequest struct {
 	request    *http.Request
 	packerType PacketType
 	isDone     bool
-	isInit     bool
+	isInit     bool // 已解析头部
 	reader     *bytes.Buffer
-	bufReader  *bufio.Reader
+	// 当前消息的头部长度、消息体边界，完成时 msgLen 为消息长度，之后的数据属于下一个消息
+	headerLen     int
+	framing       httpFraming
+	contentLength int64
+	msgLen        int
+	info          *httpMessageInfo // 已输出消息的摘要
 }
 
 func (this *HTTPRequest) Init() {
 	this.reader = bytes.NewBuffer(nil)
-	this.bufReader = bufio.NewReader(this.reader)
 }
 
 func (this *HTTPRequest) Name() string {
@@ -48,34 +54,56 @@ func (this *HTTPRequest) ParserType() ParserType {
 	return ParserTypeHttpRequest
 }
 
+func (this *HTTPRequest) buffered() []byte {
+	return this.reader.Bytes()
+}
+
 func (this *HTTPRequest) Write(b []byte) (int, error) {
-	// 如果未初始化
+	l, e := this.reader.Write(b)
+	if e != nil {
+		return 0, e
+	}
+	this.parse()
+	return l, nil
+}
+
+// parse 解析头部，检测是否接收完整个消息
+func (this *HTTPRequest) parse() {
+	if this.isDone {
+		return
+	}
+	buf := this.reader.Bytes()
 	if !this.isInit {
-		n, e := this.reader.Write(b)
-		if e != nil {
-			return n, e
+		this.headerLen = httpHeaderEnd(buf)
+		if this.headerLen < 0 {
+			return
 		}
-		req, err := http.ReadRequest(this.bufReader)
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:this.headerLen])))
 		if err != nil {
-			return 0, err
+			// 无法解析的头部，原样输出
+			this.request = nil
+			this.msgLen = len(buf)
+			this.isDone = true
+			return
 		}
 		this.request = req
 		this.isInit = true
-		return n, nil
-	}
-
-	// 如果已初始化
-	l, e := this.reader.Write(b)
-	if e != nil {
-		return 0, e
+		// 请求没有 Content-Length 和 chunked 时无消息体
+		switch {
+		case httpIsChunked(req.TransferEncoding):
+			this.framing = httpFramingChunked
+		case req.ContentLength > 0:
+			this.framing = httpFramingLength
+			this.contentLength = req.ContentLength
+		default:
+			this.framing = httpFramingNone
+		}
 	}
 
-	// TODO 检测是否接收完整个包
-	if false {
+	this.msgLen = httpMessageEnd(buf, this.headerLen, this.framing, this.contentLength)
+	if this.msgLen >= 0 {
 		this.isDone = true
 	}
-
-	return l, nil
 }
 
 func (this *HTTPRequest) detect(payload []byte) error {
@@ -86,6 +114,14 @@ func (this *HTTPRequest) detect(payload []byte) error {
 	if err != nil {
 		return err
 	}
+	// HTTP/2 连接序言 "PRI * HTTP/2.0" 由 HTTP2Request 解析
+	if req.ProtoMajor == 2 {
+		return errors.New("http2 client preface")
+	}
+	// WebSocket 握手由 WebSocket 解析
+	if wsIsHandshake(payload) {
+		return errors.New("websocket handshake")
+	}
 	this.request = req
 	return nil
 }
@@ -94,23 +130,71 @@ func (this *HTTPRequest) IsDone() bool {
 	return this.isDone
 }
 
+// Reset 丢弃已输出的消息，keep-alive 连接上之后的数据属于下一个消息
 func (this *HTTPRequest) Reset() {
+	if this.isDone {
+		this.reader.Next(this.msgLen)
+	} else {
+		this.reader.Reset()
+	}
 	this.isDone = false
 	this.isInit = false
-	this.reader.Reset()
-	this.bufReader.Reset(this.reader)
+	this.request = nil
+	this.info = nil
+	this.parse()
 }
 
 func (this *HTTPRequest) Display() []byte {
-	if this.request.Proto == "HTTP/2.0" {
-		return this.reader.Bytes()
+	// 未完成(连接超时)的消息或无法解析的头部，原样输出
+	msg := this.reader.Bytes()
+	if this.isDone {
+		msg = msg[:this.msgLen]
+	}
+	if this.request == nil || !this.isDone {
+		return msg
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(msg)))
+	if err != nil {
+		log.Println("ReadRequest error:", err)
+		return msg
 	}
-	b, e := httputil.DumpRequest(this.request, true)
+
+	// 按 Content-Encoding 解码，chunked 已由 ReadRequest 解码
+	body, packetType, truncated, err := httpDecodedBody(req.Body, req.Header)
+	if err != nil {
+		log.Println("decode request body error:", err)
+	}
+	this.packerType = packetType
+	header := req.Header
+	req.Header = httpDecodedHeader(header, packetType)
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.TransferEncoding = nil
+
+	this.info = &httpMessageInfo{
+		isRequest: true,
+		method:    req.Method,
+		host:      req.Host,
+		url:       req.URL.RequestURI(),
+		proto:     req.Proto,
+		bytes:     len(msg),
+		header:    header,
+		body:      body,
+	}
+
+	b, e := httputil.DumpRequest(req, true)
 	if e != nil {
 		log.Println("DumpRequest error:", e)
+		return msg
+	}
+	return httpTruncatedNote(b, truncated)
+}
+
+func (this *HTTPRequest) messages() []httpMessageInfo {
+	if this.info == nil {
 		return nil
 	}
-	return b
+	return []httpMessageInfo{*this.info}
 }
 
 func init() {
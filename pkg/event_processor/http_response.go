@@ -17,8 +17,7 @@ package event_processor
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
-	"fmt"
+	"errors"
 	"io"
 	"log"
 	"net/http"
@@ -29,21 +28,23 @@ import (
 const HTTP_NEW_LINE_LENGTH = 4
 
 type HTTPResponse struct {
-	response     *http.Response
-	packerType   PacketType
-	isDone       bool
-	receivedLen  int64
-	headerLength int64
-	isInit       bool
-	reader       *bytes.Buffer
-	bufReader    *bufio.Reader
+	response   *http.Response
+	packerType PacketType
+	isDone     bool
+	isInit     bool // 已解析头部
+	reader     *bytes.Buffer
+	// 当前消息的头部长度、消息体边界，完成时 msgLen 为消息长度，之后的数据属于下一个消息
+	headerLen     int
+	framing       httpFraming
+	contentLength int64
+	msgLen        int
+	head          bool             // HEAD 请求的响应，没有消息体
+	requestMethod func() string    // 配对请求的方法，见 IRequestMethodParser
+	info          *httpMessageInfo // 已输出消息的摘要
 }
 
 func (this *HTTPResponse) Init() {
 	this.reader = bytes.NewBuffer(nil)
-	this.bufReader = bufio.NewReader(this.reader)
-	this.receivedLen = 0
-	this.headerLength = 0
 }
 
 func (this *HTTPResponse) Name() string {
@@ -58,40 +59,63 @@ func (this *HTTPResponse) ParserType() ParserType {
 	return ParserTypeHttpResponse
 }
 
+func (this *HTTPResponse) buffered() []byte {
+	return this.reader.Bytes()
+}
+
+func (this *HTTPResponse) setRequestMethod(method func() string) {
+	this.requestMethod = method
+}
+
 func (this *HTTPResponse) Write(b []byte) (int, error) {
-	var l int
-	var e error
-	var req *http.Response
-	// 如果未初始化
+	l, e := this.reader.Write(b)
+	if e != nil {
+		return 0, e
+	}
+	this.parse()
+	return l, nil
+}
+
+// parse 解析头部，检测是否接收完整个消息。没有 Content-Length 和 chunked 的响应直到连接关闭，
+// 由 eventWorker 超时后输出
+func (this *HTTPResponse) parse() {
+	if this.isDone {
+		return
+	}
+	buf := this.reader.Bytes()
 	if !this.isInit {
-		l, e = this.reader.Write(b)
-		if e != nil {
-			return l, e
+		this.headerLen = httpHeaderEnd(buf)
+		if this.headerLen < 0 {
+			return
 		}
-		req, e = http.ReadResponse(this.bufReader, nil)
-
-		if e != nil {
-			return 0, e
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:this.headerLen])), nil)
+		if err != nil {
+			// 无法解析的头部，原样输出
+			this.response = nil
+			this.msgLen = len(buf)
+			this.isDone = true
+			return
 		}
-
-		this.response = req
+		this.response = res
 		this.isInit = true
-	} else {
-		// 如果已初始化
-		l, e = this.reader.Write(b)
-		if e != nil {
-			return 0, e
+		this.head = this.requestMethod != nil && this.requestMethod() == http.MethodHead
+		switch {
+		case this.head || !httpBodyAllowed(res.StatusCode):
+			this.framing = httpFramingNone
+		case httpIsChunked(res.TransferEncoding):
+			this.framing = httpFramingChunked
+		case res.ContentLength >= 0:
+			this.framing = httpFramingLength
+			this.contentLength = res.ContentLength
+		default:
+			this.framing = httpFramingClose
 		}
 	}
-	this.receivedLen += int64(l)
 
-	// 检测是否接收完整个包
-	//if this.response.ContentLength >= this.receivedLen {
-	if false {
+	this.msgLen = httpMessageEnd(buf, this.headerLen, this.framing, this.contentLength)
+	if this.msgLen >= 0 {
 		this.isDone = true
 	}
-
-	return l, nil
 }
 
 func (this *HTTPResponse) detect(payload []byte) error {
@@ -101,6 +125,10 @@ func (this *HTTPResponse) detect(payload []byte) error {
 	if err != nil {
 		return err
 	}
+	// WebSocket 握手由 WebSocket 解析
+	if wsIsHandshake(payload) {
+		return errors.New("websocket handshake")
+	}
 	this.response = res
 	return nil
 }
@@ -109,54 +137,80 @@ func (this *HTTPResponse) IsDone() bool {
 	return this.isDone
 }
 
+// Reset 丢弃已输出的消息，keep-alive 连接上之后的数据属于下一个消息
 func (this *HTTPResponse) Reset() {
+	if this.isDone {
+		this.reader.Next(this.msgLen)
+	} else {
+		this.reader.Reset()
+	}
 	this.isDone = false
 	this.isInit = false
-	this.reader.Reset()
-	this.bufReader.Reset(this.reader)
+	this.head = false
+	this.response = nil
+	this.info = nil
+	this.parse()
 }
 
 func (this *HTTPResponse) Display() []byte {
-	var reader io.ReadCloser
-	var err error
-	switch this.response.Header.Get("Content-Encoding") {
-	case "gzip":
-		reader, err = gzip.NewReader(this.response.Body)
-		if err != nil {
-			log.Println(err)
-			break
-		}
-
-		// gzip uncompressed success
-		this.response.Body = reader
-		this.packerType = PacketTypeGzip
-		defer reader.Close()
-	default:
-		//reader = this.response.Body
-		this.packerType = PacketTypeNull
-		//log.Println("not gzip content")
-		//TODO for debug
-		//return []byte("")
+	// 未完成的消息或无法解析的头部，原样输出；直到连接关闭的响应，已收到的数据即为消息体
+	msg := this.reader.Bytes()
+	if this.isDone {
+		msg = msg[:this.msgLen]
 	}
-	headerMap := bytes.NewBufferString("")
-	for k, v := range this.response.Header {
-		headerMap.WriteString(fmt.Sprintf("\t%s\t=>\t%s\n", k, v))
+	if this.response == nil || (!this.isDone && this.framing != httpFramingClose) {
+		return msg
 	}
-	log.Printf("HTTPS Headers \n\t%s", headerMap.String())
-
-	var b []byte
-	var e error
+	var req *http.Request
+	if this.head {
+		req = &http.Request{Method: http.MethodHead}
+	}
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(msg)), req)
+	if err != nil {
+		log.Println("ReadResponse error:", err)
+		return msg
+	}
+	this.response = res
 
-	if this.response.ContentLength == 0 {
-		b, e = httputil.DumpResponse(this.response, false)
-	} else {
-		b, e = httputil.DumpResponse(this.response, true)
+	// 按 Content-Encoding 解码，chunked 已由 ReadResponse 解码
+	body, packetType, truncated, err := httpDecodedBody(res.Body, res.Header)
+	if err != nil {
+		log.Println("decode response body error:", err)
+	}
+	this.packerType = packetType
+	header := res.Header
+	res.Header = httpDecodedHeader(header, packetType)
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	if !this.head {
+		// HEAD 的响应保留 Content-Length
+		res.ContentLength = int64(len(body))
+	}
+	res.TransferEncoding = nil
+
+	// 1xx 响应之后还有最终的响应，不参与配对
+	if res.StatusCode >= 200 {
+		this.info = &httpMessageInfo{
+			status: res.StatusCode,
+			proto:  res.Proto,
+			bytes:  len(msg),
+			header: header,
+			body:   body,
+		}
 	}
+
+	b, e := httputil.DumpResponse(res, len(body) > 0)
 	if e != nil {
 		log.Println("DumpResponse error:", e)
-		return []byte("")
+		return msg
+	}
+	return httpTruncatedNote(b, truncated)
+}
+
+func (this *HTTPResponse) messages() []httpMessageInfo {
+	if this.info == nil {
+		return nil
 	}
-	return b
+	return []httpMessageInfo{*this.info}
 }
 
 func init() {
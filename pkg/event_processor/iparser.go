@@ -35,6 +35,9 @@ const (
 	PacketTypeUnknow
 	PacketTypeGzip
 	PacketTypeWebSocket
+	PacketTypeDeflate
+	PacketTypeBrotli
+	PacketTypeZstd
 )
 
 const (
@@ -59,6 +62,27 @@ type IParser interface {
 	Reset()
 }
 
+// IConnParser 连接级解析器，状态在连接的整个生命周期内有效(如 HTTP/2 的 HPACK 动态表)。
+// worker 超时销毁后，同一 UUID 的后续事件继续使用该解析器，而不是重新检测；
+// fd 复用为新连接时丢弃，见 isNewConn。
+type IConnParser interface {
+	IParser
+	// setConn 连接标识，同一连接两个方向的解析器相同，用于关联请求和响应
+	setConn(conn string)
+}
+
+// IBufferedParser 能返回已缓存、未输出数据的解析器，解析失败时交给 DefaultParser 原样输出，
+// 而不只是输出当前事件的数据
+type IBufferedParser interface {
+	buffered() []byte
+}
+
+// IRequestMethodParser 响应解析器，消息体的边界取决于配对请求的方法(如 HEAD 的响应没有消息体)
+type IRequestMethodParser interface {
+	// setRequestMethod 返回连接上等待响应的请求方法的函数，未知时返回空
+	setRequestMethod(method func() string)
+}
+
 var parsers = make(map[string]IParser)
 
 func Register(p IParser) {
@@ -94,11 +118,11 @@ func NewParser(payload []byte) IParser {
 				case ParserTypeHttpResponse:
 					newParser = new(HTTPResponse)
 				case ParserTypeHttp2Request:
-					// TODO support HTTP2 request
-					// via golang.org/x/net/http2
-					//hpack.NewEncoder(buf)
+					newParser = new(HTTP2Request)
 				case ParserTypeHttp2Response:
-					// TODO  support HTTP2 response
+					newParser = new(HTTP2Response)
+				case ParserTypeWebSocket:
+					newParser = new(WebSocket)
 				}
 				break
 			}
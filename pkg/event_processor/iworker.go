@@ -17,6 +17,11 @@ package event_processor
 import (
 	"ecapture/user/event"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -29,24 +34,36 @@ type IWorker interface {
 	// 收包
 	Write(event.IEventStruct) error
 	GetUUID() string
+
+	// Drain 通知 worker 处理完队列中的事件、输出缓存的数据后退出，返回的 chan 在退出后关闭
+	Drain() <-chan struct{}
 }
 
 const (
-	MaxTickerCount = 10 // 1 Sencond/(eventWorker.ticker.C) = 10
-	MaxChanLen     = 16 // 包队列长度
+	MaxTickerCount    = 10                     // 1 Sencond/(eventWorker.ticker.C) = 10
+	MaxChanLen        = 16                     // 包队列长度
+	DefaultWorkerTick = time.Millisecond * 100 // eventWorker.ticker 的默认间隔
 	//MAX_EVENT_LEN    = 16 // 事件数组长度
 )
 
+// ErrWorkerQueueFull worker 的事件队列已满
+var ErrWorkerQueueFull = errors.New("eventWorker: incoming queue is full")
+
 type eventWorker struct {
 	incoming chan event.IEventStruct
 	//events      []user.IEventStruct
 	status      ProcessStatus
 	packetType  PacketType
 	ticker      *time.Ticker
-	tickerCount uint8
+	tickerCount int
+	maxTicker   int // 连续 maxTicker 个周期没有新事件时关闭
 	UUID        string
 	processor   *EventProcessor
 	parser      IParser
+	base        event.Base // metadata of the first event of current message
+	draining    chan struct{}
+	drainOnce   sync.Once
+	done        chan struct{} // Run 退出后关闭
 }
 
 func NewEventWorker(uuid string, processor *EventProcessor) IWorker {
@@ -59,8 +76,12 @@ func NewEventWorker(uuid string, processor *EventProcessor) IWorker {
 }
 
 func (this *eventWorker) init(uuid string, processor *EventProcessor) {
-	this.ticker = time.NewTicker(time.Millisecond * 100)
-	this.incoming = make(chan event.IEventStruct, MaxChanLen)
+	opts := processor.opts
+	this.ticker = time.NewTicker(opts.WorkerTick)
+	this.maxTicker = int(opts.WorkerTimeout / opts.WorkerTick)
+	this.incoming = make(chan event.IEventStruct, opts.WorkerChanLen)
+	this.draining = make(chan struct{})
+	this.done = make(chan struct{})
 	this.status = ProcessStateInit
 	this.UUID = uuid
 	this.processor = processor
@@ -70,13 +91,18 @@ func (this *eventWorker) GetUUID() string {
 	return this.UUID
 }
 
+// Write 队列已满时返回 ErrWorkerQueueFull，不阻塞处理器
 func (this *eventWorker) Write(e event.IEventStruct) error {
-	this.incoming <- e
-	return nil
+	select {
+	case this.incoming <- e:
+		return nil
+	default:
+		return ErrWorkerQueueFull
+	}
 }
 
-// 输出包内容
-func (this *eventWorker) Display() {
+// 输出包内容，没有可输出的内容时返回 false
+func (this *eventWorker) Display() bool {
 	// 解析器类型检测
 	if this.parser.ParserType() != ParserTypeHttpResponse {
 		//临时调试开关
@@ -87,7 +113,14 @@ func (this *eventWorker) Display() {
 	b := this.parser.Display()
 
 	if len(b) <= 0 {
-		return
+		return false
+	}
+	this.processor.countParsed(this.parser.Name())
+	this.trackMessages()
+
+	if this.processor.isJson {
+		this.displayJson(b)
+		return true
 	}
 
 	if this.processor.isHex {
@@ -95,45 +128,196 @@ func (this *eventWorker) Display() {
 	}
 
 	// TODO 格式化的终端输出
+	header := fmt.Sprintf("UUID:%s, Name:%s, Type:%d, Length:%d", this.UUID, this.parser.Name(), this.parser.ParserType(), len(b))
+	if this.base.LocalAddr != "" {
+		header += fmt.Sprintf(", Local:%s", this.base.LocalAddr)
+	}
+	if this.base.RemoteAddr != "" {
+		header += fmt.Sprintf(", Remote:%s", this.base.RemoteAddr)
+	}
+	this.processor.output([]byte(fmt.Sprintf("%s\n%s\n", header, b)))
+
 	// 重置状态
-	this.processor.GetLogger().Printf("UUID:%s, Name:%s, Type:%d, Length:%d", this.UUID, this.parser.Name(), this.parser.ParserType(), len(b))
-	this.processor.GetLogger().Println("\n" + string(b))
 	this.parser.Reset()
 	// 设定状态、重置包类型
 	this.status = ProcessStateDone
 	this.packetType = PacketTypeNull
+	return true
+}
+
+// displayJson 以JSON格式输出包内容，每行一条记录
+func (this *eventWorker) displayJson(b []byte) {
+	r := this.base
+	r.Module = this.processor.module
+	r.Payload = b
+	j, err := json.Marshal(r)
+	if err != nil {
+		this.processor.GetLogger().Printf("eventWorker: json marshal error, UUID:%s, error:%v", this.UUID, err)
+	} else {
+		this.processor.output(append(j, '\n'))
+	}
+	this.parser.Reset()
+	this.status = ProcessStateDone
+	this.packetType = PacketTypeNull
 }
 
 // 解析类型，输出
 func (this *eventWorker) parserEvent(e event.IEventStruct) {
+	if this.status != ProcessStateProcessing {
+		// 记录当前包第一个事件的元数据，用于JSON输出
+		this.base = e.Base()
+	}
+
 	if this.status == ProcessStateInit {
-		// 识别包类型，只检测，不把payload设置到parser的属性中，需要重新调用parser.Write()写入
-		parser := NewParser(e.Payload())
+		// 连接级解析器(如 HTTP/2)跨 worker 保留，连接中途的数据无法重新识别
+		var parser IParser
+		if cp := this.processor.getConnParser(this.UUID); cp != nil {
+			if isNewConn(cp, this.base, e.Payload()) {
+				// fd 复用为新连接，丢弃旧连接两个方向的解析器
+				this.processor.delConnParsers(cp.conn)
+			} else {
+				parser = cp.parser
+			}
+		}
+		if parser == nil {
+			// 识别包类型，只检测，不把payload设置到parser的属性中，需要重新调用parser.Write()写入
+			parser = NewParser(e.Payload())
+			if cp, ok := parser.(IConnParser); ok {
+				cp.setConn(connKey(this.UUID, this.base))
+				this.processor.addConnParser(this.UUID, this.base, parser)
+			}
+		}
+		if rp, ok := parser.(IRequestMethodParser); ok {
+			conn := connKey(this.UUID, this.base)
+			rp.setRequestMethod(func() string {
+				return this.processor.transactions.requestMethod(conn)
+			})
+		}
 		this.parser = parser
 	}
 
 	// 设定当前worker的状态为正在解析
 	this.status = ProcessStateProcessing
 
-	// 写入payload到parser
-	_, err := this.parser.Write(e.Payload()[:e.PayloadLen()])
-	if err != nil {
-		this.processor.GetLogger().Fatalf("eventWorker: detect packet type error, UUID:%s, error:%v", this.UUID, err)
+	payload := e.Payload()[:e.PayloadLen()]
+	err := this.parse(payload)
+	if err == nil {
+		return
 	}
 
-	// 是否接收完成，能否输出
-	if this.parser.IsDone() {
-		this.Display()
+	// 解析失败，该连接在 worker 的生命周期内退回 DefaultParser，原样输出；
+	// 失败的解析器已缓存的数据(包含当前事件)一并输出
+	this.processor.parseFailed(this.UUID, this.parser.Name(), err)
+	if bp, found := this.parser.(IBufferedParser); found {
+		if b := this.buffered(bp); len(b) > 0 {
+			payload = b
+		}
+	}
+	if _, found := this.parser.(IConnParser); found {
+		this.processor.delConnParser(this.UUID)
+	}
+	dp := &DefaultParser{}
+	dp.Init()
+	this.parser = dp
+	this.status = ProcessStateProcessing
+	_ = this.parse(payload)
+}
+
+// buffered 读取解析器已缓存的数据，解析器状态已损坏，读取时 panic 则放弃
+func (this *eventWorker) buffered(bp IBufferedParser) (b []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			b = nil
+		}
+	}()
+	return append([]byte(nil), bp.buffered()...)
+}
+
+// parse 写入payload到parser并输出完成的消息，解析器返回错误或 panic 时返回 error
+func (this *eventWorker) parse(payload []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("parser panic:%v", r)
+		}
+	}()
+
+	if _, err = this.parser.Write(payload); err != nil {
+		return err
+	}
+
+	// 是否接收完成，能否输出。keep-alive 连接上一个事件可能包含多个完整的消息
+	for this.parser.IsDone() {
+		if !this.Display() {
+			break
+		}
+	}
+	return nil
+}
+
+// trackMessages 已输出的 HTTP 消息交给处理器配对请求和响应
+func (this *eventWorker) trackMessages() {
+	mp, ok := this.parser.(IMessageParser)
+	if !ok {
+		return
+	}
+	conn := connKey(this.UUID, this.base)
+	for _, m := range mp.messages() {
+		this.processor.trackTransaction(conn, m, this.base)
 	}
 }
 
+// connAddrs 连接的本地、远端地址，未知时为空
+func connAddrs(base event.Base) string {
+	if base.LocalAddr == "" || base.RemoteAddr == "" {
+		return ""
+	}
+	return base.LocalAddr + "-" + base.RemoteAddr
+}
+
+// isNewConn 已有连接级解析器的 UUID(pid+fd)上，payload 是否属于新的连接：
+// 连接地址发生变化，或者是连接的开头(如 HTTP/2 客户端连接序言、HTTP/1.x 请求或响应)。
+// HTTP/2 服务端的 SETTINGS 帧也可能出现在连接中途，不作为新连接的依据。
+func isNewConn(cp *connParser, base event.Base, payload []byte) bool {
+	if addrs := connAddrs(base); cp.addrs != "" && addrs != "" && addrs != cp.addrs {
+		return true
+	}
+	switch NewParser(payload).(type) {
+	case *DefaultParser, *HTTP2Response:
+		return false
+	}
+	return true
+}
+
+// connKey 连接标识，有连接地址时为 pid+地址，否则为去掉方向的 UUID(如 pid_tid_comm_fd)，
+// 同一线程上交替读写的多个连接不会混在一起
+func connKey(uuid string, base event.Base) string {
+	if base.LocalAddr != "" && base.RemoteAddr != "" {
+		return fmt.Sprintf("%d_%s_%s", base.Pid, base.LocalAddr, base.RemoteAddr)
+	}
+	// 有方向的事件，UUID 的最后一段为方向(DataType)
+	if base.Direction != event.DirectionNone {
+		if i := strings.LastIndexByte(uuid, '_'); i > 0 {
+			uuid = uuid[:i]
+		}
+	}
+	return uuid
+}
+
+func (this *eventWorker) Drain() <-chan struct{} {
+	this.drainOnce.Do(func() {
+		close(this.draining)
+	})
+	return this.done
+}
+
 func (this *eventWorker) Run() {
+	defer close(this.done)
 	for {
 		select {
 		case _ = <-this.ticker.C:
 			// 输出包
-			if this.tickerCount > MaxTickerCount {
-				this.processor.GetLogger().Printf("eventWorker TickerCount > %d, event closed.", MaxTickerCount)
+			if this.tickerCount > this.maxTicker {
+				this.processor.GetLogger().Printf("eventWorker TickerCount > %d, event closed.", this.maxTicker)
 				this.Close()
 				return
 			}
@@ -142,6 +326,12 @@ func (this *eventWorker) Run() {
 			// reset tickerCount
 			this.tickerCount = 0
 			this.parserEvent(e)
+		case <-this.draining:
+			for n := len(this.incoming); n > 0; n-- {
+				this.parserEvent(<-this.incoming)
+			}
+			this.Close()
+			return
 		}
 	}
 
@@ -150,7 +340,9 @@ func (this *eventWorker) Run() {
 func (this *eventWorker) Close() {
 	// 即将关闭， 必须输出结果
 	this.ticker.Stop()
-	this.Display()
+	if this.parser != nil {
+		this.Display()
+	}
 	this.tickerCount = 0
 	this.processor.delWorkerByUUID(this)
 }
@@ -15,17 +15,104 @@
 package event_processor
 
 import (
+	"context"
 	"ecapture/user/event"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	MaxIncomingChanLen = 1024
 	MaxParserQueueLen  = 1024
+	MaxConnParserLen   = 1024 // 连接级解析器的最大数量，超过后淘汰最久未使用的
+
+	// DropLogInterval 队列已满丢弃事件时，日志的最小间隔
+	DropLogInterval = time.Second * 10
+	// DefaultShutdownTimeout 关闭时等待 worker 输出缓存数据的默认时间
+	DefaultShutdownTimeout = time.Second * 5
 )
 
+// Options EventProcessor 的队列长度和 worker 超时，零值使用默认值
+type Options struct {
+	WorkerTimeout   time.Duration // worker 没有新事件时，输出已缓存的数据并销毁的时间
+	WorkerTick      time.Duration // worker 检查超时的间隔
+	WorkerChanLen   int           // 每个 worker 的事件队列长度
+	IncomingChanLen int           // 处理器的事件队列长度
+	MaxWorkers      int           // worker 的最大数量，超过后丢弃新连接的事件
+	ShutdownTimeout time.Duration // 关闭时等待 worker 输出缓存数据的最长时间
+}
+
+// DefaultOptions 默认的队列长度和 worker 超时
+func DefaultOptions() Options {
+	return Options{
+		WorkerTimeout:   DefaultWorkerTick * MaxTickerCount,
+		WorkerTick:      DefaultWorkerTick,
+		WorkerChanLen:   MaxChanLen,
+		IncomingChanLen: MaxIncomingChanLen,
+		MaxWorkers:      MaxParserQueueLen,
+		ShutdownTimeout: DefaultShutdownTimeout,
+	}
+}
+
+// withDefaults 零值替换为默认值
+func (this Options) withDefaults() Options {
+	def := DefaultOptions()
+	if this.WorkerTick <= 0 {
+		this.WorkerTick = def.WorkerTick
+	}
+	if this.WorkerTimeout <= 0 {
+		this.WorkerTimeout = def.WorkerTimeout
+	}
+	if this.WorkerChanLen <= 0 {
+		this.WorkerChanLen = def.WorkerChanLen
+	}
+	if this.IncomingChanLen <= 0 {
+		this.IncomingChanLen = def.IncomingChanLen
+	}
+	if this.MaxWorkers <= 0 {
+		this.MaxWorkers = def.MaxWorkers
+	}
+	if this.ShutdownTimeout <= 0 {
+		this.ShutdownTimeout = def.ShutdownTimeout
+	}
+	return this
+}
+
+// Stats EventProcessor 的计数，队列已满时丢弃事件而不阻塞事件读取
+type Stats struct {
+	Events              uint64            // 收到的事件
+	DroppedEvents       uint64            // 处理器队列已满，丢弃的事件
+	DroppedWorkerEvents uint64            // worker 队列已满，丢弃的事件
+	RejectedEvents      uint64            // worker 数量达到上限，丢弃的新连接的事件
+	ParseErrors         uint64            // 解析失败，退回 DefaultParser 的次数
+	Workers             int               // 当前的 worker 数量
+	Parsed              map[string]uint64 // 各解析器输出的消息数量
+}
+
+// processorCounters 原子计数，单独分配以保证 64 位对齐
+type processorCounters struct {
+	events              uint64
+	droppedEvents       uint64
+	droppedWorkerEvents uint64
+	rejectedEvents      uint64
+	parseErrors         uint64
+	lastDropLog         int64
+}
+
+// connParser 连接级解析器及其最近使用时间
+type connParser struct {
+	parser   IParser
+	conn     string // 连接标识，见 connKey
+	addrs    string // 连接的本地、远端地址，未知时为空
+	lastSeen time.Time
+}
+
 type EventProcessor struct {
 	sync.Mutex
 	// 收包，来自调用者发来的新事件
@@ -34,45 +121,207 @@ type EventProcessor struct {
 	// key为 PID+UID+COMMON等确定唯一的信息
 	workerQueue map[string]IWorker
 
+	// 连接级解析器，key 与 workerQueue 相同，worker 销毁后保留
+	connParsers map[string]*connParser
+
+	// 请求、响应配对，输出访问日志
+	transactions *transactionTracker
+
+	// 配对的事务同时写入 HAR 文件，未设置时不写入
+	har *HarWriter
+
 	logger *log.Logger
 
+	// 解析结果的输出目标，未设置时输出到 logger
+	out io.Writer
+
 	// output model
 	isHex bool
+
+	// output newline-delimited JSON records, tagged with module name
+	isJson bool
+	module string
+
+	opts     Options
+	counters *processorCounters
+	parsed   map[string]uint64 // 各解析器输出的消息数量
+
+	// 关闭流程：Close 关闭 closing，Serve 处理剩余事件、等待 worker 退出后把结果写入 served
+	serving   bool
+	closing   chan struct{}
+	served    chan error
+	closeOnce sync.Once
 }
 
 func (this *EventProcessor) GetLogger() *log.Logger {
 	return this.logger
 }
 
+// SetJson switch output to newline-delimited JSON records of module.
+func (this *EventProcessor) SetJson(module string) {
+	this.isJson = true
+	this.module = module
+}
+
+// SetOutput 设置解析结果的输出目标，每次 Write 为一条完整记录
+func (this *EventProcessor) SetOutput(w io.Writer) {
+	this.out = w
+}
+
+// SetOptions 设置队列长度和 worker 超时，需在 Serve 之前调用
+func (this *EventProcessor) SetOptions(opts Options) {
+	this.opts = opts.withDefaults()
+	if cap(this.incoming) != this.opts.IncomingChanLen {
+		this.incoming = make(chan event.IEventStruct, this.opts.IncomingChanLen)
+	}
+}
+
+// Stats 当前的计数
+func (this *EventProcessor) Stats() Stats {
+	this.Lock()
+	workers := len(this.workerQueue)
+	parsed := make(map[string]uint64, len(this.parsed))
+	for name, n := range this.parsed {
+		parsed[name] = n
+	}
+	this.Unlock()
+	return Stats{
+		Events:              atomic.LoadUint64(&this.counters.events),
+		DroppedEvents:       atomic.LoadUint64(&this.counters.droppedEvents),
+		DroppedWorkerEvents: atomic.LoadUint64(&this.counters.droppedWorkerEvents),
+		RejectedEvents:      atomic.LoadUint64(&this.counters.rejectedEvents),
+		ParseErrors:         atomic.LoadUint64(&this.counters.parseErrors),
+		Workers:             workers,
+		Parsed:              parsed,
+	}
+}
+
+// dropped 丢弃事件计数，每 DropLogInterval 最多输出一次日志
+func (this *EventProcessor) dropped(counter *uint64, reason string) {
+	n := atomic.AddUint64(counter, 1)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&this.counters.lastDropLog)
+	if now-last < int64(DropLogInterval) || !atomic.CompareAndSwapInt64(&this.counters.lastDropLog, last, now) {
+		return
+	}
+	this.logger.Printf("EventProcessor: %s, %d events dropped", reason, n)
+}
+
+// countParsed 解析器输出消息计数
+func (this *EventProcessor) countParsed(parser string) {
+	this.Lock()
+	defer this.Unlock()
+	this.parsed[parser]++
+}
+
+// parseFailed 解析失败计数
+func (this *EventProcessor) parseFailed(uuid, parser string, err error) {
+	n := atomic.AddUint64(&this.counters.parseErrors, 1)
+	this.logger.Printf("EventProcessor: %s parse error, fallback to DefaultParser, UUID:%s, error:%v, total errors:%d", parser, uuid, err, n)
+}
+
+// SetHar 配对的 HTTP 事务写入 HAR 文件，Close 时刷新到磁盘
+func (this *EventProcessor) SetHar(har *HarWriter) {
+	this.har = har
+}
+
+// output 输出一条记录
+func (this *EventProcessor) output(record []byte) {
+	if this.out == nil {
+		if this.isJson {
+			_, _ = this.logger.Writer().Write(record)
+		} else {
+			this.logger.Print(string(record))
+		}
+		return
+	}
+	if _, err := this.out.Write(record); err != nil {
+		this.logger.Printf("EventProcessor: write record error:%v", err)
+	}
+}
+
 func (this *EventProcessor) init() {
-	this.incoming = make(chan event.IEventStruct, MaxIncomingChanLen)
+	this.opts = DefaultOptions()
+	this.counters = &processorCounters{}
+	this.parsed = make(map[string]uint64)
+	this.incoming = make(chan event.IEventStruct, this.opts.IncomingChanLen)
 	this.workerQueue = make(map[string]IWorker, MaxParserQueueLen)
+	this.closing = make(chan struct{})
+	this.served = make(chan error, 1)
+	this.connParsers = make(map[string]*connParser)
+	this.transactions = newTransactionTracker()
 }
 
-// Write event 处理器读取事件
-func (this *EventProcessor) Serve() {
+// Serve 处理器读取事件，直到 ctx 结束或 Close 被调用。
+// 退出前处理队列中剩余的事件，并通知所有 worker 输出缓存的数据，最多等待 ShutdownTimeout。
+func (this *EventProcessor) Serve(ctx context.Context) error {
+	this.Lock()
+	this.serving = true
+	this.Unlock()
 	for {
 		select {
 		case e := <-this.incoming:
 			this.dispatch(e)
+		case <-ctx.Done():
+			return this.shutdown()
+		case <-this.closing:
+			return this.shutdown()
 		}
 	}
 }
 
+func (this *EventProcessor) shutdown() error {
+	err := this.drain()
+	this.served <- err
+	return err
+}
+
+// drain 处理队列中剩余的事件，等待所有 worker 输出后退出
+func (this *EventProcessor) drain() error {
+	for n := len(this.incoming); n > 0; n-- {
+		this.dispatch(<-this.incoming)
+	}
+
+	this.Lock()
+	workers := make([]IWorker, 0, len(this.workerQueue))
+	for _, w := range this.workerQueue {
+		workers = append(workers, w)
+	}
+	this.Unlock()
+
+	timeout := time.NewTimer(this.opts.ShutdownTimeout)
+	defer timeout.Stop()
+	for _, w := range workers {
+		select {
+		case <-w.Drain():
+		case <-timeout.C:
+			return fmt.Errorf("EventProcessor: drain workers timeout after %s, %d workers remaining", this.opts.ShutdownTimeout, this.workerCount())
+		}
+	}
+	return nil
+}
+
 func (this *EventProcessor) dispatch(e event.IEventStruct) {
 	//this.logger.Printf("event ID:%s", e.GetUUID())
 	var uuid string = e.GetUUID()
 	found, eWorker := this.getWorkerByUUID(uuid)
 	if !found {
+		if this.workerCount() >= this.opts.MaxWorkers {
+			this.dropped(&this.counters.rejectedEvents, fmt.Sprintf("too many workers (max %d)", this.opts.MaxWorkers))
+			return
+		}
 		// ADD a new eventWorker into queue
 		eWorker = NewEventWorker(e.GetUUID(), this)
 		this.addWorkerByUUID(eWorker)
 	}
 
 	err := eWorker.Write(e)
+	if errors.Is(err, ErrWorkerQueueFull) {
+		this.dropped(&this.counters.droppedWorkerEvents, "worker queue is full")
+		return
+	}
 	if err != nil {
-		//...
-		this.GetLogger().Fatalf("write event failed , error:%v", err)
+		this.dropped(&this.counters.droppedWorkerEvents, fmt.Sprintf("write event failed, error:%v", err))
 	}
 }
 
@@ -92,6 +341,12 @@ func (this *EventProcessor) getWorkerByUUID(uuid string) (bool, IWorker) {
 	return true, eWorker
 }
 
+func (this *EventProcessor) workerCount() int {
+	this.Lock()
+	defer this.Unlock()
+	return len(this.workerQueue)
+}
+
 func (this *EventProcessor) addWorkerByUUID(worker IWorker) {
 	this.Lock()
 	defer this.Unlock()
@@ -105,20 +360,109 @@ func (this *EventProcessor) delWorkerByUUID(worker IWorker) {
 	delete(this.workerQueue, worker.GetUUID())
 }
 
+// getConnParser 获取 uuid 对应连接的解析器，不存在时返回 nil
+func (this *EventProcessor) getConnParser(uuid string) *connParser {
+	this.Lock()
+	defer this.Unlock()
+	cp, found := this.connParsers[uuid]
+	if !found {
+		return nil
+	}
+	cp.lastSeen = time.Now()
+	return cp
+}
+
+// delConnParser 删除连接级解析器，解析失败后连接状态不再可信
+func (this *EventProcessor) delConnParser(uuid string) {
+	this.Lock()
+	defer this.Unlock()
+	delete(this.connParsers, uuid)
+}
+
+// delConnParsers 删除连接两个方向的解析器，fd 复用为新连接后，旧连接的状态不再有效
+func (this *EventProcessor) delConnParsers(conn string) {
+	this.Lock()
+	defer this.Unlock()
+	for uuid, cp := range this.connParsers {
+		if cp.conn == conn {
+			delete(this.connParsers, uuid)
+		}
+	}
+	grpcMethods.delConn(conn)
+}
+
+// addConnParser 保存连接级解析器，超过 MaxConnParserLen 时淘汰最久未使用的
+func (this *EventProcessor) addConnParser(uuid string, base event.Base, parser IParser) {
+	this.Lock()
+	defer this.Unlock()
+	if len(this.connParsers) >= MaxConnParserLen {
+		var oldest string
+		var oldestSeen time.Time
+		for id, cp := range this.connParsers {
+			if oldest == "" || cp.lastSeen.Before(oldestSeen) {
+				oldest, oldestSeen = id, cp.lastSeen
+			}
+		}
+		delete(this.connParsers, oldest)
+	}
+	this.connParsers[uuid] = &connParser{parser: parser, conn: connKey(uuid, base), addrs: connAddrs(base), lastSeen: time.Now()}
+}
+
+// trackTransaction 记录已输出的 HTTP 消息，与同一连接上的请求/响应配对后输出一行访问日志
+func (this *EventProcessor) trackTransaction(conn string, info httpMessageInfo, base event.Base) {
+	tx := this.transactions.add(conn, info, base)
+	if tx == nil {
+		return
+	}
+	tx.Module = this.module
+	if this.har != nil {
+		this.har.Add(tx)
+	}
+	if !this.isJson {
+		this.output([]byte(tx.String() + "\n"))
+		return
+	}
+	j, err := json.Marshal(tx)
+	if err != nil {
+		this.logger.Printf("EventProcessor: json marshal transaction error:%v", err)
+		return
+	}
+	this.output(append(j, '\n'))
+}
+
 // Write event
-// 外部调用者调用该方法
+// 外部调用者调用该方法，队列已满时丢弃并计数，不阻塞调用者
 func (this *EventProcessor) Write(e event.IEventStruct) {
+	atomic.AddUint64(&this.counters.events, 1)
 	select {
 	case this.incoming <- e:
 		return
+	default:
+		this.dropped(&this.counters.droppedEvents, "incoming queue is full")
 	}
 }
 
+// Close 停止 Serve，等待所有 worker 输出缓存的数据后刷新 HAR 文件。未调用 Serve 时直接处理剩余的事件。
 func (this *EventProcessor) Close() error {
-	if len(this.workerQueue) > 0 {
-		return fmt.Errorf("EventProcessor.Close(): workerQueue is not empty:%d", len(this.workerQueue))
-	}
-	return nil
+	var err error
+	this.closeOnce.Do(func() {
+		this.Lock()
+		close(this.closing)
+		serving := this.serving
+		this.Unlock()
+		if serving {
+			err = <-this.served
+		} else {
+			err = this.drain()
+		}
+
+		if this.har != nil {
+			if e := this.har.Flush(); e != nil && err == nil {
+				err = fmt.Errorf("EventProcessor.Close(): write HAR file %s error:%v", this.har.Filename(), e)
+			}
+		}
+	})
+	return err
 }
 
 func NewEventProcessor(logger *log.Logger, isHex bool) *EventProcessor {
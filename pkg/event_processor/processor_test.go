@@ -1,11 +1,15 @@
 package event_processor
 
 import (
+	"bytes"
+	"context"
+	"ecapture/user/event"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -40,7 +44,7 @@ func TestEventProcessor_Serve(t *testing.T) {
 	ep := NewEventProcessor(logger, true)
 
 	go func() {
-		ep.Serve()
+		_ = ep.Serve(context.Background())
 	}()
 	content, err := ioutil.ReadFile(testFile)
 	if err != nil {
@@ -77,3 +81,296 @@ func TestEventProcessor_Serve(t *testing.T) {
 	}
 	t.Log("done")
 }
+
+// syncBuffer bytes.Buffer guarded by mutex, written by workers and read by tests.
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (this *syncBuffer) Write(p []byte) (int, error) {
+	this.Lock()
+	defer this.Unlock()
+	return this.buf.Write(p)
+}
+
+func (this *syncBuffer) String() string {
+	this.Lock()
+	defer this.Unlock()
+	return this.buf.String()
+}
+
+func TestEventProcessor_Json(t *testing.T) {
+	var buf syncBuffer
+	logger := log.New(&buf, "", 0)
+	ep := NewEventProcessor(logger, false)
+	ep.SetJson("EBPFProbeOPENSSL")
+
+	go func() {
+		_ = ep.Serve(context.Background())
+	}()
+
+	var comm [16]byte
+	copy(comm[:], "curl")
+	e := &BaseEvent{DataType: int64(ProbeRet), Timestamp: 1024, Pid: 100, Tid: 101, Comm: comm, Fd: 3}
+	e.Data_len = int32(copy(e.Data[:], "ecapture json output"))
+	ep.Write(e)
+
+	time.Sleep(time.Millisecond * 500)
+
+	var r event.Base
+	line := strings.TrimSpace(buf.String())
+	if err := json.Unmarshal([]byte(line), &r); err != nil {
+		t.Fatalf("json unmarshal error: %s, line:%s", err.Error(), line)
+	}
+	if r.Pid != 100 || r.Tid != 101 || r.Comm != "curl" || r.Timestamp != 1024 {
+		t.Fatalf("unexpected record: %+v", r)
+	}
+	if r.Direction != event.DirectionEgress || r.Module != "EBPFProbeOPENSSL" {
+		t.Fatalf("unexpected direction or module: %+v", r)
+	}
+	if string(r.Payload) != "ecapture json output" {
+		t.Fatalf("unexpected payload: %s", r.Payload)
+	}
+}
+
+func TestEventProcessor_Backpressure(t *testing.T) {
+	var buf syncBuffer
+	ep := NewEventProcessor(log.New(&buf, "", 0), false)
+	ep.SetOptions(Options{IncomingChanLen: 4, MaxWorkers: 1})
+
+	// Serve is not running, Write must not block when the queue is full
+	for i := 0; i < 6; i++ {
+		e := &BaseEvent{DataType: int64(ProbeEntry), Pid: uint32(100 + i%2), Tid: 100, Fd: 3}
+		e.Data_len = int32(copy(e.Data[:], "ecapture"))
+		ep.Write(e)
+	}
+	stats := ep.Stats()
+	if stats.Events != 6 || stats.DroppedEvents != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if !strings.Contains(buf.String(), "incoming queue is full") {
+		t.Fatalf("missing drop log:\n%s", buf.String())
+	}
+
+	// the second connection exceeds MaxWorkers
+	go func() {
+		_ = ep.Serve(context.Background())
+	}()
+	time.Sleep(time.Millisecond * 50)
+	stats = ep.Stats()
+	if stats.Workers != 1 || stats.RejectedEvents != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestEventProcessor_WorkerTimeout(t *testing.T) {
+	var buf syncBuffer
+	ep := NewEventProcessor(log.New(&buf, "", 0), false)
+	ep.SetOptions(Options{WorkerTimeout: time.Millisecond * 50, WorkerTick: time.Millisecond * 10})
+	go func() {
+		_ = ep.Serve(context.Background())
+	}()
+
+	// incomplete response is displayed when the worker times out
+	e := &BaseEvent{DataType: int64(ProbeEntry), Pid: 100, Tid: 100, Fd: 3}
+	e.Data_len = int32(copy(e.Data[:], "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nok"))
+	ep.Write(e)
+	time.Sleep(time.Millisecond * 200)
+	if !strings.Contains(buf.String(), "Name:HTTPResponse") || ep.Stats().Workers != 0 {
+		t.Fatalf("worker should be closed:\n%s", buf.String())
+	}
+
+	if opts := (Options{}).withDefaults(); opts != DefaultOptions() || opts.WorkerTimeout != time.Second {
+		t.Fatalf("unexpected default options %+v", opts)
+	}
+}
+
+func TestEventProcessor_Shutdown(t *testing.T) {
+	var buf syncBuffer
+	ep := NewEventProcessor(log.New(&buf, "", 0), false)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- ep.Serve(ctx)
+	}()
+
+	// incomplete message is output on shutdown without waiting for the worker timeout
+	e := &BaseEvent{DataType: int64(ProbeEntry), Pid: 100, Tid: 100, Fd: 3}
+	e.Data_len = int32(copy(e.Data[:], "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nok"))
+	ep.Write(e)
+	time.Sleep(time.Millisecond * 50)
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("serve error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve should return after ctx is done")
+	}
+	if !strings.Contains(buf.String(), "Name:HTTPResponse") || ep.Stats().Workers != 0 {
+		t.Fatalf("worker should be drained:\n%s", buf.String())
+	}
+	if err := ep.Close(); err != nil {
+		t.Fatalf("close error: %v", err)
+	}
+}
+
+func TestEventProcessor_CloseWithoutServe(t *testing.T) {
+	var buf syncBuffer
+	ep := NewEventProcessor(log.New(&buf, "", 0), false)
+
+	// events still in the queue are processed by Close
+	e := &BaseEvent{DataType: int64(ProbeRet), Pid: 100, Tid: 100, Fd: 3}
+	e.Data_len = int32(copy(e.Data[:], "GET / HTTP/1.1\r\nHost: example.com\r\n"))
+	ep.Write(e)
+	if err := ep.Close(); err != nil {
+		t.Fatalf("close error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "GET / HTTP/1.1") {
+		t.Fatalf("queued event should be output:\n%s", buf.String())
+	}
+	if err := ep.Close(); err != nil {
+		t.Fatalf("second close error: %v", err)
+	}
+}
+
+// brokenParser fails on Write, or panics if panics is set
+type brokenParser struct {
+	DefaultParser
+	panics bool
+}
+
+func (this *brokenParser) Name() string {
+	return "brokenParser"
+}
+
+func (this *brokenParser) Write(b []byte) (int, error) {
+	if this.panics {
+		panic("malformed message")
+	}
+	return 0, fmt.Errorf("malformed message")
+}
+
+func TestEventWorker_ParseError(t *testing.T) {
+	var buf syncBuffer
+	ep := NewEventProcessor(log.New(&buf, "", 0), false)
+
+	for i, p := range []*brokenParser{{}, {panics: true}} {
+		w := &eventWorker{}
+		w.init(fmt.Sprintf("broken_%d", i), ep)
+		p.Init()
+		w.parser = p
+		w.status = ProcessStateDone
+
+		e := &BaseEvent{DataType: int64(ProbeEntry), Pid: 100, Tid: 100, Fd: uint32(i)}
+		e.Data_len = int32(copy(e.Data[:], "ecapture malformed"))
+		w.parserEvent(e)
+		w.ticker.Stop()
+
+		if _, ok := w.parser.(*DefaultParser); !ok {
+			t.Fatalf("worker should fall back to DefaultParser, got %s", w.parser.Name())
+		}
+	}
+	if n := strings.Count(buf.String(), "Name:DefaultParser"); n != 2 || !strings.Contains(buf.String(), "ecapture malformed") {
+		t.Fatalf("payload should be output by DefaultParser:\n%s", buf.String())
+	}
+	if stats := ep.Stats(); stats.ParseErrors != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// bufferingParser buffers every Write and fails once the buffer holds "BAD"
+type bufferingParser struct {
+	DefaultParser
+}
+
+func (this *bufferingParser) Name() string {
+	return "bufferingParser"
+}
+
+func (this *bufferingParser) Write(b []byte) (int, error) {
+	n, _ := this.reader.Write(b)
+	if bytes.Contains(this.reader.Bytes(), []byte("BAD")) {
+		return n, fmt.Errorf("malformed message")
+	}
+	return n, nil
+}
+
+func (this *bufferingParser) buffered() []byte {
+	return this.reader.Bytes()
+}
+
+func TestEventWorker_ParseErrorBuffered(t *testing.T) {
+	var buf syncBuffer
+	ep := NewEventProcessor(log.New(&buf, "", 0), false)
+
+	w := &eventWorker{}
+	w.init("buffering", ep)
+	p := &bufferingParser{}
+	p.Init()
+	w.parser = p
+	w.status = ProcessStateDone
+	for _, data := range []string{"first part, ", "BAD tail"} {
+		e := &BaseEvent{DataType: int64(ProbeEntry), Pid: 100, Tid: 100, Fd: 3}
+		e.Data_len = int32(copy(e.Data[:], data))
+		w.parserEvent(e)
+	}
+	w.ticker.Stop()
+	w.Display()
+
+	if !strings.Contains(buf.String(), "first part, BAD tail") {
+		t.Fatalf("buffered data should be output by DefaultParser:\n%s", buf.String())
+	}
+}
+
+func TestEventWorker_ConnReuse(t *testing.T) {
+	var buf syncBuffer
+	ep := NewEventProcessor(log.New(&buf, "", 0), false)
+
+	// 同一 pid+fd 上先后两个 HTTP/2 连接，各自的 HPACK 动态表从空开始
+	parsers := make([]IParser, 0, 2)
+	for _, path := range []string{"/first", "/second"} {
+		f := newHttp2Frames()
+		f.buf.WriteString(Http2ClientPreface)
+		_ = f.framer.WriteSettings()
+		f.headers(1, true, ":method", "GET", ":scheme", "https", ":path", path, ":authority", "example.com", "x-request", path)
+
+		e := &BaseEvent{DataType: int64(ProbeRet), Pid: 100, Tid: 100, Fd: 5}
+		e.Data_len = int32(copy(e.Data[:], f.bytes()))
+		w := &eventWorker{}
+		w.init(e.GetUUID(), ep)
+		w.parserEvent(e)
+		w.ticker.Stop()
+		parsers = append(parsers, w.parser)
+	}
+
+	if parsers[0] == parsers[1] {
+		t.Fatal("connection parser reused by a new connection on the same fd")
+	}
+	out := buf.String()
+	if !strings.Contains(out, "x-request: /second") || strings.Contains(out, "error") {
+		t.Fatalf("headers of the second connection not decoded:\n%s", out)
+	}
+	if stats := ep.Stats(); stats.ParseErrors != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestIsNewConn(t *testing.T) {
+	cp := &connParser{parser: new(WebSocket), addrs: "10.0.0.1:51000-10.0.0.2:443"}
+	base := event.Base{LocalAddr: "10.0.0.1:51000", RemoteAddr: "10.0.0.2:443"}
+	frame := []byte{0x81, 0x05, 'h', 'e', 'l', 'l', 'o'}
+	if isNewConn(cp, base, frame) {
+		t.Fatal("websocket frame on the same connection")
+	}
+	if !isNewConn(cp, base, []byte("GET /chat HTTP/1.1\r\nHost: example.com\r\n\r\n")) {
+		t.Fatal("HTTP request should start a new connection")
+	}
+	base.LocalAddr = "10.0.0.1:52000"
+	if !isNewConn(cp, base, frame) {
+		t.Fatal("connection address changed")
+	}
+}
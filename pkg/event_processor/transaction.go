@@ -0,0 +1,179 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package event_processor
+
+import (
+	"ecapture/user/event"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxPendingMessages 每个连接等待配对的消息数，超过后丢弃最早的
+	MaxPendingMessages = 64
+	// MaxPendingConns 等待配对的连接数，超过后清空
+	MaxPendingConns = 10240
+
+	// RecordTypeTransaction JSON 输出中访问日志记录的 type 字段，与事件记录共用同一个输出流
+	RecordTypeTransaction = "transaction"
+)
+
+// httpMessageInfo 已输出的 HTTP 消息摘要，用于关联请求和响应
+type httpMessageInfo struct {
+	isRequest bool
+	stream    uint32 // HTTP/2 的流ID，HTTP/1 为 0
+	method    string
+	host      string
+	url       string
+	proto     string
+	status    int
+	bytes     int
+	header    http.Header
+	body      []byte // 按 Content-Encoding 解码后的消息体
+}
+
+// IMessageParser 能提供已输出消息摘要的解析器，在 Display 之后、Reset 之前调用
+type IMessageParser interface {
+	messages() []httpMessageInfo
+}
+
+// HttpTransaction 一次 HTTP 请求/响应，Latency 为请求、响应第一个事件的 BPF 时间戳之差
+type HttpTransaction struct {
+	Module        string        `json:"module"`
+	Pid           uint64        `json:"pid"`
+	Comm          string        `json:"comm"`
+	LocalAddr     string        `json:"localAddr,omitempty"`
+	RemoteAddr    string        `json:"remoteAddr,omitempty"`
+	Method        string        `json:"method"`
+	Host          string        `json:"host"`
+	URL           string        `json:"url"`
+	Proto         string        `json:"proto"`
+	Status        int           `json:"status"`
+	RequestBytes  int           `json:"requestBytes"`
+	ResponseBytes int           `json:"responseBytes"`
+	Timestamp     uint64        `json:"timestamp"` // 请求的时间戳
+	Latency       time.Duration `json:"latency"`
+
+	request, response httpMessageInfo
+}
+
+// String 访问日志格式
+func (this *HttpTransaction) String() string {
+	remote := this.RemoteAddr
+	if remote == "" {
+		remote = "-"
+	}
+	host := this.Host
+	if host == "" {
+		host = "-"
+	}
+	return fmt.Sprintf("%s[%d] %s %s \"%s %s %s\" %d %d %d %s",
+		this.Comm, this.Pid, remote, host, this.Method, this.URL, this.Proto,
+		this.Status, this.RequestBytes, this.ResponseBytes, this.Latency)
+}
+
+// MarshalJSON 带上 "type":"transaction"，区分访问日志与事件记录
+func (this *HttpTransaction) MarshalJSON() ([]byte, error) {
+	type transaction HttpTransaction
+	return json.Marshal(struct {
+		Type string `json:"type"`
+		*transaction
+	}{RecordTypeTransaction, (*transaction)(this)})
+}
+
+type pendingMessage struct {
+	info httpMessageInfo
+	base event.Base
+}
+
+// transactionTracker 按连接配对请求和响应，同一连接上的 HTTP/1 消息按顺序配对，HTTP/2 按流ID配对。
+// 请求和响应由不同的 worker 输出，先到的一方等待另一方。
+type transactionTracker struct {
+	sync.Mutex
+	pending map[string][]*pendingMessage
+}
+
+func newTransactionTracker() *transactionTracker {
+	return &transactionTracker{pending: make(map[string][]*pendingMessage)}
+}
+
+// add 记录一个消息，与等待中的另一方配对成功时返回完整的事务
+func (this *transactionTracker) add(conn string, info httpMessageInfo, base event.Base) *HttpTransaction {
+	this.Lock()
+	defer this.Unlock()
+
+	key := conn
+	if info.stream != 0 {
+		key = fmt.Sprintf("%s#%d", conn, info.stream)
+	}
+	queue := this.pending[key]
+	if len(queue) > 0 && queue[0].info.isRequest != info.isRequest {
+		peer := queue[0]
+		if len(queue) == 1 {
+			delete(this.pending, key)
+		} else {
+			this.pending[key] = queue[1:]
+		}
+		if info.isRequest {
+			return newHttpTransaction(&pendingMessage{info, base}, peer)
+		}
+		return newHttpTransaction(peer, &pendingMessage{info, base})
+	}
+
+	if len(queue) >= MaxPendingMessages {
+		queue = queue[1:]
+	}
+	if _, found := this.pending[key]; !found && len(this.pending) >= MaxPendingConns {
+		this.pending = make(map[string][]*pendingMessage)
+	}
+	this.pending[key] = append(queue, &pendingMessage{info, base})
+	return nil
+}
+
+// requestMethod 连接上最早的未配对请求的方法，没有时为空
+func (this *transactionTracker) requestMethod(conn string) string {
+	this.Lock()
+	defer this.Unlock()
+	if queue := this.pending[conn]; len(queue) > 0 && queue[0].info.isRequest {
+		return queue[0].info.method
+	}
+	return ""
+}
+
+func newHttpTransaction(req, resp *pendingMessage) *HttpTransaction {
+	tx := &HttpTransaction{
+		Pid:           req.base.Pid,
+		Comm:          req.base.Comm,
+		LocalAddr:     req.base.LocalAddr,
+		RemoteAddr:    req.base.RemoteAddr,
+		Method:        req.info.method,
+		Host:          req.info.host,
+		URL:           req.info.url,
+		Proto:         req.info.proto,
+		Status:        resp.info.status,
+		RequestBytes:  req.info.bytes,
+		ResponseBytes: resp.info.bytes,
+		Timestamp:     req.base.Timestamp,
+		request:       req.info,
+		response:      resp.info,
+	}
+	if resp.base.Timestamp > req.base.Timestamp {
+		tx.Latency = time.Duration(resp.base.Timestamp - req.base.Timestamp)
+	}
+	return tx
+}
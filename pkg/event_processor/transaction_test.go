@@ -0,0 +1,108 @@
+package event_processor
+
+import (
+	"context"
+	"ecapture/user/event"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransactionTracker(t *testing.T) {
+	tr := newTransactionTracker()
+	req := httpMessageInfo{isRequest: true, method: "GET", host: "example.com", url: "/a", proto: "HTTP/1.1", bytes: 10}
+	resp := httpMessageInfo{status: 200, proto: "HTTP/1.1", bytes: 20}
+
+	// pipelined requests are paired in order
+	if tx := tr.add("c1", req, event.Base{Timestamp: 1000}); tx != nil {
+		t.Fatal("request alone should not be paired")
+	}
+	req2 := req
+	req2.url = "/b"
+	_ = tr.add("c1", req2, event.Base{Timestamp: 2000})
+	tx := tr.add("c1", resp, event.Base{Timestamp: 5000})
+	if tx == nil || tx.URL != "/a" || tx.Latency != 4*time.Microsecond {
+		t.Fatalf("unexpected transaction %+v", tx)
+	}
+	tx = tr.add("c1", resp, event.Base{Timestamp: 6000})
+	if tx == nil || tx.URL != "/b" || tx.Latency != 4*time.Microsecond || tx.ResponseBytes != 20 {
+		t.Fatalf("unexpected transaction %+v", tx)
+	}
+
+	// HTTP/2 streams are paired by stream id, the response may come first
+	s1, s3 := req, req
+	s1.stream, s3.stream = 1, 3
+	r3 := resp
+	r3.stream = 3
+	_ = tr.add("c2", s1, event.Base{Timestamp: 1000})
+	_ = tr.add("c2", r3, event.Base{Timestamp: 900})
+	tx = tr.add("c2", s3, event.Base{Timestamp: 800})
+	if tx == nil || tx.Latency != 100*time.Nanosecond {
+		t.Fatalf("unexpected transaction %+v", tx)
+	}
+}
+
+func TestEventProcessor_Transaction(t *testing.T) {
+	var buf syncBuffer
+	ep := NewEventProcessor(log.New(&buf, "", 0), false)
+	go func() {
+		_ = ep.Serve(context.Background())
+	}()
+
+	req := &BaseEvent{DataType: int64(ProbeRet), Pid: 100, Tid: 100, Fd: 3, Timestamp: 1000}
+	req.Data_len = int32(copy(req.Data[:], "GET /path HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	req.Comm[0] = 'c'
+	ep.Write(req)
+	time.Sleep(time.Millisecond * 50)
+
+	resp := &BaseEvent{DataType: int64(ProbeEntry), Pid: 100, Tid: 100, Fd: 3, Timestamp: 5000}
+	resp.Data_len = int32(copy(resp.Data[:], "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	resp.Comm[0] = 'c'
+	ep.Write(resp)
+	time.Sleep(time.Millisecond * 200)
+
+	want := `c[100] - example.com "GET /path HTTP/1.1" 200 41 40 4µs`
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("missing access log %q:\n%s", want, buf.String())
+	}
+}
+
+func TestEventProcessor_TransactionInterleaved(t *testing.T) {
+	var buf syncBuffer
+	ep := NewEventProcessor(log.New(&buf, "", 0), false)
+	go func() {
+		_ = ep.Serve(context.Background())
+	}()
+
+	// two connections without address on one thread, the second one is answered first
+	write := func(dataType AttachType, fd uint32, data string) {
+		e := &BaseEvent{DataType: int64(dataType), Pid: 100, Tid: 100, Fd: fd}
+		e.Data_len = int32(copy(e.Data[:], data))
+		ep.Write(e)
+		time.Sleep(time.Millisecond * 50)
+	}
+	write(ProbeRet, 3, "GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	write(ProbeRet, 4, "GET /b HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	write(ProbeEntry, 4, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n")
+	write(ProbeEntry, 3, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	time.Sleep(time.Millisecond * 150)
+
+	for _, want := range []string{`"GET /a HTTP/1.1" 200`, `"GET /b HTTP/1.1" 404`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("missing access log %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestHttpTransaction_JSON(t *testing.T) {
+	tx := &HttpTransaction{Module: "openssl", Method: "GET", URL: "/", Status: 200, Latency: time.Millisecond}
+	j, err := json.Marshal(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(j), `{"type":"transaction",`) || !strings.Contains(string(j), `"latency":1000000`) || !strings.Contains(string(j), `"status":200`) {
+		t.Fatalf("unexpected json %s", j)
+	}
+}
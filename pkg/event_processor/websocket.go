@@ -0,0 +1,337 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package event_processor
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// 帧类型，RFC 6455 5.2
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+const (
+	wsFlagFin  = 0x80
+	wsFlagRsv1 = 0x40 // permessage-deflate 压缩的消息
+	wsFlagMask = 0x80
+
+	// WsMaxFrameLen 帧的最大长度，超过时视为数据错乱，丢弃缓冲区
+	WsMaxFrameLen = 16 * 1024 * 1024
+
+	// permessage-deflate 的 LZ77 滑动窗口，context takeover 时后续消息会引用之前的数据
+	wsDeflateWindow = 32 * 1024
+
+	WsDirectionClient = "client->server"
+	WsDirectionServer = "server->client"
+)
+
+// wsDeflateTail 压缩消息去掉的尾部，解压时补上，RFC 7692 7.2.2
+var wsDeflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+var wsOpNames = map[uint8]string{
+	wsOpContinuation: "continuation",
+	wsOpText:         "text",
+	wsOpBinary:       "binary",
+	wsOpClose:        "close",
+	wsOpPing:         "ping",
+	wsOpPong:         "pong",
+}
+
+// wsMessage 一个完整的消息或控制帧
+type wsMessage struct {
+	opcode     uint8
+	compressed bool
+	payload    []byte
+	err        error
+}
+
+// WebSocket 单向的 WebSocket 连接解析器，先解析 HTTP Upgrade 握手，再解析帧。
+// 握手请求为客户端到服务端，101 响应为服务端到客户端。
+type WebSocket struct {
+	conn          string
+	isInit        bool // 已解析握手
+	direction     string
+	handshake     []byte
+	reader        *bytes.Buffer // 未解析的帧数据
+	fragments     []byte        // 分片消息已收到的数据
+	fragmentOp    uint8
+	fragmentRsv1  bool
+	inflateWindow []byte // permessage-deflate 已解压的数据，作为后续消息的字典
+	messages      []*wsMessage
+}
+
+func (this *WebSocket) Init() {
+	this.reader = bytes.NewBuffer(nil)
+	this.isInit = false
+	this.handshake = nil
+	this.fragments = nil
+	this.inflateWindow = nil
+	this.messages = nil
+}
+
+func (this *WebSocket) Name() string {
+	return "WebSocket"
+}
+
+func (this *WebSocket) PacketType() PacketType {
+	return PacketTypeWebSocket
+}
+
+func (this *WebSocket) ParserType() ParserType {
+	return ParserTypeWebSocket
+}
+
+func (this *WebSocket) setConn(conn string) {
+	this.conn = conn
+}
+
+// detect Upgrade: websocket 的握手请求或 101 响应
+func (this *WebSocket) detect(payload []byte) error {
+	if !wsIsHandshake(payload) {
+		return errors.New("not websocket handshake")
+	}
+	return nil
+}
+
+func (this *WebSocket) buffered() []byte {
+	return this.reader.Bytes()
+}
+
+func (this *WebSocket) Write(b []byte) (int, error) {
+	n, e := this.reader.Write(b)
+	if e != nil {
+		return n, e
+	}
+	if !this.isInit {
+		buf := this.reader.Bytes()
+		i := bytes.Index(buf, []byte("\r\n\r\n"))
+		if i < 0 {
+			return n, nil
+		}
+		this.handshake = append([]byte(nil), buf[:i+HTTP_NEW_LINE_LENGTH]...)
+		this.reader.Next(i + HTTP_NEW_LINE_LENGTH)
+		this.direction = WsDirectionClient
+		if bytes.HasPrefix(this.handshake, []byte("HTTP/")) {
+			this.direction = WsDirectionServer
+		}
+		this.isInit = true
+	}
+	this.parseFrames()
+	return n, nil
+}
+
+func (this *WebSocket) IsDone() bool {
+	return this.handshake != nil || len(this.messages) > 0
+}
+
+// Reset 清理已输出的消息，保留连接状态
+func (this *WebSocket) Reset() {
+	this.handshake = nil
+	this.messages = nil
+}
+
+func (this *WebSocket) Display() []byte {
+	var b bytes.Buffer
+	if this.handshake != nil {
+		b.Write(this.handshake)
+	}
+	for i, m := range this.messages {
+		if i > 0 || b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		this.displayMessage(&b, m)
+	}
+	return b.Bytes()
+}
+
+func (this *WebSocket) displayMessage(b *bytes.Buffer, m *wsMessage) {
+	fmt.Fprintf(b, "WebSocket Direction:%s, Opcode:%s, Length:%d", this.direction, wsOpName(m.opcode), len(m.payload))
+	if m.compressed {
+		b.WriteString(", Compressed:permessage-deflate")
+	}
+	b.WriteString("\n")
+	if m.err != nil {
+		fmt.Fprintf(b, "[%v]\n", m.err)
+	}
+
+	switch m.opcode {
+	case wsOpClose:
+		if len(m.payload) >= 2 {
+			fmt.Fprintf(b, "Status:%d, Reason:%s\n", binary.BigEndian.Uint16(m.payload[0:2]), m.payload[2:])
+		}
+	case wsOpText:
+		b.Write(m.payload)
+		b.WriteString("\n")
+	default:
+		if len(m.payload) == 0 {
+			return
+		}
+		if utf8.Valid(m.payload) && m.opcode != wsOpBinary {
+			b.Write(m.payload)
+			b.WriteString("\n")
+		} else {
+			b.WriteString(hex.Dump(m.payload))
+		}
+	}
+}
+
+// parseFrames 解析缓冲区中完整的帧，不完整的帧留待后续数据
+func (this *WebSocket) parseFrames() {
+	for {
+		buf := this.reader.Bytes()
+		if len(buf) < 2 {
+			return
+		}
+		flags, opcode := buf[0], buf[0]&0x0f
+		masked := buf[1]&wsFlagMask != 0
+		length := uint64(buf[1] & 0x7f)
+		offset := 2
+		switch length {
+		case 126:
+			if len(buf) < offset+2 {
+				return
+			}
+			length = uint64(binary.BigEndian.Uint16(buf[offset:]))
+			offset += 2
+		case 127:
+			if len(buf) < offset+8 {
+				return
+			}
+			length = binary.BigEndian.Uint64(buf[offset:])
+			offset += 8
+		}
+		if length > WsMaxFrameLen {
+			this.messages = append(this.messages, &wsMessage{opcode: opcode, err: fmt.Errorf("frame length %d too large, %d bytes dropped", length, len(buf))})
+			this.reader.Reset()
+			return
+		}
+		var maskKey []byte
+		if masked {
+			if len(buf) < offset+4 {
+				return
+			}
+			maskKey = buf[offset : offset+4]
+			offset += 4
+		}
+		if uint64(len(buf)-offset) < length {
+			return
+		}
+		payload := append([]byte(nil), buf[offset:offset+int(length)]...)
+		for i := range payload {
+			if masked {
+				payload[i] ^= maskKey[i%4]
+			}
+		}
+		this.reader.Next(offset + int(length))
+		this.handleFrame(flags, opcode, payload)
+	}
+}
+
+func (this *WebSocket) handleFrame(flags, opcode uint8, payload []byte) {
+	fin := flags&wsFlagFin != 0
+	if opcode >= wsOpClose {
+		// 控制帧不分片，可以插在分片消息中间
+		this.messages = append(this.messages, &wsMessage{opcode: opcode, payload: payload})
+		return
+	}
+
+	if opcode != wsOpContinuation {
+		this.fragmentOp = opcode
+		this.fragmentRsv1 = flags&wsFlagRsv1 != 0
+		this.fragments = nil
+	}
+	this.fragments = append(this.fragments, payload...)
+	if !fin {
+		return
+	}
+
+	m := &wsMessage{opcode: this.fragmentOp, compressed: this.fragmentRsv1, payload: this.fragments}
+	this.fragments = nil
+	if m.compressed {
+		data, err := this.inflate(m.payload)
+		if err != nil {
+			m.err = fmt.Errorf("permessage-deflate error:%v", err)
+		} else {
+			m.payload = data
+		}
+	}
+	this.messages = append(this.messages, m)
+}
+
+// inflate 解压 permessage-deflate 消息，之前解压的数据作为字典，支持 context takeover
+func (this *WebSocket) inflate(payload []byte) ([]byte, error) {
+	data := append(append([]byte(nil), payload...), wsDeflateTail...)
+	r := flate.NewReaderDict(bytes.NewReader(data), this.inflateWindow)
+	defer r.Close()
+	out, err := io.ReadAll(r)
+	// 消息不含结束块，读到尾部后为 io.ErrUnexpectedEOF
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	this.inflateWindow = append(this.inflateWindow, out...)
+	if len(this.inflateWindow) > wsDeflateWindow {
+		this.inflateWindow = this.inflateWindow[len(this.inflateWindow)-wsDeflateWindow:]
+	}
+	return out, nil
+}
+
+func wsOpName(opcode uint8) string {
+	if name, found := wsOpNames[opcode]; found {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", opcode)
+}
+
+// wsIsHandshake HTTP Upgrade: websocket 的请求或 101 响应
+func wsIsHandshake(payload []byte) bool {
+	rd := bufio.NewReader(bytes.NewReader(payload))
+	var header http.Header
+	if bytes.HasPrefix(payload, []byte("HTTP/")) {
+		res, err := http.ReadResponse(rd, nil)
+		if err != nil || res.StatusCode != http.StatusSwitchingProtocols {
+			return false
+		}
+		header = res.Header
+	} else {
+		req, err := http.ReadRequest(rd)
+		if err != nil {
+			return false
+		}
+		header = req.Header
+	}
+	return strings.EqualFold(header.Get("Upgrade"), "websocket")
+}
+
+func init() {
+	ws := &WebSocket{}
+	ws.Init()
+	Register(ws)
+}
@@ -0,0 +1,99 @@
+package event_processor
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func wsFrame(flags, opcode uint8, mask []byte, payload []byte) []byte {
+	b := []byte{flags | opcode}
+	var maskBit uint8
+	if mask != nil {
+		maskBit = wsFlagMask
+	}
+	switch {
+	case len(payload) < 126:
+		b = append(b, maskBit|uint8(len(payload)))
+	default:
+		b = append(b, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(b[2:], uint16(len(payload)))
+	}
+	data := append([]byte(nil), payload...)
+	if mask != nil {
+		b = append(b, mask...)
+		for i := range data {
+			data[i] ^= mask[i%4]
+		}
+	}
+	return append(b, data...)
+}
+
+func TestWebSocket_Client(t *testing.T) {
+	handshake := "GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	p := NewParser([]byte(handshake))
+	if p.ParserType() != ParserTypeWebSocket {
+		t.Fatalf("parser %s, want WebSocket", p.Name())
+	}
+	_, _ = p.Write([]byte(handshake))
+	if !p.IsDone() || string(p.Display()) != handshake {
+		t.Fatal("handshake should be displayed")
+	}
+	p.Reset()
+
+	// fragmented masked text with a ping in the middle, split across writes
+	mask := []byte{1, 2, 3, 4}
+	var b []byte
+	b = append(b, wsFrame(0, wsOpText, mask, []byte("hello "))...)
+	b = append(b, wsFrame(wsFlagFin, wsOpPing, mask, nil)...)
+	b = append(b, wsFrame(wsFlagFin, wsOpContinuation, mask, []byte("world"))...)
+	_, _ = p.Write(b[:5])
+	if p.IsDone() {
+		t.Fatal("incomplete frame should not be done")
+	}
+	_, _ = p.Write(b[5:])
+	want := "WebSocket Direction:client->server, Opcode:ping, Length:0\n" +
+		"\nWebSocket Direction:client->server, Opcode:text, Length:11\nhello world\n"
+	if got := string(p.Display()); got != want {
+		t.Fatalf("display:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestWebSocket_ServerDeflate(t *testing.T) {
+	handshake := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Extensions: permessage-deflate\r\n\r\n"
+	if err := (&HTTPResponse{}).detect([]byte(handshake)); err == nil {
+		t.Fatal("HTTPResponse should not detect websocket handshake")
+	}
+
+	// context takeover: the second message references the first one
+	var compressed bytes.Buffer
+	fw, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	var msgs [][]byte
+	for _, m := range []string{"ecapture websocket message", "ecapture websocket message again"} {
+		compressed.Reset()
+		_, _ = fw.Write([]byte(m))
+		_ = fw.Flush()
+		msgs = append(msgs, bytes.TrimSuffix(append([]byte(nil), compressed.Bytes()...), wsDeflateTail))
+	}
+
+	p := &WebSocket{}
+	p.Init()
+	var b []byte
+	b = append(b, handshake...)
+	b = append(b, wsFrame(wsFlagFin|wsFlagRsv1, wsOpText, nil, msgs[0])...)
+	b = append(b, wsFrame(wsFlagFin|wsFlagRsv1, wsOpText, nil, msgs[1])...)
+	b = append(b, wsFrame(wsFlagFin, wsOpClose, nil, append([]byte{0x03, 0xe8}, "bye"...))...)
+	_, _ = p.Write(b)
+	got := string(p.Display())
+	for _, want := range []string{
+		"WebSocket Direction:server->client, Opcode:text, Length:26, Compressed:permessage-deflate\necapture websocket message\n",
+		"Length:32, Compressed:permessage-deflate\necapture websocket message again\n",
+		"Opcode:close, Length:5\nStatus:1000, Reason:bye\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("display:\n%s\nwant:\n%s", got, want)
+		}
+	}
+}
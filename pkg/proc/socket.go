@@ -0,0 +1,99 @@
+package proc
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrSocketNotFound is returned when the fd is not a TCP socket of the process
+var ErrSocketNotFound = errors.New("tcp socket not found")
+
+// SocketInode returns the inode of a socket fd of pid, via /proc/<pid>/fd/<fd>.
+// A reused fd refers to a new socket with a different inode.
+func SocketInode(pid, fd uint32) (string, error) {
+	link, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", pid, fd))
+	if err != nil {
+		return "", err
+	}
+	// socket:[12345]
+	if !strings.HasPrefix(link, "socket:[") || !strings.HasSuffix(link, "]") {
+		return "", ErrSocketNotFound
+	}
+	return link[len("socket:[") : len(link)-1], nil
+}
+
+// SocketAddr returns the local and remote address of a TCP socket fd of pid,
+// via /proc/<pid>/fd/<fd> and /proc/<pid>/net/tcp{,6}.
+func SocketAddr(pid, fd uint32) (local, remote string, err error) {
+	inode, err := SocketInode(pid, fd)
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, name := range []string{"tcp", "tcp6"} {
+		f, e := os.Open(fmt.Sprintf("/proc/%d/net/%s", pid, name))
+		if e != nil {
+			continue
+		}
+		local, remote, err = findSocketByInode(f, inode)
+		_ = f.Close()
+		if err == nil {
+			return local, remote, nil
+		}
+	}
+	return "", "", ErrSocketNotFound
+}
+
+// findSocketByInode scans a /proc/net/tcp{,6} table for the socket inode.
+func findSocketByInode(r io.Reader, inode string) (local, remote string, err error) {
+	scanner := bufio.NewScanner(r)
+	// skip header
+	scanner.Scan()
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[9] != inode {
+			continue
+		}
+		local, err = parseProcNetAddr(fields[1])
+		if err != nil {
+			return "", "", err
+		}
+		remote, err = parseProcNetAddr(fields[2])
+		if err != nil {
+			return "", "", err
+		}
+		return local, remote, nil
+	}
+	return "", "", ErrSocketNotFound
+}
+
+// parseProcNetAddr parses "0100007F:1F90" or the 32 hex digits IPv6 form.
+// the address is stored as 32bit words in host byte order (little endian on x86_64/aarch64).
+func parseProcNetAddr(s string) (string, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid address %s", s)
+	}
+	b, err := hex.DecodeString(parts[0])
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return "", fmt.Errorf("invalid address %s", s)
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid port %s", s)
+	}
+
+	ip := make(net.IP, len(b))
+	for i := 0; i < len(b); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+	return net.JoinHostPort(ip.String(), strconv.FormatUint(port, 10)), nil
+}
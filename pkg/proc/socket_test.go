@@ -0,0 +1,63 @@
+package proc
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSocketAddr(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Logf("listen %s error:%v, skip", addr, err)
+			continue
+		}
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := conn.(*net.TCPConn).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		local, remote, err := SocketAddr(uint32(os.Getpid()), uint32(f.Fd()))
+		if err != nil {
+			t.Fatalf("SocketAddr of %s error:%v", addr, err)
+		}
+		if local != conn.LocalAddr().String() || remote != conn.RemoteAddr().String() {
+			t.Fatalf("got %s -> %s, want %s -> %s", local, remote, conn.LocalAddr(), conn.RemoteAddr())
+		}
+		_ = f.Close()
+		_ = conn.Close()
+		_ = l.Close()
+	}
+}
+
+func TestFindSocketByInode(t *testing.T) {
+	table := `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0000000000000000FFFF00000100007F:01BB 0000000000000000FFFF00000200000A:C738 01 00000000:00000000 00:00000000 00000000     0        0 4242 1 0000000000000000 20 4 30 10 -1
+   1: 000080FE00000000FF0000000100000A:20FB 000080FE00000000FF0000000200000A:9C40 01 00000000:00000000 00:00000000 00000000     0        0 4343 1 0000000000000000 20 4 30 10 -1
+`
+	local, remote, err := findSocketByInode(strings.NewReader(table), "4242")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local != "127.0.0.1:443" || remote != "10.0.0.2:51000" {
+		t.Fatalf("got %s -> %s", local, remote)
+	}
+
+	local, remote, err = findSocketByInode(strings.NewReader(table), "4343")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local != "[fe80::ff:a00:1]:8443" || remote != "[fe80::ff:a00:2]:40000" {
+		t.Fatalf("got %s -> %s", local, remote)
+	}
+
+	if _, _, err = findSocketByInode(strings.NewReader(table), "1"); err != ErrSocketNotFound {
+		t.Fatalf("unexpected error:%v", err)
+	}
+}
@@ -0,0 +1,426 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pcapfilter 实现 tcpdump(pcap-filter) 语法的子集，在用户态过滤 TC 捕获的以太网帧。
+//
+// 支持的表达式：
+//
+//	[ip|ip6|tcp] [src|dst] host <ip>
+//	[ip|ip6|tcp] [src|dst] net <cidr>
+//	[ip|ip6|tcp] [src|dst] port <port>
+//	[ip|ip6|tcp] [src|dst] portrange <port>-<port>
+//	ip | ip6 | tcp
+//	not/!, and/&&, or/||, (...)
+//
+// TC classifier 只捕获 TCP 数据包，udp 永远不会匹配，编译时返回 ErrUDPNotSupported。
+//
+// 与 tcpdump 一样，省略类型的值沿用前一个条件的限定词，如 "port 80 or 443"。
+package pcapfilter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrUDPNotSupported TC classifier 只捕获 TCP 数据包
+var ErrUDPNotSupported = errors.New("udp is not supported, only TCP packets are captured")
+
+// Filter 编译后的过滤表达式，可并发使用
+type Filter struct {
+	expr string
+	root node
+}
+
+// Compile 编译过滤表达式，空表达式返回 nil
+func Compile(expr string) (*Filter, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return nil, nil
+	}
+	p := &parser{tokens: tokenize(expr)}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("pcap filter %q: %w", expr, err)
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("pcap filter %q: unexpected %q", expr, p.tokens[p.pos])
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// Match 以太网帧是否满足过滤条件，无法解析的帧视为不满足
+func (this *Filter) Match(frame []byte) bool {
+	var pkt packet
+	if !pkt.decode(frame) {
+		return false
+	}
+	return this.root.match(&pkt)
+}
+
+func (this *Filter) String() string {
+	return this.expr
+}
+
+////////////////////// packet //////////////////////
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86DD
+	etherTypeVLAN = 0x8100
+
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+)
+
+type packet struct {
+	ipv6    bool
+	proto   uint8
+	src     net.IP
+	dst     net.IP
+	hasPort bool
+	srcPort uint16
+	dstPort uint16
+}
+
+func (this *packet) decode(frame []byte) bool {
+	if len(frame) < 14 {
+		return false
+	}
+	etherType := binary.BigEndian.Uint16(frame[12:14])
+	l3 := frame[14:]
+	if etherType == etherTypeVLAN && len(frame) >= 18 {
+		etherType = binary.BigEndian.Uint16(frame[16:18])
+		l3 = frame[18:]
+	}
+
+	var l4 []byte
+	switch etherType {
+	case etherTypeIPv4:
+		if len(l3) < 20 {
+			return false
+		}
+		ihl := int(l3[0]&0x0f) * 4
+		if ihl < 20 || len(l3) < ihl {
+			return false
+		}
+		this.proto = l3[9]
+		this.src = net.IP(l3[12:16])
+		this.dst = net.IP(l3[16:20])
+		l4 = l3[ihl:]
+	case etherTypeIPv6:
+		if len(l3) < 40 {
+			return false
+		}
+		this.ipv6 = true
+		this.proto = l3[6]
+		this.src = net.IP(l3[8:24])
+		this.dst = net.IP(l3[24:40])
+		l4 = l3[40:]
+	default:
+		return false
+	}
+
+	if (this.proto == ipProtoTCP || this.proto == ipProtoUDP) && len(l4) >= 4 {
+		this.hasPort = true
+		this.srcPort = binary.BigEndian.Uint16(l4[0:2])
+		this.dstPort = binary.BigEndian.Uint16(l4[2:4])
+	}
+	return true
+}
+
+////////////////////// nodes //////////////////////
+
+type node interface {
+	match(pkt *packet) bool
+}
+
+type andNode struct{ left, right node }
+
+func (this andNode) match(pkt *packet) bool { return this.left.match(pkt) && this.right.match(pkt) }
+
+type orNode struct{ left, right node }
+
+func (this orNode) match(pkt *packet) bool { return this.left.match(pkt) || this.right.match(pkt) }
+
+type notNode struct{ child node }
+
+func (this notNode) match(pkt *packet) bool { return !this.child.match(pkt) }
+
+const (
+	dirAny = iota
+	dirSrc
+	dirDst
+)
+
+// protoNode ip / ip6 / tcp
+type protoNode struct{ proto string }
+
+func (this protoNode) match(pkt *packet) bool {
+	switch this.proto {
+	case "ip":
+		return !pkt.ipv6
+	case "ip6":
+		return pkt.ipv6
+	case "tcp":
+		return pkt.proto == ipProtoTCP
+	}
+	return false
+}
+
+// netNode host / net
+type netNode struct {
+	dir   int
+	ipNet *net.IPNet
+}
+
+func (this netNode) match(pkt *packet) bool {
+	switch this.dir {
+	case dirSrc:
+		return this.ipNet.Contains(pkt.src)
+	case dirDst:
+		return this.ipNet.Contains(pkt.dst)
+	}
+	return this.ipNet.Contains(pkt.src) || this.ipNet.Contains(pkt.dst)
+}
+
+// portNode port / portrange
+type portNode struct {
+	dir      int
+	min, max uint16
+}
+
+func (this portNode) in(port uint16) bool {
+	return port >= this.min && port <= this.max
+}
+
+func (this portNode) match(pkt *packet) bool {
+	if !pkt.hasPort {
+		return false
+	}
+	switch this.dir {
+	case dirSrc:
+		return this.in(pkt.srcPort)
+	case dirDst:
+		return this.in(pkt.dstPort)
+	}
+	return this.in(pkt.srcPort) || this.in(pkt.dstPort)
+}
+
+////////////////////// parser //////////////////////
+
+func tokenize(expr string) []string {
+	for _, op := range []string{"(", ")", "&&", "||"} {
+		expr = strings.ReplaceAll(expr, op, " "+op+" ")
+	}
+	var tokens []string
+	for _, field := range strings.Fields(expr) {
+		// "!" 可以紧跟其后的条件，如 "!tcp"
+		for strings.HasPrefix(field, "!") && field != "!" {
+			tokens = append(tokens, "!")
+			field = field[1:]
+		}
+		tokens = append(tokens, field)
+	}
+	return tokens
+}
+
+// qualifier 条件的限定词，省略类型的值沿用上一个条件的限定词
+type qualifier struct {
+	proto string
+	dir   int
+	typ   string
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+	last   qualifier
+}
+
+func (this *parser) peek() string {
+	if this.pos < len(this.tokens) {
+		return this.tokens[this.pos]
+	}
+	return ""
+}
+
+func (this *parser) next() string {
+	t := this.peek()
+	if t != "" {
+		this.pos++
+	}
+	return t
+}
+
+func (this *parser) parseOr() (node, error) {
+	left, err := this.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for this.peek() == "or" || this.peek() == "||" {
+		this.next()
+		right, err := this.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (this *parser) parseAnd() (node, error) {
+	left, err := this.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for this.peek() == "and" || this.peek() == "&&" {
+		this.next()
+		right, err := this.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (this *parser) parseNot() (node, error) {
+	if this.peek() == "not" || this.peek() == "!" {
+		this.next()
+		child, err := this.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{child}, nil
+	}
+	if this.peek() == "(" {
+		this.next()
+		n, err := this.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if this.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return n, nil
+	}
+	return this.parsePrimitive()
+}
+
+func (this *parser) parsePrimitive() (node, error) {
+	var q qualifier
+	var qualified bool
+
+	switch this.peek() {
+	case "udp":
+		return nil, ErrUDPNotSupported
+	case "ip", "ip6", "tcp":
+		q.proto = this.next()
+		qualified = true
+	}
+	switch this.peek() {
+	case "src":
+		q.dir = dirSrc
+		this.next()
+		qualified = true
+	case "dst":
+		q.dir = dirDst
+		this.next()
+		qualified = true
+	}
+	switch this.peek() {
+	case "host", "net", "port", "portrange":
+		q.typ = this.next()
+		qualified = true
+	}
+
+	if !qualified {
+		// 省略限定词的值，如 "port 80 or 443" 中的 443
+		if this.last.typ == "" {
+			return nil, fmt.Errorf("unexpected %q", this.peek())
+		}
+		q = this.last
+	} else if q.typ == "" {
+		switch this.peek() {
+		case "", "and", "&&", "or", "||", ")":
+			// 仅协议，如 "tcp"
+			if q.proto == "" {
+				return nil, fmt.Errorf("src/dst requires a value")
+			}
+			return protoNode{q.proto}, nil
+		}
+		// "src 10.0.0.1"
+		q.typ = "host"
+	}
+
+	value := this.next()
+	if value == "" {
+		return nil, fmt.Errorf("%s requires a value", q.typ)
+	}
+	n, err := newPrimitive(q, value)
+	if err != nil {
+		return nil, err
+	}
+	this.last = q
+	if q.proto != "" {
+		n = andNode{protoNode{q.proto}, n}
+	}
+	return n, nil
+}
+
+func newPrimitive(q qualifier, value string) (node, error) {
+	switch q.typ {
+	case "host":
+		if strings.Contains(value, "/") {
+			return newPrimitive(qualifier{dir: q.dir, typ: "net"}, value)
+		}
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid host %q", value)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return netNode{q.dir, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}, nil
+	case "net":
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid net %q", value)
+		}
+		return netNode{q.dir, ipNet}, nil
+	case "port":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", value)
+		}
+		return portNode{q.dir, uint16(port), uint16(port)}, nil
+	case "portrange":
+		parts := strings.SplitN(value, "-", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid portrange %q", value)
+		}
+		min, err1 := strconv.ParseUint(parts[0], 10, 16)
+		max, err2 := strconv.ParseUint(parts[1], 10, 16)
+		if err1 != nil || err2 != nil || min > max {
+			return nil, fmt.Errorf("invalid portrange %q", value)
+		}
+		return portNode{q.dir, uint16(min), uint16(max)}, nil
+	}
+	return nil, fmt.Errorf("unknown type %q", q.typ)
+}
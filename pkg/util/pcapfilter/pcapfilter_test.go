@@ -0,0 +1,105 @@
+package pcapfilter
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+// frame builds an ethernet frame with an IPv4/IPv6 header and the first 4 bytes of the TCP/UDP header
+func frame(proto uint8, src, dst string, srcPort, dstPort uint16) []byte {
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	b := make([]byte, 14)
+	if srcIP.To4() != nil {
+		binary.BigEndian.PutUint16(b[12:14], etherTypeIPv4)
+		ip := make([]byte, 20)
+		ip[0] = 0x45
+		ip[9] = proto
+		copy(ip[12:16], srcIP.To4())
+		copy(ip[16:20], dstIP.To4())
+		b = append(b, ip...)
+	} else {
+		binary.BigEndian.PutUint16(b[12:14], etherTypeIPv6)
+		ip := make([]byte, 40)
+		ip[0] = 0x60
+		ip[6] = proto
+		copy(ip[8:24], srcIP)
+		copy(ip[24:40], dstIP)
+		b = append(b, ip...)
+	}
+	l4 := make([]byte, 20)
+	binary.BigEndian.PutUint16(l4[0:2], srcPort)
+	binary.BigEndian.PutUint16(l4[2:4], dstPort)
+	return append(b, l4...)
+}
+
+func TestFilter_Match(t *testing.T) {
+	tcp4 := frame(ipProtoTCP, "10.0.0.1", "192.168.1.20", 51000, 443)
+	tcp6 := frame(ipProtoTCP, "fd00::1", "fd00::2", 8443, 40000)
+	udp4 := frame(ipProtoUDP, "10.0.0.1", "8.8.8.8", 53000, 53)
+
+	tests := []struct {
+		expr string
+		pkt  []byte
+		want bool
+	}{
+		{"host 10.0.0.1", tcp4, true},
+		{"src host 192.168.1.20", tcp4, false},
+		{"dst 192.168.1.20", tcp4, true},
+		{"net 192.168.0.0/16", tcp4, true},
+		{"src net 192.168.0.0/16", tcp4, false},
+		{"port 443", tcp4, true},
+		{"dst port 443", tcp4, true},
+		{"src port 443", tcp4, false},
+		{"portrange 8000-9000", tcp6, true},
+		{"port 80 or 8443", tcp6, true},
+		{"tcp port 53", udp4, false},
+		{"port 53", udp4, true},
+		{"ip6", tcp6, true},
+		{"ip and tcp", tcp6, false},
+		{"host fd00::2 and not port 22", tcp6, true},
+		{"ip6 net fd00::/8", tcp6, true},
+		{"!tcp", udp4, true},
+		{"(host 10.0.0.1 || host 10.0.0.2) && (port 80 || port 443)", tcp4, true},
+		{"not (port 443 or port 53)", udp4, false},
+	}
+	for _, tt := range tests {
+		f, err := Compile(tt.expr)
+		if err != nil {
+			t.Fatalf("Compile(%q) error:%v", tt.expr, err)
+		}
+		if got := f.Match(tt.pkt); got != tt.want {
+			t.Fatalf("%q match %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestCompile_Error(t *testing.T) {
+	for _, expr := range []string{
+		"host",
+		"host 10.0.0.256",
+		"port 70000",
+		"portrange 90-80",
+		"net 10.0.0.1",
+		"(port 80",
+		"port 80 )",
+		"src",
+		"foo",
+	} {
+		if _, err := Compile(expr); err == nil {
+			t.Fatalf("Compile(%q) should fail", expr)
+		}
+	}
+
+	for _, expr := range []string{"udp", "udp port 53", "tcp or udp", "not udp"} {
+		if _, err := Compile(expr); !errors.Is(err, ErrUDPNotSupported) {
+			t.Fatalf("Compile(%q) error:%v, want %v", expr, err, ErrUDPNotSupported)
+		}
+	}
+
+	f, err := Compile("  ")
+	if f != nil || err != nil {
+		t.Fatal("empty expression should compile to nil")
+	}
+}
@@ -131,6 +131,11 @@ func getDynPathByElf(elfName, soName string) (string, error) {
 	return realSoName, nil
 }
 
+// GetLibcPath 从 elfName 的依赖中查找 libc.so，用于 connect/accept 的 uprobe
+func GetLibcPath(elfName string) (string, error) {
+	return getDynPathByElf(elfName, "libc.so")
+}
+
 func recurseDynStrings(dynSym []string, searchPath []string, soName string) string {
 	var realSoName string
 	for _, el := range dynSym {
@@ -25,8 +25,8 @@ type BashConfig struct {
 	eConfig
 	Bashpath string `json:"bashpath"` //bash的文件路径
 	Readline string `json:"readline"`
-	ErrNo    int
-	ElfType  uint8 //
+	ErrNo    int    `json:"errNo"`
+	ElfType  uint8  `json:"-"` //
 }
 
 func NewBashConfig() *BashConfig {
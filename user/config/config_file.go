@@ -0,0 +1,119 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileSection 配置文件中的一节，Value 为指向配置结构体的指针，字段名使用结构体的 json tag
+type FileSection struct {
+	Name  string
+	Value interface{}
+}
+
+// IFileLoaded 配置节从文件加载后的回调，keys 为文件中该节出现的字段，用于处理字段之间的默认值关系
+type IFileLoaded interface {
+	FileLoaded(keys map[string]bool)
+}
+
+// LoadFile 读取 YAML 或 JSON 格式的配置文件，写入对应的 section，文件中没有的字段保持原值。
+// 未知的 section 或字段返回错误
+func LoadFile(filename string, sections []FileSection) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	// JSON 是 YAML 的子集，统一按 YAML 解析
+	var raw map[string]interface{}
+	if err = yaml.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("config file %s: %v", filename, err)
+	}
+
+	for name, value := range raw {
+		var target interface{}
+		for _, s := range sections {
+			if s.Name == name {
+				target = s.Value
+				break
+			}
+		}
+		if target == nil {
+			return fmt.Errorf("config file %s: unknown section:%s", filename, name)
+		}
+
+		b, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("config file %s: section %s: %v", filename, name, err)
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(target); err != nil {
+			return fmt.Errorf("config file %s: section %s: %v", filename, name, err)
+		}
+		if fl, ok := target.(IFileLoaded); ok {
+			keys := make(map[string]bool)
+			if m, ok := value.(map[string]interface{}); ok {
+				for k := range m {
+					keys[k] = true
+				}
+			}
+			fl.FileLoaded(keys)
+		}
+	}
+	return nil
+}
+
+// DumpFile 按 sections 的顺序输出 YAML 格式的配置，可作为 --config 文件使用
+func DumpFile(sections []FileSection) ([]byte, error) {
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	for _, s := range sections {
+		b, err := json.Marshal(s.Value)
+		if err != nil {
+			return nil, err
+		}
+		// 经 JSON 转换保留结构体的字段顺序和 json tag
+		var node yaml.Node
+		if err = yaml.Unmarshal(b, &node); err != nil {
+			return nil, err
+		}
+		value := node.Content[0]
+		blockStyle(value)
+		doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: s.Name}, value)
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// blockStyle JSON 解析得到的是 flow 风格的节点，改为 YAML 的 block 风格，字符串只在必要时加引号
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, n := range node.Content {
+		blockStyle(n)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testGlobalConfig struct {
+	Pid       uint64          `json:"pid"`
+	Sinks     []string        `json:"sinks"`
+	Processor ProcessorConfig `json:"processor"`
+}
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadFile(t *testing.T) {
+	global := &testGlobalConfig{Pid: 1, Processor: ProcessorConfig{WorkerTick: time.Millisecond * 100, MaxWorkers: 1024}}
+	oc := NewOpensslConfig()
+	oc.Port = 443
+	oc.Pid = 7
+	sections := []FileSection{{Name: "global", Value: global}, {Name: "openssl", Value: oc}}
+
+	filename := writeConfigFile(t, "ecapture.yaml", `
+global:
+  pid: 1234
+  sinks: [stdout, "tcp://127.0.0.1:9000"]
+  processor:
+    workerTimeout: 3s
+    maxWorkers: 64
+openssl:
+  openssl: /lib/x86_64-linux-gnu/libssl.so.3
+  rotateSize: 10
+`)
+	if err := LoadFile(filename, sections); err != nil {
+		t.Fatal(err)
+	}
+	if global.Pid != 1234 || len(global.Sinks) != 2 || global.Sinks[1] != "tcp://127.0.0.1:9000" {
+		t.Fatalf("unexpected global config %+v", global)
+	}
+	want := ProcessorConfig{WorkerTimeout: time.Second * 3, WorkerTick: time.Millisecond * 100, MaxWorkers: 64}
+	if global.Processor != want {
+		t.Fatalf("processor config %+v, want %+v", global.Processor, want)
+	}
+	// 文件中没有的字段保持原值
+	if oc.Openssl != "/lib/x86_64-linux-gnu/libssl.so.3" || oc.RotateSize != 10 || oc.Port != 443 || oc.Pid != 7 {
+		t.Fatalf("unexpected openssl config %+v", oc)
+	}
+
+	// JSON 格式
+	filename = writeConfigFile(t, "ecapture.json", `{"openssl": {"port": 8443}}`)
+	if err := LoadFile(filename, sections); err != nil {
+		t.Fatal(err)
+	}
+	if oc.Port != 8443 {
+		t.Fatalf("port %d, want 8443", oc.Port)
+	}
+
+	// 与命令行一致，只指定 pcapFilter 时不限制端口
+	filename = writeConfigFile(t, "filter.yaml", "openssl:\n  pcapFilter: host 10.0.0.1\n")
+	if err := LoadFile(filename, sections); err != nil {
+		t.Fatal(err)
+	}
+	if oc.Port != 0 || oc.PcapFilter != "host 10.0.0.1" {
+		t.Fatalf("port %d, filter %q", oc.Port, oc.PcapFilter)
+	}
+	filename = writeConfigFile(t, "filter.yaml", "openssl:\n  pcapFilter: host 10.0.0.1\n  port: 8443\n")
+	if err := LoadFile(filename, sections); err != nil {
+		t.Fatal(err)
+	}
+	if oc.Port != 8443 {
+		t.Fatalf("port %d, want 8443", oc.Port)
+	}
+}
+
+func TestLoadFile_Invalid(t *testing.T) {
+	sections := []FileSection{{Name: "openssl", Value: NewOpensslConfig()}, {Name: "global", Value: &testGlobalConfig{}}}
+	for _, c := range []struct {
+		content string
+		err     string
+	}{
+		{"bash:\n  bashpath: /bin/bash\n", "unknown section:bash"},
+		{"openssl:\n  libssl: /lib/libssl.so\n", `unknown field "libssl"`},
+		// 全局参数只能在 global 节中设置
+		{"openssl:\n  Pid: 1\n", `unknown field "Pid"`},
+		{"global:\n  processor:\n    workerTimeout: 3\n", "cannot unmarshal number"},
+		{"global:\n  processor:\n    workerTick: 1x\n", `unknown unit "x"`},
+		{"openssl: [", "yaml"},
+	} {
+		err := LoadFile(writeConfigFile(t, "ecapture.yaml", c.content), sections)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("LoadFile(%q) error:%v, want %q", c.content, err, c.err)
+		}
+	}
+}
+
+func TestDumpFile(t *testing.T) {
+	global := &testGlobalConfig{Pid: 1234, Sinks: []string{"stdout"}, Processor: ProcessorConfig{WorkerTimeout: time.Second}}
+	bc := NewBashConfig()
+	bc.Bashpath = "/bin/bash"
+	bc.ErrNo = 128
+	bc.Readline = "123"
+	sections := []FileSection{{Name: "global", Value: global}, {Name: "bash", Value: bc}}
+
+	b, err := DumpFile(sections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(b)
+	for _, s := range []string{"global:\n  pid: 1234\n", "  workerTimeout: 1s\n", "bash:\n", "  errNo: 128\n", `  readline: "123"`} {
+		if !strings.Contains(out, s) {
+			t.Errorf("DumpFile output missing %q:\n%s", s, out)
+		}
+	}
+	if strings.Index(out, "global:") > strings.Index(out, "bash:") {
+		t.Errorf("sections out of order:\n%s", out)
+	}
+
+	// 输出的配置可以重新读取
+	global2, bc2 := &testGlobalConfig{}, NewBashConfig()
+	if err = LoadFile(writeConfigFile(t, "dump.yaml", out), []FileSection{{Name: "global", Value: global2}, {Name: "bash", Value: bc2}}); err != nil {
+		t.Fatal(err)
+	}
+	if global2.Pid != global.Pid || global2.Processor != global.Processor || *bc2 != *bc {
+		t.Fatalf("reload %+v %+v, want %+v %+v", global2, bc2, global, bc)
+	}
+}
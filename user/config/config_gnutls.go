@@ -19,7 +19,7 @@ type GnutlsConfig struct {
 	eConfig
 	Curlpath string `json:"curlpath"` //curl的文件路径
 	Gnutls   string `json:"gnutls"`
-	ElfType  uint8  //
+	ElfType  uint8  `json:"-"` //
 }
 
 func NewGnutlsConfig() *GnutlsConfig {
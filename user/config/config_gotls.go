@@ -26,10 +26,12 @@ var (
 // GoTLSConfig represents configuration for Go SSL probe
 type GoTLSConfig struct {
 	eConfig
-	Path   string `json:"path"`   // path to binary built with Go toolchain.
-	Write  string `json:"write"`  // Write  the  raw  packets  to file rather than parsing and printing them out.
-	Ifname string `json:"ifName"` // (TC Classifier) Interface name on which the probe will be attached.
-	Port   uint16 `json:"port"`   // capture port
+	PcapngRotate
+	Path       string `json:"path"`       // path to binary built with Go toolchain.
+	Write      string `json:"write"`      // Write  the  raw  packets  to file rather than parsing and printing them out.
+	Ifname     string `json:"ifName"`     // (TC Classifier) Interface names on which the probe will be attached, separated by commas, or "all".
+	Port       uint16 `json:"port"`       // capture port
+	PcapFilter string `json:"pcapFilter"` // (TC Classifier) tcpdump-like filter expression, e.g. "host 10.0.0.1 and port 443"
 }
 
 // NewGoTLSConfig creates a new config for Go SSL
@@ -37,11 +39,26 @@ func NewGoTLSConfig() *GoTLSConfig {
 	return &GoTLSConfig{}
 }
 
+// FileLoaded 与命令行一致，配置文件指定了 pcapFilter 而没有指定 port 时，不再限制为默认的 443 端口
+func (c *GoTLSConfig) FileLoaded(keys map[string]bool) {
+	if keys["pcapFilter"] && !keys["port"] {
+		c.Port = 0
+	}
+}
+
 func (c *GoTLSConfig) Check() error {
 	if c.Path == "" {
 		return ErrorGoBINNotSET
 	}
 
+	if err := c.checkRotate(); err != nil {
+		return err
+	}
+
+	if err := checkPcapFilter(c.PcapFilter); err != nil {
+		return err
+	}
+
 	if c.Ifname == "" || len(c.Ifname) == 0 {
 		c.Ifname = DefaultIfname
 	}
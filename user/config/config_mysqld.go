@@ -42,9 +42,9 @@ type MysqldConfig struct {
 	Mysqldpath  string     `json:"mysqldPath"` //curl的文件路径
 	FuncName    string     `json:"funcName"`
 	Offset      uint64     `json:"offset"`
-	ElfType     uint8      //
-	Version     MysqldType //
-	VersionInfo string     // info
+	ElfType     uint8      `json:"-"` //
+	Version     MysqldType `json:"-"` //
+	VersionInfo string     `json:"-"` // info
 }
 
 func NewMysqldConfig() *MysqldConfig {
@@ -19,7 +19,7 @@ type NsprConfig struct {
 	eConfig
 	Firefoxpath string `json:"firefoxpath"` //curl的文件路径
 	Nsprpath    string `json:"nsprpath"`
-	ElfType     uint8  //
+	ElfType     uint8  `json:"-"` //
 }
 
 func NewNsprConfig() *NsprConfig {
@@ -17,18 +17,27 @@ package config
 // 最终使用openssl参数
 type OpensslConfig struct {
 	eConfig
+	PcapngRotate
 	Curlpath string `json:"curlPath"` //curl的文件路径
 	Openssl  string `json:"openssl"`
 	//Pthread    string `json:"pThread"`    // /lib/x86_64-linux-gnu/libpthread.so.0
 	Write      string `json:"write"`      // Write  the  raw  packets  to file rather than parsing and printing them out.
-	Ifname     string `json:"ifName"`     // (TC Classifier) Interface name on which the probe will be attached.
+	Ifname     string `json:"ifName"`     // (TC Classifier) Interface names on which the probe will be attached, separated by commas, or "all".
 	Port       uint16 `json:"port"`       // capture port
+	PcapFilter string `json:"pcapFilter"` // (TC Classifier) tcpdump-like filter expression, e.g. "host 10.0.0.1 and port 443"
 	SslVersion string `json:"sslVersion"` // openssl version like 1.1.1a/1.1.1f/boringssl_1.1.1
-	ElfType    uint8  //
-	IsAndroid  bool   //	is Android OS ?
+	ElfType    uint8  `json:"-"`          //
+	IsAndroid  bool   `json:"-"`          //	is Android OS ?
 }
 
 func NewOpensslConfig() *OpensslConfig {
 	config := &OpensslConfig{}
 	return config
 }
+
+// FileLoaded 与命令行一致，配置文件指定了 pcapFilter 而没有指定 port 时，不再限制为默认的 443 端口
+func (this *OpensslConfig) FileLoaded(keys map[string]bool) {
+	if keys["pcapFilter"] && !keys["port"] {
+		this.Port = 0
+	}
+}
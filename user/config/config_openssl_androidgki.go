@@ -31,6 +31,13 @@ const (
 
 func (this *OpensslConfig) Check() error {
 	this.IsAndroid = true
+	if err := this.checkRotate(); err != nil {
+		return err
+	}
+	if err := checkPcapFilter(this.PcapFilter); err != nil {
+		return err
+	}
+
 	// 如果readline 配置，且存在，则直接返回。
 	if this.Openssl != "" || len(strings.TrimSpace(this.Openssl)) > 0 {
 		_, e := os.Stat(this.Openssl)
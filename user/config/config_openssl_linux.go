@@ -54,6 +54,13 @@ func (this *OpensslConfig) checkOpenssl() error {
 
 func (this *OpensslConfig) Check() error {
 	this.IsAndroid = false
+	if err := this.checkRotate(); err != nil {
+		return err
+	}
+	if err := checkPcapFilter(this.PcapFilter); err != nil {
+		return err
+	}
+
 	var checkedOpenssl bool
 	// 如果readline 配置，且存在，则直接返回。
 	if this.Openssl != "" || len(strings.TrimSpace(this.Openssl)) > 0 {
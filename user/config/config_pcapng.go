@@ -0,0 +1,45 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"ecapture/pkg/util/pcapfilter"
+	"errors"
+)
+
+// PcapngRotate pcapng 文件轮转参数(TC 模式 -w)，均为 0 时不轮转，类似 tcpdump 的 -C/-G/-W
+type PcapngRotate struct {
+	RotateSize    uint64 `json:"rotateSize"`    // 单个文件大小上限，单位 MB
+	RotateTime    uint64 `json:"rotateTime"`    // 单个文件时长上限，单位 秒
+	RotatePackets uint64 `json:"rotatePackets"` // 单个文件数据包数量上限
+	RotateFiles   uint64 `json:"rotateFiles"`   // 文件数量上限，超过后循环覆盖最早的文件
+}
+
+func (this PcapngRotate) Enable() bool {
+	return this.RotateSize > 0 || this.RotateTime > 0 || this.RotatePackets > 0
+}
+
+func (this PcapngRotate) checkRotate() error {
+	if this.RotateFiles > 0 && !this.Enable() {
+		return errors.New("rotate files requires one of rotate size, rotate time and rotate packets")
+	}
+	return nil
+}
+
+// checkPcapFilter 检查 tcpdump 风格的过滤表达式(TC 模式)
+func checkPcapFilter(expr string) error {
+	_, err := pcapfilter.Compile(expr)
+	return err
+}
@@ -23,3 +23,8 @@ const (
 	X86BinaryPrefix    = "/lib/x86_64-linux-gnu"
 	OthersBinaryPrefix = "/usr/lib"
 )
+
+const (
+	OutputFormatText = "text"
+	OutputFormatJson = "json"
+)
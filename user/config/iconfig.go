@@ -14,7 +14,12 @@
 
 package config
 
-import "ecapture/pkg/util/kernel"
+import (
+	"bytes"
+	"ecapture/pkg/util/kernel"
+	"encoding/json"
+	"time"
+)
 
 type IConfig interface {
 	Check() error //检测配置合法性
@@ -23,20 +28,89 @@ type IConfig interface {
 	GetHex() bool
 	GetDebug() bool
 	GetNoSearch() bool
+	GetFormat() string
+	GetProcessor() ProcessorConfig
 	SetPid(uint64)
 	SetUid(uint64)
 	SetHex(bool)
 	SetDebug(bool)
 	SetNoSearch(bool)
+	SetFormat(string)
+	SetProcessor(ProcessorConfig)
 	EnableGlobalVar() bool //
 }
 
+// ProcessorConfig 事件处理器的队列长度和 worker 超时，零值使用默认值
+type ProcessorConfig struct {
+	WorkerTimeout    time.Duration // 连接没有新数据时，输出已缓存的数据的时间
+	WorkerTick       time.Duration // 检查 WorkerTimeout 的间隔
+	WorkerQueueLen   int           // 每个连接的事件队列长度
+	IncomingQueueLen int           // 事件总队列长度
+	MaxWorkers       int           // 同时处理的连接数
+	ShutdownTimeout  time.Duration // 退出时等待输出已缓存数据的最长时间
+}
+
+// processorConfigJson ProcessorConfig 在配置文件中的格式，时间为 "1s"、"500ms" 格式的字符串
+type processorConfigJson struct {
+	WorkerTimeout    *jsonDuration `json:"workerTimeout"`
+	WorkerTick       *jsonDuration `json:"workerTick"`
+	WorkerQueueLen   *int          `json:"workerQueue"`
+	IncomingQueueLen *int          `json:"eventQueue"`
+	MaxWorkers       *int          `json:"maxWorkers"`
+	ShutdownTimeout  *jsonDuration `json:"shutdownTimeout"`
+}
+
+func (this *ProcessorConfig) jsonFields() processorConfigJson {
+	return processorConfigJson{
+		WorkerTimeout:    (*jsonDuration)(&this.WorkerTimeout),
+		WorkerTick:       (*jsonDuration)(&this.WorkerTick),
+		WorkerQueueLen:   &this.WorkerQueueLen,
+		IncomingQueueLen: &this.IncomingQueueLen,
+		MaxWorkers:       &this.MaxWorkers,
+		ShutdownTimeout:  (*jsonDuration)(&this.ShutdownTimeout),
+	}
+}
+
+func (this ProcessorConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(this.jsonFields())
+}
+
+// UnmarshalJSON 只修改出现的字段
+func (this *ProcessorConfig) UnmarshalJSON(b []byte) error {
+	v := this.jsonFields()
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(&v)
+}
+
+type jsonDuration time.Duration
+
+func (this jsonDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(this).String())
+}
+
+func (this *jsonDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*this = jsonDuration(d)
+	return nil
+}
+
+// eConfig 全局参数，由命令行的全局参数(或配置文件的 global 节)设置，不单独出现在配置文件中
 type eConfig struct {
-	Pid      uint64
-	Uid      uint64
-	IsHex    bool
-	Debug    bool
-	NoSearch bool
+	Pid       uint64          `json:"-"`
+	Uid       uint64          `json:"-"`
+	IsHex     bool            `json:"-"`
+	Debug     bool            `json:"-"`
+	NoSearch  bool            `json:"-"`
+	Format    string          `json:"-"` // output format of events, text or json
+	Processor ProcessorConfig `json:"-"`
 }
 
 func (this *eConfig) GetPid() uint64 {
@@ -59,6 +133,14 @@ func (this *eConfig) GetNoSearch() bool {
 	return this.NoSearch
 }
 
+func (this *eConfig) GetFormat() string {
+	return this.Format
+}
+
+func (this *eConfig) GetProcessor() ProcessorConfig {
+	return this.Processor
+}
+
 func (this *eConfig) SetPid(pid uint64) {
 	this.Pid = pid
 }
@@ -79,6 +161,14 @@ func (this *eConfig) SetNoSearch(noSearch bool) {
 	this.NoSearch = noSearch
 }
 
+func (this *eConfig) SetFormat(format string) {
+	this.Format = format
+}
+
+func (this *eConfig) SetProcessor(processor ProcessorConfig) {
+	this.Processor = processor
+}
+
 func (this *eConfig) EnableGlobalVar() bool {
 	kv, err := kernel.HostVersion()
 	if err != nil {
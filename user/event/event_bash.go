@@ -92,3 +92,12 @@ func (this *BashEvent) Payload() []byte {
 func (this *BashEvent) PayloadLen() int {
 	return len(this.Line)
 }
+
+func (this *BashEvent) Base() Base {
+	return Base{
+		Pid:       uint64(this.Pid),
+		Comm:      CToGoString(this.Comm[:]),
+		Direction: DirectionNone,
+		Payload:   []byte(unix.ByteSliceToString(this.Line[:])),
+	}
+}
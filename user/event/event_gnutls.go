@@ -114,3 +114,14 @@ func (this *GnutlsDataEvent) Payload() []byte {
 func (this *GnutlsDataEvent) PayloadLen() int {
 	return int(this.Data_len)
 }
+
+func (this *GnutlsDataEvent) Base() Base {
+	return Base{
+		Pid:       uint64(this.Pid),
+		Tid:       uint64(this.Tid),
+		Comm:      CToGoString(this.Comm[:]),
+		Timestamp: this.Timestamp,
+		Direction: direction(this.DataType),
+		Payload:   this.Payload(),
+	}
+}
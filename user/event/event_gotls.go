@@ -66,3 +66,14 @@ func (this *GoTLSEvent) Payload() []byte {
 func (this *GoTLSEvent) PayloadLen() int {
 	return int(this.Len)
 }
+
+func (this *GoTLSEvent) Base() Base {
+	return Base{
+		Pid:       uint64(this.Pid),
+		Tid:       uint64(this.Tid),
+		Comm:      CToGoString(this.Comm[:]),
+		Timestamp: this.TimestampNS,
+		Direction: DirectionNone,
+		Payload:   this.Payload(),
+	}
+}
@@ -121,6 +121,13 @@ func (this *MasterSecretEvent) PayloadLen() int {
 	return len(this.payload)
 }
 
+func (this *MasterSecretEvent) Base() Base {
+	return Base{
+		Direction: DirectionNone,
+		Payload:   this.Payload(),
+	}
+}
+
 // for BoringSSL  TLS 1.3
 type MasterSecretBSSLEvent struct {
 	event_type EventType
@@ -214,3 +221,10 @@ func (this *MasterSecretBSSLEvent) Payload() []byte {
 func (this *MasterSecretBSSLEvent) PayloadLen() int {
 	return len(this.payload)
 }
+
+func (this *MasterSecretBSSLEvent) Base() Base {
+	return Base{
+		Direction: DirectionNone,
+		Payload:   this.Payload(),
+	}
+}
@@ -102,3 +102,10 @@ func (this *MasterSecretGotlsEvent) Payload() []byte {
 func (this *MasterSecretGotlsEvent) PayloadLen() int {
 	return len(this.payload)
 }
+
+func (this *MasterSecretGotlsEvent) Base() Base {
+	return Base{
+		Direction: DirectionNone,
+		Payload:   this.Payload(),
+	}
+}
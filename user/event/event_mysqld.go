@@ -131,3 +131,13 @@ func (this *MysqldEvent) Payload() []byte {
 func (this *MysqldEvent) PayloadLen() int {
 	return int(this.Len)
 }
+
+func (this *MysqldEvent) Base() Base {
+	return Base{
+		Pid:       this.Pid,
+		Comm:      CToGoString(this.Comm[:]),
+		Timestamp: this.Timestamp,
+		Direction: DirectionNone,
+		Payload:   this.Payload(),
+	}
+}
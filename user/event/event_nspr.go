@@ -134,3 +134,14 @@ func (this *NsprDataEvent) Payload() []byte {
 func (this *NsprDataEvent) PayloadLen() int {
 	return int(this.DataLen)
 }
+
+func (this *NsprDataEvent) Base() Base {
+	return Base{
+		Pid:       uint64(this.Pid),
+		Tid:       uint64(this.Tid),
+		Comm:      CToGoString(this.Comm[:]),
+		Timestamp: this.Timestamp,
+		Direction: direction(this.DataType),
+		Payload:   this.Payload(),
+	}
+}
@@ -29,7 +29,13 @@ const (
 )
 
 const MaxDataSize = 1024 * 4
-const SaDataLen = 14
+const SaDataLen = 26
+
+// sa_family of connect_events
+const (
+	AfInet  = 2
+	AfInet6 = 10
+)
 
 const (
 	Ssl2Version   = 0x0002
@@ -79,6 +85,8 @@ type SSLDataEvent struct {
 	Comm       [16]byte          `json:"Comm"`
 	Fd         uint32            `json:"fd"`
 	Version    int32             `json:"version"`
+	LocalAddr  string            `json:"localAddr"`  // 非内核数据，由 module 根据 pid+fd 查询
+	RemoteAddr string            `json:"remoteAddr"` // 非内核数据，由 module 根据 pid+fd 查询
 }
 
 func (this *SSLDataEvent) Decode(payload []byte) (err error) {
@@ -126,9 +134,33 @@ func (this *SSLDataEvent) PayloadLen() int {
 	return int(this.DataLen)
 }
 
+func (this *SSLDataEvent) Base() Base {
+	return Base{
+		Pid:        uint64(this.Pid),
+		Tid:        uint64(this.Tid),
+		Comm:       CToGoString(this.Comm[:]),
+		Timestamp:  this.Timestamp,
+		Direction:  direction(this.DataType),
+		LocalAddr:  this.LocalAddr,
+		RemoteAddr: this.RemoteAddr,
+		Payload:    this.Payload(),
+	}
+}
+
+// addr 连接地址，本地地址未知时只显示远端地址
+func (this *SSLDataEvent) addr() string {
+	remote := this.RemoteAddr
+	if remote == "" {
+		remote = "[unknown]"
+	}
+	if this.LocalAddr == "" {
+		return remote
+	}
+	return fmt.Sprintf("%s (local %s)", remote, this.LocalAddr)
+}
+
 func (this *SSLDataEvent) StringHex() string {
-	//addr := this.module.(*module.MOpenSSLProbe).GetConn(this.Pid, this.Fd)
-	addr := "[TODO]"
+	addr := this.addr()
 	var perfix, connInfo string
 	switch AttachType(this.DataType) {
 	case ProbeEntry:
@@ -150,8 +182,7 @@ func (this *SSLDataEvent) StringHex() string {
 }
 
 func (this *SSLDataEvent) String() string {
-	//addr := this.module.(*module.MOpenSSLProbe).GetConn(this.Pid, this.Fd)
-	addr := "[TODO]"
+	addr := this.addr()
 	var perfix, connInfo string
 	switch AttachType(this.DataType) {
 	case ProbeEntry:
@@ -184,6 +215,7 @@ uint64_t timestamp_ns;
   uint32_t pid;
   uint32_t tid;
   uint32_t fd;
+  uint16_t sa_family;
   char sa_data[SA_DATA_LEN];
   char Comm[TASK_COMM_LEN];
 */
@@ -193,6 +225,7 @@ type ConnDataEvent struct {
 	Pid         uint32          `json:"pid"`
 	Tid         uint32          `json:"tid"`
 	Fd          uint32          `json:"fd"`
+	SaFamily    uint16          `json:"saFamily"`
 	SaData      [SaDataLen]byte `json:"saData"`
 	Comm        [16]byte        `json:"Comm"`
 	Addr        string          `json:"addr"`
@@ -212,15 +245,28 @@ func (this *ConnDataEvent) Decode(payload []byte) (err error) {
 	if err = binary.Read(buf, binary.LittleEndian, &this.Fd); err != nil {
 		return
 	}
+	if err = binary.Read(buf, binary.LittleEndian, &this.SaFamily); err != nil {
+		return
+	}
 	if err = binary.Read(buf, binary.LittleEndian, &this.SaData); err != nil {
 		return
 	}
 	if err = binary.Read(buf, binary.LittleEndian, &this.Comm); err != nil {
 		return
 	}
+	// sockaddr_in: port(2) + addr(4), sockaddr_in6: port(2) + flowinfo(4) + addr(16) + scope_id(4)
 	port := binary.BigEndian.Uint16(this.SaData[0:2])
-	ip := net.IPv4(this.SaData[2], this.SaData[3], this.SaData[4], this.SaData[5])
-	this.Addr = fmt.Sprintf("%s:%d", ip, port)
+	var ip net.IP
+	switch this.SaFamily {
+	case AfInet:
+		ip = net.IPv4(this.SaData[2], this.SaData[3], this.SaData[4], this.SaData[5])
+	case AfInet6:
+		ip = make(net.IP, net.IPv6len)
+		copy(ip, this.SaData[6:22])
+	default:
+		return fmt.Errorf("unsupported sa_family:%d", this.SaFamily)
+	}
+	this.Addr = net.JoinHostPort(ip.String(), fmt.Sprintf("%d", port))
 	return nil
 }
 
@@ -255,3 +301,14 @@ func (this *ConnDataEvent) Payload() []byte {
 func (this *ConnDataEvent) PayloadLen() int {
 	return len(this.Addr)
 }
+
+func (this *ConnDataEvent) Base() Base {
+	return Base{
+		Pid:       uint64(this.Pid),
+		Tid:       uint64(this.Tid),
+		Comm:      CToGoString(this.Comm[:]),
+		Timestamp: this.TimestampNs,
+		Direction: DirectionNone,
+		Payload:   this.Payload(),
+	}
+}
@@ -93,3 +93,13 @@ func (this *TcSkbEvent) Payload() []byte {
 func (this *TcSkbEvent) PayloadLen() int {
 	return int(this.Len)
 }
+
+func (this *TcSkbEvent) Base() Base {
+	return Base{
+		Pid:       uint64(this.Pid),
+		Comm:      CToGoString(this.Comm[:]),
+		Timestamp: this.Ts,
+		Direction: DirectionNone,
+		Payload:   this.Payload(),
+	}
+}
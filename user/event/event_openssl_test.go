@@ -0,0 +1,54 @@
+package event
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func connectEventPayload(family uint16, saData []byte) []byte {
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, uint64(1))  // timestamp_ns
+	_ = binary.Write(buf, binary.LittleEndian, uint32(10)) // pid
+	_ = binary.Write(buf, binary.LittleEndian, uint32(11)) // tid
+	_ = binary.Write(buf, binary.LittleEndian, uint32(3))  // fd
+	_ = binary.Write(buf, binary.LittleEndian, family)
+	var sa [SaDataLen]byte
+	copy(sa[:], saData)
+	buf.Write(sa[:])
+	var comm [16]byte
+	copy(comm[:], "curl")
+	buf.Write(comm[:])
+	return buf.Bytes()
+}
+
+func TestConnDataEvent_Decode(t *testing.T) {
+	sa4 := []byte{0x01, 0xbb, 10, 0, 0, 1}
+	sa6 := make([]byte, 22)
+	binary.BigEndian.PutUint16(sa6[0:2], 8443)
+	copy(sa6[6:22], net.ParseIP("fd00::1"))
+
+	tests := map[string]struct {
+		family uint16
+		saData []byte
+		addr   string
+	}{
+		"ipv4": {AfInet, sa4, "10.0.0.1:443"},
+		"ipv6": {AfInet6, sa6, "[fd00::1]:8443"},
+	}
+	for name, tt := range tests {
+		e := &ConnDataEvent{}
+		if err := e.Decode(connectEventPayload(tt.family, tt.saData)); err != nil {
+			t.Fatalf("%s: decode error:%v", name, err)
+		}
+		if e.Addr != tt.addr {
+			t.Fatalf("%s: addr %s, want %s", name, e.Addr, tt.addr)
+		}
+	}
+
+	e := &ConnDataEvent{}
+	if err := e.Decode(connectEventPayload(1, nil)); err == nil {
+		t.Fatal("AF_UNIX should not be decoded")
+	}
+}
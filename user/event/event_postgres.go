@@ -89,3 +89,13 @@ func (this *PostgresEvent) Payload() []byte {
 func (this *PostgresEvent) PayloadLen() int {
 	return len(this.Query)
 }
+
+func (this *PostgresEvent) Base() Base {
+	return Base{
+		Pid:       this.Pid,
+		Comm:      CToGoString(this.Comm[:]),
+		Timestamp: this.Timestamp,
+		Direction: DirectionNone,
+		Payload:   []byte(unix.ByteSliceToString(this.Query[:])),
+	}
+}
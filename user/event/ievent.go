@@ -38,4 +38,25 @@ type IEventStruct interface {
 	//SetModule(IModule)
 	EventType() EventType
 	GetUUID() string
+	Base() Base
+}
+
+const (
+	DirectionNone    = ""
+	DirectionIngress = "ingress" // received by the hooked process
+	DirectionEgress  = "egress"  // sent by the hooked process
+)
+
+// Base common fields of all events, used by structured output such as --format=json.
+// Payload is encoded as base64 by encoding/json.
+type Base struct {
+	Pid        uint64 `json:"pid"`
+	Tid        uint64 `json:"tid"`
+	Comm       string `json:"comm"`
+	Timestamp  uint64 `json:"timestamp"`
+	Direction  string `json:"direction"`
+	LocalAddr  string `json:"localAddr,omitempty"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	Module     string `json:"module"`
+	Payload    []byte `json:"payload"`
 }
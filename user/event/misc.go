@@ -78,6 +78,17 @@ func dumpByteSlice(b []byte, perfix string) *bytes.Buffer {
 	return bb
 }
 
+// direction convert AttachType of data event into Base.Direction
+func direction(dataType int64) string {
+	switch AttachType(dataType) {
+	case ProbeEntry:
+		return DirectionIngress
+	case ProbeRet:
+		return DirectionEgress
+	}
+	return DirectionNone
+}
+
 func CToGoString(c []byte) string {
 	n := -1
 	for i, b := range c {
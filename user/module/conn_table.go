@@ -0,0 +1,209 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package module
+
+import (
+	"ecapture/pkg/proc"
+	"fmt"
+	manager "github.com/gojue/ebpfmanager"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// ConnTableMaxSize 连接表的最大数量，超过后清理已退出进程的连接
+	ConnTableMaxSize = 10240
+	// ConnTableRecheckInterval 没有 connect/accept 事件时，检查 fd 是否已复用(socket inode 变化)的最小间隔
+	ConnTableRecheckInterval = time.Second
+)
+
+// ConnInfo 连接的本地、远端地址
+type ConnInfo struct {
+	Local  string
+	Remote string
+	// resolved 已通过 /proc 查询过，查询失败时不再重复查询
+	resolved bool
+	// inode fd 对应的 socket inode，fd 复用后 inode 变化
+	inode string
+	// checked 上次从 /proc 检查的时间，connect/accept 事件的记录为零值，首次查询时检查
+	checked time.Time
+}
+
+// ConnTable pid+fd 到连接地址的映射，由 connect/accept 事件填充，缺失时从 /proc/<pid>/fd 查询。
+// fd 复用时，新的 connect/accept 事件会覆盖旧的连接；没有 connect/accept 事件时，
+// 查询时通过 socket inode 发现 fd 已指向新的连接，丢弃旧的记录。
+type ConnTable struct {
+	sync.Mutex
+	conns map[uint32]map[uint32]*ConnInfo // pid -> fd -> conn
+	size  int
+}
+
+func NewConnTable() *ConnTable {
+	return &ConnTable{conns: make(map[uint32]map[uint32]*ConnInfo)}
+}
+
+// AddConn 记录 connect/accept 事件中的远端地址，本地地址在首次查询时从 /proc 补全
+func (this *ConnTable) AddConn(pid, fd uint32, remote string) {
+	this.Lock()
+	defer this.Unlock()
+	this.set(pid, fd, &ConnInfo{Remote: remote})
+}
+
+func (this *ConnTable) DelConn(pid, fd uint32) {
+	this.Lock()
+	defer this.Unlock()
+	fds, found := this.conns[pid]
+	if !found {
+		return
+	}
+	if _, found = fds[fd]; found {
+		delete(fds, fd)
+		this.size--
+	}
+	if len(fds) == 0 {
+		delete(this.conns, pid)
+	}
+}
+
+// GetConn 查询连接地址，本地地址未知或 fd 已复用时从 /proc 查询。
+// 进程已退出或 fd 已关闭时，返回缓存的地址。每个 SSL 事件都会查询，/proc 的读取不持有锁，
+// 同一 fd 在 ConnTableRecheckInterval 内只检查一次。
+func (this *ConnTable) GetConn(pid, fd uint32) ConnInfo {
+	now := time.Now()
+	this.Lock()
+	conn := this.conns[pid][fd]
+	var cached ConnInfo
+	if conn != nil {
+		cached = *conn
+	}
+	this.Unlock()
+	if conn != nil && !cached.checked.IsZero() && now.Sub(cached.checked) < ConnTableRecheckInterval {
+		return cached
+	}
+
+	info := this.resolve(pid, fd, conn != nil, cached)
+	info.checked = now
+
+	this.Lock()
+	defer this.Unlock()
+	// 查询期间 connect/accept 事件更新了记录，以事件为准
+	if cur := this.conns[pid][fd]; cur != conn && cur != nil {
+		return *cur
+	}
+	stored := info
+	this.set(pid, fd, &stored)
+	return info
+}
+
+// resolve 从 /proc 查询连接地址，found 为 cached 是否有效，不持有锁
+func (this *ConnTable) resolve(pid, fd uint32, found bool, cached ConnInfo) ConnInfo {
+	inode, err := proc.SocketInode(pid, fd)
+	if found && err == nil {
+		switch cached.inode {
+		case "":
+			if cached.resolved {
+				// 上次查询时 fd 不是 socket
+				found = false
+			} else {
+				// connect/accept 事件之后的首次查询
+				cached.inode = inode
+			}
+		case inode:
+		default:
+			// fd 已复用
+			found = false
+		}
+	}
+	if found && (cached.Local != "" || cached.resolved) {
+		return cached
+	}
+
+	local, remote, err := proc.SocketAddr(pid, fd)
+	if err != nil {
+		if !found {
+			cached = ConnInfo{inode: inode}
+		}
+		cached.resolved = true
+		return cached
+	}
+	return ConnInfo{Local: local, Remote: remote, resolved: true, inode: inode}
+}
+
+// set 需持有锁
+func (this *ConnTable) set(pid, fd uint32, conn *ConnInfo) {
+	fds, found := this.conns[pid]
+	if !found {
+		if this.size >= ConnTableMaxSize {
+			this.cleanup()
+		}
+		fds = make(map[uint32]*ConnInfo)
+		this.conns[pid] = fds
+	}
+	if _, found = fds[fd]; !found {
+		this.size++
+	}
+	fds[fd] = conn
+}
+
+// cleanup 删除已退出进程的连接
+func (this *ConnTable) cleanup() {
+	for pid, fds := range this.conns {
+		if _, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); os.IsNotExist(err) {
+			this.size -= len(fds)
+			delete(this.conns, pid)
+		}
+	}
+}
+
+// connProbes libc 中 connect、accept、accept4 的 uprobe，事件写入 connect_events
+func connProbes(libc string) []*manager.Probe {
+	return []*manager.Probe{
+		{
+			Section:          "uprobe/connect",
+			EbpfFuncName:     "probe_connect",
+			AttachToFuncName: "connect",
+			BinaryPath:       libc,
+		},
+		{
+			Section:          "uprobe/accept",
+			EbpfFuncName:     "probe_entry_accept",
+			AttachToFuncName: "accept",
+			BinaryPath:       libc,
+			UID:              "uprobe_accept",
+		},
+		{
+			Section:          "uretprobe/accept",
+			EbpfFuncName:     "probe_ret_accept",
+			AttachToFuncName: "accept",
+			BinaryPath:       libc,
+			UID:              "uretprobe_accept",
+		},
+		{
+			Section:          "uprobe/accept",
+			EbpfFuncName:     "probe_entry_accept",
+			AttachToFuncName: "accept4",
+			BinaryPath:       libc,
+			UID:              "uprobe_accept4",
+		},
+		{
+			Section:          "uretprobe/accept",
+			EbpfFuncName:     "probe_ret_accept",
+			AttachToFuncName: "accept4",
+			BinaryPath:       libc,
+			UID:              "uretprobe_accept4",
+		},
+	}
+}
@@ -0,0 +1,73 @@
+package module
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestConnTable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	f, err := conn.(*net.TCPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	pid, fd := uint32(os.Getpid()), uint32(f.Fd())
+	ct := NewConnTable()
+
+	// remote address from connect event, local address from /proc
+	ct.AddConn(pid, fd, conn.RemoteAddr().String())
+	c := ct.GetConn(pid, fd)
+	if c.Local != conn.LocalAddr().String() || c.Remote != conn.RemoteAddr().String() {
+		t.Fatalf("got %s -> %s, want %s -> %s", c.Local, c.Remote, conn.LocalAddr(), conn.RemoteAddr())
+	}
+
+	// connect event of an exited process
+	ct.AddConn(1<<30, 3, "10.0.0.1:443")
+	if c = ct.GetConn(1<<30, 3); c.Remote != "10.0.0.1:443" || c.Local != "" {
+		t.Fatalf("unexpected conn: %+v", c)
+	}
+
+	// no connect event, found via /proc only
+	ct.DelConn(pid, fd)
+	if c = ct.GetConn(pid, fd); c.Remote != conn.RemoteAddr().String() {
+		t.Fatalf("unexpected conn: %+v", c)
+	}
+
+	// fd reused by a new connection without connect event
+	conn2, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	f2, err := conn2.(*net.TCPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	if err = unix.Dup2(int(f2.Fd()), int(fd)); err != nil {
+		t.Fatal(err)
+	}
+	// 检查间隔内返回缓存的地址，不重复读取 /proc
+	if c = ct.GetConn(pid, fd); c.Local != conn.LocalAddr().String() {
+		t.Fatalf("fd rechecked within %s: %+v", ConnTableRecheckInterval, c)
+	}
+	ct.conns[pid][fd].checked = time.Now().Add(-ConnTableRecheckInterval)
+	if c = ct.GetConn(pid, fd); c.Local != conn2.LocalAddr().String() || c.Remote != conn2.RemoteAddr().String() {
+		t.Fatalf("got %s -> %s after fd reuse, want %s -> %s", c.Local, c.Remote, conn2.LocalAddr(), conn2.RemoteAddr())
+	}
+}
@@ -53,4 +53,5 @@ const BufferSizeOfEbpfMap = 1024
 
 const (
 	MasterSecretKeyLogName = "ecapture_masterkey.log"
+	KeylogWriteRetries     = 3 // keylog 文件写入失败的重试次数
 )
@@ -0,0 +1,577 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package module
+
+import (
+	"bytes"
+	"context"
+	"ecapture/user/config"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DaemonEventQueueLen = 1024            // 每个 /events 客户端的事件队列长度，队列已满时丢弃
+	DaemonTimeout       = 3 * time.Second // 读取请求头、关闭服务的超时
+)
+
+var (
+	ErrModuleNotFound   = errors.New("module not found")
+	ErrInstanceNotFound = errors.New("module instance not found")
+	ErrInstanceStarting = errors.New("module instance is starting")
+	ErrModuleConfig     = errors.New("invalid module config")
+	ErrDaemonClosed     = errors.New("daemon is closed")
+)
+
+// ConfigFactory 创建 module 对应的配置，不支持的 module 返回 nil
+type ConfigFactory func(modName string) config.IConfig
+
+// StartRequest POST /modules/{name}/start 的请求，未出现的字段使用 daemon 的全局参数
+type StartRequest struct {
+	Pid       uint64                 `json:"pid"`
+	Uid       uint64                 `json:"uid"`
+	Hex       bool                   `json:"hex"`
+	Debug     bool                   `json:"debug"`
+	NoSearch  bool                   `json:"noSearch"`
+	Format    string                 `json:"format"`
+	Processor config.ProcessorConfig `json:"processor"`
+	Config    json.RawMessage        `json:"config"` // module 的配置，字段名同配置文件中 module 的节
+}
+
+// ModuleStatus GET /modules 的返回，Instances 为运行中、启动中的实例ID
+type ModuleStatus struct {
+	Name      string   `json:"name"`
+	Instances []string `json:"instances"`
+}
+
+// InstanceStatus module 实例的运行状态，POST /modules/{name}/start、GET /instances/{id} 的返回
+type InstanceStatus struct {
+	ID        string       `json:"id"`
+	Module    string       `json:"module"`
+	Running   bool         `json:"running"`
+	StartTime *time.Time   `json:"startTime,omitempty"`
+	Pid       uint64       `json:"pid"`
+	Uid       uint64       `json:"uid"`
+	Stats     *ModuleStats `json:"stats,omitempty"`
+}
+
+// moduleInstance daemon 启动的 module 实例，同一 module 可以不同的配置启动多个实例
+type moduleInstance struct {
+	id        string
+	seq       uint64 // 启动顺序，用于排序
+	name      string
+	mod       IModule
+	conf      config.IConfig
+	cancel    context.CancelFunc
+	startTime time.Time
+	running   bool // Init、Run 完成前为 false，不能停止
+}
+
+// Daemon 在 unix socket 上提供 HTTP API，按需启动、停止 module 实例，并推送事件：
+//
+//	GET  /modules                          已注册的 module 及运行中的实例
+//	GET  /modules/{name}                   module 运行中的实例
+//	POST /modules/{name}/start             以请求中的配置启动一个新的实例，返回实例ID，见 StartRequest
+//	GET  /instances/{id}                   实例的运行状态和计数
+//	POST /instances/{id}/stop              停止实例
+//	GET  /events?module={name}&instance={id} 持续输出事件，每行一条记录，参数为空时不过滤
+type Daemon struct {
+	sync.Mutex
+	logger    *log.Logger
+	newConfig ConfigFactory
+	defaults  StartRequest
+	sink      EventSink
+	metrics   *MetricsServer
+	instances map[string]*moduleInstance // key 为实例ID，启动中的实例已预留
+	seq       uint64
+	starting  sync.WaitGroup // 启动中的实例，Close 等待其完成后统一停止
+	listener  net.Listener
+	server    *http.Server
+
+	subLock   sync.Mutex
+	subs      map[*daemonSubscriber]struct{}
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// daemonSubscriber /events 客户端
+type daemonSubscriber struct {
+	module   string
+	instance string
+	events   chan []byte
+}
+
+// NewDaemon 监听 unix socket，Start 之后开始处理请求。socket 文件已存在时删除后重新创建
+func NewDaemon(socket string, logger *log.Logger, newConfig ConfigFactory) (*Daemon, error) {
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("daemon remove socket %s error:%v", socket, err)
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("daemon listen %s error:%v", socket, err)
+	}
+	// 可以启动 eBPF 程序，只允许当前用户访问
+	if err = os.Chmod(socket, 0600); err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("daemon chmod %s error:%v", socket, err)
+	}
+
+	this := &Daemon{
+		logger:    logger,
+		newConfig: newConfig,
+		instances: make(map[string]*moduleInstance),
+		listener:  l,
+		subs:      make(map[*daemonSubscriber]struct{}),
+		closing:   make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/modules", this.handleModules)
+	mux.HandleFunc("/modules/", this.handleModule)
+	mux.HandleFunc("/instances/", this.handleInstance)
+	mux.HandleFunc("/events", this.handleEvents)
+	this.server = &http.Server{Handler: mux, ReadHeaderTimeout: DaemonTimeout}
+	return this, nil
+}
+
+// SetDefaults 启动 module 时请求中未指定的全局参数
+func (this *Daemon) SetDefaults(req StartRequest) {
+	this.defaults = req
+	this.defaults.Config = nil
+}
+
+// SetSink 除 /events 客户端外，事件同时写入 sink
+func (this *Daemon) SetSink(sink EventSink) {
+	this.sink = sink
+}
+
+// SetMetrics 运行中的实例输出到 metrics
+func (this *Daemon) SetMetrics(ms *MetricsServer) {
+	this.metrics = ms
+}
+
+// Addr 监听的 socket 文件
+func (this *Daemon) Addr() string {
+	return this.listener.Addr().String()
+}
+
+func (this *Daemon) Start() {
+	go func() {
+		_ = this.server.Serve(this.listener)
+	}()
+}
+
+// Close 断开 /events 客户端，停止服务和所有运行中的实例
+func (this *Daemon) Close() error {
+	// 持有锁关闭 closing，之后不再预留新的实例，starting 不会再增加
+	this.closeOnce.Do(func() {
+		this.Lock()
+		close(this.closing)
+		this.Unlock()
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), DaemonTimeout)
+	defer cancel()
+	err := this.server.Shutdown(ctx)
+	this.starting.Wait()
+
+	this.Lock()
+	ids := make([]string, 0, len(this.instances))
+	for id := range this.instances {
+		ids = append(ids, id)
+	}
+	this.Unlock()
+	for _, id := range ids {
+		if _, e := this.StopInstance(id); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// StartModule 以 req 中的配置启动 module 的一个新实例，返回的状态中包含实例ID。
+// 持有锁只预留实例，加载 eBPF 程序等耗时的 Init、Run 不阻塞其他请求
+func (this *Daemon) StartModule(name string, req StartRequest) (InstanceStatus, error) {
+	if GetModuleByName(name) == nil {
+		return InstanceStatus{}, ErrModuleNotFound
+	}
+	mod := NewModule(name)
+	conf := this.newConfig(name)
+	if mod == nil || conf == nil {
+		return InstanceStatus{}, fmt.Errorf("module %s is not supported by daemon", name)
+	}
+	if len(req.Config) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(req.Config))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(conf); err != nil {
+			return InstanceStatus{}, fmt.Errorf("%w of %s:%v", ErrModuleConfig, name, err)
+		}
+	}
+	conf.SetPid(req.Pid)
+	conf.SetUid(req.Uid)
+	conf.SetHex(req.Hex)
+	conf.SetDebug(req.Debug)
+	conf.SetNoSearch(req.NoSearch)
+	conf.SetFormat(req.Format)
+	conf.SetProcessor(req.Processor)
+	if err := conf.Check(); err != nil {
+		return InstanceStatus{}, fmt.Errorf("%w of %s:%v", ErrModuleConfig, name, err)
+	}
+
+	ins, err := this.reserve(name, mod, conf)
+	if err != nil {
+		return InstanceStatus{}, err
+	}
+	defer this.starting.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mod.SetSink(&daemonSink{daemon: this, module: name, instance: ins.id})
+	err = mod.Init(ctx, this.logger, conf)
+	if err == nil {
+		if err = mod.Run(); err != nil {
+			// Init 已加载 eBPF 程序，Run 失败时关闭 module 释放
+			if e := mod.Close(); e != nil {
+				this.logger.Printf("%s\tmodule instance %s close failed. error:%v", name, ins.id, e)
+			}
+		}
+	}
+	this.Lock()
+	defer this.Unlock()
+	if err != nil {
+		cancel()
+		delete(this.instances, ins.id)
+		return InstanceStatus{}, err
+	}
+	ins.cancel = cancel
+	ins.startTime = time.Now()
+	ins.running = true
+	this.metrics.AddInstance(mod, ins.id)
+	this.logger.Printf("%s\tmodule instance %s started by daemon, pid:%d, uid:%d", name, ins.id, req.Pid, req.Uid)
+	return ins.status(), nil
+}
+
+// reserve 分配实例ID并预留，daemon 关闭后返回 ErrDaemonClosed
+func (this *Daemon) reserve(name string, mod IModule, conf config.IConfig) (*moduleInstance, error) {
+	this.Lock()
+	defer this.Unlock()
+	select {
+	case <-this.closing:
+		return nil, ErrDaemonClosed
+	default:
+	}
+	this.seq++
+	ins := &moduleInstance{id: fmt.Sprintf("%s-%d", name, this.seq), seq: this.seq, name: name, mod: mod, conf: conf}
+	this.instances[ins.id] = ins
+	this.starting.Add(1)
+	return ins, nil
+}
+
+// StopInstance 停止实例，返回停止时的计数。持有锁只移除实例，Close 在锁外执行
+func (this *Daemon) StopInstance(id string) (InstanceStatus, error) {
+	this.Lock()
+	ins, found := this.instances[id]
+	if !found {
+		this.Unlock()
+		return InstanceStatus{}, ErrInstanceNotFound
+	}
+	if !ins.running {
+		this.Unlock()
+		return InstanceStatus{}, ErrInstanceStarting
+	}
+	delete(this.instances, id)
+	this.Unlock()
+
+	this.metrics.Remove(ins.mod)
+	ins.cancel()
+	err := ins.mod.Close()
+	status := ins.status()
+	status.Running = false
+	this.logger.Printf("%s\tmodule instance %s stopped by daemon", ins.name, id)
+	return status, err
+}
+
+// Status 已注册的 module 及运行中的实例，按名称排序
+func (this *Daemon) Status() []ModuleStatus {
+	this.Lock()
+	defer this.Unlock()
+
+	names := make([]string, 0, len(GetAllModules()))
+	for name := range GetAllModules() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	statuses := make([]ModuleStatus, 0, len(names))
+	for _, name := range names {
+		statuses = append(statuses, this.moduleStatus(name))
+	}
+	return statuses
+}
+
+// ModuleStatus module 运行中的实例
+func (this *Daemon) ModuleStatus(name string) (ModuleStatus, error) {
+	this.Lock()
+	defer this.Unlock()
+
+	if GetModuleByName(name) == nil {
+		return ModuleStatus{}, ErrModuleNotFound
+	}
+	return this.moduleStatus(name), nil
+}
+
+// InstanceStatus 实例的运行状态和计数
+func (this *Daemon) InstanceStatus(id string) (InstanceStatus, error) {
+	this.Lock()
+	defer this.Unlock()
+
+	ins, found := this.instances[id]
+	if !found {
+		return InstanceStatus{}, ErrInstanceNotFound
+	}
+	return ins.status(), nil
+}
+
+// moduleStatus 实例按启动顺序排列，调用方持有锁
+func (this *Daemon) moduleStatus(name string) ModuleStatus {
+	instances := make([]*moduleInstance, 0)
+	for _, ins := range this.instances {
+		if ins.name == name {
+			instances = append(instances, ins)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].seq < instances[j].seq
+	})
+	status := ModuleStatus{Name: name, Instances: make([]string, 0, len(instances))}
+	for _, ins := range instances {
+		status.Instances = append(status.Instances, ins.id)
+	}
+	return status
+}
+
+// status 启动中的实例没有计数
+func (this *moduleInstance) status() InstanceStatus {
+	if !this.running {
+		return InstanceStatus{ID: this.id, Module: this.name, Pid: this.conf.GetPid(), Uid: this.conf.GetUid()}
+	}
+	stats := this.mod.Stats()
+	startTime := this.startTime
+	return InstanceStatus{
+		ID:        this.id,
+		Module:    this.name,
+		Running:   true,
+		StartTime: &startTime,
+		Pid:       this.conf.GetPid(),
+		Uid:       this.conf.GetUid(),
+		Stats:     &stats,
+	}
+}
+
+// publish 事件写入 sink，并推送给订阅了该 module 或实例的 /events 客户端，客户端队列已满时丢弃
+func (this *Daemon) publish(module, instance string, record []byte) (int, error) {
+	this.subLock.Lock()
+	for sub := range this.subs {
+		if (sub.module != "" && sub.module != module) || (sub.instance != "" && sub.instance != instance) {
+			continue
+		}
+		select {
+		case sub.events <- record:
+		default:
+		}
+	}
+	this.subLock.Unlock()
+
+	if this.sink != nil {
+		return this.sink.Write(record)
+	}
+	return len(record), nil
+}
+
+func (this *Daemon) subscribe(module, instance string) *daemonSubscriber {
+	sub := &daemonSubscriber{module: module, instance: instance, events: make(chan []byte, DaemonEventQueueLen)}
+	this.subLock.Lock()
+	this.subs[sub] = struct{}{}
+	this.subLock.Unlock()
+	return sub
+}
+
+func (this *Daemon) unsubscribe(sub *daemonSubscriber) {
+	this.subLock.Lock()
+	delete(this.subs, sub)
+	this.subLock.Unlock()
+}
+
+// daemonSink module 实例的输出，经 Daemon.publish 推送
+type daemonSink struct {
+	daemon   *Daemon
+	module   string
+	instance string
+}
+
+func (this *daemonSink) Write(record []byte) (int, error) {
+	// 客户端异步写入，复制一份，避免调用方复用 record
+	return this.daemon.publish(this.module, this.instance, append([]byte(nil), record...))
+}
+
+// Close 共用的 sink 由 Daemon 的调用方关闭
+func (this *daemonSink) Close() error {
+	return nil
+}
+
+func (this *Daemon) handleModules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeDaemonError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	writeDaemonJson(w, http.StatusOK, this.Status())
+}
+
+// handleModule /modules/{name}、/modules/{name}/start
+func (this *Daemon) handleModule(w http.ResponseWriter, r *http.Request) {
+	name, action, ok := daemonPath(w, r, "/modules/", "start")
+	if !ok {
+		return
+	}
+
+	switch action {
+	case "":
+		status, err := this.ModuleStatus(name)
+		writeDaemonResult(w, status, err)
+	case "start":
+		req := this.defaults
+		if r.ContentLength != 0 {
+			dec := json.NewDecoder(r.Body)
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&req); err != nil {
+				writeDaemonError(w, http.StatusBadRequest, fmt.Errorf("invalid request:%v", err))
+				return
+			}
+		}
+		status, err := this.StartModule(name, req)
+		writeDaemonResult(w, status, err)
+	}
+}
+
+// handleInstance /instances/{id}、/instances/{id}/stop
+func (this *Daemon) handleInstance(w http.ResponseWriter, r *http.Request) {
+	id, action, ok := daemonPath(w, r, "/instances/", "stop")
+	if !ok {
+		return
+	}
+
+	var status InstanceStatus
+	var err error
+	switch action {
+	case "":
+		status, err = this.InstanceStatus(id)
+	case "stop":
+		status, err = this.StopInstance(id)
+	}
+	writeDaemonResult(w, status, err)
+}
+
+// daemonPath 解析 {prefix}{name} 和 {prefix}{name}/{action}，无 action 时为 GET，否则为 POST。
+// 路径或方法不匹配时输出错误，返回 false
+func daemonPath(w http.ResponseWriter, r *http.Request, prefix, action string) (string, string, bool) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	if parts[0] == "" || len(parts) > 2 || (len(parts) == 2 && parts[1] != action) {
+		writeDaemonError(w, http.StatusNotFound, fmt.Errorf("unknown path %s", r.URL.Path))
+		return "", "", false
+	}
+	method := http.MethodGet
+	if len(parts) == 2 {
+		method = http.MethodPost
+	}
+	if r.Method != method {
+		writeDaemonError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return "", "", false
+	}
+	if len(parts) == 2 {
+		return parts[0], parts[1], true
+	}
+	return parts[0], "", true
+}
+
+// handleEvents 持续输出事件，直到客户端断开或 daemon 关闭
+func (this *Daemon) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeDaemonError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	module, instance := r.URL.Query().Get("module"), r.URL.Query().Get("instance")
+	if module != "" && GetModuleByName(module) == nil {
+		writeDaemonError(w, http.StatusNotFound, ErrModuleNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeDaemonError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+
+	sub := this.subscribe(module, instance)
+	defer this.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case record := <-sub.events:
+			if _, err := w.Write(record); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-this.closing:
+			return
+		}
+	}
+}
+
+func writeDaemonJson(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeDaemonResult 输出 v，err 不为 nil 时按错误类型输出对应的状态码
+func writeDaemonResult(w http.ResponseWriter, v interface{}, err error) {
+	switch {
+	case err == nil:
+		writeDaemonJson(w, http.StatusOK, v)
+	case errors.Is(err, ErrModuleNotFound), errors.Is(err, ErrInstanceNotFound):
+		writeDaemonError(w, http.StatusNotFound, err)
+	case errors.Is(err, ErrModuleConfig):
+		writeDaemonError(w, http.StatusBadRequest, err)
+	case errors.Is(err, ErrInstanceStarting):
+		writeDaemonError(w, http.StatusConflict, err)
+	case errors.Is(err, ErrDaemonClosed):
+		writeDaemonError(w, http.StatusServiceUnavailable, err)
+	default:
+		writeDaemonError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func writeDaemonError(w http.ResponseWriter, code int, err error) {
+	writeDaemonJson(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,259 @@
+package module
+
+import (
+	"bufio"
+	"context"
+	"ecapture/user/config"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testDaemonModule = "EBPFProbeTestDaemon"
+
+// fakeDaemonModules 已创建的实例，第一个为注册时的共用实例
+var fakeDaemonModules []*fakeModule
+
+// fakeDaemonInit、fakeDaemonRunErr 新建实例的 fakeModule.init、fakeModule.runErr
+var (
+	fakeDaemonInit   chan struct{}
+	fakeDaemonRunErr error
+)
+
+func init() {
+	RegisterFunc(func() IModule {
+		mod := &fakeModule{Module: Module{name: testDaemonModule}, init: fakeDaemonInit, runErr: fakeDaemonRunErr}
+		fakeDaemonModules = append(fakeDaemonModules, mod)
+		return mod
+	})
+}
+
+func daemonConfig(modName string) config.IConfig {
+	if modName == testDaemonModule {
+		return config.NewGoTLSConfig()
+	}
+	return nil
+}
+
+// daemonRequest 通过 unix socket 请求 daemon，返回状态码和 JSON 解码后的结果
+func daemonRequest(t *testing.T, client *http.Client, method, path, body string, v interface{}) int {
+	req, err := http.NewRequest(method, "http://ecapture"+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestDaemon(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "ecapture.sock")
+	d, err := NewDaemon(socket, log.New(io.Discard, "", 0), daemonConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetDefaults(StartRequest{Uid: 7, Format: config.OutputFormatText})
+	d.Start()
+	defer d.Close()
+
+	if fi, err := os.Stat(socket); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("socket %v, error:%v", fi, err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+
+	var statuses []ModuleStatus
+	if code := daemonRequest(t, client, http.MethodGet, "/modules", "", &statuses); code != http.StatusOK {
+		t.Fatalf("list modules status code %d", code)
+	}
+	found := false
+	for _, s := range statuses {
+		if s.Name == testDaemonModule {
+			found = len(s.Instances) == 0
+		}
+	}
+	if !found {
+		t.Fatalf("module %s not listed as stopped: %+v", testDaemonModule, statuses)
+	}
+
+	// 先订阅事件，再启动 module
+	resp, err := client.Get("http://ecapture/events?module=" + testDaemonModule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := bufio.NewReader(resp.Body)
+
+	// 同一 module 以不同的配置启动两个实例
+	created := len(fakeDaemonModules)
+	var ins1, ins2, status InstanceStatus
+	var errResp map[string]string
+	body := `{"pid": 42, "config": {"path": "` + os.Args[0] + `"}}`
+	if code := daemonRequest(t, client, http.MethodPost, "/modules/"+testDaemonModule+"/start", body, &ins1); code != http.StatusOK {
+		t.Fatalf("start status code %d", code)
+	}
+	if ins1.ID == "" || ins1.Module != testDaemonModule || !ins1.Running || ins1.Pid != 42 || ins1.Uid != 7 || ins1.Stats == nil || ins1.Stats.EventsDecoded != 1 {
+		t.Fatalf("unexpected status %+v", ins1)
+	}
+	if line, err := events.ReadString('\n'); err != nil || line != "hello\n" {
+		t.Fatalf("event %q, error:%v", line, err)
+	}
+	body2 := `{"pid": 43, "config": {"path": "` + os.Args[0] + `"}}`
+	if code := daemonRequest(t, client, http.MethodPost, "/modules/"+testDaemonModule+"/start", body2, &ins2); code != http.StatusOK {
+		t.Fatalf("start again status code %d", code)
+	}
+	if ins2.ID == ins1.ID || ins2.Pid != 43 {
+		t.Fatalf("unexpected second instance %+v", ins2)
+	}
+	// 每个实例是新建的 module，不是注册时的共用实例
+	if len(fakeDaemonModules) != created+2 {
+		t.Fatalf("%d module instances created", len(fakeDaemonModules)-created)
+	}
+	mod1, mod2 := fakeDaemonModules[created], fakeDaemonModules[created+1]
+
+	var ms ModuleStatus
+	if code := daemonRequest(t, client, http.MethodGet, "/modules/"+testDaemonModule, "", &ms); code != http.StatusOK || len(ms.Instances) != 2 || ms.Instances[0] != ins1.ID || ms.Instances[1] != ins2.ID {
+		t.Fatalf("status code %d, status %+v", code, ms)
+	}
+	if code := daemonRequest(t, client, http.MethodGet, "/instances/"+ins1.ID, "", &status); code != http.StatusOK || !status.Running || status.Pid != 42 {
+		t.Fatalf("status code %d, status %+v", code, status)
+	}
+
+	if code := daemonRequest(t, client, http.MethodPost, "/instances/"+ins1.ID+"/stop", "", &status); code != http.StatusOK || status.Running || status.ID != ins1.ID {
+		t.Fatalf("stop status code %d, status %+v", code, status)
+	}
+	if mod1.closed != 1 || mod2.closed != 0 {
+		t.Fatalf("module closed %d, %d times", mod1.closed, mod2.closed)
+	}
+	if code := daemonRequest(t, client, http.MethodPost, "/instances/"+ins1.ID+"/stop", "", &errResp); code != http.StatusNotFound {
+		t.Fatalf("stop twice status code %d, %v", code, errResp)
+	}
+	if code := daemonRequest(t, client, http.MethodGet, "/instances/"+ins2.ID, "", &status); code != http.StatusOK || !status.Running {
+		t.Fatalf("status code %d, status %+v", code, status)
+	}
+
+	for _, c := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{http.MethodPost, "/modules/" + testDaemonModule + "/start", `{"config": {"bogus": 1}}`, http.StatusBadRequest},
+		{http.MethodPost, "/modules/" + testDaemonModule + "/start", `{"config": {"path": "/nonexistent"}}`, http.StatusBadRequest},
+		{http.MethodPost, "/modules/" + testDaemonModule + "/start", `{"bogus": 1}`, http.StatusBadRequest},
+		{http.MethodPost, "/modules/unknown/start", "", http.StatusNotFound},
+		{http.MethodGet, "/modules/" + testDaemonModule + "/start", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/modules/" + testDaemonModule + "/restart", "", http.StatusNotFound},
+		{http.MethodPost, "/modules/" + testDaemonModule + "/stop", "", http.StatusNotFound},
+		{http.MethodGet, "/instances/unknown", "", http.StatusNotFound},
+		{http.MethodGet, "/instances/" + ins2.ID + "/stop", "", http.StatusMethodNotAllowed},
+	} {
+		if code := daemonRequest(t, client, c.method, c.path, c.body, &errResp); code != c.code || errResp["error"] == "" {
+			t.Errorf("%s %s %s: status code %d, want %d, %v", c.method, c.path, c.body, code, c.code, errResp)
+		}
+	}
+
+	// 关闭 daemon 时停止剩余的实例
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if mod2.closed != 1 {
+		t.Fatal("running instance not closed by daemon")
+	}
+}
+
+func TestDaemon_SlowStart(t *testing.T) {
+	d, err := NewDaemon(filepath.Join(t.TempDir(), "ecapture.sock"), log.New(io.Discard, "", 0), daemonConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeDaemonInit = make(chan struct{})
+	defer func() { fakeDaemonInit = nil }()
+
+	type result struct {
+		status InstanceStatus
+		err    error
+	}
+	started := make(chan result)
+	go func() {
+		status, err := d.StartModule(testDaemonModule, StartRequest{Config: json.RawMessage(`{"path": "` + os.Args[0] + `"}`)})
+		started <- result{status, err}
+	}()
+
+	// Init 未完成时，其他请求不被阻塞，实例已预留但不能停止
+	var id string
+	for id == "" {
+		ms, err := d.ModuleStatus(testDaemonModule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ms.Instances) > 0 {
+			id = ms.Instances[0]
+		}
+	}
+	if status, err := d.InstanceStatus(id); err != nil || status.Running || status.Stats != nil {
+		t.Fatalf("starting instance %+v, error:%v", status, err)
+	}
+	if _, err = d.StopInstance(id); !errors.Is(err, ErrInstanceStarting) {
+		t.Fatalf("stop starting instance error:%v", err)
+	}
+
+	// Close 等待启动完成后停止实例，之后不再启动新的实例
+	closed := make(chan error)
+	go func() {
+		closed <- d.Close()
+	}()
+	close(fakeDaemonInit)
+	r := <-started
+	if r.err != nil || r.status.ID != id || !r.status.Running {
+		t.Fatalf("start %+v, error:%v", r.status, r.err)
+	}
+	if err = <-closed; err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.InstanceStatus(id); !errors.Is(err, ErrInstanceNotFound) {
+		t.Fatalf("instance not stopped by Close, error:%v", err)
+	}
+	if _, err = d.StartModule(testDaemonModule, StartRequest{Config: json.RawMessage(`{"path": "` + os.Args[0] + `"}`)}); !errors.Is(err, ErrDaemonClosed) {
+		t.Fatalf("start after close error:%v", err)
+	}
+}
+
+func TestDaemon_RunFailed(t *testing.T) {
+	d, err := NewDaemon(filepath.Join(t.TempDir(), "ecapture.sock"), log.New(io.Discard, "", 0), daemonConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	fakeDaemonRunErr = errors.New("attach failed")
+	defer func() { fakeDaemonRunErr = nil }()
+
+	created := len(fakeDaemonModules)
+	_, err = d.StartModule(testDaemonModule, StartRequest{Config: json.RawMessage(`{"path": "` + os.Args[0] + `"}`)})
+	if !errors.Is(err, fakeDaemonRunErr) {
+		t.Fatalf("start error:%v", err)
+	}
+	if len(fakeDaemonModules) != created+1 || fakeDaemonModules[created].closed != 1 {
+		t.Fatal("module not closed after Run failed")
+	}
+	if ms, err := d.ModuleStatus(testDaemonModule); err != nil || len(ms.Instances) != 0 {
+		t.Fatalf("failed instance listed %+v, error:%v", ms, err)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"ecapture/pkg/util/kernel"
 	"ecapture/user/config"
 	"ecapture/user/event"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/cilium/ebpf"
@@ -28,6 +29,7 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync/atomic"
 )
 
 type IModule interface {
@@ -51,6 +53,12 @@ type IModule interface {
 
 	SetChild(module IModule)
 
+	// SetSink 设置事件输出目标，需在 Init 之前调用，未设置时输出到 logger
+	SetSink(EventSink)
+
+	// SetHar 配对的 HTTP 事务写入 HAR 文件，需在 Init 之前调用，Close 时刷新
+	SetHar(*event_processor.HarWriter)
+
 	Decode(*ebpf.Map, []byte) (event.IEventStruct, error)
 
 	Events() []*ebpf.Map
@@ -58,16 +66,43 @@ type IModule interface {
 	DecodeFun(p *ebpf.Map) (event.IEventStruct, bool)
 
 	Dispatcher(event.IEventStruct)
+
+	// Stats 运行计数，用于监控
+	Stats() ModuleStats
+
+	// SetEventHandler 解码后的事件交给 handler，不再格式化输出到 sink，需在 Run 之前调用
+	SetEventHandler(func(event.IEventStruct))
+}
+
+// ModuleStats module 的运行计数
+type ModuleStats struct {
+	EventsDecoded  uint64 // 解码成功的事件
+	DecodeErrors   uint64 // 解码失败的事件
+	LostSamples    uint64 // perf 缓冲区已满，内核丢弃的事件
+	KeylogEntries  uint64 // 写入 keylog 文件的记录
+	PcapngBuffered int    // 等待写入 pcapng 文件的数据包
+	Processor      event_processor.Stats
+}
+
+// moduleCounters 原子计数，单独分配以保证 64 位对齐
+type moduleCounters struct {
+	eventsDecoded uint64
+	decodeErrors  uint64
+	lostSamples   uint64
+	keylogEntries uint64
 }
 
 const KernelLess52Prefix = "_less52.o"
 
 type Module struct {
-	opts   *ebpf.CollectionOptions
-	reader []IClose
-	ctx    context.Context
-	logger *log.Logger
-	child  IModule
+	opts    *ebpf.CollectionOptions
+	reader  []IClose
+	ctx     context.Context
+	logger  *log.Logger
+	sink    EventSink
+	handler func(event.IEventStruct)
+	har     *event_processor.HarWriter
+	child   IModule
 	// probe的名字
 	name string
 
@@ -78,13 +113,35 @@ type Module struct {
 
 	processor       *event_processor.EventProcessor
 	isKernelLess5_2 bool //is  kernel version less 5.2
+	counters        *moduleCounters
 }
 
 // Init 对象初始化
 func (this *Module) Init(ctx context.Context, logger *log.Logger, conf config.IConfig) {
 	this.ctx = ctx
 	this.logger = logger
+	this.reader = nil // daemon 模式下 module 可以停止后重新启动
+	this.counters = &moduleCounters{}
 	this.processor = event_processor.NewEventProcessor(logger, conf.GetHex())
+	pc := conf.GetProcessor()
+	this.processor.SetOptions(event_processor.Options{
+		WorkerTimeout:   pc.WorkerTimeout,
+		WorkerTick:      pc.WorkerTick,
+		WorkerChanLen:   pc.WorkerQueueLen,
+		IncomingChanLen: pc.IncomingQueueLen,
+		MaxWorkers:      pc.MaxWorkers,
+		ShutdownTimeout: pc.ShutdownTimeout,
+	})
+	if conf.GetFormat() == config.OutputFormatJson {
+		this.processor.SetJson(this.name)
+	}
+	if this.sink == nil {
+		this.sink = NewLoggerSink(logger, conf.GetFormat() == config.OutputFormatJson)
+	}
+	this.processor.SetOutput(this.sink)
+	if this.har != nil {
+		this.processor.SetHar(this.har)
+	}
 	this.isKernelLess5_2 = false //set false default
 	kv, err := kernel.HostVersion()
 	if err != nil {
@@ -106,6 +163,38 @@ func (this *Module) SetChild(module IModule) {
 	this.child = module
 }
 
+func (this *Module) SetSink(sink EventSink) {
+	this.sink = sink
+}
+
+func (this *Module) SetEventHandler(handler func(event.IEventStruct)) {
+	this.handler = handler
+}
+
+func (this *Module) SetHar(har *event_processor.HarWriter) {
+	this.har = har
+}
+
+// Stats 运行计数，未初始化时为零值
+func (this *Module) Stats() ModuleStats {
+	var stats ModuleStats
+	if this.counters != nil {
+		stats.EventsDecoded = atomic.LoadUint64(&this.counters.eventsDecoded)
+		stats.DecodeErrors = atomic.LoadUint64(&this.counters.decodeErrors)
+		stats.LostSamples = atomic.LoadUint64(&this.counters.lostSamples)
+		stats.KeylogEntries = atomic.LoadUint64(&this.counters.keylogEntries)
+	}
+	if this.processor != nil {
+		stats.Processor = this.processor.Stats()
+	}
+	return stats
+}
+
+// keylogWritten keylog 记录计数
+func (this *Module) keylogWritten(n int) {
+	atomic.AddUint64(&this.counters.keylogEntries, uint64(n))
+}
+
 func (this *Module) Start() error {
 	panic("Module.Start() not implemented yet")
 }
@@ -135,7 +224,9 @@ func (this *Module) Run() error {
 	}()
 
 	go func() {
-		this.processor.Serve()
+		if err := this.processor.Serve(this.ctx); err != nil {
+			this.logger.Printf("%s\tevent processor stopped, error:%v", this.child.Name(), err)
+		}
 	}()
 
 	err = this.readEvents()
@@ -156,7 +247,7 @@ func (this *Module) run() {
 		case _ = <-this.ctx.Done():
 			err := this.child.Stop()
 			if err != nil {
-				this.logger.Fatalf("%s\t stop Module error:%v.", this.child.Name(), err)
+				this.logger.Printf("%s\t stop Module error:%v.", this.child.Name(), err)
 			}
 			return
 		}
@@ -170,6 +261,8 @@ func (this *Module) readEvents() error {
 			select {
 			case err := <-errChan:
 				this.logger.Printf("%s\treadEvents error:%v", this.child.Name(), err)
+			case <-this.ctx.Done():
+				return
 			}
 		}
 	}()
@@ -216,6 +309,7 @@ func (this *Module) perfEventReader(errChan chan error, em *ebpf.Map) {
 			}
 
 			if record.LostSamples != 0 {
+				atomic.AddUint64(&this.counters.lostSamples, record.LostSamples)
 				this.logger.Printf("%s\tperf event ring buffer full, dropped %d samples", this.child.Name(), record.LostSamples)
 				continue
 			}
@@ -223,9 +317,11 @@ func (this *Module) perfEventReader(errChan chan error, em *ebpf.Map) {
 			var e event.IEventStruct
 			e, err = this.child.Decode(em, record.RawSample)
 			if err != nil {
+				atomic.AddUint64(&this.counters.decodeErrors, 1)
 				this.logger.Printf("%s\tthis.child.decode error:%v", this.child.Name(), err)
 				continue
 			}
+			atomic.AddUint64(&this.counters.eventsDecoded, 1)
 
 			// 上报数据
 			this.Dispatcher(e)
@@ -263,9 +359,11 @@ func (this *Module) ringbufEventReader(errChan chan error, em *ebpf.Map) {
 			var e event.IEventStruct
 			e, err = this.child.Decode(em, record.RawSample)
 			if err != nil {
+				atomic.AddUint64(&this.counters.decodeErrors, 1)
 				this.logger.Printf("%s\tthis.child.decode error:%v", this.child.Name(), err)
 				continue
 			}
+			atomic.AddUint64(&this.counters.eventsDecoded, 1)
 
 			// 上报数据
 			this.Dispatcher(e)
@@ -290,13 +388,18 @@ func (this *Module) Decode(em *ebpf.Map, b []byte) (event event.IEventStruct, er
 
 // 写入数据，或者上传到远程数据库，写入到其他chan 等。
 func (this *Module) Dispatcher(e event.IEventStruct) {
+	// 设置了 handler 时，事件交给 handler。module 自身的数据(如 master secret、连接信息)仍需处理
+	if this.handler != nil {
+		if e.EventType() == event.EventTypeModuleData {
+			this.child.Dispatcher(e)
+		}
+		this.handler(e)
+		return
+	}
+
 	switch e.EventType() {
 	case event.EventTypeOutput:
-		if this.conf.GetHex() {
-			this.logger.Println(e.StringHex())
-		} else {
-			this.logger.Println(e.String())
-		}
+		this.output(e)
 	case event.EventTypeEventProcessor:
 		this.processor.Write(e)
 	case event.EventTypeModuleData:
@@ -305,6 +408,31 @@ func (this *Module) Dispatcher(e event.IEventStruct) {
 	}
 }
 
+// output 按照输出格式，写入一条事件记录到 sink
+func (this *Module) output(e event.IEventStruct) {
+	var record []byte
+	switch {
+	case this.conf.GetFormat() == config.OutputFormatJson:
+		b := e.Base()
+		b.Module = this.child.Name()
+		j, err := json.Marshal(b)
+		if err != nil {
+			this.logger.Printf("%s\tjson marshal error:%v", this.child.Name(), err)
+			return
+		}
+		record = append(j, '\n')
+	case this.conf.GetHex():
+		record = []byte(e.StringHex() + "\n")
+	default:
+		record = []byte(e.String() + "\n")
+	}
+
+	_, err := this.sink.Write(record)
+	if err != nil {
+		this.logger.Printf("%s\twrite event to sink error:%v", this.child.Name(), err)
+	}
+}
+
 func (this *Module) Close() error {
 	this.logger.Printf("%s\tclose", this.child.Name())
 	for _, iClose := range this.reader {
@@ -0,0 +1,46 @@
+package module
+
+import (
+	"context"
+	"ecapture/user/config"
+	"log"
+)
+
+// fakeModule 测试用的 module，不加载 eBPF 程序，Run 时输出一条事件
+type fakeModule struct {
+	Module
+	init   chan struct{} // 不为 nil 时 Init 等待其关闭，模拟加载 eBPF 程序的耗时
+	runErr error         // Run 返回的错误
+	stats  *ModuleStats  // 不为 nil 时 Stats 返回该计数
+	closed int
+}
+
+func (this *fakeModule) Init(ctx context.Context, logger *log.Logger, conf config.IConfig) error {
+	if this.init != nil {
+		<-this.init
+	}
+	this.Module.Init(ctx, logger, conf)
+	this.conf = conf
+	this.counters.eventsDecoded = 1
+	return nil
+}
+
+func (this *fakeModule) Run() error {
+	if this.runErr != nil {
+		return this.runErr
+	}
+	_, err := this.sink.Write([]byte("hello\n"))
+	return err
+}
+
+func (this *fakeModule) Stats() ModuleStats {
+	if this.stats != nil {
+		return *this.stats
+	}
+	return this.Module.Stats()
+}
+
+func (this *fakeModule) Close() error {
+	this.closed++
+	return nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package module
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	SinkTypeStdout = "stdout"
+	SinkTypeFile   = "file"
+	SinkTypeUnix   = "unix"
+	SinkTypeTcp    = "tcp"
+)
+
+// EventSink 事件输出目标，每次 Write 写入一条完整的记录（以 \n 结尾）
+type EventSink interface {
+	Write(record []byte) (int, error)
+	Close() error
+}
+
+// NewEventSink 根据描述创建输出目标，格式如下：
+//
+//	stdout
+//	file:///var/log/ecapture/events.log?max_size=100&max_backups=5   (max_size 单位 MB)
+//	unix:///run/collector.sock
+//	tcp://127.0.0.1:9000
+func NewEventSink(spec string) (EventSink, error) {
+	if spec == SinkTypeStdout {
+		return NewStdoutSink(), nil
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sink:%s, error:%v", spec, err)
+	}
+
+	switch u.Scheme {
+	case SinkTypeStdout:
+		return NewStdoutSink(), nil
+	case SinkTypeFile:
+		var maxSize, maxBackups = DefaultSinkFileMaxSize, DefaultSinkFileMaxBackups
+		if v := u.Query().Get("max_size"); v != "" {
+			maxSize, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid max_size of sink:%s, error:%v", spec, err)
+			}
+			maxSize = maxSize * 1024 * 1024
+		}
+		if v := u.Query().Get("max_backups"); v != "" {
+			maxBackups, err = strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid max_backups of sink:%s, error:%v", spec, err)
+			}
+		}
+		path := u.Path
+		if path == "" {
+			// file:events.log
+			path = u.Opaque
+		}
+		return NewFileSink(path, maxSize, maxBackups)
+	case SinkTypeUnix:
+		path := u.Path
+		if path == "" {
+			path = u.Opaque
+		}
+		return NewNetSink(SinkTypeUnix, path), nil
+	case SinkTypeTcp:
+		return NewNetSink(SinkTypeTcp, u.Host), nil
+	}
+	return nil, fmt.Errorf("unsupported sink:%s, must be one of stdout, file://, unix:// and tcp://", spec)
+}
+
+// NewEventSinks 创建多个输出目标，数量大于1时合并为 MultiSink
+func NewEventSinks(specs []string) (EventSink, error) {
+	var sinks = make([]EventSink, 0, len(specs))
+	for _, spec := range specs {
+		s, err := NewEventSink(strings.TrimSpace(spec))
+		if err != nil {
+			for _, opened := range sinks {
+				_ = opened.Close()
+			}
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+
+	switch len(sinks) {
+	case 0:
+		return nil, nil
+	case 1:
+		return sinks[0], nil
+	}
+	return NewMultiSink(sinks...), nil
+}
+
+// MultiSink 同时写入多个输出目标，单个目标失败不影响其他目标
+type MultiSink struct {
+	sinks []EventSink
+}
+
+func NewMultiSink(sinks ...EventSink) *MultiSink {
+	return &MultiSink{sinks: sinks}
+}
+
+func (this *MultiSink) Write(record []byte) (int, error) {
+	var errs []string
+	for _, s := range this.sinks {
+		if _, err := s.Write(record); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return 0, fmt.Errorf("MultiSink write failed:%s", strings.Join(errs, "; "))
+	}
+	return len(record), nil
+}
+
+func (this *MultiSink) Close() error {
+	var errs []string
+	for _, s := range this.sinks {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("MultiSink close failed:%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// StdoutSink 原样写入标准输出
+type StdoutSink struct {
+	sync.Mutex
+}
+
+func NewStdoutSink() *StdoutSink {
+	return &StdoutSink{}
+}
+
+func (this *StdoutSink) Write(record []byte) (int, error) {
+	this.Lock()
+	defer this.Unlock()
+	return os.Stdout.Write(record)
+}
+
+func (this *StdoutSink) Close() error {
+	return nil
+}
+
+// LoggerSink 未指定 --sink 时的默认输出，文本记录经由 logger 输出(带日志前缀)，
+// JSON记录直接写入 logger 的 Writer，保持每行一条记录。
+type LoggerSink struct {
+	logger *log.Logger
+	raw    bool
+}
+
+// loggerSinkLock 多个 module 的 LoggerSink 共用同一个 logger，JSON 记录绕过了 logger 的锁，
+// 由该锁串行写入，每条记录一次 Write，不与其他记录交错
+var loggerSinkLock sync.Mutex
+
+func NewLoggerSink(logger *log.Logger, raw bool) *LoggerSink {
+	return &LoggerSink{logger: logger, raw: raw}
+}
+
+func (this *LoggerSink) Write(record []byte) (int, error) {
+	if this.raw {
+		loggerSinkLock.Lock()
+		defer loggerSinkLock.Unlock()
+		return this.logger.Writer().Write(record)
+	}
+	this.logger.Print(string(record))
+	return len(record), nil
+}
+
+func (this *LoggerSink) Close() error {
+	return nil
+}
@@ -0,0 +1,237 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package module
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MetricsPath        = "/metrics"
+	MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+	MetricsTimeout     = 3 * time.Second // 读取请求头、关闭服务的超时
+	MetricsNamespace   = "ecapture_"
+)
+
+const (
+	metricsTypeCounter = "counter"
+	metricsTypeGauge   = "gauge"
+)
+
+// MetricsServer 以 Prometheus 文本格式输出各 module 的运行计数，见
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+type MetricsServer struct {
+	sync.Mutex
+	modules  []metricsModule
+	listener net.Listener
+	server   *http.Server
+}
+
+// NewMetricsServer 监听 addr，Start 之后开始处理请求
+func NewMetricsServer(addr string) (*MetricsServer, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("metrics server listen %s error:%v", addr, err)
+	}
+	this := &MetricsServer{listener: l}
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, this)
+	this.server = &http.Server{Handler: mux, ReadHeaderTimeout: MetricsTimeout}
+	return this, nil
+}
+
+// Addr 实际监听的地址
+func (this *MetricsServer) Addr() string {
+	return this.listener.Addr().String()
+}
+
+func (this *MetricsServer) Start() {
+	go func() {
+		_ = this.server.Serve(this.listener)
+	}()
+}
+
+// metricsModule instance 为 daemon 启动的实例ID，同一 module 的多个实例以 instance 标签区分
+type metricsModule struct {
+	mod      IModule
+	instance string
+}
+
+// Add 输出 mod 的计数，this 为 nil 时忽略(未指定 --metrics-addr)
+func (this *MetricsServer) Add(mod IModule) {
+	this.AddInstance(mod, "")
+}
+
+// AddInstance 输出 daemon 启动的 module 实例的计数，带 instance 标签，this 为 nil 时忽略
+func (this *MetricsServer) AddInstance(mod IModule, instance string) {
+	if this == nil {
+		return
+	}
+	this.Lock()
+	defer this.Unlock()
+	this.modules = append(this.modules, metricsModule{mod: mod, instance: instance})
+}
+
+// Remove 不再输出 mod 的计数(daemon 停止 module)，this 为 nil 时忽略
+func (this *MetricsServer) Remove(mod IModule) {
+	if this == nil {
+		return
+	}
+	this.Lock()
+	defer this.Unlock()
+	for i, m := range this.modules {
+		if m.mod == mod {
+			this.modules = append(this.modules[:i], this.modules[i+1:]...)
+			return
+		}
+	}
+}
+
+// Close 停止服务，this 为 nil 时忽略
+func (this *MetricsServer) Close() error {
+	if this == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), MetricsTimeout)
+	defer cancel()
+	return this.server.Shutdown(ctx)
+}
+
+func (this *MetricsServer) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	this.Lock()
+	stats := make([]moduleMetricsStats, 0, len(this.modules))
+	for _, m := range this.modules {
+		stats = append(stats, moduleMetricsStats{module: m.mod.Name(), instance: m.instance, stats: m.mod.Stats()})
+	}
+	this.Unlock()
+
+	var b bytes.Buffer
+	writeMetrics(&b, stats)
+	w.Header().Set("Content-Type", MetricsContentType)
+	_, _ = w.Write(b.Bytes())
+}
+
+type metricSample struct {
+	labels [][2]string
+	value  float64
+}
+
+type metric struct {
+	name    string
+	help    string
+	typ     string
+	samples func(stats ModuleStats) []metricSample
+}
+
+// moduleSample 只有 module 标签的样本
+func moduleSample(v float64) []metricSample {
+	return []metricSample{{value: v}}
+}
+
+var moduleMetrics = []metric{
+	{"events_decoded_total", "Events decoded from eBPF maps.", metricsTypeCounter, func(s ModuleStats) []metricSample {
+		return moduleSample(float64(s.EventsDecoded))
+	}},
+	{"decode_errors_total", "Events failed to decode.", metricsTypeCounter, func(s ModuleStats) []metricSample {
+		return moduleSample(float64(s.DecodeErrors))
+	}},
+	{"lost_samples_total", "Samples dropped by the kernel because the perf buffer was full.", metricsTypeCounter, func(s ModuleStats) []metricSample {
+		return moduleSample(float64(s.LostSamples))
+	}},
+	{"keylog_entries_total", "Entries written to the TLS keylog file.", metricsTypeCounter, func(s ModuleStats) []metricSample {
+		return moduleSample(float64(s.KeylogEntries))
+	}},
+	{"pcapng_packets_buffered", "Packets buffered in memory, waiting to be written to the pcapng file.", metricsTypeGauge, func(s ModuleStats) []metricSample {
+		return moduleSample(float64(s.PcapngBuffered))
+	}},
+	{"event_workers", "Active event workers, one per connection.", metricsTypeGauge, func(s ModuleStats) []metricSample {
+		return moduleSample(float64(s.Processor.Workers))
+	}},
+	{"processor_events_total", "Events received by the event processor.", metricsTypeCounter, func(s ModuleStats) []metricSample {
+		return moduleSample(float64(s.Processor.Events))
+	}},
+	{"processor_dropped_events_total", "Events dropped because a processor or worker queue was full, or too many workers.", metricsTypeCounter, func(s ModuleStats) []metricSample {
+		return moduleSample(float64(s.Processor.DroppedEvents + s.Processor.DroppedWorkerEvents + s.Processor.RejectedEvents))
+	}},
+	{"parse_errors_total", "Messages failed to parse, fallback to DefaultParser.", metricsTypeCounter, func(s ModuleStats) []metricSample {
+		return moduleSample(float64(s.Processor.ParseErrors))
+	}},
+	{"parsed_messages_total", "Messages output by each parser.", metricsTypeCounter, func(s ModuleStats) []metricSample {
+		names := make([]string, 0, len(s.Processor.Parsed))
+		for name := range s.Processor.Parsed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		samples := make([]metricSample, 0, len(names))
+		for _, name := range names {
+			samples = append(samples, metricSample{
+				labels: [][2]string{{"parser", name}},
+				value:  float64(s.Processor.Parsed[name]),
+			})
+		}
+		return samples
+	}},
+}
+
+type moduleMetricsStats struct {
+	module   string
+	instance string
+	stats    ModuleStats
+}
+
+// writeMetrics 按 module 名称、实例ID排序输出，保证每次抓取的顺序相同
+func writeMetrics(w io.Writer, stats []moduleMetricsStats) {
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].module != stats[j].module {
+			return stats[i].module < stats[j].module
+		}
+		return stats[i].instance < stats[j].instance
+	})
+
+	for _, m := range moduleMetrics {
+		name := MetricsNamespace + m.name
+		fmt.Fprintf(w, "# HELP %s %s\n", name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, m.typ)
+		for _, ms := range stats {
+			for _, sample := range m.samples(ms.stats) {
+				labels := [][2]string{{"module", ms.module}}
+				if ms.instance != "" {
+					labels = append(labels, [2]string{"instance", ms.instance})
+				}
+				labels = append(labels, sample.labels...)
+				fmt.Fprintf(w, "%s{%s} %v\n", name, metricsLabels(labels), sample.value)
+			}
+		}
+	}
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func metricsLabels(labels [][2]string) string {
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, l[0], metricsLabelEscaper.Replace(l[1])))
+	}
+	return strings.Join(pairs, ",")
+}
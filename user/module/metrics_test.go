@@ -0,0 +1,102 @@
+package module
+
+import (
+	"bufio"
+	"ecapture/pkg/event_processor"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// scrape 读取 metrics，返回 样本名{标签} -> 值
+func scrape(t *testing.T, addr string) map[string]string {
+	resp, err := http.Get("http://" + addr + MetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %s", ct)
+	}
+	samples := make(map[string]string)
+	s := bufio.NewScanner(resp.Body)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			t.Fatalf("invalid sample %q", line)
+		}
+		samples[line[:i]] = line[i+1:]
+	}
+	return samples
+}
+
+func TestMetricsServer(t *testing.T) {
+	ms, err := NewMetricsServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.Start()
+	defer ms.Close()
+
+	openssl := &fakeModule{Module: Module{name: ModuleNameOpenssl}, stats: &ModuleStats{
+		EventsDecoded:  10,
+		DecodeErrors:   1,
+		LostSamples:    3,
+		KeylogEntries:  5,
+		PcapngBuffered: 7,
+		Processor: event_processor.Stats{
+			Workers:       2,
+			DroppedEvents: 4,
+			Parsed:        map[string]uint64{"HTTPRequest": 6, "HTTP2Response": 1},
+		},
+	}}
+	bash := &fakeModule{Module: Module{name: ModuleNameBash}}
+	bash2 := &fakeModule{Module: Module{name: ModuleNameBash}, stats: &ModuleStats{EventsDecoded: 8}}
+	ms.Add(openssl)
+	ms.Add(bash)
+	ms.AddInstance(bash2, "EBPFProbeBash-1")
+
+	samples := scrape(t, ms.Addr())
+	want := map[string]string{
+		`ecapture_events_decoded_total{module="EBPFProbeOPENSSL"}`:                         "10",
+		`ecapture_decode_errors_total{module="EBPFProbeOPENSSL"}`:                          "1",
+		`ecapture_lost_samples_total{module="EBPFProbeOPENSSL"}`:                           "3",
+		`ecapture_keylog_entries_total{module="EBPFProbeOPENSSL"}`:                         "5",
+		`ecapture_pcapng_packets_buffered{module="EBPFProbeOPENSSL"}`:                      "7",
+		`ecapture_event_workers{module="EBPFProbeOPENSSL"}`:                                "2",
+		`ecapture_processor_dropped_events_total{module="EBPFProbeOPENSSL"}`:               "4",
+		`ecapture_parsed_messages_total{module="EBPFProbeOPENSSL",parser="HTTPRequest"}`:   "6",
+		`ecapture_parsed_messages_total{module="EBPFProbeOPENSSL",parser="HTTP2Response"}`: "1",
+		`ecapture_events_decoded_total{module="EBPFProbeBash"}`:                            "0",
+		`ecapture_events_decoded_total{module="EBPFProbeBash",instance="EBPFProbeBash-1"}`: "8",
+	}
+	for k, v := range want {
+		if samples[k] != v {
+			t.Fatalf("%s = %q, want %q\n%v", k, samples[k], v, samples)
+		}
+	}
+
+	// nil server is disabled
+	var disabled *MetricsServer
+	disabled.Add(bash)
+	if err = disabled.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModule_Stats(t *testing.T) {
+	m := &Module{counters: &moduleCounters{eventsDecoded: 2, lostSamples: 1}}
+	m.keylogWritten(5)
+	stats := m.Stats()
+	if stats.EventsDecoded != 2 || stats.LostSamples != 1 || stats.KeylogEntries != 5 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	// not initialized
+	if stats = (&Module{}).Stats(); stats.EventsDecoded != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package module
+
+import (
+	"bytes"
+	"context"
+	"ecapture/assets"
+	"ecapture/user/config"
+	"ecapture/user/event"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/cilium/ebpf"
+	manager "github.com/gojue/ebpfmanager"
+	"golang.org/x/sys/unix"
+)
+
+// ProbeEventMap eBPF 事件 map 及其事件结构，读取到的数据由 Event.Clone() 解码
+type ProbeEventMap struct {
+	Name  string
+	Event event.IEventStruct
+}
+
+// ProbeDescriptor 声明式描述一个 module，由 ProbeModule 加载字节码、挂载 hook 点、读取事件
+type ProbeDescriptor struct {
+	Name     string // module 名称
+	Type     string // ProbeTypeUprobe 等
+	Bytecode string // 字节码文件，如 user/bytecode/bash_kern.o，内核低于 5.2 时使用 _less52.o
+
+	// Probes 根据已通过 Check 的配置(m.conf)返回 hook 点
+	Probes func(m *ProbeModule) ([]*manager.Probe, error)
+
+	EventMaps []ProbeEventMap
+
+	// Constants target_pid、target_uid 之外需要替换的常量，可为 nil
+	Constants func(m *ProbeModule) []manager.ConstantEditor
+}
+
+// ProbeModule 由 ProbeDescriptor 驱动的 module，见 RegisterProbe。
+// hook 点在运行时才能确定的 module(如 openssl、gotls)嵌入 ProbeModule，Start 前设置 desc
+type ProbeModule struct {
+	Module
+	desc              *ProbeDescriptor
+	bpfManager        *manager.Manager
+	bpfManagerOptions manager.Options
+	eventFuncMaps     map[*ebpf.Map]event.IEventStruct
+	eventMaps         []*ebpf.Map
+}
+
+// RegisterProbe 注册由 desc 描述的 module
+func RegisterProbe(desc ProbeDescriptor) {
+	RegisterFunc(func() IModule {
+		return NewProbeModule(desc)
+	})
+}
+
+func NewProbeModule(desc ProbeDescriptor) *ProbeModule {
+	mod := &ProbeModule{desc: &desc}
+	mod.name = desc.Name
+	mod.mType = desc.Type
+	return mod
+}
+
+// 对象初始化
+func (this *ProbeModule) Init(ctx context.Context, logger *log.Logger, conf config.IConfig) error {
+	this.Module.Init(ctx, logger, conf)
+	this.conf = conf
+	this.Module.SetChild(this)
+	return nil
+}
+
+func (this *ProbeModule) Start() error {
+	// fetch ebpf assets
+	var bpfFileName = this.geteBPFName(this.desc.Bytecode)
+	this.logger.Printf("%s\tBPF bytecode filename:%s\n", this.Name(), bpfFileName)
+	byteBuf, err := assets.Asset(bpfFileName)
+	if err != nil {
+		return fmt.Errorf("couldn't find asset %v", err)
+	}
+
+	// setup the managers
+	probes, err := this.desc.Probes(this)
+	if err != nil {
+		return fmt.Errorf("%s module couldn't setup probes %v", this.Name(), err)
+	}
+	maps := make([]*manager.Map, 0, len(this.desc.EventMaps))
+	for _, em := range this.desc.EventMaps {
+		maps = append(maps, &manager.Map{Name: em.Name})
+	}
+	this.bpfManager = &manager.Manager{
+		Probes: probes,
+		Maps:   maps,
+	}
+	this.bpfManagerOptions = defaultManagerOptions()
+	if this.conf.EnableGlobalVar() {
+		// 填充 RewriteContants 对应map
+		editors := this.targetConstants()
+		if this.desc.Constants != nil {
+			editors = append(editors, this.desc.Constants(this)...)
+		}
+		this.bpfManagerOptions.ConstantEditors = editors
+	}
+
+	// initialize the bootstrap manager
+	if err = this.bpfManager.InitWithOptions(bytes.NewReader(byteBuf), this.bpfManagerOptions); err != nil {
+		return fmt.Errorf("couldn't init manager %v", err)
+	}
+
+	// start the bootstrap manager
+	if err = this.bpfManager.Start(); err != nil {
+		return fmt.Errorf("couldn't start bootstrap manager %v", err)
+	}
+
+	// 加载map信息，map对应events decode表。
+	return this.initDecodeFun()
+}
+
+// Close Start 失败或未调用时 bpfManager 可能为 nil
+func (this *ProbeModule) Close() error {
+	if this.bpfManager != nil {
+		if err := this.bpfManager.Stop(manager.CleanAll); err != nil {
+			return fmt.Errorf("couldn't stop manager %v", err)
+		}
+	}
+	return this.Module.Close()
+}
+
+func (this *ProbeModule) DecodeFun(em *ebpf.Map) (event.IEventStruct, bool) {
+	fun, found := this.eventFuncMaps[em]
+	return fun, found
+}
+
+func (this *ProbeModule) initDecodeFun() error {
+	this.eventMaps = make([]*ebpf.Map, 0, len(this.desc.EventMaps))
+	this.eventFuncMaps = make(map[*ebpf.Map]event.IEventStruct)
+	for _, em := range this.desc.EventMaps {
+		m, found, err := this.bpfManager.GetMap(em.Name)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("cant found map:%s", em.Name)
+		}
+		this.eventMaps = append(this.eventMaps, m)
+		this.eventFuncMaps[m] = em.Event
+	}
+	return nil
+}
+
+func (this *ProbeModule) Events() []*ebpf.Map {
+	return this.eventMaps
+}
+
+// defaultManagerOptions 各 module 共用的 ebpfmanager 参数
+func defaultManagerOptions() manager.Options {
+	return manager.Options{
+		DefaultKProbeMaxActive: 512,
+
+		VerifierOptions: ebpf.CollectionOptions{
+			Programs: ebpf.ProgramOptions{
+				LogSize: 2097152,
+			},
+		},
+
+		RLimit: &unix.Rlimit{
+			Cur: math.MaxUint64,
+			Max: math.MaxUint64,
+		},
+	}
+}
+
+// targetConstants 通过elf的常量替换方式传递 target_pid、target_uid
+func (this *Module) targetConstants() []manager.ConstantEditor {
+	var editor = []manager.ConstantEditor{
+		{
+			Name:  "target_pid",
+			Value: uint64(this.conf.GetPid()),
+			//FailOnMissing: true,
+		},
+		{
+			Name:  "target_uid",
+			Value: uint64(this.conf.GetUid()),
+		},
+	}
+
+	if this.conf.GetPid() <= 0 {
+		this.logger.Printf("%s\ttarget all process. \n", this.Name())
+	} else {
+		this.logger.Printf("%s\ttarget PID:%d \n", this.Name(), this.conf.GetPid())
+	}
+
+	if this.conf.GetUid() <= 0 {
+		this.logger.Printf("%s\ttarget all users. \n", this.Name())
+	} else {
+		this.logger.Printf("%s\ttarget UID:%d \n", this.Name(), this.conf.GetUid())
+	}
+
+	return editor
+}
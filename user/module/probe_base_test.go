@@ -0,0 +1,101 @@
+package module
+
+import (
+	"context"
+	"ecapture/user/config"
+	"ecapture/user/event"
+	"io"
+	"log"
+	"testing"
+
+	manager "github.com/gojue/ebpfmanager"
+)
+
+func TestRegisterProbe(t *testing.T) {
+	const name = "EBPFProbeTestDescriptor"
+	RegisterProbe(ProbeDescriptor{
+		Name:     name,
+		Type:     ProbeTypeUprobe,
+		Bytecode: "user/bytecode/bash_kern.o",
+		Probes: func(m *ProbeModule) ([]*manager.Probe, error) {
+			return nil, nil
+		},
+		EventMaps: []ProbeEventMap{
+			{Name: "events", Event: &event.BashEvent{}},
+		},
+	})
+
+	mod1, mod2 := NewModule(name), NewModule(name)
+	if mod1 == nil || mod1 == mod2 {
+		t.Fatalf("NewModule(%s) = %v, %v", name, mod1, mod2)
+	}
+	pm := mod1.(*ProbeModule)
+	if pm.Name() != name || pm.mType != ProbeTypeUprobe {
+		t.Fatalf("name:%s, type:%s", pm.Name(), pm.mType)
+	}
+
+	conf := config.NewBashConfig()
+	conf.SetPid(1234)
+	if err := pm.Init(context.Background(), log.New(io.Discard, "", 0), conf); err != nil {
+		t.Fatal(err)
+	}
+	if pm.child != IModule(pm) || pm.conf != conf {
+		t.Fatal("Init not wired to the module")
+	}
+	if _, found := pm.DecodeFun(nil); found {
+		t.Fatal("DecodeFun found before Start")
+	}
+	// Start 失败或未调用时 bpfManager 为 nil
+	if err := pm.Close(); err != nil {
+		t.Fatalf("Close before Start: %v", err)
+	}
+
+	editors := pm.targetConstants()
+	want := map[string]uint64{"target_pid": 1234, "target_uid": 0}
+	if len(editors) != len(want) {
+		t.Fatalf("constants %v", editors)
+	}
+	for _, e := range editors {
+		if v, ok := want[e.Name]; !ok || e.Value != v {
+			t.Errorf("constant %s = %v", e.Name, e.Value)
+		}
+	}
+}
+
+func TestProbeModules(t *testing.T) {
+	for _, name := range []string{ModuleNameBash, ModuleNameGnutls, ModuleNameNspr} {
+		pm, ok := NewModule(name).(*ProbeModule)
+		if !ok {
+			t.Errorf("%s is not a ProbeModule", name)
+			continue
+		}
+		if pm.desc.Bytecode == "" || pm.desc.Probes == nil || len(pm.desc.EventMaps) == 0 {
+			t.Errorf("%s descriptor incomplete: %+v", name, pm.desc)
+		}
+	}
+
+	// 运行时生成 ProbeDescriptor 的 module
+	gotls := NewModule(ModuleNameGotls).(*GoTLSProbe)
+	gotls.conf = config.NewGoTLSConfig()
+	gotls.conf.(*config.GoTLSConfig).Port = 443
+	desc := gotls.descriptor(nil, []ProbeEventMap{{Name: "events", Event: &event.GoTLSEvent{}}})
+	if desc.Name != ModuleNameGotls || desc.Bytecode != "user/bytecode/gotls_kern.o" || len(desc.EventMaps) != 1 {
+		t.Fatalf("gotls descriptor %+v", desc)
+	}
+	if c := desc.Constants(&gotls.ProbeModule); len(c) != 1 || c[0].Name != "target_port" || c[0].Value != uint64(443) {
+		t.Fatalf("gotls constants %+v", c)
+	}
+	openssl := NewModule(ModuleNameOpenssl).(*MOpenSSLProbe)
+	openssl.sslBpfFile = "openssl_3_0_0_kern.o"
+	if desc = openssl.descriptor(nil, nil); desc.Bytecode != "user/bytecode/openssl_3_0_0_kern.o" {
+		t.Fatalf("openssl descriptor %+v", desc)
+	}
+	if _, ok := openssl.masterkeyEvent().(*event.MasterSecretEvent); !ok {
+		t.Fatal("openssl master key event")
+	}
+
+	opts := defaultManagerOptions()
+	if opts.DefaultKProbeMaxActive != 512 || opts.RLimit == nil || opts.VerifierOptions.Programs.LogSize != 2097152 {
+		t.Fatalf("defaultManagerOptions %+v", opts)
+	}
+}
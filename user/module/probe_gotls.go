@@ -2,29 +2,29 @@
 package module
 
 import (
-	"bytes"
 	"context"
-	"ecapture/assets"
 	"ecapture/pkg/proc"
 	"ecapture/user/config"
 	"ecapture/user/event"
 	"errors"
 	"fmt"
 	"log"
-	"math"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
 
-	"github.com/cilium/ebpf"
 	manager "github.com/gojue/ebpfmanager"
 	"golang.org/x/sys/unix"
 )
 
 func init() {
-	mod := &GoTLSProbe{}
-	Register(mod)
+	RegisterFunc(func() IModule {
+		mod := &GoTLSProbe{}
+		mod.name = ModuleNameGotls
+		mod.mType = ProbeTypeUprobe
+		return mod
+	})
 }
 
 const (
@@ -38,12 +38,8 @@ var (
 
 // GoTLSProbe represents a probe for Go SSL
 type GoTLSProbe struct {
-	Module
+	ProbeModule
 	MTCProbe
-	bpfManager        *manager.Manager
-	bpfManagerOptions manager.Options
-	eventFuncMaps     map[*ebpf.Map]event.IEventStruct
-	eventMaps         []*ebpf.Map
 
 	keyloggerFilename string
 	keylogger         *os.File
@@ -54,13 +50,9 @@ type GoTLSProbe struct {
 }
 
 func (this *GoTLSProbe) Init(ctx context.Context, l *log.Logger, cfg config.IConfig) error {
-	this.Module.Init(ctx, l, cfg)
-	this.conf = cfg
+	_ = this.ProbeModule.Init(ctx, l, cfg)
 	this.Module.SetChild(this)
 
-	this.eventMaps = make([]*ebpf.Map, 0, 2)
-	this.eventFuncMaps = make(map[*ebpf.Map]event.IEventStruct)
-
 	this.masterSecrets = make(map[string]bool)
 	this.path = cfg.(*config.GoTLSConfig).Path
 	ver, err := proc.ExtraceGoVersion(this.path)
@@ -88,6 +80,7 @@ func (this *GoTLSProbe) Init(ctx context.Context, l *log.Logger, cfg config.ICon
 			return err
 		}
 		this.pcapngFilename = fileInfo
+		this.pcapngRotate = this.conf.(*config.GoTLSConfig).PcapngRotate
 	} else {
 		this.eBPFProgramType = EbpfprogramtypeOpensslUprobe
 		this.logger.Printf("%s\tmaster key keylogger: %s\n", this.Name(), this.keyloggerFilename)
@@ -106,7 +99,6 @@ func (this *GoTLSProbe) Init(ctx context.Context, l *log.Logger, cfg config.ICon
 
 	this.tcPackets = make([]*TcPacket, 0, 1024)
 	this.tcPacketLocker = &sync.Mutex{}
-	this.masterKeyBuffer = bytes.NewBuffer([]byte{})
 	return nil
 }
 
@@ -119,53 +111,29 @@ func (this *GoTLSProbe) Start() error {
 }
 
 func (this *GoTLSProbe) start() error {
+	var desc *ProbeDescriptor
 	var err error
 	switch this.eBPFProgramType {
 	case EbpfprogramtypeOpensslTc:
 		this.logger.Printf("%s\tTC MODEL\n", this.Name())
-		err = this.setupManagersTC()
+		desc, err = this.setupManagersTC()
 	case EbpfprogramtypeOpensslUprobe:
 		this.logger.Printf("%s\tUPROBE MODEL\n", this.Name())
-		err = this.setupManagersUprobe()
+		desc, err = this.setupManagersUprobe()
 	default:
 		this.logger.Printf("%s\tUPROBE MODEL\n", this.Name())
-		err = this.setupManagersUprobe()
-	}
-	if err != nil {
-		return err
+		desc, err = this.setupManagersUprobe()
 	}
-
-	var bpfFileName = this.geteBPFName("user/bytecode/gotls_kern.o")
-	this.logger.Printf("%s\tBPF bytecode filename:%s\n", this.Name(), bpfFileName)
-	byteBuf, err := assets.Asset(bpfFileName)
 	if err != nil {
 		return err
 	}
 
-	if err = this.bpfManager.InitWithOptions(bytes.NewReader(byteBuf), this.bpfManagerOptions); err != nil {
-		return fmt.Errorf("couldn't init manager %v", err)
-	}
-	// start the bootstrap manager
-	if err = this.bpfManager.Start(); err != nil {
-		return fmt.Errorf("couldn't start bootstrap manager %v .", err)
-	}
-
-	// 加载map信息，map对应events decode表。
-	switch this.eBPFProgramType {
-	case EbpfprogramtypeOpensslTc:
-		err = this.initDecodeFunTC()
-	case EbpfprogramtypeOpensslUprobe:
-		err = this.initDecodeFun()
-	default:
-		err = this.initDecodeFun()
-	}
-	if err != nil {
-		return err
-	}
-	return nil
+	// 加载字节码、挂载 hook 点、建立 map 与 events decode 的对应
+	this.desc = desc
+	return this.ProbeModule.Start()
 }
 
-func (this *GoTLSProbe) setupManagersUprobe() error {
+func (this *GoTLSProbe) setupManagersUprobe() (*ProbeDescriptor, error) {
 	var (
 		sec, ms_sec string
 		fn, ms_fn   string
@@ -183,130 +151,52 @@ func (this *GoTLSProbe) setupManagersUprobe() error {
 		ms_fn = "gotls_mastersecret_stack"
 	}
 	this.logger.Printf("%s\teBPF Function Name:%s, isRegisterABI:%t\n", this.Name(), fn, this.isRegisterABI)
-	this.bpfManager = &manager.Manager{
-		Probes: []*manager.Probe{
-			{
-				Section:          sec,
-				EbpfFuncName:     fn,
-				AttachToFuncName: goTlsHookFunc,
-				BinaryPath:       this.path,
-			},
-			// gotls master secrets
-			// crypto/tls.(*Config).writeKeyLog
-			// crypto/tls/common.go
-			/*
-				func (c *Config) writeKeyLog(label string, clientRandom, secret []byte) error {
-				}
-			*/
-			{
-				Section:          ms_sec,
-				EbpfFuncName:     ms_fn,
-				AttachToFuncName: goTlsMasterSecretFunc,
-				BinaryPath:       this.path,
-				UID:              "uprobe_gotls_master_secret",
-			},
-		},
-		Maps: []*manager.Map{
-			{
-				Name: "mastersecret_go_events",
-			},
-			{
-				Name: "events",
-			},
-		},
-	}
-
-	this.bpfManagerOptions = manager.Options{
-		DefaultKProbeMaxActive: 512,
-
-		VerifierOptions: ebpf.CollectionOptions{
-			Programs: ebpf.ProgramOptions{
-				LogSize: 2097152,
-			},
-		},
-
-		RLimit: &unix.Rlimit{
-			Cur: math.MaxUint64,
-			Max: math.MaxUint64,
-		},
-	}
-
-	if this.conf.EnableGlobalVar() {
-		// 填充 RewriteContants 对应map
-		this.bpfManagerOptions.ConstantEditors = this.constantEditor()
-	}
-	return nil
-}
-
-// 通过elf的常量替换方式传递数据
-func (this *GoTLSProbe) constantEditor() []manager.ConstantEditor {
-	var editor = []manager.ConstantEditor{
-		{
-			Name:  "target_pid",
-			Value: uint64(this.conf.GetPid()),
-			//FailOnMissing: true,
-		},
+	probes := []*manager.Probe{
 		{
-			Name:  "target_uid",
-			Value: uint64(this.conf.GetUid()),
+			Section:          sec,
+			EbpfFuncName:     fn,
+			AttachToFuncName: goTlsHookFunc,
+			BinaryPath:       this.path,
 		},
+		// gotls master secrets
+		// crypto/tls.(*Config).writeKeyLog
+		// crypto/tls/common.go
+		/*
+			func (c *Config) writeKeyLog(label string, clientRandom, secret []byte) error {
+			}
+		*/
 		{
-			Name:  "target_port",
-			Value: uint64(this.conf.(*config.GoTLSConfig).Port),
+			Section:          ms_sec,
+			EbpfFuncName:     ms_fn,
+			AttachToFuncName: goTlsMasterSecretFunc,
+			BinaryPath:       this.path,
+			UID:              "uprobe_gotls_master_secret",
 		},
 	}
-
-	if this.conf.GetPid() <= 0 {
-		this.logger.Printf("%s\ttarget all process. \n", this.Name())
-	} else {
-		this.logger.Printf("%s\ttarget PID:%d \n", this.Name(), this.conf.GetPid())
-	}
-
-	if this.conf.GetUid() <= 0 {
-		this.logger.Printf("%s\ttarget all users. \n", this.Name())
-	} else {
-		this.logger.Printf("%s\ttarget UID:%d \n", this.Name(), this.conf.GetUid())
-	}
-
-	return editor
+	return this.descriptor(probes, []ProbeEventMap{
+		{Name: "events", Event: &event.GoTLSEvent{}},
+		{Name: "mastersecret_go_events", Event: &event.MasterSecretGotlsEvent{}},
+	}), nil
 }
 
-func (this *GoTLSProbe) initDecodeFun() error {
-
-	m, found, err := this.bpfManager.GetMap("events")
-	if err != nil {
-		return err
-	}
-	if !found {
-		return errors.New("cant found map:tls_events")
-	}
-
-	this.eventMaps = append(this.eventMaps, m)
-	gotlsEvent := &event.GoTLSEvent{}
-	//sslEvent.SetModule(this)
-	this.eventFuncMaps[m] = gotlsEvent
-	// master secrets map at ebpf code
-	MasterkeyEventsMap, found, err := this.bpfManager.GetMap("mastersecret_go_events")
-	if err != nil {
-		return err
-	}
-	if !found {
-		return errors.New("cant found map:mastersecret_events")
+// descriptor hook 点、事件 map 已确定后生成的 ProbeDescriptor
+func (this *GoTLSProbe) descriptor(probes []*manager.Probe, eventMaps []ProbeEventMap) *ProbeDescriptor {
+	return &ProbeDescriptor{
+		Name:     this.Name(),
+		Type:     this.mType,
+		Bytecode: "user/bytecode/gotls_kern.o",
+		Probes: func(*ProbeModule) ([]*manager.Probe, error) {
+			return probes, nil
+		},
+		EventMaps: eventMaps,
+		Constants: func(*ProbeModule) []manager.ConstantEditor {
+			// 通过elf的常量替换方式传递数据
+			return []manager.ConstantEditor{{
+				Name:  "target_port",
+				Value: uint64(this.conf.(*config.GoTLSConfig).Port),
+			}}
+		},
 	}
-	this.eventMaps = append(this.eventMaps, MasterkeyEventsMap)
-
-	var masterkeyEvent event.IEventStruct
-
-	// goTLS Event struct
-	masterkeyEvent = &event.MasterSecretGotlsEvent{}
-
-	this.eventFuncMaps[MasterkeyEventsMap] = masterkeyEvent
-	return nil
-}
-
-func (this *GoTLSProbe) DecodeFun(m *ebpf.Map) (event.IEventStruct, bool) {
-	fun, found := this.eventFuncMaps[m]
-	return fun, found
 }
 
 func (this *GoTLSProbe) Close() error {
@@ -325,10 +215,13 @@ func (this *GoTLSProbe) Close() error {
 	}
 
 	this.logger.Printf("%s\tclose. \n", this.Name())
-	if err := this.bpfManager.Stop(manager.CleanAll); err != nil {
-		return fmt.Errorf("couldn't stop manager %v .", err)
-	}
-	return this.Module.Close()
+	return this.ProbeModule.Close()
+}
+
+func (this *GoTLSProbe) Stats() ModuleStats {
+	stats := this.Module.Stats()
+	stats.PcapngBuffered = this.pcapngBuffered()
+	return stats
 }
 
 func (this *GoTLSProbe) saveMasterSecret(secretEvent *event.MasterSecretGotlsEvent) {
@@ -349,15 +242,17 @@ func (this *GoTLSProbe) saveMasterSecret(secretEvent *event.MasterSecretGotlsEve
 	// save to file
 	var b string
 	b = fmt.Sprintf("%s %02x %02x\n", label, clientRandom, secret)
-	l, e := this.keylogger.WriteString(b)
+	l, e := writeKeylog(this.keylogger, []byte(b))
 	if e != nil {
-		this.logger.Fatalf("%s: save masterSecrets to file error:%s", secretEvent.String(), e.Error())
+		this.logger.Printf("%s: save masterSecrets to file error:%s", secretEvent.String(), e.Error())
 		return
 	}
+	this.masterSecrets[k] = true
+	this.keylogWritten(1)
 	this.logger.Printf("%s: save CLIENT_RANDOM %02x to file success, %d bytes", label, clientRandom, l)
 	e = this.savePcapngSslKeyLog([]byte(b))
 	if e != nil {
-		this.logger.Fatalf("%s: save masterSecrets to pcapng error:%s", secretEvent.String(), e.Error())
+		this.logger.Printf("%s: save masterSecrets to pcapng error:%s", secretEvent.String(), e.Error())
 		return
 	}
 
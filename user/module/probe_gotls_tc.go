@@ -17,46 +17,27 @@ package module
 import (
 	"ecapture/user/config"
 	"ecapture/user/event"
-	"errors"
-	"fmt"
-	"github.com/cilium/ebpf"
 	manager "github.com/gojue/ebpfmanager"
-	"golang.org/x/sys/unix"
-	"math"
-	"net"
 )
 
-func (this *GoTLSProbe) setupManagersTC() error {
+func (this *GoTLSProbe) setupManagersTC() (*ProbeDescriptor, error) {
 	var ifname string
 
 	ifname = this.conf.(*config.GoTLSConfig).Ifname
-	this.ifName = ifname
-	interf, err := net.InterfaceByName(this.ifName)
+	// 多个网卡以逗号分隔，all 为全部已启用的网卡，包括 loopback
+	netIfs, err := tcInterfaces(ifname)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// loopback devices are special, some tc probes should be skipped
-	isNetIfaceLo := interf.Flags&net.FlagLoopback == net.FlagLoopback
-	skipLoopback := true // TODO: detect loopback devices via aquasecrity/tracee/pkg/ebpf/probes/probe.go line 322
-	if isNetIfaceLo && skipLoopback {
-		return fmt.Errorf("%s\t%s is a loopback interface, skip it", this.Name(), this.ifName)
-	}
-	this.ifIdex = interf.Index
-
 	this.logger.Printf("%s\tHOOK type:golang elf, binrayPath:%s\n", this.Name(), this.path)
-	this.logger.Printf("%s\tIfname:%s, Ifindex:%d,  Port:%d, Pcapng filepath:%s\n", this.Name(), this.ifName, this.ifIdex, this.conf.(*config.GoTLSConfig).Port, this.pcapngFilename)
+	this.logger.Printf("%s\tIfname:%s,  Port:%d, Filter:%s, Pcapng filepath:%s\n", this.Name(), tcInterfaceNames(netIfs), this.conf.(*config.GoTLSConfig).Port, this.conf.(*config.GoTLSConfig).PcapFilter, this.pcapngFilename)
 	this.logger.Printf("%s\tHook masterKey function:%s\n", this.Name(), goTlsMasterSecretFunc)
 
 	// create pcapng writer
-	netIfs, err := net.Interfaces()
-	if err != nil {
-		return err
-	}
-
-	err = this.createPcapng(netIfs)
+	err = this.createPcapng(netIfs, this.conf.(*config.GoTLSConfig).PcapFilter)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var (
@@ -72,97 +53,18 @@ func (this *GoTLSProbe) setupManagersTC() error {
 		fn = "gotls_mastersecret_stack"
 	}
 
-	this.bpfManager = &manager.Manager{
-		Probes: []*manager.Probe{
-			{
-				Section:          "classifier/egress",
-				EbpfFuncName:     "egress_cls_func",
-				Ifname:           this.ifName,
-				NetworkDirection: manager.Egress,
-			},
-			{
-				Section:          "classifier/ingress",
-				EbpfFuncName:     "ingress_cls_func",
-				Ifname:           this.ifName,
-				NetworkDirection: manager.Ingress,
-			},
-			// --------------------------------------------------
-
-			// gotls master secrets
-			{
-				Section:          sec,
-				EbpfFuncName:     fn,
-				AttachToFuncName: goTlsMasterSecretFunc,
-				BinaryPath:       this.path,
-				UID:              "uprobe_gotls_master_secret",
-			},
-		},
-
-		Maps: []*manager.Map{
-			{
-				Name: "mastersecret_go_events",
-			},
-			{
-				Name: "skb_events",
-			},
-		},
-	}
-
-	this.bpfManagerOptions = manager.Options{
-		DefaultKProbeMaxActive: 512,
-
-		VerifierOptions: ebpf.CollectionOptions{
-			Programs: ebpf.ProgramOptions{
-				LogSize: 2097152,
-			},
+	probes := append(tcProbes(netIfs),
+		// gotls master secrets
+		&manager.Probe{
+			Section:          sec,
+			EbpfFuncName:     fn,
+			AttachToFuncName: goTlsMasterSecretFunc,
+			BinaryPath:       this.path,
+			UID:              "uprobe_gotls_master_secret",
 		},
-
-		RLimit: &unix.Rlimit{
-			Cur: math.MaxUint64,
-			Max: math.MaxUint64,
-		},
-	}
-
-	if this.conf.EnableGlobalVar() {
-		// 填充 RewriteContants 对应map
-		this.bpfManagerOptions.ConstantEditors = this.constantEditor()
-	}
-	return nil
-}
-
-func (this *GoTLSProbe) initDecodeFunTC() error {
-	//SkbEventsMap 与解码函数映射
-	SkbEventsMap, found, err := this.bpfManager.GetMap("skb_events")
-	if err != nil {
-		return err
-	}
-	if !found {
-		return errors.New("cant found map:skb_events")
-	}
-	this.eventMaps = append(this.eventMaps, SkbEventsMap)
-	sslEvent := &event.TcSkbEvent{}
-	//sslEvent.SetModule(this)
-	this.eventFuncMaps[SkbEventsMap] = sslEvent
-
-	// master secrets map at ebpf code
-	MasterkeyEventsMap, found, err := this.bpfManager.GetMap("mastersecret_go_events")
-	if err != nil {
-		return err
-	}
-	if !found {
-		return errors.New("cant found map:mastersecret_events")
-	}
-	this.eventMaps = append(this.eventMaps, MasterkeyEventsMap)
-
-	var masterkeyEvent event.IEventStruct
-
-	// goTLS Event struct
-	masterkeyEvent = &event.MasterSecretGotlsEvent{}
-
-	this.eventFuncMaps[MasterkeyEventsMap] = masterkeyEvent
-	return nil
-}
-
-func (this *GoTLSProbe) Events() []*ebpf.Map {
-	return this.eventMaps
+	)
+	return this.descriptor(probes, []ProbeEventMap{
+		{Name: "skb_events", Event: &event.TcSkbEvent{}},
+		{Name: "mastersecret_go_events", Event: &event.MasterSecretGotlsEvent{}},
+	}), nil
 }
@@ -18,93 +18,18 @@
 package module
 
 import (
-	"bytes"
-	"context"
-	"ecapture/assets"
 	"ecapture/user/config"
 	"ecapture/user/event"
-	"errors"
-	"fmt"
-	"github.com/cilium/ebpf"
-	manager "github.com/gojue/ebpfmanager"
-	"golang.org/x/sys/unix"
-	"log"
-	"math"
 	"os"
-)
-
-type MMysqldProbe struct {
-	Module
-	bpfManager        *manager.Manager
-	bpfManagerOptions manager.Options
-	eventFuncMaps     map[*ebpf.Map]event.IEventStruct
-	eventMaps         []*ebpf.Map
-}
-
-// 对象初始化
-func (this *MMysqldProbe) Init(ctx context.Context, logger *log.Logger, conf config.IConfig) error {
-	this.Module.Init(ctx, logger, conf)
-	this.conf = conf
-	this.Module.SetChild(this)
-	this.eventMaps = make([]*ebpf.Map, 0, 2)
-	this.eventFuncMaps = make(map[*ebpf.Map]event.IEventStruct)
-	return nil
-}
-
-func (this *MMysqldProbe) Start() error {
-	if err := this.start(); err != nil {
-		return err
-	}
-	return nil
-}
-
-func (this *MMysqldProbe) start() error {
-
-	// fetch ebpf assets
-	var bpfFileName = this.geteBPFName("user/bytecode/mysqld_kern.o")
-	this.logger.Printf("%s\tBPF bytecode filename:%s\n", this.Name(), bpfFileName)
-	byteBuf, err := assets.Asset(bpfFileName)
-	if err != nil {
-		return fmt.Errorf("couldn't find asset %v.", err)
-	}
 
-	// setup the managers
-	err = this.setupManagers()
-	if err != nil {
-		return fmt.Errorf("mysqld module couldn't find binPath %v.", err)
-	}
-
-	// initialize the bootstrap manager
-	if err = this.bpfManager.InitWithOptions(bytes.NewReader(byteBuf), this.bpfManagerOptions); err != nil {
-		return fmt.Errorf("couldn't init manager %v", err)
-	}
-
-	// start the bootstrap manager
-	if err = this.bpfManager.Start(); err != nil {
-		return fmt.Errorf("couldn't start bootstrap manager %v", err)
-	}
-
-	// 加载map信息，map对应events decode表。
-	err = this.initDecodeFun()
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (this *MMysqldProbe) Close() error {
-	if err := this.bpfManager.Stop(manager.CleanAll); err != nil {
-		return fmt.Errorf("couldn't stop manager %v", err)
-	}
-	return this.Module.Close()
-}
+	manager "github.com/gojue/ebpfmanager"
+)
 
-func (this *MMysqldProbe) setupManagers() error {
+func mysqldProbes(m *ProbeModule) ([]*manager.Probe, error) {
 	var binaryPath string
-	switch this.conf.(*config.MysqldConfig).ElfType {
+	switch m.conf.(*config.MysqldConfig).ElfType {
 	case config.ElfTypeBin:
-		binaryPath = this.conf.(*config.MysqldConfig).Mysqldpath
+		binaryPath = m.conf.(*config.MysqldConfig).Mysqldpath
 	default:
 		//如果没找到
 		binaryPath = "/usr/sbin/mariadbd"
@@ -112,12 +37,12 @@ func (this *MMysqldProbe) setupManagers() error {
 
 	_, err := os.Stat(binaryPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	attachFunc := this.conf.(*config.MysqldConfig).FuncName
-	offset := this.conf.(*config.MysqldConfig).Offset
-	version := this.conf.(*config.MysqldConfig).Version
-	versionInfo := this.conf.(*config.MysqldConfig).VersionInfo
+	attachFunc := m.conf.(*config.MysqldConfig).FuncName
+	offset := m.conf.(*config.MysqldConfig).Offset
+	version := m.conf.(*config.MysqldConfig).Version
+	versionInfo := m.conf.(*config.MysqldConfig).VersionInfo
 
 	// mariadbd version : 10.5.13-MariaDB-0ubuntu0.21.04.1
 	// objdump -T /usr/sbin/mariadbd |grep dispatch_command
@@ -178,61 +103,18 @@ func (this *MMysqldProbe) setupManagers() error {
 		}
 	}
 
-	this.bpfManager = &manager.Manager{
-		Probes: probes,
-		Maps: []*manager.Map{
-			{
-				Name: "events",
-			},
-		},
-	}
-
-	this.logger.Printf("%s\tMysql Version:%s, binrayPath:%s, FunctionName:%s ,UprobeOffset:%d\n", this.Name(), versionInfo, binaryPath, attachFunc, offset)
-
-	this.bpfManagerOptions = manager.Options{
-		DefaultKProbeMaxActive: 512,
-
-		VerifierOptions: ebpf.CollectionOptions{
-			Programs: ebpf.ProgramOptions{
-				LogSize: 2097152,
-			},
-		},
-
-		RLimit: &unix.Rlimit{
-			Cur: math.MaxUint64,
-			Max: math.MaxUint64,
-		},
-	}
-	return nil
-}
-
-func (this *MMysqldProbe) DecodeFun(em *ebpf.Map) (event.IEventStruct, bool) {
-	fun, found := this.eventFuncMaps[em]
-	return fun, found
-}
-
-func (this *MMysqldProbe) initDecodeFun() error {
-	// mysqldEventsMap 与解码函数映射
-	mysqldEventsMap, found, err := this.bpfManager.GetMap("events")
-	if err != nil {
-		return err
-	}
-	if !found {
-		return errors.New("cant found map:events")
-	}
-	this.eventMaps = append(this.eventMaps, mysqldEventsMap)
-	this.eventFuncMaps[mysqldEventsMap] = &event.MysqldEvent{}
-
-	return nil
-}
-
-func (this *MMysqldProbe) Events() []*ebpf.Map {
-	return this.eventMaps
+	m.logger.Printf("%s\tMysql Version:%s, binrayPath:%s, FunctionName:%s ,UprobeOffset:%d\n", m.Name(), versionInfo, binaryPath, attachFunc, offset)
+	return probes, nil
 }
 
 func init() {
-	mod := &MMysqldProbe{}
-	mod.name = ModuleNameMysqld
-	mod.mType = ProbeTypeUprobe
-	Register(mod)
+	RegisterProbe(ProbeDescriptor{
+		Name:     ModuleNameMysqld,
+		Type:     ProbeTypeUprobe,
+		Bytecode: "user/bytecode/mysqld_kern.o",
+		Probes:   mysqldProbes,
+		EventMaps: []ProbeEventMap{
+			{Name: "events", Event: &event.MysqldEvent{}},
+		},
+	})
 }
@@ -15,112 +15,20 @@
 package module
 
 import (
-	"bytes"
-	"context"
-	"ecapture/assets"
 	"ecapture/user/config"
 	"ecapture/user/event"
-	"errors"
-	"fmt"
-	"github.com/cilium/ebpf"
-	manager "github.com/gojue/ebpfmanager"
-	"golang.org/x/sys/unix"
-	"log"
-	"math"
 	"os"
-)
-
-type MNsprProbe struct {
-	Module
-	bpfManager        *manager.Manager
-	bpfManagerOptions manager.Options
-	eventFuncMaps     map[*ebpf.Map]event.IEventStruct
-	eventMaps         []*ebpf.Map
-}
-
-// 对象初始化
-func (this *MNsprProbe) Init(ctx context.Context, logger *log.Logger, conf config.IConfig) error {
-	this.Module.Init(ctx, logger, conf)
-	this.conf = conf
-	this.Module.SetChild(this)
-	this.eventMaps = make([]*ebpf.Map, 0, 2)
-	this.eventFuncMaps = make(map[*ebpf.Map]event.IEventStruct)
-	return nil
-}
-
-func (this *MNsprProbe) Start() error {
-	if err := this.start(); err != nil {
-		return err
-	}
-	return nil
-}
-
-func (this *MNsprProbe) start() error {
-
-	// fetch ebpf assets
-	var bpfFileName = this.geteBPFName("user/bytecode/nspr_kern.o")
-	this.logger.Printf("%s\tBPF bytecode filename:%s\n", this.Name(), bpfFileName)
-	byteBuf, err := assets.Asset(bpfFileName)
-	if err != nil {
-		return fmt.Errorf("couldn't find asset %v .", err)
-	}
-
-	// setup the managers
-	err = this.setupManagers()
-	if err != nil {
-		return fmt.Errorf("tls module couldn't find binPath %v ", err)
-	}
-
-	// initialize the bootstrap manager
-	if err = this.bpfManager.InitWithOptions(bytes.NewReader(byteBuf), this.bpfManagerOptions); err != nil {
-		return fmt.Errorf("couldn't init manager %v ", err)
-	}
-
-	// start the bootstrap manager
-	if err := this.bpfManager.Start(); err != nil {
-		return fmt.Errorf("couldn't start bootstrap manager %v ", err)
-	}
 
-	// 加载map信息，map对应events decode表。
-	err = this.initDecodeFun()
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (this *MNsprProbe) Close() error {
-	if err := this.bpfManager.Stop(manager.CleanAll); err != nil {
-		return fmt.Errorf("couldn't stop manager %v ", err)
-	}
-	return this.Module.Close()
-}
-
-// 通过elf的常量替换方式传递数据
-func (this *MNsprProbe) constantEditor() []manager.ConstantEditor {
-	var editor = []manager.ConstantEditor{
-		{
-			Name:  "target_pid",
-			Value: uint64(this.conf.GetPid()),
-		},
-	}
-
-	if this.conf.GetPid() <= 0 {
-		this.logger.Printf("%s\ttarget all process. \n", this.Name())
-	} else {
-		this.logger.Printf("%s\ttarget PID:%d \n", this.Name(), this.conf.GetPid())
-	}
-	return editor
-}
+	manager "github.com/gojue/ebpfmanager"
+)
 
-func (this *MNsprProbe) setupManagers() error {
+func nsprProbes(m *ProbeModule) ([]*manager.Probe, error) {
 	var binaryPath string
-	switch this.conf.(*config.NsprConfig).ElfType {
+	switch m.conf.(*config.NsprConfig).ElfType {
 	case config.ElfTypeBin:
-		binaryPath = this.conf.(*config.NsprConfig).Firefoxpath
+		binaryPath = m.conf.(*config.NsprConfig).Firefoxpath
 	case config.ElfTypeSo:
-		binaryPath = this.conf.(*config.NsprConfig).Nsprpath
+		binaryPath = m.conf.(*config.NsprConfig).Nsprpath
 	default:
 		//如果没找到
 		binaryPath = "/lib/x86_64-linux-gnu/libnspr4.so"
@@ -128,130 +36,82 @@ func (this *MNsprProbe) setupManagers() error {
 
 	_, err := os.Stat(binaryPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	this.logger.Printf("%s\tHOOK type:%d, binrayPath:%s\n", this.Name(), this.conf.(*config.NsprConfig).ElfType, binaryPath)
-
-	this.bpfManager = &manager.Manager{
-		Probes: []*manager.Probe{
-			{
-				Section:          "uprobe/PR_Write",
-				EbpfFuncName:     "probe_entry_SSL_write",
-				AttachToFuncName: "PR_Write",
-				BinaryPath:       binaryPath,
-			},
-			{
-				Section:          "uretprobe/PR_Write",
-				EbpfFuncName:     "probe_ret_SSL_write",
-				AttachToFuncName: "PR_Write",
-				BinaryPath:       binaryPath,
-			},
-
-			// for PR_Send start
-			//  |  ``PR_Send`` or ``PR_Write``
-			//   | ``PR_Read`` or ``PR_Recv``
-			{
-				UID:              "PR_Write-PR_Send",
-				Section:          "uprobe/PR_Write",
-				EbpfFuncName:     "probe_entry_SSL_write",
-				AttachToFuncName: "PR_Send",
-				BinaryPath:       binaryPath,
-			},
-			{
-				UID:              "PR_Write-PR_Send",
-				Section:          "uretprobe/PR_Write",
-				EbpfFuncName:     "probe_ret_SSL_write",
-				AttachToFuncName: "PR_Send",
-				BinaryPath:       binaryPath,
-			},
-			// for PR_Send end
-
-			{
-				Section:          "uprobe/PR_Read",
-				EbpfFuncName:     "probe_entry_SSL_read",
-				AttachToFuncName: "PR_Read",
-				BinaryPath:       binaryPath,
-			},
-			{
-				Section:          "uretprobe/PR_Read",
-				EbpfFuncName:     "probe_ret_SSL_read",
-				AttachToFuncName: "PR_Read",
-				BinaryPath:       binaryPath,
-			},
+	m.logger.Printf("%s\tHOOK type:%d, binrayPath:%s\n", m.Name(), m.conf.(*config.NsprConfig).ElfType, binaryPath)
 
-			{
-				UID:              "PR_Read-PR_Recv",
-				Section:          "uprobe/PR_Read",
-				EbpfFuncName:     "probe_entry_SSL_read",
-				AttachToFuncName: "PR_Recv",
-				BinaryPath:       binaryPath,
-			},
-			{
-				UID:              "PR_Read-PR_Recv",
-				Section:          "uretprobe/PR_Read",
-				EbpfFuncName:     "probe_ret_SSL_read",
-				AttachToFuncName: "PR_Recv",
-				BinaryPath:       binaryPath,
-			},
+	return []*manager.Probe{
+		{
+			Section:          "uprobe/PR_Write",
+			EbpfFuncName:     "probe_entry_SSL_write",
+			AttachToFuncName: "PR_Write",
+			BinaryPath:       binaryPath,
 		},
-
-		Maps: []*manager.Map{
-			{
-				Name: "nspr_events",
-			},
+		{
+			Section:          "uretprobe/PR_Write",
+			EbpfFuncName:     "probe_ret_SSL_write",
+			AttachToFuncName: "PR_Write",
+			BinaryPath:       binaryPath,
 		},
-	}
 
-	this.bpfManagerOptions = manager.Options{
-		DefaultKProbeMaxActive: 512,
-
-		VerifierOptions: ebpf.CollectionOptions{
-			Programs: ebpf.ProgramOptions{
-				LogSize: 2097152,
-			},
+		// for PR_Send start
+		//  |  ``PR_Send`` or ``PR_Write``
+		//   | ``PR_Read`` or ``PR_Recv``
+		{
+			UID:              "PR_Write-PR_Send",
+			Section:          "uprobe/PR_Write",
+			EbpfFuncName:     "probe_entry_SSL_write",
+			AttachToFuncName: "PR_Send",
+			BinaryPath:       binaryPath,
 		},
-
-		RLimit: &unix.Rlimit{
-			Cur: math.MaxUint64,
-			Max: math.MaxUint64,
+		{
+			UID:              "PR_Write-PR_Send",
+			Section:          "uretprobe/PR_Write",
+			EbpfFuncName:     "probe_ret_SSL_write",
+			AttachToFuncName: "PR_Send",
+			BinaryPath:       binaryPath,
 		},
-	}
-
-	if this.conf.EnableGlobalVar() {
-		// 填充 RewriteContants 对应map
-		this.bpfManagerOptions.ConstantEditors = this.constantEditor()
-	}
-	return nil
-}
+		// for PR_Send end
 
-func (this *MNsprProbe) DecodeFun(em *ebpf.Map) (event.IEventStruct, bool) {
-	fun, found := this.eventFuncMaps[em]
-	return fun, found
-}
-
-func (this *MNsprProbe) initDecodeFun() error {
-	// NsprEventsMap 与解码函数映射
-	NsprEventsMap, found, err := this.bpfManager.GetMap("nspr_events")
-	if err != nil {
-		return err
-	}
-	if !found {
-		return errors.New("cant found map:nspr_events")
-	}
-	this.eventMaps = append(this.eventMaps, NsprEventsMap)
-	this.eventFuncMaps[NsprEventsMap] = &event.NsprDataEvent{}
-
-	return nil
-}
+		{
+			Section:          "uprobe/PR_Read",
+			EbpfFuncName:     "probe_entry_SSL_read",
+			AttachToFuncName: "PR_Read",
+			BinaryPath:       binaryPath,
+		},
+		{
+			Section:          "uretprobe/PR_Read",
+			EbpfFuncName:     "probe_ret_SSL_read",
+			AttachToFuncName: "PR_Read",
+			BinaryPath:       binaryPath,
+		},
 
-func (this *MNsprProbe) Events() []*ebpf.Map {
-	return this.eventMaps
+		{
+			UID:              "PR_Read-PR_Recv",
+			Section:          "uprobe/PR_Read",
+			EbpfFuncName:     "probe_entry_SSL_read",
+			AttachToFuncName: "PR_Recv",
+			BinaryPath:       binaryPath,
+		},
+		{
+			UID:              "PR_Read-PR_Recv",
+			Section:          "uretprobe/PR_Read",
+			EbpfFuncName:     "probe_ret_SSL_read",
+			AttachToFuncName: "PR_Recv",
+			BinaryPath:       binaryPath,
+		},
+	}, nil
 }
 
 func init() {
-	mod := &MNsprProbe{}
-	mod.name = ModuleNameNspr
-	mod.mType = ProbeTypeUprobe
-	Register(mod)
+	RegisterProbe(ProbeDescriptor{
+		Name:     ModuleNameNspr,
+		Type:     ProbeTypeUprobe,
+		Bytecode: "user/bytecode/nspr_kern.o",
+		Probes:   nsprProbes,
+		EventMaps: []ProbeEventMap{
+			{Name: "nspr_events", Event: &event.NsprDataEvent{}},
+		},
+	})
 }
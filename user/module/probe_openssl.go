@@ -18,17 +18,15 @@ import (
 	"bytes"
 	"context"
 	"crypto"
-	"ecapture/assets"
 	"ecapture/pkg/util/hkdf"
 	"ecapture/user/config"
 	"ecapture/user/event"
-	"errors"
 	"fmt"
 	"github.com/cilium/ebpf"
 	manager "github.com/gojue/ebpfmanager"
 	"golang.org/x/sys/unix"
+	"io"
 	"log"
-	"math"
 	"os"
 	"path/filepath"
 	"strings"
@@ -55,16 +53,13 @@ const (
 	EbpfprogramtypeOpensslUprobe
 )
 
+// MOpenSSLProbe 字节码、hook 点由检测到的 SSL 库和运行模式决定，Start 时生成 ProbeDescriptor
 type MOpenSSLProbe struct {
-	Module
+	ProbeModule
 	MTCProbe
-	bpfManager        *manager.Manager
-	bpfManagerOptions manager.Options
-	eventFuncMaps     map[*ebpf.Map]event.IEventStruct
-	eventMaps         []*ebpf.Map
 
 	// pid[fd:Addr]
-	//pidConns map[uint32]map[uint32]string
+	conns *ConnTable
 
 	keyloggerFilename string
 	keylogger         *os.File
@@ -79,12 +74,9 @@ type MOpenSSLProbe struct {
 
 // 对象初始化
 func (this *MOpenSSLProbe) Init(ctx context.Context, logger *log.Logger, conf config.IConfig) error {
-	this.Module.Init(ctx, logger, conf)
-	this.conf = conf
+	_ = this.ProbeModule.Init(ctx, logger, conf)
 	this.Module.SetChild(this)
-	this.eventMaps = make([]*ebpf.Map, 0, 2)
-	this.eventFuncMaps = make(map[*ebpf.Map]event.IEventStruct)
-	//this.pidConns = make(map[uint32]map[uint32]string)
+	this.conns = NewConnTable()
 	this.masterKeys = make(map[string]bool)
 	this.sslVersionBpfMap = make(map[string]string)
 
@@ -103,6 +95,7 @@ func (this *MOpenSSLProbe) Init(ctx context.Context, logger *log.Logger, conf co
 			return err
 		}
 		this.pcapngFilename = fileInfo
+		this.pcapngRotate = this.conf.(*config.OpensslConfig).PcapngRotate
 	} else {
 		this.eBPFProgramType = EbpfprogramtypeOpensslUprobe
 		this.logger.Printf("%s\tmaster key keylogger: %s\n", this.Name(), this.keyloggerFilename)
@@ -123,7 +116,6 @@ func (this *MOpenSSLProbe) Init(ctx context.Context, logger *log.Logger, conf co
 
 	this.tcPackets = make([]*TcPacket, 0, 1024)
 	this.tcPacketLocker = &sync.Mutex{}
-	this.masterKeyBuffer = bytes.NewBuffer([]byte{})
 
 	this.initOpensslOffset()
 	return nil
@@ -161,58 +153,27 @@ func (this *MOpenSSLProbe) Start() error {
 }
 
 func (this *MOpenSSLProbe) start() error {
-
+	var desc *ProbeDescriptor
 	var err error
 	// setup the managers
 	switch this.eBPFProgramType {
 	case EbpfprogramtypeOpensslTc:
 		this.logger.Printf("%s\tTC MODEL\n", this.Name())
-		err = this.setupManagersTC()
+		desc, err = this.setupManagersTC()
 	case EbpfprogramtypeOpensslUprobe:
 		this.logger.Printf("%s\tUPROBE MODEL\n", this.Name())
-		err = this.setupManagersUprobe()
+		desc, err = this.setupManagersUprobe()
 	default:
 		this.logger.Printf("%s\tUPROBE MODEL\n", this.Name())
-		err = this.setupManagersUprobe()
+		desc, err = this.setupManagersUprobe()
 	}
 	if err != nil {
 		return err
 	}
 
-	// fetch ebpf assets
-	// user/bytecode/openssl_kern.o
-	var bpfFileName = this.geteBPFName(filepath.Join("user/bytecode", this.sslBpfFile))
-	this.logger.Printf("%s\tBPF bytecode filename:%s\n", this.Name(), bpfFileName)
-	byteBuf, err := assets.Asset(bpfFileName)
-
-	if err != nil {
-		return fmt.Errorf("%s\tcouldn't find asset %v .", this.Name(), err)
-	}
-
-	// initialize the bootstrap manager
-	if err = this.bpfManager.InitWithOptions(bytes.NewReader(byteBuf), this.bpfManagerOptions); err != nil {
-		return fmt.Errorf("couldn't init manager %v", err)
-	}
-
-	// start the bootstrap manager
-	if err = this.bpfManager.Start(); err != nil {
-		return fmt.Errorf("couldn't start bootstrap manager %v .", err)
-	}
-
-	// 加载map信息，map对应events decode表。
-	switch this.eBPFProgramType {
-	case EbpfprogramtypeOpensslTc:
-		err = this.initDecodeFunTC()
-	case EbpfprogramtypeOpensslUprobe:
-		err = this.initDecodeFun()
-	default:
-		err = this.initDecodeFun()
-	}
-	if err != nil {
-		return err
-	}
-
-	return nil
+	// 加载字节码、挂载 hook 点、建立 map 与 events decode 的对应
+	this.desc = desc
+	return this.ProbeModule.Start()
 }
 
 func (this *MOpenSSLProbe) Close() error {
@@ -230,46 +191,38 @@ func (this *MOpenSSLProbe) Close() error {
 	}
 
 	this.logger.Printf("%s\tclose. \n", this.Name())
-	if err := this.bpfManager.Stop(manager.CleanAll); err != nil {
-		return fmt.Errorf("couldn't stop manager %v .", err)
-	}
-	return this.Module.Close()
+	return this.ProbeModule.Close()
 }
 
-// 通过elf的常量替换方式传递数据
-func (this *MOpenSSLProbe) constantEditor() []manager.ConstantEditor {
-	var editor = []manager.ConstantEditor{
-		{
-			Name:  "target_pid",
-			Value: uint64(this.conf.GetPid()),
-			//FailOnMissing: true,
+// descriptor hook 点、事件 map 已确定后生成的 ProbeDescriptor，字节码为检测到的 SSL 库对应的文件
+func (this *MOpenSSLProbe) descriptor(probes []*manager.Probe, eventMaps []ProbeEventMap) *ProbeDescriptor {
+	return &ProbeDescriptor{
+		Name:     this.Name(),
+		Type:     this.mType,
+		Bytecode: filepath.Join("user/bytecode", this.sslBpfFile),
+		Probes: func(*ProbeModule) ([]*manager.Probe, error) {
+			return probes, nil
 		},
-		{
-			Name:  "target_uid",
-			Value: uint64(this.conf.GetUid()),
-		},
-		{
-			Name:  "target_port",
-			Value: uint64(this.conf.(*config.OpensslConfig).Port),
+		EventMaps: eventMaps,
+		Constants: func(*ProbeModule) []manager.ConstantEditor {
+			// 通过elf的常量替换方式传递数据
+			return []manager.ConstantEditor{{
+				Name:  "target_port",
+				Value: uint64(this.conf.(*config.OpensslConfig).Port),
+			}}
 		},
 	}
+}
 
-	if this.conf.GetPid() <= 0 {
-		this.logger.Printf("%s\ttarget all process. \n", this.Name())
-	} else {
-		this.logger.Printf("%s\ttarget PID:%d \n", this.Name(), this.conf.GetPid())
-	}
-
-	if this.conf.GetUid() <= 0 {
-		this.logger.Printf("%s\ttarget all users. \n", this.Name())
-	} else {
-		this.logger.Printf("%s\ttarget UID:%d \n", this.Name(), this.conf.GetUid())
+// masterkeyEvent mastersecret_events 的事件结构，BoringSSL 与 OpenSSL 不同
+func (this *MOpenSSLProbe) masterkeyEvent() event.IEventStruct {
+	if this.isBoringSSL {
+		return &event.MasterSecretBSSLEvent{}
 	}
-
-	return editor
+	return &event.MasterSecretEvent{}
 }
 
-func (this *MOpenSSLProbe) setupManagersUprobe() error {
+func (this *MOpenSSLProbe) setupManagersUprobe() (*ProbeDescriptor, error) {
 	var binaryPath, sslVersion string
 	sslVersion = this.conf.(*config.OpensslConfig).SslVersion
 	sslVersion = strings.ToLower(sslVersion)
@@ -280,164 +233,78 @@ func (this *MOpenSSLProbe) setupManagersUprobe() error {
 		binaryPath = this.conf.(*config.OpensslConfig).Openssl
 		err := this.getSslBpfFile(binaryPath, sslVersion)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	default:
 		//如果没找到
 		binaryPath = "/lib/x86_64-linux-gnu/libssl.so.1.1"
 		err := this.getSslBpfFile(binaryPath, sslVersion)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	_, err := os.Stat(binaryPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	this.logger.Printf("%s\tHOOK type:%d, binrayPath:%s\n", this.Name(), this.conf.(*config.OpensslConfig).ElfType, binaryPath)
 	this.logger.Printf("%s\tHook masterKey function:%s\n", this.Name(), this.masterHookFunc)
 
-	this.bpfManager = &manager.Manager{
-		Probes: []*manager.Probe{
-
-			{
-				Section:          "uprobe/SSL_write",
-				EbpfFuncName:     "probe_entry_SSL_write",
-				AttachToFuncName: "SSL_write",
-				BinaryPath:       binaryPath,
-			},
-			{
-				Section:          "uretprobe/SSL_write",
-				EbpfFuncName:     "probe_ret_SSL_write",
-				AttachToFuncName: "SSL_write",
-				BinaryPath:       binaryPath,
-			},
-			{
-				Section:          "uprobe/SSL_read",
-				EbpfFuncName:     "probe_entry_SSL_read",
-				AttachToFuncName: "SSL_read",
-				BinaryPath:       binaryPath,
-			},
-			{
-				Section:          "uretprobe/SSL_read",
-				EbpfFuncName:     "probe_ret_SSL_read",
-				AttachToFuncName: "SSL_read",
-				BinaryPath:       binaryPath,
-			},
-
-			// --------------------------------------------------
-			/*
-				{
-					Section:          "uprobe/connect",
-					EbpfFuncName:     "probe_connect",
-					AttachToFuncName: "connect",
-					BinaryPath:       libPthread,
-				},
-			*/
-			// --------------------------------------------------
-
-			// openssl masterkey
-			{
-				Section:          "uprobe/SSL_write_key",
-				EbpfFuncName:     "probe_ssl_master_key",
-				AttachToFuncName: this.masterHookFunc,
-				BinaryPath:       binaryPath,
-				UID:              "uprobe_ssl_master_key",
-			},
-		},
+	probes := []*manager.Probe{
 
-		Maps: []*manager.Map{
-			{
-				Name: "tls_events",
-			},
-			{
-				Name: "connect_events",
-			},
-			{
-				Name: "mastersecret_events",
-			},
+		{
+			Section:          "uprobe/SSL_write",
+			EbpfFuncName:     "probe_entry_SSL_write",
+			AttachToFuncName: "SSL_write",
+			BinaryPath:       binaryPath,
 		},
-	}
-
-	this.bpfManagerOptions = manager.Options{
-		DefaultKProbeMaxActive: 512,
-
-		VerifierOptions: ebpf.CollectionOptions{
-			Programs: ebpf.ProgramOptions{
-				LogSize: 2097152,
-			},
+		{
+			Section:          "uretprobe/SSL_write",
+			EbpfFuncName:     "probe_ret_SSL_write",
+			AttachToFuncName: "SSL_write",
+			BinaryPath:       binaryPath,
 		},
-
-		RLimit: &unix.Rlimit{
-			Cur: math.MaxUint64,
-			Max: math.MaxUint64,
+		{
+			Section:          "uprobe/SSL_read",
+			EbpfFuncName:     "probe_entry_SSL_read",
+			AttachToFuncName: "SSL_read",
+			BinaryPath:       binaryPath,
+		},
+		{
+			Section:          "uretprobe/SSL_read",
+			EbpfFuncName:     "probe_ret_SSL_read",
+			AttachToFuncName: "SSL_read",
+			BinaryPath:       binaryPath,
 		},
-	}
-
-	if this.conf.EnableGlobalVar() {
-		// 填充 RewriteContants 对应map
-		this.bpfManagerOptions.ConstantEditors = this.constantEditor()
-	}
-	return nil
-}
 
-func (this *MOpenSSLProbe) DecodeFun(em *ebpf.Map) (event.IEventStruct, bool) {
-	fun, found := this.eventFuncMaps[em]
-	return fun, found
-}
+		// --------------------------------------------------
 
-func (this *MOpenSSLProbe) initDecodeFun() error {
-	//SSLDumpEventsMap 与解码函数映射
-	SSLDumpEventsMap, found, err := this.bpfManager.GetMap("tls_events")
-	if err != nil {
-		return err
-	}
-	if !found {
-		return errors.New("cant found map:tls_events")
-	}
-	this.eventMaps = append(this.eventMaps, SSLDumpEventsMap)
-	sslEvent := &event.SSLDataEvent{}
-	//sslEvent.SetModule(this)
-	this.eventFuncMaps[SSLDumpEventsMap] = sslEvent
-
-	ConnEventsMap, found, err := this.bpfManager.GetMap("connect_events")
-	if err != nil {
-		return err
-	}
-	if !found {
-		return errors.New("cant found map:connect_events")
+		// openssl masterkey
+		{
+			Section:          "uprobe/SSL_write_key",
+			EbpfFuncName:     "probe_ssl_master_key",
+			AttachToFuncName: this.masterHookFunc,
+			BinaryPath:       binaryPath,
+			UID:              "uprobe_ssl_master_key",
+		},
 	}
-	this.eventMaps = append(this.eventMaps, ConnEventsMap)
-	connEvent := &event.ConnDataEvent{}
-	//connEvent.SetModule(this)
-	this.eventFuncMaps[ConnEventsMap] = connEvent
 
-	MasterkeyEventsMap, found, err := this.bpfManager.GetMap("mastersecret_events")
+	// connect/accept 事件用于记录连接的远端地址，找不到 libc 时仅从 /proc 查询
+	libc, err := config.GetLibcPath(binaryPath)
 	if err != nil {
-		return err
-	}
-	if !found {
-		return errors.New("cant found map:mastersecret_events")
-	}
-	this.eventMaps = append(this.eventMaps, MasterkeyEventsMap)
-
-	var masterkeyEvent event.IEventStruct
-
-	if this.isBoringSSL {
-		masterkeyEvent = &event.MasterSecretBSSLEvent{}
+		this.logger.Printf("%s\tcant found libc.so from %s, connection address will be read from /proc. error:%v\n", this.Name(), binaryPath, err)
 	} else {
-		masterkeyEvent = &event.MasterSecretEvent{}
+		this.logger.Printf("%s\tlibc path:%s\n", this.Name(), libc)
+		probes = append(probes, connProbes(libc)...)
 	}
-	//masterkeyEvent.SetModule(this)
-	this.eventFuncMaps[MasterkeyEventsMap] = masterkeyEvent
-
-	return nil
-}
 
-func (this *MOpenSSLProbe) Events() []*ebpf.Map {
-	return this.eventMaps
+	return this.descriptor(probes, []ProbeEventMap{
+		{Name: "tls_events", Event: &event.SSLDataEvent{}},
+		{Name: "connect_events", Event: &event.ConnDataEvent{}},
+		{Name: "mastersecret_events", Event: this.masterkeyEvent()},
+	}), nil
 }
 
 func (this *MOpenSSLProbe) saveMasterSecret(secretEvent *event.MasterSecretEvent) {
@@ -494,18 +361,21 @@ func (this *MOpenSSLProbe) saveMasterSecret(secretEvent *event.MasterSecretEvent
 		b = bytes.NewBufferString(fmt.Sprintf("%s %02x %02x\n", hkdf.KeyLogLabelTLS12, secretEvent.ClientRandom, secretEvent.MasterKey))
 	}
 	v := event.TlsVersion{Version: secretEvent.Version}
-	l, e := this.keylogger.WriteString(b.String())
+	l, e := writeKeylog(this.keylogger, b.Bytes())
 	if e != nil {
-		this.logger.Fatalf("%s: save CLIENT_RANDOM to file error:%s", v.String(), e.Error())
+		// 未写入，再次收到该随机数时重试
+		delete(this.masterKeys, k)
+		this.logger.Printf("%s: save CLIENT_RANDOM to file error:%s", v.String(), e.Error())
 		return
 	}
+	this.keylogWritten(strings.Count(b.String(), "\n"))
 
 	//
 	switch this.eBPFProgramType {
 	case EbpfprogramtypeOpensslTc:
 		e = this.savePcapngSslKeyLog(b.Bytes())
 		if e != nil {
-			this.logger.Fatalf("%s: save CLIENT_RANDOM to pcapng error:%s", v.String(), e.Error())
+			this.logger.Printf("%s: save CLIENT_RANDOM to pcapng error:%s", v.String(), e.Error())
 			return
 		}
 	default:
@@ -552,11 +422,14 @@ func (this *MOpenSSLProbe) saveMasterSecretBSSL(secretEvent *event.MasterSecretB
 	}
 
 	v := event.TlsVersion{Version: secretEvent.Version}
-	l, e := this.keylogger.WriteString(b.String())
+	l, e := writeKeylog(this.keylogger, b.Bytes())
 	if e != nil {
-		this.logger.Fatalf("%s: save CLIENT_RANDOM to file error:%s", v.String(), e.Error())
+		// 未写入，再次收到该随机数时重试
+		delete(this.masterKeys, k)
+		this.logger.Printf("%s: save CLIENT_RANDOM to file error:%s", v.String(), e.Error())
 		return
 	}
+	this.keylogWritten(strings.Count(b.String(), "\n"))
 
 	//
 	switch this.eBPFProgramType {
@@ -564,7 +437,7 @@ func (this *MOpenSSLProbe) saveMasterSecretBSSL(secretEvent *event.MasterSecretB
 		this.logger.Printf("%s: save CLIENT_RANDOM %02x to file success, %d bytes", v.String(), secretEvent.ClientRandom, l)
 		e = this.savePcapngSslKeyLog(b.Bytes())
 		if e != nil {
-			this.logger.Fatalf("%s: save CLIENT_RANDOM to pcapng error:%s", v.String(), e.Error())
+			this.logger.Printf("%s: save CLIENT_RANDOM to pcapng error:%s", v.String(), e.Error())
 			return
 		}
 	default:
@@ -572,6 +445,30 @@ func (this *MOpenSSLProbe) saveMasterSecretBSSL(secretEvent *event.MasterSecretB
 	}
 }
 
+// writeKeylog 写入 keylog 文件，未写完时重试 KeylogWriteRetries 次。仍未写完时截断到写入前的位置，
+// 不留下没有换行的半行，之后重新写入时不会与其拼接。管道等无法 Seek 的文件不截断
+func writeKeylog(f *os.File, b []byte) (n int, err error) {
+	offset, seekErr := f.Seek(0, io.SeekEnd)
+	for i := 0; i < KeylogWriteRetries; i++ {
+		var w int
+		w, err = f.Write(b[n:])
+		n += w
+		if n == len(b) {
+			return n, nil
+		}
+	}
+	if err == nil {
+		err = io.ErrShortWrite
+	}
+	if n == 0 || seekErr != nil {
+		return n, err
+	}
+	if e := f.Truncate(offset); e != nil {
+		return n, fmt.Errorf("%v, truncate partial write error:%v", err, e)
+	}
+	return 0, err
+}
+
 func (this *MOpenSSLProbe) bSSLEvent12NullSecrets(e *event.MasterSecretBSSLEvent) bool {
 	var isNull = true
 	var hashLen = int(e.HashLen)
@@ -618,11 +515,30 @@ func (this *MOpenSSLProbe) bSSLEvent13NullSecrets(e *event.MasterSecretBSSLEvent
 	return isNUllCount != 0
 }
 
+func (this *MOpenSSLProbe) Stats() ModuleStats {
+	stats := this.Module.Stats()
+	stats.PcapngBuffered = this.pcapngBuffered()
+	return stats
+}
+
+// Decode 解码事件，为 SSLDataEvent 补充连接的本地、远端地址
+func (this *MOpenSSLProbe) Decode(em *ebpf.Map, b []byte) (event.IEventStruct, error) {
+	e, err := this.Module.Decode(em, b)
+	if err != nil {
+		return nil, err
+	}
+	if sslEvent, ok := e.(*event.SSLDataEvent); ok {
+		conn := this.conns.GetConn(sslEvent.Pid, sslEvent.Fd)
+		sslEvent.LocalAddr, sslEvent.RemoteAddr = conn.Local, conn.Remote
+	}
+	return e, nil
+}
+
 func (this *MOpenSSLProbe) Dispatcher(eventStruct event.IEventStruct) {
 	// detect eventStruct type
 	switch eventStruct.(type) {
 	case *event.ConnDataEvent:
-		//this.AddConn(eventStruct.(*event.ConnDataEvent).Pid, eventStruct.(*event.ConnDataEvent).Fd, eventStruct.(*event.ConnDataEvent).Addr)
+		this.conns.AddConn(eventStruct.(*event.ConnDataEvent).Pid, eventStruct.(*event.ConnDataEvent).Fd, eventStruct.(*event.ConnDataEvent).Addr)
 	case *event.MasterSecretEvent:
 		this.saveMasterSecret(eventStruct.(*event.MasterSecretEvent))
 	case *event.MasterSecretBSSLEvent:
@@ -637,8 +553,10 @@ func (this *MOpenSSLProbe) Dispatcher(eventStruct event.IEventStruct) {
 }
 
 func init() {
-	mod := &MOpenSSLProbe{}
-	mod.name = ModuleNameOpenssl
-	mod.mType = ProbeTypeUprobe
-	Register(mod)
+	RegisterFunc(func() IModule {
+		mod := &MOpenSSLProbe{}
+		mod.name = ModuleNameOpenssl
+		mod.mType = ProbeTypeUprobe
+		return mod
+	})
 }
@@ -17,13 +17,7 @@ package module
 import (
 	"ecapture/user/config"
 	"ecapture/user/event"
-	"errors"
-	"fmt"
-	"github.com/cilium/ebpf"
 	manager "github.com/gojue/ebpfmanager"
-	"golang.org/x/sys/unix"
-	"math"
-	"net"
 	"strings"
 )
 
@@ -33,24 +27,16 @@ type NetEventMetadata struct {
 	ProcessName [16]byte `json:"processName"`
 }
 
-func (this *MOpenSSLProbe) setupManagersTC() error {
+func (this *MOpenSSLProbe) setupManagersTC() (*ProbeDescriptor, error) {
 	var ifname, binaryPath, sslVersion string
 
 	ifname = this.conf.(*config.OpensslConfig).Ifname
-	this.ifName = ifname
-	interf, err := net.InterfaceByName(this.ifName)
+	// 多个网卡以逗号分隔，all 为全部已启用的网卡，包括 loopback
+	netIfs, err := tcInterfaces(ifname)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// loopback devices are special, some tc probes should be skipped
-	isNetIfaceLo := interf.Flags&net.FlagLoopback == net.FlagLoopback
-	skipLoopback := true // TODO: detect loopback devices via aquasecrity/tracee/pkg/ebpf/probes/probe.go line 322
-	if isNetIfaceLo && skipLoopback {
-		return fmt.Errorf("%s\t%s is a loopback interface, skip it", this.Name(), this.ifName)
-	}
-	this.ifIdex = interf.Index
-
 	sslVersion = this.conf.(*config.OpensslConfig).SslVersion
 	sslVersion = strings.ToLower(sslVersion)
 	switch this.conf.(*config.OpensslConfig).ElfType {
@@ -60,131 +46,39 @@ func (this *MOpenSSLProbe) setupManagersTC() error {
 		binaryPath = this.conf.(*config.OpensslConfig).Openssl
 		err := this.getSslBpfFile(binaryPath, sslVersion)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	default:
 		//如果没找到
 		binaryPath = "/lib/x86_64-linux-gnu/libssl.so.1.1"
 		err := this.getSslBpfFile(binaryPath, sslVersion)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	this.logger.Printf("%s\tHOOK type:%d, binrayPath:%s\n", this.Name(), this.conf.(*config.OpensslConfig).ElfType, binaryPath)
-	this.logger.Printf("%s\tIfname:%s, Ifindex:%d,  Port:%d, Pcapng filepath:%s\n", this.Name(), this.ifName, this.ifIdex, this.conf.(*config.OpensslConfig).Port, this.pcapngFilename)
+	this.logger.Printf("%s\tIfname:%s,  Port:%d, Filter:%s, Pcapng filepath:%s\n", this.Name(), tcInterfaceNames(netIfs), this.conf.(*config.OpensslConfig).Port, this.conf.(*config.OpensslConfig).PcapFilter, this.pcapngFilename)
 	this.logger.Printf("%s\tHook masterKey function:%s\n", this.Name(), this.masterHookFunc)
 
 	// create pcapng writer
-	netIfs, err := net.Interfaces()
-	if err != nil {
-		return err
-	}
-
-	err = this.createPcapng(netIfs)
+	err = this.createPcapng(netIfs, this.conf.(*config.OpensslConfig).PcapFilter)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	this.bpfManager = &manager.Manager{
-		Probes: []*manager.Probe{
-			// customize deleteed TC filter
-			// tc filter del dev eth0 ingress
-			// tc filter del dev eth0 egress
-			// loopback devices are special, some tc probes should be skipped
-			// TODO: detect loopback devices via aquasecrity/tracee/pkg/ebpf/probes/probe.go line 322
-			// isNetIfaceLo := netIface.Flags&net.FlagLoopback == net.FlagLoopback
-			//	if isNetIfaceLo && p.skipLoopback {
-			//		return nil
-			//	}
-			{
-				Section:          "classifier/egress",
-				EbpfFuncName:     "egress_cls_func",
-				Ifname:           this.ifName,
-				NetworkDirection: manager.Egress,
-			},
-			{
-				Section:          "classifier/ingress",
-				EbpfFuncName:     "ingress_cls_func",
-				Ifname:           this.ifName,
-				NetworkDirection: manager.Ingress,
-			},
-			// --------------------------------------------------
-
-			// openssl masterkey
-			{
-				Section:          "uprobe/SSL_write_key",
-				EbpfFuncName:     "probe_ssl_master_key",
-				AttachToFuncName: this.masterHookFunc, // SSL_do_handshake or SSL_write
-				BinaryPath:       binaryPath,
-				UID:              "uprobe_ssl_master_key",
-			},
-		},
-
-		Maps: []*manager.Map{
-			{
-				Name: "mastersecret_events",
-			},
-			{
-				Name: "skb_events",
-			},
+	probes := append(tcProbes(netIfs),
+		// openssl masterkey
+		&manager.Probe{
+			Section:          "uprobe/SSL_write_key",
+			EbpfFuncName:     "probe_ssl_master_key",
+			AttachToFuncName: this.masterHookFunc, // SSL_do_handshake or SSL_write
+			BinaryPath:       binaryPath,
+			UID:              "uprobe_ssl_master_key",
 		},
-	}
-
-	this.bpfManagerOptions = manager.Options{
-		DefaultKProbeMaxActive: 512,
-
-		VerifierOptions: ebpf.CollectionOptions{
-			Programs: ebpf.ProgramOptions{
-				LogSize: 2097152,
-			},
-		},
-
-		RLimit: &unix.Rlimit{
-			Cur: math.MaxUint64,
-			Max: math.MaxUint64,
-		},
-	}
-
-	if this.conf.EnableGlobalVar() {
-		// 填充 RewriteContants 对应map
-		this.bpfManagerOptions.ConstantEditors = this.constantEditor()
-	}
-	return nil
-}
-
-func (this *MOpenSSLProbe) initDecodeFunTC() error {
-	//SkbEventsMap 与解码函数映射
-	SkbEventsMap, found, err := this.bpfManager.GetMap("skb_events")
-	if err != nil {
-		return err
-	}
-	if !found {
-		return errors.New("cant found map:skb_events")
-	}
-	this.eventMaps = append(this.eventMaps, SkbEventsMap)
-	sslEvent := &event.TcSkbEvent{}
-	//sslEvent.SetModule(this)
-	this.eventFuncMaps[SkbEventsMap] = sslEvent
-
-	MasterkeyEventsMap, found, err := this.bpfManager.GetMap("mastersecret_events")
-	if err != nil {
-		return err
-	}
-	if !found {
-		return errors.New("cant found map:mastersecret_events")
-	}
-	this.eventMaps = append(this.eventMaps, MasterkeyEventsMap)
-
-	var masterkeyEvent event.IEventStruct
-
-	if this.isBoringSSL {
-		masterkeyEvent = &event.MasterSecretBSSLEvent{}
-	} else {
-		masterkeyEvent = &event.MasterSecretEvent{}
-	}
-
-	//masterkeyEvent.SetModule(this)
-	this.eventFuncMaps[MasterkeyEventsMap] = masterkeyEvent
-	return nil
+	)
+	return this.descriptor(probes, []ProbeEventMap{
+		{Name: "skb_events", Event: &event.TcSkbEvent{}},
+		{Name: "mastersecret_events", Event: this.masterkeyEvent()},
+	}), nil
 }
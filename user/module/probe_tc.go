@@ -1,23 +1,31 @@
 package module
 
 import (
-	"bytes"
+	"bufio"
+	"ecapture/pkg/util/pcapfilter"
+	"ecapture/user/config"
 	"ecapture/user/event"
 	"fmt"
+	manager "github.com/gojue/ebpfmanager"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcapgo"
+	"io"
 	"math"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 // packets of TC probe
 type TcPacket struct {
-	info gopacket.CaptureInfo
-	data []byte
+	info    gopacket.CaptureInfo
+	data    []byte
+	comment string // 所属进程信息，写入 EPB 的 opt_comment
 }
 
 type NetCaptureData struct {
@@ -29,55 +37,345 @@ func (NetCaptureData) GetSizeBytes() uint32 {
 	return 8
 }
 
+// PcapngFlushInterval 数据包写入 pcapng 文件的周期。
+// 数据包在内存中停留 1~2 个周期，等待可能晚到的 master secret，保证 DSB 写在对应会话的数据包之前。
+const PcapngFlushInterval = time.Second
+
+// 轮转时写入新文件的 master secrets。会话的握手包与 master secret 在同一文件中才能解密，
+// 已写入旧文件的会话在新文件中无法解密，只需保留握手包可能延后写入新文件的近期 secrets。
+const (
+	PcapngSecretsRetention = time.Minute     // 保留最近多久的 secrets
+	PcapngSecretsMaxSize   = 4 * 1024 * 1024 // 保留的 secrets 最大字节数，超过后丢弃最早的
+)
+
+// TcInterfaceAll --ifname=all 时，在全部已启用的以太网网卡(包括 loopback)上捕获
+const TcInterfaceAll = "all"
+
+// 网卡的 ARPHRD 类型，见 /sys/class/net/<ifname>/type
+const (
+	arphrdEther    = 1
+	arphrdLoopback = 772
+)
+
 type MTCProbe struct {
 	//logger          *log.Logger
 	//mName           string
-	pcapngFilename  string
-	ifIdex          int
-	ifName          string
-	pcapWriter      *pcapgo.NgWriter
-	startTime       uint64
-	bootTime        uint64
-	tcPackets       []*TcPacket
-	masterKeyBuffer *bytes.Buffer
-	tcPacketLocker  *sync.Mutex
+	pcapngFilename   string
+	pcapngRotate     config.PcapngRotate
+	netIfs           []net.Interface    // 捕获的网卡，顺序即 pcapng 中的 interface ID
+	pcapngIfIndexes  map[uint32]int     // 网卡 ifindex 到 pcapng interface ID 的映射
+	pcapFilter       *pcapfilter.Filter // tcpdump 风格的过滤表达式，为 nil 时不过滤
+	pcapFile         *os.File
+	pcapFileCounter  *countWriter
+	pcapBuffer       *bufio.Writer // 与 pcapWriter 共用，写入自定义的 EPB
+	pcapWriter       *pcapgo.NgWriter
+	pcapngIndex      uint64    // 轮转文件序号，从1开始
+	pcapngCreatedAt  time.Time // 当前文件的创建时间
+	pcapngPackets    uint64    // 当前文件的数据包数量
+	startTime        uint64
+	bootTime         uint64
+	tcPackets        []*TcPacket // 本周期收到的数据包
+	tcPacketsPending []*TcPacket // 上周期收到，下次 flush 时写入的数据包
+	tcPacketsWritten int
+	tcPacketLocker   *sync.Mutex
+	pcapngSecrets    []pcapngSecret // 近期的 master secrets，写入轮转文件的开头
+	pcapngSecretSize int
+	pcapngErr        error // flush 协程中的错误，下次写入时返回
+	pcapngStop       chan struct{}
+	pcapngStopOnce   sync.Once
+	pcapngDone       chan struct{} // flush 协程退出后关闭
+	procCmdlines     procCmdlineCache
+}
+
+// pcapngSecret 收到的 master secrets 及时间
+type pcapngSecret struct {
+	at   time.Time
+	data []byte
+}
+
+// countWriter 统计写入文件的字节数
+type countWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (this *countWriter) Write(p []byte) (int, error) {
+	n, err := this.w.Write(p)
+	this.n += uint64(n)
+	return n, err
+}
+
+// tcInterfaces 解析 --ifname 参数，多个网卡以逗号分隔，all 表示全部已启用的网卡
+func tcInterfaces(ifname string) ([]net.Interface, error) {
+	if strings.TrimSpace(ifname) == TcInterfaceAll {
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			return nil, err
+		}
+		var netIfs []net.Interface
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagUp == net.FlagUp && tcEthernetInterface(iface) {
+				netIfs = append(netIfs, iface)
+			}
+		}
+		if len(netIfs) == 0 {
+			return nil, fmt.Errorf("no ethernet interface is up")
+		}
+		return netIfs, nil
+	}
+
+	var netIfs []net.Interface
+	var exists = make(map[string]bool)
+	for _, name := range strings.Split(ifname, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || exists[name] {
+			continue
+		}
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("interface %s error:%v", name, err)
+		}
+		if !tcEthernetInterface(*iface) {
+			return nil, fmt.Errorf("interface %s is not an ethernet interface, layer 3 devices such as tun and wireguard are not supported", name)
+		}
+		exists[name] = true
+		netIfs = append(netIfs, *iface)
+	}
+	if len(netIfs) == 0 {
+		return nil, fmt.Errorf("no network interface specified")
+	}
+	return netIfs, nil
+}
+
+// tcEthernetInterface 是否为以太网或 loopback 网卡。classifier 和 pcapng 中的 LinkTypeEthernet
+// 都按以太网帧解析数据包，tun、wireguard 等三层网卡的数据包没有以太网头，不支持。
+func tcEthernetInterface(iface net.Interface) bool {
+	b, err := os.ReadFile(filepath.Join("/sys/class/net", iface.Name, "type"))
+	if err != nil {
+		return iface.Flags&net.FlagLoopback == net.FlagLoopback || len(iface.HardwareAddr) == 6
+	}
+	arphrd, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	return err == nil && (arphrd == arphrdEther || arphrd == arphrdLoopback)
+}
+
+// tcProbes 在每个网卡上挂载 egress、ingress 两个 classifier，以网卡名区分 UID
+func tcProbes(netIfs []net.Interface) []*manager.Probe {
+	var probes = make([]*manager.Probe, 0, len(netIfs)*2)
+	for _, iface := range netIfs {
+		probes = append(probes,
+			&manager.Probe{
+				Section:          "classifier/egress",
+				EbpfFuncName:     "egress_cls_func",
+				Ifname:           iface.Name,
+				NetworkDirection: manager.Egress,
+				UID:              "egress_" + iface.Name,
+			},
+			&manager.Probe{
+				Section:          "classifier/ingress",
+				EbpfFuncName:     "ingress_cls_func",
+				Ifname:           iface.Name,
+				NetworkDirection: manager.Ingress,
+				UID:              "ingress_" + iface.Name,
+			},
+		)
+	}
+	return probes
+}
+
+// tcInterfaceNames 网卡名列表，用于日志输出
+func tcInterfaceNames(netIfs []net.Interface) string {
+	var names = make([]string, 0, len(netIfs))
+	for _, iface := range netIfs {
+		names = append(names, fmt.Sprintf("%s(%d)", iface.Name, iface.Index))
+	}
+	return strings.Join(names, ",")
 }
 
 func (this *MTCProbe) dumpTcSkb(tcEvent *event.TcSkbEvent) error {
+	ifaceIdx, found := this.pcapngIfIndexes[tcEvent.Ifindex]
+	if !found {
+		return fmt.Errorf("packet from unknown interface, ifindex:%d", tcEvent.Ifindex)
+	}
+	if this.pcapFilter != nil && !this.pcapFilter.Match(tcEvent.Payload()) {
+		return nil
+	}
 	var timeStamp = this.bootTime + tcEvent.Ts
-	return this.writePacket(tcEvent.Len, this.ifIdex, time.Unix(0, int64(timeStamp)), tcEvent.Payload())
+	var comment string
+	if tcEvent.Pid > 0 {
+		comment = pcapngPacketComment(tcEvent.Pid, event.CToGoString(tcEvent.Comm[:]), this.procCmdlines.Get(tcEvent.Pid))
+	}
+	return this.writePacket(tcEvent.Len, ifaceIdx, time.Unix(0, int64(timeStamp)), tcEvent.Payload(), comment)
 }
 
-// save pcapng file ,merge master key into pcapng file TODO
+// savePcapng 写入剩余的数据包，并同步到磁盘，在 Close 时调用。返回写入的数据包总数。
 func (this *MTCProbe) savePcapng() (i int, err error) {
-	err = this.pcapWriter.WriteDecryptionSecretsBlock(pcapgo.DSB_SECRETS_TYPE_TLS, this.masterKeyBuffer.Bytes())
-	if err != nil {
+	if this.pcapngStop == nil {
+		// uprobe 模式，未创建 pcapng 文件
 		return
 	}
+	// 等待 flush 协程退出后再关闭文件
+	this.pcapngStopOnce.Do(func() {
+		close(this.pcapngStop)
+	})
+	<-this.pcapngDone
+
 	this.tcPacketLocker.Lock()
 	defer this.tcPacketLocker.Unlock()
-	for _, packet := range this.tcPackets {
-		err = this.pcapWriter.WritePacket(packet.info, packet.data)
-		i++
+	if this.pcapWriter == nil {
+		// 已经关闭
+		return this.tcPacketsWritten, nil
+	}
+	err = this.writePackets(this.tcPacketsPending)
+	if err == nil {
+		err = this.writePackets(this.tcPackets)
+	}
+	this.tcPacketsPending, this.tcPackets = nil, nil
+	i = this.tcPacketsWritten
+	if err != nil {
+		_ = this.pcapFile.Close()
+	} else {
+		err = this.closePcapng()
+	}
+	this.pcapWriter = nil
+	return
+}
+
+// writePackets 写入数据包，需持有 tcPacketLocker
+func (this *MTCProbe) writePackets(packets []*TcPacket) error {
+	for _, packet := range packets {
+		if this.needRotate() {
+			if err := this.rotatePcapng(); err != nil {
+				return err
+			}
+		}
+		var err error
+		if packet.comment != "" {
+			err = writeEnhancedPacket(this.pcapBuffer, packet)
+		} else {
+			err = this.pcapWriter.WritePacket(packet.info, packet.data)
+		}
 		if err != nil {
+			return err
+		}
+		this.tcPacketsWritten++
+		this.pcapngPackets++
+	}
+	return nil
+}
+
+// flushPcapng 周期性写入上一周期的数据包，并刷新到文件
+func (this *MTCProbe) flushPcapng() {
+	defer close(this.pcapngDone)
+	ticker := time.NewTicker(PcapngFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.pcapngStop:
 			return
+		case <-ticker.C:
+		}
+
+		this.tcPacketLocker.Lock()
+		err := this.writePackets(this.tcPacketsPending)
+		this.tcPacketsPending, this.tcPackets = this.tcPackets, this.tcPacketsPending[:0]
+		if err == nil {
+			err = this.pcapWriter.Flush()
+		}
+		if err != nil {
+			this.pcapngErr = err
 		}
+		this.tcPacketLocker.Unlock()
 	}
+}
 
-	if i == 0 {
-		return
+// currentPcapngFilename 未开启轮转时为 -w 参数的文件名，否则为 name-N.ext
+func (this *MTCProbe) currentPcapngFilename() string {
+	if !this.pcapngRotate.Enable() {
+		return this.pcapngFilename
 	}
-	err = this.pcapWriter.Flush()
-	return
+	ext := filepath.Ext(this.pcapngFilename)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(this.pcapngFilename, ext), this.pcapngIndex, ext)
 }
 
-func (this *MTCProbe) createPcapng(netIfs []net.Interface) error {
-	pcapFile, err := os.OpenFile(this.pcapngFilename, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0644)
+// needRotate 当前文件是否达到轮转条件，每个文件至少写入一个数据包
+func (this *MTCProbe) needRotate() bool {
+	if !this.pcapngRotate.Enable() || this.pcapngPackets == 0 {
+		return false
+	}
+	if this.pcapngRotate.RotatePackets > 0 && this.pcapngPackets >= this.pcapngRotate.RotatePackets {
+		return true
+	}
+	if this.pcapngRotate.RotateSize > 0 && this.pcapFileCounter.n >= this.pcapngRotate.RotateSize*1024*1024 {
+		return true
+	}
+	if this.pcapngRotate.RotateTime > 0 && time.Since(this.pcapngCreatedAt) >= time.Duration(this.pcapngRotate.RotateTime)*time.Second {
+		return true
+	}
+	return false
+}
+
+// rotatePcapng 关闭当前文件，创建下一个文件，超过 RotateFiles 后从序号1开始覆盖
+func (this *MTCProbe) rotatePcapng() error {
+	if err := this.closePcapng(); err != nil {
+		return err
+	}
+	this.pcapngIndex++
+	if this.pcapngRotate.RotateFiles > 0 && this.pcapngIndex > this.pcapngRotate.RotateFiles {
+		this.pcapngIndex = 1
+	}
+	return this.openPcapng()
+}
+
+func (this *MTCProbe) closePcapng() error {
+	if err := this.pcapWriter.Flush(); err != nil {
+		_ = this.pcapFile.Close()
+		return err
+	}
+	if err := this.pcapFile.Sync(); err != nil {
+		_ = this.pcapFile.Close()
+		return err
+	}
+	return this.pcapFile.Close()
+}
+
+func (this *MTCProbe) createPcapng(netIfs []net.Interface, filter string) error {
+	if len(netIfs) == 0 {
+		return fmt.Errorf("no network interface to capture")
+	}
+	pcapFilter, err := pcapfilter.Compile(filter)
+	if err != nil {
+		return err
+	}
+	this.pcapFilter = pcapFilter
+	this.netIfs = netIfs
+	this.pcapngIfIndexes = make(map[uint32]int, len(netIfs))
+	for i, iface := range netIfs {
+		this.pcapngIfIndexes[uint32(iface.Index)] = i
+	}
+	this.pcapngIndex = 1
+	err = this.openPcapng()
+	if err != nil {
+		return err
+	}
+
+	this.pcapngStop = make(chan struct{})
+	this.pcapngDone = make(chan struct{})
+	go this.flushPcapng()
+	return nil
+}
+
+// openPcapng 创建 pcapng 文件，写入网卡信息，以及已知的全部 master secrets
+func (this *MTCProbe) openPcapng() error {
+	filename := this.currentPcapngFilename()
+	pcapFile, err := os.OpenFile(filename, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		return fmt.Errorf("error creating pcap file: %v", err)
 	}
+	counter := &countWriter{w: pcapFile}
+	// NgWriter 内部的 bufio.NewWriter 会直接复用该 bufio.Writer
+	buffer := bufio.NewWriter(counter)
 
-	// TODO : write Application "ecapture.lua" to decode PID/Comm info.
+	// 数据包所属进程信息写在 EPB 的 opt_comment 中，由 "ecapture.lua" 解析
 	pcapOption := pcapgo.NgWriterOptions{
 		SectionInfo: pcapgo.NgSectionInfo{
 			Hardware:    "eCapture Hardware",
@@ -86,32 +384,42 @@ func (this *MTCProbe) createPcapng(netIfs []net.Interface) error {
 			Comment:     "see https://ecapture.cc for more information. CFC4N <cfc4n.cs@gmail.com>",
 		},
 	}
-	// write interface description
-	ngIface := pcapgo.NgInterface{
-		Name:       this.ifName,
-		Comment:    "eCapture (旁观者): github.com/gojue/ecapture",
-		Filter:     "",
-		LinkType:   layers.LinkTypeEthernet,
-		SnapLength: uint32(math.MaxUint16),
+	// write interface description, interface ID is the index in this.netIfs
+	var filter string
+	if this.pcapFilter != nil {
+		filter = this.pcapFilter.String()
+	}
+	ngIfaces := make([]pcapgo.NgInterface, 0, len(this.netIfs))
+	for _, iface := range this.netIfs {
+		ngIfaces = append(ngIfaces, pcapgo.NgInterface{
+			Name:       iface.Name,
+			Comment:    "eCapture (旁观者): github.com/gojue/ecapture",
+			Filter:     filter,
+			LinkType:   layers.LinkTypeEthernet,
+			SnapLength: uint32(math.MaxUint16),
+		})
 	}
 
-	pcapWriter, err := pcapgo.NewNgWriterInterface(pcapFile, ngIface, pcapOption)
+	pcapWriter, err := pcapgo.NewNgWriterInterface(buffer, ngIfaces[0], pcapOption)
 	if err != nil {
+		_ = pcapFile.Close()
 		return err
 	}
 
 	// insert other interfaces into pcapng file
-	for _, iface := range netIfs {
-		ngIface = pcapgo.NgInterface{
-			Name:       iface.Name,
-			Comment:    "eCapture (旁观者): github.com/gojue/ecapture",
-			Filter:     "",
-			LinkType:   layers.LinkTypeEthernet,
-			SnapLength: uint32(math.MaxUint16),
+	for _, ngIface := range ngIfaces[1:] {
+		_, err := pcapWriter.AddInterface(ngIface)
+		if err != nil {
+			_ = pcapFile.Close()
+			return err
 		}
+	}
 
-		_, err := pcapWriter.AddInterface(ngIface)
+	// 轮转后的文件需要单独解密，写入近期的 master secrets
+	if secrets := this.recentSecrets(); len(secrets) > 0 {
+		err = pcapWriter.WriteDecryptionSecretsBlock(pcapgo.DSB_SECRETS_TYPE_TLS, secrets)
 		if err != nil {
+			_ = pcapFile.Close()
 			return err
 		}
 	}
@@ -119,15 +427,30 @@ func (this *MTCProbe) createPcapng(netIfs []net.Interface) error {
 	// Flush the header
 	err = pcapWriter.Flush()
 	if err != nil {
+		_ = pcapFile.Close()
 		return err
 	}
 
-	// TODO 保存数据包所属进程ID信息，以LRU Cache方式存储。
+	this.pcapFile = pcapFile
+	this.pcapFileCounter = counter
+	this.pcapBuffer = buffer
 	this.pcapWriter = pcapWriter
+	this.pcapngCreatedAt = time.Now()
+	this.pcapngPackets = 0
 	return nil
 }
 
-func (this *MTCProbe) writePacket(dataLen uint32, ifaceIdx int, timeStamp time.Time, packetBytes []byte) error {
+// pcapngBuffered 等待写入 pcapng 文件的数据包数量
+func (this *MTCProbe) pcapngBuffered() int {
+	if this.tcPacketLocker == nil {
+		return 0
+	}
+	this.tcPacketLocker.Lock()
+	defer this.tcPacketLocker.Unlock()
+	return len(this.tcPackets) + len(this.tcPacketsPending)
+}
+
+func (this *MTCProbe) writePacket(dataLen uint32, ifaceIdx int, timeStamp time.Time, packetBytes []byte, comment string) error {
 	info := gopacket.CaptureInfo{
 		Timestamp:      timeStamp,
 		CaptureLength:  int(dataLen),
@@ -135,13 +458,62 @@ func (this *MTCProbe) writePacket(dataLen uint32, ifaceIdx int, timeStamp time.T
 		InterfaceIndex: ifaceIdx,
 	}
 
-	packet := &TcPacket{info: info, data: packetBytes}
+	packet := &TcPacket{info: info, data: packetBytes, comment: comment}
 
+	this.tcPacketLocker.Lock()
+	defer this.tcPacketLocker.Unlock()
 	this.tcPackets = append(this.tcPackets, packet)
+	if this.pcapngErr != nil {
+		err := this.pcapngErr
+		this.pcapngErr = nil
+		return fmt.Errorf("write pcapng file error:%v", err)
+	}
 	return nil
 }
 
+// savePcapngSslKeyLog 立即写入 Decryption Secrets Block，位于尚未写入的数据包之前
 func (this *MTCProbe) savePcapngSslKeyLog(sslKeyLog []byte) (err error) {
-	_, e := this.masterKeyBuffer.Write(sslKeyLog)
-	return e
+	if this.tcPacketLocker == nil {
+		// uprobe 模式，未创建 pcapng 文件
+		return nil
+	}
+	this.tcPacketLocker.Lock()
+	defer this.tcPacketLocker.Unlock()
+	if this.pcapWriter == nil {
+		// 未创建或已关闭 pcapng 文件
+		return nil
+	}
+	if this.pcapngRotate.Enable() {
+		this.pcapngSecrets = append(this.pcapngSecrets, pcapngSecret{at: time.Now(), data: append([]byte(nil), sslKeyLog...)})
+		this.pcapngSecretSize += len(sslKeyLog)
+		this.pruneSecrets()
+	}
+	err = this.pcapWriter.WriteDecryptionSecretsBlock(pcapgo.DSB_SECRETS_TYPE_TLS, sslKeyLog)
+	if err != nil {
+		return
+	}
+	return this.pcapWriter.Flush()
+}
+
+// pruneSecrets 丢弃超过 PcapngSecretsRetention 或 PcapngSecretsMaxSize 的 secrets，需持有 tcPacketLocker
+func (this *MTCProbe) pruneSecrets() {
+	var i int
+	for ; i < len(this.pcapngSecrets); i++ {
+		secret := this.pcapngSecrets[i]
+		if time.Since(secret.at) <= PcapngSecretsRetention && this.pcapngSecretSize <= PcapngSecretsMaxSize {
+			break
+		}
+		this.pcapngSecretSize -= len(secret.data)
+	}
+	this.pcapngSecrets = append(this.pcapngSecrets[:0], this.pcapngSecrets[i:]...)
+}
+
+// recentSecrets 需要写入新文件的 secrets，需持有 tcPacketLocker
+func (this *MTCProbe) recentSecrets() []byte {
+	this.pruneSecrets()
+	buf := make([]byte, 0, this.pcapngSecretSize)
+	for _, secret := range this.pcapngSecrets {
+		buf = append(buf, secret.data...)
+	}
+	return buf
 }
@@ -0,0 +1,128 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package module
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	pcapngBlockTypeEnhancedPacket uint32 = 6
+	pcapngOptionCodeEndOfOpt      uint16 = 0
+	pcapngOptionCodeComment       uint16 = 1
+
+	// ProcCmdlineCacheSize 进程 cmdline 缓存的最大数量，超过后清空重建
+	ProcCmdlineCacheSize = 1024
+	// PcapngCommentMaxCmdline opt_comment 中 cmdline 的最大长度
+	PcapngCommentMaxCmdline = 1024
+)
+
+// pcapngPacketComment EPB 的 opt_comment 内容，与 utils/ecapture.lua 的解析规则保持一致
+func pcapngPacketComment(pid uint32, comm, cmdline string) string {
+	if pid == 0 {
+		return ""
+	}
+	if len(cmdline) > PcapngCommentMaxCmdline {
+		cmdline = cmdline[:PcapngCommentMaxCmdline]
+	}
+	return fmt.Sprintf("Pid:%d, Comm:%s, Cmdline:%s", pid, comm, cmdline)
+}
+
+// writeEnhancedPacket 写入带 opt_comment 的 Enhanced Packet Block。
+// pcapgo.NgWriter 不支持 EPB options，这里直接写入与 NgWriter 共用的 bufio.Writer，保证块的顺序。
+func writeEnhancedPacket(w *bufio.Writer, packet *TcPacket) error {
+	data := packet.data
+	comment := []byte(packet.comment)
+	dataPadding := (4 - len(data)&3) & 3
+	commentPadding := (4 - len(comment)&3) & 3
+
+	// block header(8) + EPB fields(20) + data + opt_comment + opt_endofopt(4) + block length(4)
+	length := 28 + len(data) + dataPadding + 4 + len(comment) + commentPadding + 4 + 4
+	ts := packet.info.Timestamp.UnixNano()
+
+	var buf [28]byte
+	binary.LittleEndian.PutUint32(buf[0:4], pcapngBlockTypeEnhancedPacket)
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(length))
+	binary.LittleEndian.PutUint32(buf[8:12], uint32(packet.info.InterfaceIndex))
+	binary.LittleEndian.PutUint32(buf[12:16], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(buf[16:20], uint32(ts))
+	binary.LittleEndian.PutUint32(buf[20:24], uint32(packet.info.CaptureLength))
+	binary.LittleEndian.PutUint32(buf[24:28], uint32(packet.info.Length))
+	if _, err := w.Write(buf[:28]); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+
+	var zero [4]byte
+	if _, err := w.Write(zero[:dataPadding]); err != nil {
+		return err
+	}
+
+	binary.LittleEndian.PutUint16(buf[0:2], pcapngOptionCodeComment)
+	binary.LittleEndian.PutUint16(buf[2:4], uint16(len(comment)))
+	if _, err := w.Write(buf[:4]); err != nil {
+		return err
+	}
+	if _, err := w.Write(comment); err != nil {
+		return err
+	}
+	if _, err := w.Write(zero[:commentPadding]); err != nil {
+		return err
+	}
+
+	binary.LittleEndian.PutUint16(buf[0:2], pcapngOptionCodeEndOfOpt)
+	binary.LittleEndian.PutUint16(buf[2:4], 0)
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(length))
+	_, err := w.Write(buf[:8])
+	return err
+}
+
+// procCmdlineCache 缓存 pid 对应的 cmdline，避免每个数据包都读取 /proc。
+// pid 复用时可能得到旧进程的 cmdline，缓存写满后整体清空。
+type procCmdlineCache struct {
+	sync.Mutex
+	cmdlines map[uint32]string
+}
+
+func (this *procCmdlineCache) Get(pid uint32) string {
+	this.Lock()
+	defer this.Unlock()
+	if cmdline, ok := this.cmdlines[pid]; ok {
+		return cmdline
+	}
+	if this.cmdlines == nil || len(this.cmdlines) >= ProcCmdlineCacheSize {
+		this.cmdlines = make(map[uint32]string)
+	}
+	cmdline := readProcCmdline(pid)
+	this.cmdlines[pid] = cmdline
+	return cmdline
+}
+
+// readProcCmdline 读取 /proc/<pid>/cmdline，参数以空格分隔。进程已退出时返回空字符串。
+func readProcCmdline(pid uint32) string {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return ""
+	}
+	b = bytes.TrimRight(b, "\x00")
+	return string(bytes.ReplaceAll(b, []byte{0}, []byte{' '}))
+}
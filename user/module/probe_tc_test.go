@@ -0,0 +1,332 @@
+package module
+
+import (
+	"bytes"
+	"ecapture/user/config"
+	"ecapture/user/event"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestMTCProbe_StreamPcapng(t *testing.T) {
+	tc := &MTCProbe{
+		pcapngFilename: filepath.Join(t.TempDir(), "save.pcapng"),
+		tcPacketLocker: &sync.Mutex{},
+	}
+	if err := tc.createPcapng([]net.Interface{{Index: 2, Name: "eth0"}}, ""); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(tc.pcapngFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerSize := fi.Size()
+
+	comment := pcapngPacketComment(1234, "curl", "curl https://ecapture.cc")
+	if err = tc.writePacket(4, 0, time.Now(), []byte{0x01, 0x02, 0x03, 0x04}, comment); err != nil {
+		t.Fatal(err)
+	}
+	if err = tc.savePcapngSslKeyLog([]byte("CLIENT_RANDOM 00 00\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// packets reach the disk after at most two flush intervals, without Close()
+	time.Sleep(PcapngFlushInterval*2 + time.Millisecond*200)
+	fi, err = os.Stat(tc.pcapngFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() <= headerSize {
+		t.Fatalf("packets not flushed, file size:%d, header size:%d", fi.Size(), headerSize)
+	}
+
+	if err = tc.writePacket(4, 0, time.Now(), []byte{0x05, 0x06, 0x07, 0x08}, ""); err != nil {
+		t.Fatal(err)
+	}
+	i, err := tc.savePcapng()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 2 {
+		t.Fatalf("saved %d packets, want 2", i)
+	}
+	// Close 可能被多次调用
+	if i, err = tc.savePcapng(); err != nil || i != 2 {
+		t.Fatalf("second savePcapng: %d, %v", i, err)
+	}
+	if err = tc.savePcapngSslKeyLog([]byte("CLIENT_RANDOM 01 01\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(tc.pcapngFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for {
+		_, _, err = r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("read %d packets from pcapng file, want 2", n)
+	}
+
+	b, err := os.ReadFile(tc.pcapngFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte(comment)) {
+		t.Fatal("process info not found in enhanced packet block")
+	}
+}
+
+func TestMTCProbe_RotatePcapng(t *testing.T) {
+	dir := t.TempDir()
+	tc := &MTCProbe{
+		pcapngFilename: filepath.Join(dir, "save.pcapng"),
+		pcapngRotate:   config.PcapngRotate{RotatePackets: 2, RotateFiles: 2},
+		tcPacketLocker: &sync.Mutex{},
+	}
+	if err := tc.createPcapng([]net.Interface{{Index: 2, Name: "eth0"}}, ""); err != nil {
+		t.Fatal(err)
+	}
+	keylog := []byte("CLIENT_RANDOM 00 00\n")
+	if err := tc.savePcapngSslKeyLog(keylog); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := tc.writePacket(4, 0, time.Now(), []byte{0x01, 0x02, 0x03, byte(i)}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	i, err := tc.savePcapng()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 5 {
+		t.Fatalf("saved %d packets, want 5", i)
+	}
+
+	// save-1: packet 4 (ring buffer overwritten), save-2: packet 2,3
+	want := map[string]int{"save-1.pcapng": 1, "save-2.pcapng": 2}
+	for name, packets := range want {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// every segment carries the decryption secrets
+		if !bytes.Contains(b, keylog) {
+			t.Fatalf("%s has no decryption secrets block", name)
+		}
+		r, err := pcapgo.NewNgReader(bytes.NewReader(b), pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		for {
+			if _, _, err = r.ReadPacketData(); err != nil {
+				break
+			}
+			n++
+		}
+		if n != packets {
+			t.Fatalf("read %d packets from %s, want %d", n, name, packets)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dir, "save-3.pcapng")); !os.IsNotExist(err) {
+		t.Fatal("rotate files exceeded, save-3.pcapng exists")
+	}
+}
+
+func TestMTCProbe_RotateSecrets(t *testing.T) {
+	dir := t.TempDir()
+	tc := &MTCProbe{
+		pcapngFilename: filepath.Join(dir, "save.pcapng"),
+		pcapngRotate:   config.PcapngRotate{RotatePackets: 1},
+		tcPacketLocker: &sync.Mutex{},
+	}
+	if err := tc.createPcapng([]net.Interface{{Index: 2, Name: "eth0"}}, ""); err != nil {
+		t.Fatal(err)
+	}
+	expired, recent := []byte("CLIENT_RANDOM 01 01\n"), []byte("CLIENT_RANDOM 02 02\n")
+	if err := tc.savePcapngSslKeyLog(expired); err != nil {
+		t.Fatal(err)
+	}
+	tc.pcapngSecrets[0].at = time.Now().Add(-PcapngSecretsRetention * 2)
+	if err := tc.savePcapngSslKeyLog(recent); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := tc.writePacket(4, 0, time.Now(), []byte{0x01, 0x02, 0x03, byte(i)}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tc.savePcapng(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 过期的 secrets 不再写入轮转后的文件
+	b, err := os.ReadFile(filepath.Join(dir, "save-2.pcapng"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, expired) || !bytes.Contains(b, recent) {
+		t.Fatal("unexpected decryption secrets in save-2.pcapng")
+	}
+
+	// 超过 PcapngSecretsMaxSize 时丢弃最早的 secrets
+	secret := bytes.Repeat([]byte{'a'}, 1024*1024)
+	for i := 0; i < 6; i++ {
+		tc.pcapngSecrets = append(tc.pcapngSecrets, pcapngSecret{at: time.Now(), data: secret})
+		tc.pcapngSecretSize += len(secret)
+		tc.pruneSecrets()
+	}
+	if tc.pcapngSecretSize > PcapngSecretsMaxSize || len(tc.recentSecrets()) != tc.pcapngSecretSize {
+		t.Fatalf("secrets size %d exceeds %d", tc.pcapngSecretSize, PcapngSecretsMaxSize)
+	}
+}
+
+func tcSkbEvent(t *testing.T, ifindex uint32, pid uint32, data []byte) *event.TcSkbEvent {
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, uint64(time.Now().UnixNano()))
+	_ = binary.Write(buf, binary.LittleEndian, pid)
+	var comm [16]byte
+	copy(comm[:], "curl")
+	buf.Write(comm[:])
+	_ = binary.Write(buf, binary.LittleEndian, uint32(len(data)))
+	_ = binary.Write(buf, binary.LittleEndian, ifindex)
+	buf.Write(data)
+	e := &event.TcSkbEvent{}
+	if err := e.Decode(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestMTCProbe_MultiInterface(t *testing.T) {
+	tc := &MTCProbe{
+		pcapngFilename: filepath.Join(t.TempDir(), "save.pcapng"),
+		tcPacketLocker: &sync.Mutex{},
+	}
+	netIfs := []net.Interface{{Index: 1, Name: "lo"}, {Index: 7, Name: "bond0"}, {Index: 3, Name: "eth1"}}
+	if err := tc.createPcapng(netIfs, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, ifindex := range []uint32{7, 1, 3} {
+		if err := tc.dumpTcSkb(tcSkbEvent(t, ifindex, 0, []byte{0x01, 0x02, 0x03, 0x04})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tc.dumpTcSkb(tcSkbEvent(t, 9, 0, []byte{0x01, 0x02, 0x03, 0x04})); err == nil {
+		t.Fatal("packet from unknown interface should be rejected")
+	}
+	if _, err := tc.savePcapng(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(tc.pcapngFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []int{1, 0, 2} {
+		_, ci, err := r.ReadPacketData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ci.InterfaceIndex != want {
+			t.Fatalf("packet interface index %d, want %d", ci.InterfaceIndex, want)
+		}
+	}
+	if r.NInterfaces() != len(netIfs) {
+		t.Fatalf("%d interfaces in pcapng file, want %d", r.NInterfaces(), len(netIfs))
+	}
+}
+
+func TestMTCProbe_PcapFilter(t *testing.T) {
+	tc := &MTCProbe{
+		pcapngFilename: filepath.Join(t.TempDir(), "save.pcapng"),
+		tcPacketLocker: &sync.Mutex{},
+	}
+	if err := tc.createPcapng([]net.Interface{{Index: 2, Name: "eth0"}}, "tcp port 443"); err != nil {
+		t.Fatal(err)
+	}
+
+	// ethernet + IPv4 + TCP header, source port 443 / 80
+	for _, port := range []uint16{443, 80} {
+		frame := make([]byte, 14+20+20)
+		binary.BigEndian.PutUint16(frame[12:14], 0x0800)
+		frame[14] = 0x45
+		frame[14+9] = 6
+		binary.BigEndian.PutUint16(frame[34:36], port)
+		binary.BigEndian.PutUint16(frame[36:38], 51000)
+		if err := tc.dumpTcSkb(tcSkbEvent(t, 2, 0, frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	i, err := tc.savePcapng()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 1 {
+		t.Fatalf("saved %d packets, want 1", i)
+	}
+
+	f, err := os.Open(tc.pcapngFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iface, err := r.Interface(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iface.Filter != "tcp port 443" {
+		t.Fatalf("interface filter %q, want %q", iface.Filter, "tcp port 443")
+	}
+}
+
+func TestTcInterfaces(t *testing.T) {
+	netIfs, err := tcInterfaces(TcInterfaceAll)
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, iface := range netIfs {
+		if !tcEthernetInterface(iface) {
+			t.Fatalf("%s is not an ethernet interface", iface.Name)
+		}
+	}
+
+	// 读取不到 /sys/class/net 时，根据 MAC 地址和 loopback 标志判断
+	l3 := net.Interface{Name: "ecapture-tun-test", Flags: net.FlagUp | net.FlagPointToPoint}
+	if tcEthernetInterface(l3) {
+		t.Fatal("layer 3 interface accepted")
+	}
+	eth := net.Interface{Name: "ecapture-eth-test", HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}}
+	if !tcEthernetInterface(eth) {
+		t.Fatal("ethernet interface rejected")
+	}
+}
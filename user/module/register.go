@@ -20,6 +20,9 @@ import (
 
 var modules = make(map[string]IModule)
 
+// factories 创建新的 module 实例，见 NewModule
+var factories = make(map[string]func() IModule)
+
 func Register(p IModule) {
 	if p == nil {
 		panic("Register probe is nil")
@@ -31,6 +34,23 @@ func Register(p IModule) {
 	modules[name] = p
 }
 
+// RegisterFunc 注册 module，f 用于创建新的实例，如 pkg/capture 中每次启动独立的 module
+func RegisterFunc(f func() IModule) {
+	p := f()
+	Register(p)
+	factories[p.Name()] = f
+}
+
+// NewModule 创建新的 module 实例，与 GetModuleByName 返回的共用实例互不影响。
+// 未注册或注册时没有提供 RegisterFunc 时返回 nil
+func NewModule(modName string) IModule {
+	f, found := factories[modName]
+	if !found {
+		return nil
+	}
+	return f()
+}
+
 // GetModules 获取modules列表
 func GetAllModules() map[string]IModule {
 	return modules
@@ -0,0 +1,105 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package module
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	DefaultSinkFileMaxSize    int64 = 100 * 1024 * 1024
+	DefaultSinkFileMaxBackups       = 5
+)
+
+// FileSink 写入文件，超过 maxSize 后轮转为 filename.1 ... filename.N
+type FileSink struct {
+	sync.Mutex
+	filename   string
+	maxSize    int64
+	maxBackups int
+	size       int64
+	file       *os.File
+}
+
+func NewFileSink(filename string, maxSize int64, maxBackups int) (*FileSink, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("FileSink: filename cant be empty")
+	}
+	s := &FileSink{
+		filename:   filename,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (this *FileSink) open() error {
+	f, err := os.OpenFile(this.filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("FileSink: open %s error:%v", this.filename, err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	this.file = f
+	this.size = fi.Size()
+	return nil
+}
+
+// rotate filename.N-1 -> filename.N, ..., filename -> filename.1
+func (this *FileSink) rotate() error {
+	if err := this.file.Close(); err != nil {
+		return err
+	}
+	if this.maxBackups > 0 {
+		for i := this.maxBackups - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", this.filename, i), fmt.Sprintf("%s.%d", this.filename, i+1))
+		}
+		if err := os.Rename(this.filename, this.filename+".1"); err != nil {
+			return err
+		}
+	} else {
+		if err := os.Remove(this.filename); err != nil {
+			return err
+		}
+	}
+	return this.open()
+}
+
+func (this *FileSink) Write(record []byte) (int, error) {
+	this.Lock()
+	defer this.Unlock()
+	if this.maxSize > 0 && this.size > 0 && this.size+int64(len(record)) > this.maxSize {
+		if err := this.rotate(); err != nil {
+			return 0, fmt.Errorf("FileSink: rotate %s error:%v", this.filename, err)
+		}
+	}
+	n, err := this.file.Write(record)
+	this.size += int64(n)
+	return n, err
+}
+
+func (this *FileSink) Close() error {
+	this.Lock()
+	defer this.Unlock()
+	return this.file.Close()
+}
@@ -0,0 +1,166 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package module
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	NetSinkDialTimeout   = 3 * time.Second
+	NetSinkWriteTimeout  = 3 * time.Second
+	NetSinkRetryInterval = 3 * time.Second  // 连接失败后，间隔多久再次重连，期间的记录丢弃
+	NetSinkQueueLen      = 4096             // 待写入记录的队列长度
+	NetSinkDropLogPeriod = 10 * time.Second // 丢弃记录时，Write 最多每个周期返回一次错误
+)
+
+var errNetSinkClosed = errors.New("NetSink: sink closed")
+
+// NetSink 以流的方式写入 unix domain socket 或 TCP 连接。
+// Write 只将记录放入队列，由后台协程建立连接并写入，不阻塞读取事件的协程；
+// 队列已满或连接失败时丢弃记录，通过 Dropped 计数。写入失败后断开，下次写入时重连。
+type NetSink struct {
+	network string
+	address string
+	conn    net.Conn
+
+	// 保护 queue 的关闭，Write 时持有读锁
+	lock   sync.RWMutex
+	closed bool
+	queue  chan []byte
+	done   chan struct{}
+
+	dropped     uint64
+	lastDropErr int64        // 上次返回丢弃错误的时间
+	lastErr     atomic.Value // 后台协程最近一次写入错误
+	retryAt     time.Time    // 连接失败后，下次重连的时间
+	dialErr     error        // 最近一次连接失败的错误
+}
+
+func NewNetSink(network, address string) *NetSink {
+	this := &NetSink{
+		network: network,
+		address: address,
+		queue:   make(chan []byte, NetSinkQueueLen),
+		done:    make(chan struct{}),
+	}
+	go this.run()
+	return this
+}
+
+func (this *NetSink) Write(record []byte) (int, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	if this.closed {
+		return 0, errNetSinkClosed
+	}
+
+	// 调用方可能复用 record
+	select {
+	case this.queue <- append([]byte(nil), record...):
+	default:
+		this.drop()
+	}
+	return len(record), this.dropError()
+}
+
+// Dropped 队列已满或写入失败而丢弃的记录数
+func (this *NetSink) Dropped() uint64 {
+	return atomic.LoadUint64(&this.dropped)
+}
+
+func (this *NetSink) drop() {
+	atomic.AddUint64(&this.dropped, 1)
+}
+
+// dropError 有记录被丢弃时，每 NetSinkDropLogPeriod 最多返回一次错误
+func (this *NetSink) dropError() error {
+	n := this.Dropped()
+	if n == 0 {
+		return nil
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&this.lastDropErr)
+	if now-last < int64(NetSinkDropLogPeriod) || !atomic.CompareAndSwapInt64(&this.lastDropErr, last, now) {
+		return nil
+	}
+	if err, ok := this.lastErr.Load().(error); ok {
+		return fmt.Errorf("%v, %d records dropped", err, n)
+	}
+	return fmt.Errorf("NetSink: %d records dropped, queue is full", n)
+}
+
+// run 后台写入队列中的记录，队列关闭后写完剩余记录并断开连接
+func (this *NetSink) run() {
+	defer close(this.done)
+	for record := range this.queue {
+		if err := this.write(record); err != nil {
+			this.drop()
+			this.lastErr.Store(err)
+		}
+	}
+	if this.conn != nil {
+		_ = this.conn.Close()
+		this.conn = nil
+	}
+}
+
+func (this *NetSink) write(record []byte) error {
+	// 对端重启后，旧连接的首次写入会失败，重连后重试一次
+	var err error
+	for i := 0; i < 2; i++ {
+		if this.conn == nil {
+			if time.Now().Before(this.retryAt) {
+				return this.dialErr
+			}
+			this.conn, err = net.DialTimeout(this.network, this.address, NetSinkDialTimeout)
+			if err != nil {
+				this.conn = nil
+				this.retryAt = time.Now().Add(NetSinkRetryInterval)
+				this.dialErr = fmt.Errorf("NetSink: dial %s://%s error:%v", this.network, this.address, err)
+				return this.dialErr
+			}
+		}
+
+		_ = this.conn.SetWriteDeadline(time.Now().Add(NetSinkWriteTimeout))
+		_, err = this.conn.Write(record)
+		if err == nil {
+			return nil
+		}
+		_ = this.conn.Close()
+		this.conn = nil
+	}
+	return fmt.Errorf("NetSink: write %s://%s error:%v", this.network, this.address, err)
+}
+
+// Close 停止接收记录，等待后台协程写完队列中的记录
+func (this *NetSink) Close() error {
+	this.lock.Lock()
+	if this.closed {
+		this.lock.Unlock()
+		return nil
+	}
+	this.closed = true
+	close(this.queue)
+	this.lock.Unlock()
+
+	<-this.done
+	return nil
+}
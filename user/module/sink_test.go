@@ -0,0 +1,180 @@
+package module
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewEventSink(t *testing.T) {
+	dir := t.TempDir()
+	specs := map[string]bool{
+		SinkTypeStdout: true,
+		"file://" + filepath.Join(dir, "events.log") + "?max_size=1&max_backups=2": true,
+		"unix://" + filepath.Join(dir, "collector.sock"):                           true,
+		"tcp://127.0.0.1:9000":   true,
+		"kafka://127.0.0.1:9092": false,
+	}
+	for spec, ok := range specs {
+		s, err := NewEventSink(spec)
+		if ok != (err == nil) {
+			t.Fatalf("NewEventSink(%s) error:%v", spec, err)
+		}
+		if s != nil {
+			_ = s.Close()
+		}
+	}
+}
+
+func TestFileSink_Rotate(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "events.log")
+	s, err := NewFileSink(filename, 16, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	record := []byte("0123456789\n")
+	for i := 0; i < 4; i++ {
+		if _, err = s.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{filename, filename + ".1", filename + ".2"} {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("read %s error:%v", name, err)
+		}
+		if string(b) != string(record) {
+			t.Fatalf("unexpected content of %s: %q", name, b)
+		}
+	}
+	if _, err = os.Stat(filename + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("max_backups exceeded, %s.3 exists", filename)
+	}
+}
+
+func TestMultiSink_Unix(t *testing.T) {
+	sockFile := filepath.Join(t.TempDir(), "collector.sock")
+	l, err := net.Listen("unix", sockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	lines := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		lines <- line
+	}()
+
+	filename := filepath.Join(t.TempDir(), "events.log")
+	fs, err := NewFileSink(filename, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewMultiSink(NewNetSink(SinkTypeUnix, sockFile), fs)
+	defer s.Close()
+
+	record := "{\"pid\":1}\n"
+	if _, err = s.Write([]byte(record)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case line := <-lines:
+		if line != record {
+			t.Fatalf("unexpected record from unix socket: %q", line)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("timeout waiting for record from unix socket")
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != record {
+		t.Fatalf("unexpected record from file: %q", b)
+	}
+}
+
+func TestNetSink_Drop(t *testing.T) {
+	// 对端不存在时 Write 不阻塞，记录被丢弃并计数
+	s := NewNetSink(SinkTypeUnix, filepath.Join(t.TempDir(), "collector.sock"))
+	record := []byte("{\"pid\":1}\n")
+	start := time.Now()
+	var reported bool
+	for i := 0; i < NetSinkQueueLen*2; i++ {
+		n, err := s.Write(record)
+		if n != len(record) {
+			t.Fatalf("Write returned %d", n)
+		}
+		reported = reported || err != nil
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Write blocked for %v", time.Since(start))
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Dropped() != uint64(NetSinkQueueLen*2) {
+		t.Fatalf("dropped %d records, want %d", s.Dropped(), NetSinkQueueLen*2)
+	}
+	if !reported {
+		t.Fatal("drops not reported by Write")
+	}
+	if _, err := s.Write(record); err == nil {
+		t.Fatal("Write after Close should fail")
+	}
+}
+
+// concurrentWriter fails the test when two Writes overlap
+type concurrentWriter struct {
+	t       *testing.T
+	writing int32
+	lines   int32
+}
+
+func (this *concurrentWriter) Write(b []byte) (int, error) {
+	if !atomic.CompareAndSwapInt32(&this.writing, 0, 1) {
+		this.t.Error("overlapping writes")
+	}
+	time.Sleep(time.Microsecond)
+	atomic.AddInt32(&this.lines, 1)
+	atomic.StoreInt32(&this.writing, 0)
+	return len(b), nil
+}
+
+func TestLoggerSink_Raw(t *testing.T) {
+	w := &concurrentWriter{t: t}
+	logger := log.New(w, "tls_", log.LstdFlags)
+	// 多个 module 共用同一个 logger
+	sinks := []*LoggerSink{NewLoggerSink(logger, true), NewLoggerSink(logger, true)}
+	var wg sync.WaitGroup
+	for _, s := range sinks {
+		wg.Add(1)
+		go func(s *LoggerSink) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				_, _ = s.Write([]byte("{\"pid\":1}\n"))
+			}
+		}(s)
+	}
+	wg.Wait()
+	if w.lines != 200 {
+		t.Fatalf("%d records written", w.lines)
+	}
+}